@@ -0,0 +1,342 @@
+package cachesrv
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/acme"
+)
+
+// With TURBO_ACME_DOMAIN the certificate comes from an ACME CA such as
+// Let's Encrypt and is renewed before it expires. The account key and the
+// certificate are kept in the storage dir, so restarts don't order new ones.
+
+// ACMEManager obtains and renews the certificate of the TLS listener
+type ACMEManager struct {
+	client  *acme.Client
+	domains []string
+	email   string
+	dir     string
+	http01  bool // answer http-01 challenges instead of tls-alpn-01
+	logger  *log.Logger
+
+	mu         sync.RWMutex
+	cert       *tls.Certificate
+	alpnCerts  map[string]*tls.Certificate // domain -> tls-alpn-01 challenge cert
+	httpTokens map[string]string           // http-01 path -> key authorization
+}
+
+// acmeConfigFromEnv returns the TLS settings of an ACME managed listener,
+// or nil if TURBO_ACME_DOMAIN is unset
+func acmeConfigFromEnv(storagePath string, logger *log.Logger) (*tls.Config, *ACMEManager, error) {
+	var domains []string
+	for _, domain := range strings.Split(getenv("TURBO_ACME_DOMAIN"), ",") {
+		if domain = strings.TrimSpace(domain); domain != "" {
+			domains = append(domains, strings.ToLower(domain))
+		}
+	}
+	if len(domains) == 0 {
+		return nil, nil, nil
+	}
+	if getenv("TURBO_TLS_CERT") != "" {
+		return nil, nil, errors.New("TURBO_ACME_DOMAIN and TURBO_TLS_CERT exclude each other")
+	}
+	m := &ACMEManager{
+		domains:    domains,
+		email:      getenv("TURBO_ACME_EMAIL"),
+		dir:        envString("TURBO_ACME_CACHE_DIR", filepath.Join(storagePath, ".acme")),
+		http01:     getenv("TURBO_TLS_REDIRECT_ADDR") != "",
+		logger:     logger,
+		alpnCerts:  make(map[string]*tls.Certificate),
+		httpTokens: make(map[string]string),
+	}
+	if err := os.MkdirAll(m.dir, 0o700); err != nil {
+		return nil, nil, fmt.Errorf("failed to create ACME cache dir: %w", err)
+	}
+	key, err := m.accountKey()
+	if err != nil {
+		return nil, nil, err
+	}
+	m.client = &acme.Client{Key: key, DirectoryURL: envString("TURBO_ACME_DIRECTORY", acme.LetsEncryptURL)}
+	if cert, err := m.readCertificate(); err == nil {
+		m.cert = cert
+	}
+
+	config, err := newTLSConfig(m.GetCertificate)
+	if err != nil {
+		return nil, nil, err
+	}
+	config.NextProtos = []string{"h2", "http/1.1", acme.ALPNProto}
+	return config, m, nil
+}
+
+// accountKey reads the ACME account key, creating it on first use
+func (m *ACMEManager) accountKey() (crypto.Signer, error) {
+	path := filepath.Join(m.dir, "account.key")
+	if data, err := os.ReadFile(path); err == nil {
+		block, _ := pem.Decode(data)
+		if block == nil {
+			return nil, fmt.Errorf("failed to read ACME account key %s: no PEM data", path)
+		}
+		key, err := x509.ParseECPrivateKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read ACME account key %s: %w", path, err)
+		}
+		return key, nil
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("failed to read ACME account key: %w", err)
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	if err := writeFileAtomic(path, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), 0o600); err != nil {
+		return nil, fmt.Errorf("failed to save ACME account key: %w", err)
+	}
+	return key, nil
+}
+
+func (m *ACMEManager) certPaths() (string, string) {
+	name := strings.ReplaceAll(m.domains[0], "*", "_")
+	return filepath.Join(m.dir, name+".crt"), filepath.Join(m.dir, name+".key")
+}
+
+// readCertificate reads the cached certificate if it covers the domains
+func (m *ACMEManager) readCertificate() (*tls.Certificate, error) {
+	certPath, keyPath := m.certPaths()
+	cert, err := tls.LoadX509KeyPair(certPath, keyPath)
+	if err != nil {
+		return nil, err
+	}
+	for _, domain := range m.domains {
+		if err := cert.Leaf.VerifyHostname(domain); err != nil {
+			return nil, err
+		}
+	}
+	return &cert, nil
+}
+
+// GetCertificate serves the current certificate, or the challenge
+// certificate to the CA validating a tls-alpn-01 challenge
+func (m *ACMEManager) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if len(hello.SupportedProtos) == 1 && hello.SupportedProtos[0] == acme.ALPNProto {
+		if cert, ok := m.alpnCerts[strings.ToLower(hello.ServerName)]; ok {
+			return cert, nil
+		}
+		return nil, fmt.Errorf("no tls-alpn-01 challenge for %q", hello.ServerName)
+	}
+	if m.cert == nil {
+		return nil, errors.New("no certificate obtained yet")
+	}
+	return m.cert, nil
+}
+
+// HTTPHandler answers http-01 challenges and hands other requests to next
+func (m *ACMEManager) HTTPHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.URL.Path, "/.well-known/acme-challenge/") {
+			next.ServeHTTP(w, r)
+			return
+		}
+		m.mu.RLock()
+		response, ok := m.httpTokens[r.URL.Path]
+		m.mu.RUnlock()
+		if !ok {
+			http.Error(w, "Challenge not found", http.StatusNotFound)
+			return
+		}
+		w.Write([]byte(response))
+	})
+}
+
+// renewAt is when the certificate is due for renewal: a third of its
+// lifetime before it expires, so 30 days for the 90 days of Let's Encrypt
+func (m *ACMEManager) renewAt() time.Time {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if m.cert == nil {
+		return time.Time{}
+	}
+	leaf := m.cert.Leaf
+	return leaf.NotAfter.Add(-leaf.NotAfter.Sub(leaf.NotBefore) / 3)
+}
+
+// Run obtains the certificate if there is none and renews it when due.
+// Failed attempts are retried with a backoff of up to an hour, as the CA
+// limits how many may fail.
+func (m *ACMEManager) Run(stop <-chan struct{}) {
+	retry := time.Minute
+	for {
+		wait := time.Until(m.renewAt())
+		if wait <= 0 {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+			err := m.obtain(ctx)
+			cancel()
+			if err != nil {
+				m.logger.Printf("Failed to obtain certificate for %s, retrying in %v: %v", strings.Join(m.domains, ", "), retry, err)
+				wait = retry
+				retry = min(2*retry, time.Hour)
+			} else {
+				m.logger.Printf("Obtained certificate for %s, renewing it after %s",
+					strings.Join(m.domains, ", "), m.renewAt().Format(time.RFC3339))
+				retry = time.Minute
+				continue
+			}
+		}
+		select {
+		case <-time.After(wait):
+		case <-stop:
+			return
+		}
+	}
+}
+
+// obtain orders a new certificate and saves it
+func (m *ACMEManager) obtain(ctx context.Context) error {
+	account := &acme.Account{}
+	if m.email != "" {
+		account.Contact = []string{"mailto:" + m.email}
+	}
+	if _, err := m.client.Register(ctx, account, acme.AcceptTOS); err != nil && !errors.Is(err, acme.ErrAccountAlreadyExists) {
+		return fmt.Errorf("failed to register ACME account: %w", err)
+	}
+
+	order, err := m.client.AuthorizeOrder(ctx, acme.DomainIDs(m.domains...))
+	if err != nil {
+		return fmt.Errorf("failed to order certificate: %w", err)
+	}
+	for _, url := range order.AuthzURLs {
+		if err := m.authorize(ctx, url); err != nil {
+			return err
+		}
+	}
+	if order, err = m.client.WaitOrder(ctx, order.URI); err != nil {
+		return fmt.Errorf("failed to order certificate: %w", err)
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject:  pkix.Name{CommonName: m.domains[0]},
+		DNSNames: m.domains,
+	}, key)
+	if err != nil {
+		return err
+	}
+	chain, _, err := m.client.CreateOrderCert(ctx, order.FinalizeURL, csr, true)
+	if err != nil {
+		return fmt.Errorf("failed to finalize certificate: %w", err)
+	}
+	leaf, err := x509.ParseCertificate(chain[0])
+	if err != nil {
+		return fmt.Errorf("failed to parse certificate: %w", err)
+	}
+
+	var certPEM []byte
+	for _, der := range chain {
+		certPEM = append(certPEM, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})...)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return err
+	}
+	certPath, keyPath := m.certPaths()
+	if err := writeFileAtomic(keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		return fmt.Errorf("failed to save certificate: %w", err)
+	}
+	if err := writeFileAtomic(certPath, certPEM, 0o644); err != nil {
+		return fmt.Errorf("failed to save certificate: %w", err)
+	}
+
+	m.mu.Lock()
+	m.cert = &tls.Certificate{Certificate: chain, PrivateKey: key, Leaf: leaf}
+	m.mu.Unlock()
+	return nil
+}
+
+// authorize proves control of the domain of one authorization
+func (m *ACMEManager) authorize(ctx context.Context, url string) error {
+	authz, err := m.client.GetAuthorization(ctx, url)
+	if err != nil {
+		return fmt.Errorf("failed to get authorization: %w", err)
+	}
+	if authz.Status == acme.StatusValid {
+		return nil
+	}
+	domain := authz.Identifier.Value
+	kind := "tls-alpn-01"
+	if m.http01 {
+		kind = "http-01"
+	}
+	var challenge *acme.Challenge
+	for _, c := range authz.Challenges {
+		if c.Type == kind {
+			challenge = c
+		}
+	}
+	if challenge == nil {
+		return fmt.Errorf("the CA offers no %s challenge for %s", kind, domain)
+	}
+
+	if m.http01 {
+		response, err := m.client.HTTP01ChallengeResponse(challenge.Token)
+		if err != nil {
+			return err
+		}
+		path := m.client.HTTP01ChallengePath(challenge.Token)
+		m.mu.Lock()
+		m.httpTokens[path] = response
+		m.mu.Unlock()
+		defer func() {
+			m.mu.Lock()
+			delete(m.httpTokens, path)
+			m.mu.Unlock()
+		}()
+	} else {
+		cert, err := m.client.TLSALPN01ChallengeCert(challenge.Token, domain)
+		if err != nil {
+			return err
+		}
+		m.mu.Lock()
+		m.alpnCerts[domain] = &cert
+		m.mu.Unlock()
+		defer func() {
+			m.mu.Lock()
+			delete(m.alpnCerts, domain)
+			m.mu.Unlock()
+		}()
+	}
+
+	if _, err := m.client.Accept(ctx, challenge); err != nil {
+		return fmt.Errorf("failed to accept %s challenge for %s: %w", kind, domain, err)
+	}
+	if _, err := m.client.WaitAuthorization(ctx, authz.URI); err != nil {
+		m.client.RevokeAuthorization(ctx, authz.URI)
+		return fmt.Errorf("failed %s challenge for %s: %w", kind, domain, err)
+	}
+	return nil
+}
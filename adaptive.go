@@ -0,0 +1,284 @@
+package cachesrv
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// AdaptiveLimit caps how many operations run against storage at once and
+// tunes the cap AIMD-style from how long they take: an operation finishing
+// within the target latency raises the limit by 1/limit, so by one per
+// limit's worth of operations, and one taking longer or timing out cuts it
+// by a quarter, at most once per target so a burst of slow operations counts
+// once. Latency is measured per MB moved, in storage calls only, so large
+// artifacts and slow clients don't read as slow storage. Without a target
+// the limit stays fixed at its maximum; a nil limit admits everything.
+//
+// With shedding enabled, a limit refuses requests of the lowest priority
+// class outright once shedDepth operations are waiting, the next class up at
+// twice that, and so on, so overload drops PR builds before release builds
+// rather than letting every class queue until its client times out.
+type AdaptiveLimit struct {
+	name     string
+	min, max float64
+	target   time.Duration
+	logger   *log.Logger
+
+	mu           sync.Mutex
+	limit        float64
+	inflight     int
+	changed      chan struct{}
+	waiting      map[int]int   // by priority rank
+	latency      time.Duration // moving average per MB
+	lastDecrease time.Time
+	decreases    int64
+	lastLog      time.Time
+
+	shedDepth   int
+	priorities  *PriorityClasses
+	shed        int64
+	lastShedLog time.Time
+}
+
+// errOverloaded is returned by Acquire when it sheds a request
+var errOverloaded = errors.New("too many operations waiting")
+
+// AdaptiveLimitStatus is what /admin/limits reports about a limit
+type AdaptiveLimitStatus struct {
+	Name      string  `json:"name"`
+	Limit     int     `json:"limit"`
+	InFlight  int     `json:"inFlight"`
+	Waiting   int     `json:"waiting"`
+	Min       int     `json:"min"`
+	Max       int     `json:"max"`
+	TargetMs  float64 `json:"targetMs"`
+	LatencyMs float64 `json:"latencyMs"`
+	Decreases int64   `json:"decreases"`
+	Shed      int64   `json:"shed"`
+}
+
+// AdaptiveSlot is held by one admitted operation
+type AdaptiveSlot struct {
+	l *AdaptiveLimit
+}
+
+func NewAdaptiveLimit(name string, lower, upper int, target time.Duration, logger *log.Logger) *AdaptiveLimit {
+	lower = max(1, lower)
+	upper = max(lower, upper)
+	return &AdaptiveLimit{
+		name:    name,
+		min:     float64(lower),
+		max:     float64(upper),
+		target:  target,
+		logger:  logger,
+		limit:   float64(upper),
+		changed: make(chan struct{}),
+		waiting: make(map[int]int),
+	}
+}
+
+// ShedAt enables shedding once depth operations are waiting; 0 disables it
+func (l *AdaptiveLimit) ShedAt(depth int, priorities *PriorityClasses) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.shedDepth = depth
+	l.priorities = priorities
+}
+
+// Acquire waits until the operation may run or ctx is done. Operations of
+// a higher priority (see priorityOf) waiting at the same time go first. It
+// fails with errOverloaded when shedding the operation instead.
+func (l *AdaptiveLimit) Acquire(ctx context.Context) (*AdaptiveSlot, error) {
+	if l == nil {
+		return nil, nil
+	}
+	rank := priorityOf(ctx)
+	queued := false
+	for {
+		l.mu.Lock()
+		if l.inflight < int(l.limit) && !l.waitingAbove(rank) {
+			if queued {
+				l.waiting[rank]--
+			}
+			l.inflight++
+			l.mu.Unlock()
+			return &AdaptiveSlot{l: l}, nil
+		}
+		if !queued {
+			if l.shedding(rank) {
+				l.mu.Unlock()
+				return nil, errOverloaded
+			}
+			l.waiting[rank]++
+			queued = true
+		}
+		changed := l.changed
+		l.mu.Unlock()
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			l.mu.Lock()
+			l.waiting[rank]--
+			l.notify()
+			l.mu.Unlock()
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// waitingAbove reports whether operations of a higher priority than rank
+// are waiting; callers must hold the lock
+func (l *AdaptiveLimit) waitingAbove(rank int) bool {
+	for r, n := range l.waiting {
+		if r < rank && n > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// shedding reports whether an operation of rank arriving now is refused,
+// counting and logging it if so; callers must hold the lock
+func (l *AdaptiveLimit) shedding(rank int) bool {
+	if l.shedDepth <= 0 {
+		return false
+	}
+	classes := 1
+	if l.priorities != nil {
+		classes = len(l.priorities.names)
+	}
+	waiting := l.waitingTotal()
+	if waiting < l.shedDepth*(classes-rank) {
+		return false
+	}
+	l.shed++
+	if now := time.Now(); now.Sub(l.lastShedLog) >= time.Minute {
+		l.lastShedLog = now
+		class := l.priorities.Name(rank)
+		if class == "" {
+			class = "all"
+		}
+		l.logger.Printf("Shedding %s of class %s: %d waiting", l.name, class, waiting)
+	}
+	return true
+}
+
+// waitingTotal counts the waiting operations; callers must hold the lock
+func (l *AdaptiveLimit) waitingTotal() int {
+	waiting := 0
+	for _, n := range l.waiting {
+		waiting += n
+	}
+	return waiting
+}
+
+// notify wakes the waiting operations to check again; callers must hold the
+// lock
+func (l *AdaptiveLimit) notify() {
+	close(l.changed)
+	l.changed = make(chan struct{})
+}
+
+// Done releases the slot. elapsed is the time spent in storage calls, size
+// the bytes they moved, and failed reports a timeout or another sign of
+// overloaded storage.
+func (slot *AdaptiveSlot) Done(elapsed time.Duration, size int64, failed bool) {
+	if slot == nil {
+		return
+	}
+	l := slot.l
+	perMB := time.Duration(float64(elapsed) / math.Max(1, float64(size)/(1<<20)))
+	now := time.Now()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.inflight--
+	if l.latency == 0 {
+		l.latency = perMB
+	} else {
+		l.latency += (perMB - l.latency) / 8
+	}
+	switch {
+	case l.target == 0:
+	case failed || perMB > l.target:
+		if now.Sub(l.lastDecrease) >= l.target {
+			l.limit = math.Max(l.min, l.limit*0.75)
+			l.lastDecrease = now
+			l.decreases++
+			if now.Sub(l.lastLog) >= time.Minute {
+				l.lastLog = now
+				l.logger.Printf("Lowered %s limit to %d: %v per MB against a %v target",
+					l.name, int(l.limit), l.latency.Round(time.Millisecond), l.target)
+			}
+		}
+	default:
+		l.limit = math.Min(l.max, l.limit+1/l.limit)
+	}
+	l.notify()
+}
+
+func (l *AdaptiveLimit) Status() AdaptiveLimitStatus {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return AdaptiveLimitStatus{
+		Name:      l.name,
+		Limit:     int(l.limit),
+		InFlight:  l.inflight,
+		Waiting:   l.waitingTotal(),
+		Min:       int(l.min),
+		Max:       int(l.max),
+		TargetMs:  float64(l.target) / float64(time.Millisecond),
+		LatencyMs: float64(l.latency) / float64(time.Millisecond),
+		Decreases: l.decreases,
+		Shed:      l.shed,
+	}
+}
+
+// timedReader adds up the time spent in Read, to tell the time waiting for
+// a client apart from the time spent in storage
+type timedReader struct {
+	r     io.Reader
+	spent time.Duration
+}
+
+func (tr *timedReader) Read(p []byte) (int, error) {
+	start := time.Now()
+	n, err := tr.r.Read(p)
+	tr.spent += time.Since(start)
+	return n, err
+}
+
+// refuseBusy answers a request that didn't get a slot: shed requests are
+// told to come back shortly, the others have given up waiting anyway
+func refuseBusy(w http.ResponseWriter, err error) {
+	if errors.Is(err, errOverloaded) {
+		w.Header().Set("Retry-After", "1")
+		http.Error(w, "Server overloaded", http.StatusServiceUnavailable)
+		return
+	}
+	http.Error(w, "Server busy", http.StatusServiceUnavailable)
+}
+
+// Handler for /admin/limits
+func (s *Server) listLimits(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	limits := make([]AdaptiveLimitStatus, 0, 3)
+	for _, l := range []*AdaptiveLimit{s.uploadLimit, s.downloadLimit, s.scanner.limit} {
+		if l != nil {
+			limits = append(limits, l.Status())
+		}
+	}
+	s.writeList(w, r, limits, "name", "name")
+}
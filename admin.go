@@ -0,0 +1,386 @@
+package cachesrv
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+type RotateTokenRequest struct {
+	Token     string `json:"token"`
+	Overlap   string `json:"overlap,omitempty"`
+	ExpiresIn string `json:"expiresIn,omitempty"`
+}
+
+type RotateTokenResponse struct {
+	ID        string     `json:"id"`
+	Name      string     `json:"name"`
+	Token     string     `json:"token"`
+	ExpiresAt *time.Time `json:"expiresAt,omitempty"`
+}
+
+type CreateTokenRequest struct {
+	Name      string   `json:"name"`
+	Scope     string   `json:"scope,omitempty"`
+	Priority  string   `json:"priority,omitempty"`
+	Teams     []string `json:"teams,omitempty"`
+	ExpiresIn string   `json:"expiresIn,omitempty"`
+}
+
+// CreateTokenResponse is the only answer that carries a new token's value
+type CreateTokenResponse struct {
+	TokenInfo
+	Token string `json:"token"`
+}
+
+// Middleware to restrict admin endpoints to the admin tokens, tokens of the
+// admin scope or LDAP users. Reads need the viewer role, anything else the
+// given write role.
+func (s *Server) handleAdminAuth(write Role, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		lrw := newLoggingResponseWriter(w)
+		rl := &requestLog{start: time.Now(), w: lrw}
+		r, release := s.limitRequest(lrw, r)
+		defer release()
+		defer func() { rl.log(s.slogger, "admin request", r, nil) }()
+		if username, _, ok := r.BasicAuth(); ok {
+			rl.user = username
+		}
+
+		role, err := s.authenticateAdmin(r)
+		if errors.Is(err, errNotAuthorized) {
+			// The credentials are right, they just don't grant a role
+			rl.reason = err.Error()
+			http.Error(lrw, "Forbidden", http.StatusForbidden)
+			return
+		}
+		if err != nil {
+			if s.ldap != nil {
+				lrw.Header().Set("WWW-Authenticate", `Basic realm="turbo-cache admin"`)
+			}
+			rl.reason = err.Error()
+			http.Error(lrw, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		rl.role = role.String()
+
+		required := write
+		if r.Method == http.MethodGet || r.Method == http.MethodHead {
+			required = roleViewer
+		}
+		if role < required {
+			rl.reason = "requires " + required.String()
+			http.Error(lrw, "Forbidden", http.StatusForbidden)
+			return
+		}
+
+		lrw.Header().Set("Content-Type", "application/json")
+		next(lrw, r)
+	}
+}
+
+// authenticateAdmin accepts the admin tokens and tokens of the admin scope,
+// or LDAP credentials via basic auth when an LDAP server is configured, and
+// returns the caller's role
+func (s *Server) authenticateAdmin(r *http.Request) (Role, error) {
+	if username, password, ok := r.BasicAuth(); ok && s.ldap != nil {
+		groups, err := s.ldap.AuthenticatePassword(r.Context(), username, password)
+		if err != nil {
+			return roleNone, fmt.Errorf("ldap user %s: %w", username, err)
+		}
+		role := s.roles.IdentityRole(username, groups)
+		if role == roleNone {
+			return roleNone, fmt.Errorf("ldap user %s has no admin role: %w", username, errNotAuthorized)
+		}
+		s.logger.Printf("Admin request authenticated as ldap user %s (%s)", username, role)
+		return role, nil
+	}
+
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") {
+		if !s.roles.Enabled() {
+			return roleNone, errors.New("no admin token configured")
+		}
+		return roleNone, errors.New("invalid admin token")
+	}
+	value := strings.TrimPrefix(auth, "Bearer ")
+	if role := s.roles.TokenRole(value); role != roleNone {
+		return role, nil
+	}
+	// Tokens of the admin scope only get the role TURBO_ADMIN_SCOPE_ROLE grants them
+	if s.roles.scopeRole != roleNone {
+		if token, err := s.tokens.Lookup(value); err == nil && token.Scope == scopeAdmin {
+			s.logger.Printf("Admin request authenticated as token %s (%s)", token.Name, s.roles.scopeRole)
+			return s.roles.scopeRole, nil
+		}
+	}
+	if !s.roles.Enabled() {
+		return roleNone, errors.New("no admin token configured")
+	}
+	return roleNone, errors.New("invalid admin token")
+}
+
+// Handler for /admin/tokens
+func (s *Server) handleTokens(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		s.listTokens(w, r)
+	case http.MethodPost:
+		s.createToken(w, r)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (s *Server) listTokens(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	s.writeList(w, r, s.tokens.List(), "createdAt", "id")
+}
+
+func (s *Server) createToken(w http.ResponseWriter, r *http.Request) {
+	var req CreateTokenRequest
+	if !s.decodeBody(w, r, &req) {
+		return
+	}
+	if req.Name == "" {
+		http.Error(w, "Missing token name", http.StatusBadRequest)
+		return
+	}
+	switch req.Scope {
+	case "", scopeRead, scopeReadWrite, scopeAdmin:
+	default:
+		http.Error(w, "Invalid scope (expected read, read-write or admin)", http.StatusBadRequest)
+		return
+	}
+	if req.Priority != "" && !s.priorities.Has(req.Priority) {
+		http.Error(w, "Unknown priority class", http.StatusBadRequest)
+		return
+	}
+	for _, team := range req.Teams {
+		if team == "" {
+			http.Error(w, "Invalid team", http.StatusBadRequest)
+			return
+		}
+	}
+
+	var lifetime time.Duration
+	if req.ExpiresIn != "" {
+		d, err := parseDuration(req.ExpiresIn)
+		if err != nil || d <= 0 {
+			http.Error(w, "Invalid expiresIn", http.StatusBadRequest)
+			return
+		}
+		lifetime = d
+	}
+
+	token, value, err := s.tokens.Create(req.Name, req.Scope, req.Priority, req.Teams, lifetime)
+	switch {
+	case errors.Is(err, errTokenExists):
+		http.Error(w, "Token name already in use", http.StatusConflict)
+		return
+	case err != nil:
+		s.logger.Printf("Failed to create token %s: %v", req.Name, err)
+		http.Error(w, "Failed to create token", http.StatusInternalServerError)
+		return
+	}
+
+	s.logger.Printf("Token %s created as %s", token.Name, token.ID)
+
+	info, _ := s.tokens.Info(token.ID)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(CreateTokenResponse{TokenInfo: info, Token: value})
+}
+
+// Handler for /admin/tokens/{ref}, an ID or the name of the current token
+func (s *Server) handleToken(w http.ResponseWriter, r *http.Request) {
+	ref := strings.TrimPrefix(r.URL.Path, "/admin/tokens/")
+	if ref == "" || strings.Contains(ref, "/") {
+		http.NotFound(w, r)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		info, err := s.tokens.Info(ref)
+		if err != nil {
+			http.Error(w, "Token not found", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(info)
+	case http.MethodDelete:
+		revoked, err := s.tokens.Revoke(ref)
+		switch {
+		case errors.Is(err, errTokenNotFound):
+			http.Error(w, "Token not found", http.StatusNotFound)
+			return
+		case errors.Is(err, errTokenStatic):
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		case err != nil:
+			s.logger.Printf("Failed to revoke token %s: %v", ref, err)
+			http.Error(w, "Failed to revoke token", http.StatusInternalServerError)
+			return
+		}
+		for _, t := range revoked {
+			s.logger.Printf("Token %s (%s) revoked", t.Name, t.ID)
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// Handler for /admin/tokens/rotate
+func (s *Server) rotateToken(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req RotateTokenRequest
+	if !s.decodeBody(w, r, &req) {
+		return
+	}
+	if req.Token == "" {
+		http.Error(w, "Missing token", http.StatusBadRequest)
+		return
+	}
+
+	overlap := s.rotationOverlap
+	if req.Overlap != "" {
+		d, err := parseDuration(req.Overlap)
+		if err != nil || d < 0 {
+			http.Error(w, "Invalid overlap", http.StatusBadRequest)
+			return
+		}
+		overlap = d
+	}
+
+	var lifetime time.Duration
+	if req.ExpiresIn != "" {
+		d, err := parseDuration(req.ExpiresIn)
+		if err != nil || d <= 0 {
+			http.Error(w, "Invalid expiresIn", http.StatusBadRequest)
+			return
+		}
+		lifetime = d
+	}
+
+	token, value, err := s.tokens.Rotate(req.Token, overlap, lifetime)
+	switch {
+	case errors.Is(err, errTokenNotFound):
+		http.Error(w, "Token not found", http.StatusNotFound)
+		return
+	case errors.Is(err, errTokenStatic):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	case err != nil:
+		s.logger.Printf("Token rotation failed for %s: %v", req.Token, err)
+		http.Error(w, "Failed to rotate token", http.StatusInternalServerError)
+		return
+	}
+
+	s.logger.Printf("Token %s rotated to %s (overlap %v)", req.Token, token.ID, overlap)
+
+	json.NewEncoder(w).Encode(RotateTokenResponse{
+		ID:        token.ID,
+		Name:      token.Name,
+		Token:     value,
+		ExpiresAt: token.ExpiresAt,
+	})
+}
+
+type QuotaResponse struct {
+	Team     string `json:"team"`
+	Limit    int64  `json:"limit"`
+	Used     int64  `json:"used"`
+	Reserved int64  `json:"reserved"`
+}
+
+// Handler for /admin/quotas?team=
+func (s *Server) getQuota(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	team := r.URL.Query().Get("team")
+	used, reserved := s.quotas.Usage(team)
+	json.NewEncoder(w).Encode(QuotaResponse{
+		Team:     team,
+		Limit:    s.quotas.Limit(team),
+		Used:     used,
+		Reserved: reserved,
+	})
+}
+
+// Handler for /admin/scan?verify=true
+func (s *Server) runScan(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	verify, dryRun := r.URL.Query().Get("verify") == "true", dryRunRequested(r)
+	if asyncRequested(r) {
+		s.startJob(w, "scan", func(ctx context.Context, job *Job) (any, error) {
+			report, err := s.scanner.Scan(ctx, verify, dryRun, job)
+			if report != nil {
+				job.Logf("%d scanned, %d adopted, %d missing, %d verified, %d corrupt",
+					report.Scanned, report.Adopted, report.Missing, report.Verified, len(report.Corrupt))
+			}
+			return report, err
+		})
+		return
+	}
+
+	report, err := s.scanner.Scan(r.Context(), verify, dryRun, nil)
+	switch {
+	case errors.Is(err, errScanRunning):
+		http.Error(w, "Scan already running", http.StatusConflict)
+		return
+	case err != nil:
+		s.logger.Printf("Maintenance scan failed: %v", err)
+		http.Error(w, "Scan failed", http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(report)
+}
+
+// Handler for /admin/metrics/history
+func (s *Server) getMetricsHistory(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	s.writeList(w, r, s.metrics.History(), "start", "start")
+}
+
+// Handler for /admin/artifacts?<header>=<value>
+func (s *Server) findArtifacts(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodDelete:
+		s.deleteArtifacts(w, r)
+		return
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	filter := make(map[string]string)
+	for _, name := range s.metadataHeaders {
+		if value := r.URL.Query().Get(name); value != "" {
+			filter[name] = value
+		}
+	}
+	s.writeList(w, r, s.index.Find(filter), "-createdAt", "hash")
+}
@@ -0,0 +1,235 @@
+package cachesrv
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// MetricsBucket counts cache traffic over one interval
+type MetricsBucket struct {
+	Start       time.Time `json:"start"`
+	Hits        int64     `json:"hits"`
+	Misses      int64     `json:"misses"`
+	Uploads     int64     `json:"uploads"`
+	UploadBytes int64     `json:"uploadBytes"`
+	// AbortedUploads counts uploads the client disconnected from
+	AbortedUploads int64 `json:"abortedUploads"`
+	DownloadBytes  int64 `json:"downloadBytes"`
+}
+
+func (b *MetricsBucket) hitRate() float64 {
+	if b.Hits+b.Misses == 0 {
+		return 0
+	}
+	return float64(b.Hits) / float64(b.Hits+b.Misses)
+}
+
+func (b *MetricsBucket) avgUploadSize() float64 {
+	if b.Uploads == 0 {
+		return 0
+	}
+	return float64(b.UploadBytes) / float64(b.Uploads)
+}
+
+// CacheMetrics keeps a short history of per-interval traffic counts, and
+// their totals since startup for /metrics
+type CacheMetrics struct {
+	mu      sync.Mutex
+	current MetricsBucket
+	totals  MetricsBucket
+	history []MetricsBucket
+	keep    int
+}
+
+func NewCacheMetrics(keep int) *CacheMetrics {
+	return &CacheMetrics{current: MetricsBucket{Start: time.Now()}, keep: keep}
+}
+
+func (m *CacheMetrics) RecordHit() {
+	m.mu.Lock()
+	m.current.Hits++
+	m.totals.Hits++
+	m.mu.Unlock()
+}
+
+func (m *CacheMetrics) RecordMiss() {
+	m.mu.Lock()
+	m.current.Misses++
+	m.totals.Misses++
+	m.mu.Unlock()
+}
+
+func (m *CacheMetrics) RecordUpload(size int64) {
+	m.mu.Lock()
+	m.current.Uploads++
+	m.current.UploadBytes += size
+	m.totals.Uploads++
+	m.totals.UploadBytes += size
+	m.mu.Unlock()
+}
+
+func (m *CacheMetrics) RecordDownload(size int64) {
+	m.mu.Lock()
+	m.current.DownloadBytes += size
+	m.totals.DownloadBytes += size
+	m.mu.Unlock()
+}
+
+func (m *CacheMetrics) RecordAbortedUpload() {
+	m.mu.Lock()
+	m.current.AbortedUploads++
+	m.totals.AbortedUploads++
+	m.mu.Unlock()
+}
+
+// rotate closes the current bucket, returning it and the buckets before it
+func (m *CacheMetrics) rotate(now time.Time) (MetricsBucket, []MetricsBucket) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	closed := m.current
+	baseline := append([]MetricsBucket(nil), m.history...)
+	m.history = append(m.history, closed)
+	if len(m.history) > m.keep {
+		m.history = m.history[len(m.history)-m.keep:]
+	}
+	m.current = MetricsBucket{Start: now}
+	return closed, baseline
+}
+
+// Totals returns the counts since startup
+func (m *CacheMetrics) Totals() MetricsBucket {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.totals
+}
+
+// History returns the completed buckets, oldest first
+func (m *CacheMetrics) History() []MetricsBucket {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]MetricsBucket(nil), m.history...)
+}
+
+// Anomaly is a detected deviation from the recent baseline
+type Anomaly struct {
+	Kind     string    `json:"kind"`
+	Message  string    `json:"message"`
+	Value    float64   `json:"value"`
+	Baseline float64   `json:"baseline"`
+	Time     time.Time `json:"time"`
+}
+
+const (
+	anomalyHitRateDrop = "hit_rate_drop"
+	anomalyUploadSpike = "upload_size_spike"
+	anomalyMissStorm   = "miss_storm"
+)
+
+// AnomalyDetector compares every closed metrics bucket with the average of
+// the ones before it. A hit rate that suddenly drops or a storm of misses
+// usually means hashes changed for everyone, e.g. after a turbo.json edit.
+type AnomalyDetector struct {
+	metrics     *CacheMetrics
+	notify      *Notifications
+	logger      *log.Logger
+	hitRateDrop float64
+	spikeFactor float64
+	minRequests int64
+	cooldown    time.Duration
+	lastAlert   map[string]time.Time
+}
+
+func NewAnomalyDetector(metrics *CacheMetrics, notify *Notifications, hitRateDrop, spikeFactor float64, cooldown time.Duration, logger *log.Logger) *AnomalyDetector {
+	return &AnomalyDetector{
+		metrics:     metrics,
+		notify:      notify,
+		logger:      logger,
+		hitRateDrop: hitRateDrop,
+		spikeFactor: spikeFactor,
+		minRequests: 20,
+		cooldown:    cooldown,
+		lastAlert:   make(map[string]time.Time),
+	}
+}
+
+// Run closes a bucket and checks it at every interval
+func (d *AnomalyDetector) Run(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			bucket, baseline := d.metrics.rotate(now)
+			for _, a := range d.check(bucket, baseline) {
+				d.alert(a)
+			}
+		case <-stop:
+			return
+		}
+	}
+}
+
+func (d *AnomalyDetector) check(b MetricsBucket, baseline []MetricsBucket) []Anomaly {
+	// Too little history to tell normal from abnormal
+	if len(baseline) < 5 {
+		return nil
+	}
+	var base MetricsBucket
+	for _, h := range baseline {
+		base.Hits += h.Hits
+		base.Misses += h.Misses
+		base.Uploads += h.Uploads
+		base.UploadBytes += h.UploadBytes
+	}
+	n := float64(len(baseline))
+	now := time.Now()
+	var anomalies []Anomaly
+
+	if b.Hits+b.Misses >= d.minRequests && base.Hits+base.Misses > 0 {
+		if rate, baseRate := b.hitRate(), base.hitRate(); baseRate-rate >= d.hitRateDrop {
+			anomalies = append(anomalies, Anomaly{
+				Kind:     anomalyHitRateDrop,
+				Message:  fmt.Sprintf("Cache hit rate dropped to %.0f%% (baseline %.0f%%)", rate*100, baseRate*100),
+				Value:    rate,
+				Baseline: baseRate,
+				Time:     now,
+			})
+		}
+	}
+
+	if meanMisses := float64(base.Misses) / n; b.Misses >= d.minRequests && float64(b.Misses) > d.spikeFactor*meanMisses {
+		anomalies = append(anomalies, Anomaly{
+			Kind:     anomalyMissStorm,
+			Message:  fmt.Sprintf("%d cache misses in one interval (baseline %.1f)", b.Misses, meanMisses),
+			Value:    float64(b.Misses),
+			Baseline: meanMisses,
+			Time:     now,
+		})
+	}
+
+	if b.Uploads > 0 && base.Uploads > 0 {
+		if size, baseSize := b.avgUploadSize(), base.avgUploadSize(); size > d.spikeFactor*baseSize {
+			anomalies = append(anomalies, Anomaly{
+				Kind:     anomalyUploadSpike,
+				Message:  fmt.Sprintf("Average upload size jumped to %.0f bytes (baseline %.0f)", size, baseSize),
+				Value:    size,
+				Baseline: baseSize,
+				Time:     now,
+			})
+		}
+	}
+	return anomalies
+}
+
+// alert logs an anomaly and sends a notification, at most once per
+// cooldown for each kind
+func (d *AnomalyDetector) alert(a Anomaly) {
+	if last, ok := d.lastAlert[a.Kind]; ok && time.Since(last) < d.cooldown {
+		return
+	}
+	d.lastAlert[a.Kind] = time.Now()
+	d.logger.Printf("Anomaly detected: %s", a.Message)
+	d.notify.Send(eventAnomaly, severityWarning, a.Message, a)
+}
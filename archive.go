@@ -0,0 +1,137 @@
+package cachesrv
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"path"
+	"strings"
+)
+
+const tagsHeader = "X-Artifact-Tags"
+
+// ArchiveMirror copies artifacts with matching tags to archival storage that
+// is outside of eviction, so release artifacts stay reproducible. Archived
+// artifacts are written once and never overwritten or deleted.
+type ArchiveMirror struct {
+	storage  Storage
+	patterns []string
+	queue    chan archiveJob
+	logger   *log.Logger
+}
+
+type archiveJob struct {
+	hash   string
+	source Storage
+}
+
+func NewArchiveMirror(storage Storage, patterns []string, logger *log.Logger) *ArchiveMirror {
+	a := &ArchiveMirror{
+		storage:  storage,
+		patterns: patterns,
+		queue:    make(chan archiveJob, 1000),
+		logger:   logger,
+	}
+	go a.run()
+	return a
+}
+
+// Pending returns the number of artifacts waiting to be archived and how many fit
+func (a *ArchiveMirror) Pending() (int, int) {
+	return len(a.queue), cap(a.queue)
+}
+
+// Matches reports whether any tag matches an archive pattern such as release-*
+func (a *ArchiveMirror) Matches(tags []string) bool {
+	return matchTags(a.patterns, tags)
+}
+
+// matchTags reports whether any tag matches any of the patterns
+func matchTags(patterns, tags []string) bool {
+	for _, tag := range tags {
+		for _, pattern := range patterns {
+			if ok, _ := path.Match(pattern, tag); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Enqueue schedules an artifact to be copied from source to the archive
+func (a *ArchiveMirror) Enqueue(hash string, source Storage) {
+	select {
+	case a.queue <- archiveJob{hash: hash, source: source}:
+	default:
+		a.logger.Printf("Archive queue full, %s was not archived", hash)
+	}
+}
+
+// Get reads an artifact from the archive
+func (a *ArchiveMirror) Get(hash string) (io.ReadCloser, int64, error) {
+	return a.storage.Get(hash)
+}
+
+func (a *ArchiveMirror) run() {
+	for job := range a.queue {
+		if err := a.copy(job); err != nil {
+			a.logger.Printf("Failed to archive %s: %v", job.hash, err)
+		}
+	}
+}
+
+func (a *ArchiveMirror) copy(job archiveJob) error {
+	exists, err := a.storage.Exists(job.hash)
+	if err != nil {
+		return err
+	}
+	if exists {
+		return nil
+	}
+	reader, _, err := job.source.Get(job.hash)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+	if err := a.storage.Store(job.hash, reader); err != nil {
+		return err
+	}
+	a.logger.Printf("Archived %s", job.hash)
+	return nil
+}
+
+// parseTags reads the comma separated tags of an upload
+func parseTags(header string) []string {
+	var tags []string
+	for _, tag := range strings.Split(header, ",") {
+		if tag = strings.TrimSpace(tag); tag != "" {
+			tags = append(tags, tag)
+		}
+	}
+	return tags
+}
+
+func newArchiveMirrorFromEnv(cacheDir string, logger *log.Logger) (*ArchiveMirror, error) {
+	patterns := parseTags(getenv("TURBO_ARCHIVE_TAGS"))
+	if len(patterns) == 0 {
+		return nil, nil
+	}
+	for _, p := range patterns {
+		if _, err := path.Match(p, ""); err != nil {
+			return nil, fmt.Errorf("invalid TURBO_ARCHIVE_TAGS pattern %q: %w", p, err)
+		}
+	}
+
+	backend := envString("TURBO_ARCHIVE_BACKEND", "fs")
+	dir := cacheDir
+	if backend == "fs" {
+		if dir = getenv("TURBO_ARCHIVE_DIR"); dir == "" {
+			return nil, fmt.Errorf("TURBO_ARCHIVE_DIR is required for the fs archive backend")
+		}
+	}
+	storage, err := newBackend("TURBO_ARCHIVE_", backend, dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialize archive storage: %w", err)
+	}
+	return NewArchiveMirror(storage, patterns, logger), nil
+}
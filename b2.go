@@ -0,0 +1,345 @@
+package cachesrv
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const b2AuthorizeURL = "https://api.backblazeb2.com/b2api/v2/b2_authorize_account"
+
+// B2Storage stores artifacts in a Backblaze B2 bucket using the native B2
+// API. B2 needs the length and SHA-1 of every upload up front, so uploads are
+// spooled to a temp file first.
+type B2Storage struct {
+	client   *http.Client
+	keyID    string
+	appKey   string
+	bucket   string
+	prefix   string
+	spoolDir string
+
+	mu          sync.Mutex
+	accountID   string
+	apiURL      string
+	downloadURL string
+	token       string
+	bucketID    string
+}
+
+func NewB2Storage(keyID, appKey, bucket, prefix, spoolDir string) (*B2Storage, error) {
+	b := &B2Storage{
+		client:   &http.Client{},
+		keyID:    keyID,
+		appKey:   appKey,
+		bucket:   bucket,
+		prefix:   prefix,
+		spoolDir: spoolDir,
+	}
+	if err := b.authorize(); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// authorize obtains a fresh account token and resolves the bucket id
+func (b *B2Storage) authorize() error {
+	req, err := http.NewRequest(http.MethodGet, b2AuthorizeURL, nil)
+	if err != nil {
+		return err
+	}
+	req.SetBasicAuth(b.keyID, b.appKey)
+	resp, err := b.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("b2 authorization failed: %w", err)
+	}
+	var account struct {
+		AccountID          string `json:"accountId"`
+		AuthorizationToken string `json:"authorizationToken"`
+		APIURL             string `json:"apiUrl"`
+		DownloadURL        string `json:"downloadUrl"`
+	}
+	if err := decodeJSONResponse(resp, &account); err != nil {
+		return fmt.Errorf("b2 authorization failed: %w", err)
+	}
+
+	b.mu.Lock()
+	b.accountID, b.apiURL, b.downloadURL, b.token = account.AccountID, account.APIURL, account.DownloadURL, account.AuthorizationToken
+	known := b.bucketID != ""
+	b.mu.Unlock()
+	if known {
+		return nil
+	}
+
+	var buckets struct {
+		Buckets []struct {
+			BucketID string `json:"bucketId"`
+		} `json:"buckets"`
+	}
+	if err := b.call("b2_list_buckets", map[string]string{"accountId": account.AccountID, "bucketName": b.bucket}, &buckets); err != nil {
+		return err
+	}
+	if len(buckets.Buckets) == 0 {
+		return fmt.Errorf("b2 bucket %s not found", b.bucket)
+	}
+	b.mu.Lock()
+	b.bucketID = buckets.Buckets[0].BucketID
+	b.mu.Unlock()
+	return nil
+}
+
+// call invokes a B2 API operation, re-authorizing once if the token expired
+func (b *B2Storage) call(operation string, request, response any) error {
+	payload, err := json.Marshal(request)
+	if err != nil {
+		return err
+	}
+	for attempt := 0; ; attempt++ {
+		b.mu.Lock()
+		apiURL, token := b.apiURL, b.token
+		b.mu.Unlock()
+
+		req, err := http.NewRequest(http.MethodPost, apiURL+"/b2api/v2/"+operation, bytes.NewReader(payload))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Authorization", token)
+		resp, err := b.client.Do(req)
+		if err != nil {
+			return fmt.Errorf("%s failed: %w", operation, err)
+		}
+		if resp.StatusCode == http.StatusUnauthorized && attempt == 0 {
+			resp.Body.Close()
+			if err := b.authorize(); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := decodeJSONResponse(resp, response); err != nil {
+			return fmt.Errorf("%s failed: %w", operation, err)
+		}
+		return nil
+	}
+}
+
+func (b *B2Storage) Store(hash string, data io.Reader) error {
+	spool, err := os.CreateTemp(b.spoolDir, ".b2-upload-*")
+	if err != nil {
+		return fmt.Errorf("failed to create spool file: %w", err)
+	}
+	defer os.Remove(spool.Name())
+	defer spool.Close()
+
+	digest := sha1.New()
+	size, err := io.Copy(io.MultiWriter(spool, digest), data)
+	if err != nil {
+		return fmt.Errorf("failed to spool upload: %w", err)
+	}
+
+	// Upload URLs are single-use per uploader, so get one per artifact
+	var target struct {
+		UploadURL          string `json:"uploadUrl"`
+		AuthorizationToken string `json:"authorizationToken"`
+	}
+	b.mu.Lock()
+	bucketID := b.bucketID
+	b.mu.Unlock()
+	if err := b.call("b2_get_upload_url", map[string]string{"bucketId": bucketID}, &target); err != nil {
+		return err
+	}
+
+	if _, err := spool.Seek(0, io.SeekStart); err != nil {
+		return fmt.Errorf("failed to rewind spool file: %w", err)
+	}
+	req, err := http.NewRequest(http.MethodPost, target.UploadURL, spool)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = size
+	req.Header.Set("Authorization", target.AuthorizationToken)
+	req.Header.Set("X-Bz-File-Name", b2EscapeName(b.prefix+hash))
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.Header.Set("X-Bz-Content-Sha1", hex.EncodeToString(digest.Sum(nil)))
+
+	resp, err := b.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to upload file: %w", err)
+	}
+	var uploaded struct{}
+	if err := decodeJSONResponse(resp, &uploaded); err != nil {
+		return fmt.Errorf("failed to upload file: %w", err)
+	}
+	return nil
+}
+
+// download sends an authorized GET or HEAD for a file by name
+func (b *B2Storage) download(method, hash string) (*http.Response, error) {
+	for attempt := 0; ; attempt++ {
+		b.mu.Lock()
+		downloadURL, token := b.downloadURL, b.token
+		b.mu.Unlock()
+
+		req, err := http.NewRequest(method, downloadURL+"/file/"+b.bucket+"/"+b2EscapeName(b.prefix+hash), nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Authorization", token)
+		resp, err := b.client.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode == http.StatusUnauthorized && attempt == 0 {
+			resp.Body.Close()
+			if err := b.authorize(); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		return resp, nil
+	}
+}
+
+func (b *B2Storage) Get(hash string) (io.ReadCloser, int64, error) {
+	resp, err := b.download(http.MethodGet, hash)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to download file: %w", err)
+	}
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return resp.Body, resp.ContentLength, nil
+	case http.StatusNotFound:
+		resp.Body.Close()
+		return nil, 0, errArtifactNotFound
+	default:
+		resp.Body.Close()
+		return nil, 0, fmt.Errorf("failed to download file: %s", resp.Status)
+	}
+}
+
+func (b *B2Storage) Exists(hash string) (bool, error) {
+	resp, err := b.download(http.MethodHead, hash)
+	if err != nil {
+		return false, fmt.Errorf("failed to check file: %w", err)
+	}
+	resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return true, nil
+	case http.StatusNotFound:
+		return false, nil
+	default:
+		return false, fmt.Errorf("failed to check file: %s", resp.Status)
+	}
+}
+
+// Delete removes every version of the file, since B2 keeps (and bills) old
+// versions of overwritten files
+func (b *B2Storage) Delete(hash string) error {
+	name := b.prefix + hash
+	b.mu.Lock()
+	bucketID := b.bucketID
+	b.mu.Unlock()
+
+	var versions struct {
+		Files []struct {
+			FileID   string `json:"fileId"`
+			FileName string `json:"fileName"`
+		} `json:"files"`
+	}
+	err := b.call("b2_list_file_versions", map[string]any{
+		"bucketId":      bucketID,
+		"startFileName": name,
+		"prefix":        name,
+		"maxFileCount":  100,
+	}, &versions)
+	if err != nil {
+		return fmt.Errorf("failed to delete file: %w", err)
+	}
+	for _, v := range versions.Files {
+		if v.FileName != name {
+			continue
+		}
+		var deleted struct{}
+		if err := b.call("b2_delete_file_version", map[string]string{"fileName": v.FileName, "fileId": v.FileID}, &deleted); err != nil {
+			return fmt.Errorf("failed to delete file: %w", err)
+		}
+	}
+	return nil
+}
+
+// List pages through the current file names in the bucket
+func (b *B2Storage) List() ([]ArtifactStat, error) {
+	b.mu.Lock()
+	bucketID := b.bucketID
+	b.mu.Unlock()
+
+	var artifacts []ArtifactStat
+	start := ""
+	for {
+		var page struct {
+			Files []struct {
+				FileName        string `json:"fileName"`
+				ContentLength   int64  `json:"contentLength"`
+				UploadTimestamp int64  `json:"uploadTimestamp"`
+				Action          string `json:"action"`
+			} `json:"files"`
+			NextFileName *string `json:"nextFileName"`
+		}
+		err := b.call("b2_list_file_names", map[string]any{
+			"bucketId":      bucketID,
+			"startFileName": start,
+			"prefix":        b.prefix,
+			"maxFileCount":  10000,
+		}, &page)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list bucket: %w", err)
+		}
+
+		for _, f := range page.Files {
+			hash := strings.TrimPrefix(f.FileName, b.prefix)
+			if f.Action != "upload" || hash == "" || strings.Contains(hash, "/") || strings.HasPrefix(hash, ".") {
+				continue
+			}
+			artifacts = append(artifacts, ArtifactStat{
+				Hash:    hash,
+				Size:    f.ContentLength,
+				ModTime: time.UnixMilli(f.UploadTimestamp),
+			})
+		}
+		if page.NextFileName == nil {
+			return artifacts, nil
+		}
+		start = *page.NextFileName
+	}
+}
+
+func newB2StorageFromEnv(prefix, cacheDir string) (*B2Storage, error) {
+	values, err := requireEnv(prefix+"B2_KEY_ID", prefix+"B2_APPLICATION_KEY", prefix+"B2_BUCKET")
+	if err != nil {
+		return nil, err
+	}
+	spoolDir := envString(prefix+"B2_SPOOL_DIR", filepath.Join(cacheDir, ".spool"))
+	if err := os.MkdirAll(spoolDir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create spool directory: %w", err)
+	}
+	return NewB2Storage(values[0], values[1], values[2], envString(prefix+"B2_PREFIX", ""), spoolDir)
+}
+
+// b2EscapeName percent-encodes a file name, keeping '/' literal as B2 expects
+func b2EscapeName(name string) string {
+	segments := strings.Split(name, "/")
+	for i, s := range segments {
+		segments[i] = url.PathEscape(s)
+	}
+	return strings.Join(segments, "/")
+}
@@ -0,0 +1,352 @@
+package cachesrv
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Every storage backend, and each tier of a tiered one, is watched on its
+// own: calls, failures, latency and a circuit breaker per backend, so a
+// deployment with several layers can tell which one is sick. The admin API
+// lists them at /admin/backends and /metrics exports them.
+
+var errBreakerOpen = errors.New("circuit breaker open")
+
+// Circuit breaker states
+const (
+	breakerClosed   = "closed"    // calls go through
+	breakerOpen     = "open"      // calls fail fast until the cooldown is over
+	breakerHalfOpen = "half-open" // one trial call decides
+)
+
+// latencySamples is how many recent call latencies each backend keeps for
+// its percentiles
+const latencySamples = 1024
+
+// MonitoredStorage records the health of the backend it wraps and, once
+// that keeps failing, stops calling it for a while so requests fail fast
+// instead of waiting on a dead backend
+type MonitoredStorage struct {
+	inner      Storage
+	name       string
+	breakAfter int // consecutive failures that open the breaker, 0 = never
+	cooldown   time.Duration
+	logger     *log.Logger
+
+	mu          sync.Mutex
+	calls       int64
+	failures    int64
+	rejected    int64
+	consecutive int
+	lastError   string
+	lastErrorAt time.Time
+	lastSuccess time.Time
+	latencies   []time.Duration // ring of the latest samples
+	next        int
+	state       string
+	openedAt    time.Time
+	trial       bool
+}
+
+// Unwrap returns the wrapped storage
+func (m *MonitoredStorage) Unwrap() Storage {
+	return m.inner
+}
+
+// admit decides whether a call may go to the backend, and whether it is
+// the trial call of a half-open breaker
+func (m *MonitoredStorage) admit() (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	switch m.state {
+	case breakerOpen:
+		if time.Since(m.openedAt) < m.cooldown {
+			m.rejected++
+			return false, fmt.Errorf("storage backend %s: %w", m.name, errBreakerOpen)
+		}
+		m.state = breakerHalfOpen
+	case breakerHalfOpen:
+		if m.trial {
+			m.rejected++
+			return false, fmt.Errorf("storage backend %s: %w", m.name, errBreakerOpen)
+		}
+	default:
+		return false, nil
+	}
+	m.trial = true
+	return true, nil
+}
+
+// record accounts a finished call; a missing artifact counts as success.
+// Stores stream the client's upload, so their duration isn't the backend's.
+func (m *MonitoredStorage) record(start time.Time, trial, timed bool, err error) {
+	now := time.Now()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.calls++
+	if timed {
+		if len(m.latencies) < latencySamples {
+			m.latencies = append(m.latencies, now.Sub(start))
+		} else {
+			m.latencies[m.next] = now.Sub(start)
+			m.next = (m.next + 1) % latencySamples
+		}
+	}
+	if trial {
+		m.trial = false
+	}
+
+	if err == nil || errors.Is(err, errArtifactNotFound) {
+		m.consecutive = 0
+		m.lastSuccess = now
+		if trial {
+			m.state = breakerClosed
+			m.logger.Printf("Storage backend %s answers again, closing its circuit breaker", m.name)
+		}
+		return
+	}
+	m.failures++
+	m.consecutive++
+	m.lastError, m.lastErrorAt = err.Error(), now
+	switch {
+	case trial:
+		m.state, m.openedAt = breakerOpen, now
+	case m.state == breakerClosed && m.breakAfter > 0 && m.consecutive >= m.breakAfter:
+		m.state, m.openedAt = breakerOpen, now
+		m.logger.Printf("Storage backend %s failed %d times in a row, opening its circuit breaker for %v: %v",
+			m.name, m.consecutive, m.cooldown, err)
+	}
+}
+
+func (m *MonitoredStorage) Store(hash string, data io.Reader) error {
+	trial, err := m.admit()
+	if err != nil {
+		return err
+	}
+	start := time.Now()
+	err = m.inner.Store(hash, data)
+	m.record(start, trial, false, err)
+	return err
+}
+
+func (m *MonitoredStorage) Get(hash string) (io.ReadCloser, int64, error) {
+	trial, err := m.admit()
+	if err != nil {
+		return nil, 0, err
+	}
+	start := time.Now()
+	reader, size, err := m.inner.Get(hash)
+	m.record(start, trial, true, err)
+	return reader, size, err
+}
+
+func (m *MonitoredStorage) Exists(hash string) (bool, error) {
+	trial, err := m.admit()
+	if err != nil {
+		return false, err
+	}
+	start := time.Now()
+	exists, err := m.inner.Exists(hash)
+	m.record(start, trial, true, err)
+	return exists, err
+}
+
+func (m *MonitoredStorage) Delete(hash string) error {
+	trial, err := m.admit()
+	if err != nil {
+		return err
+	}
+	start := time.Now()
+	err = m.inner.Delete(hash)
+	m.record(start, trial, true, err)
+	return err
+}
+
+// List is neither timed nor held back by the breaker: it only runs at
+// startup and in maintenance scans, and takes as long as the bucket is big
+func (m *MonitoredStorage) List() ([]ArtifactStat, error) {
+	stats, err := m.inner.List()
+	m.record(time.Now(), false, false, err)
+	return stats, err
+}
+
+// BackendHealthInfo is the admin view of a storage backend
+type BackendHealthInfo struct {
+	Name                string     `json:"name"`
+	Reachable           bool       `json:"reachable"`
+	Breaker             string     `json:"breaker"`
+	ConsecutiveFailures int        `json:"consecutiveFailures"`
+	Calls               int64      `json:"calls"`
+	Failures            int64      `json:"failures"`
+	Rejected            int64      `json:"rejected"`
+	LatencyP50Ms        float64    `json:"latencyP50Ms"`
+	LatencyP99Ms        float64    `json:"latencyP99Ms"`
+	LastError           string     `json:"lastError,omitempty"`
+	LastErrorAt         *time.Time `json:"lastErrorAt,omitempty"`
+	LastSuccessAt       *time.Time `json:"lastSuccessAt,omitempty"`
+}
+
+// Info returns the current health of the backend
+func (m *MonitoredStorage) Info() BackendHealthInfo {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	info := BackendHealthInfo{
+		Name:                m.name,
+		Reachable:           m.consecutive == 0 && m.state == breakerClosed,
+		Breaker:             m.state,
+		ConsecutiveFailures: m.consecutive,
+		Calls:               m.calls,
+		Failures:            m.failures,
+		Rejected:            m.rejected,
+		LastError:           m.lastError,
+	}
+	if len(m.latencies) > 0 {
+		sorted := append([]time.Duration(nil), m.latencies...)
+		sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+		info.LatencyP50Ms = durationMs(sorted[len(sorted)/2])
+		info.LatencyP99Ms = durationMs(sorted[len(sorted)*99/100])
+	}
+	if !m.lastErrorAt.IsZero() {
+		at := m.lastErrorAt
+		info.LastErrorAt = &at
+	}
+	if !m.lastSuccess.IsZero() {
+		at := m.lastSuccess
+		info.LastSuccessAt = &at
+	}
+	return info
+}
+
+func durationMs(d time.Duration) float64 {
+	return float64(d.Microseconds()) / 1000
+}
+
+// BackendMonitors holds every monitored backend of the process, tenants'
+// included
+type BackendMonitors struct {
+	mu       sync.Mutex
+	monitors []*MonitoredStorage
+	logger   *log.Logger
+}
+
+// storageMonitors is filled while the storages are created, before there is
+// a server to hold it
+var storageMonitors = &BackendMonitors{logger: log.Default()}
+
+// Monitor wraps a backend under a name, with the circuit breaker settings
+// of TURBO_BACKEND_BREAKER_AFTER and TURBO_BACKEND_BREAKER_COOLDOWN
+func (b *BackendMonitors) Monitor(name string, inner Storage) (Storage, error) {
+	breakAfter, err := envInt("TURBO_BACKEND_BREAKER_AFTER", 0)
+	if err != nil {
+		return nil, err
+	}
+	cooldown, err := envDuration("TURBO_BACKEND_BREAKER_COOLDOWN", 30*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	m := &MonitoredStorage{inner: inner, name: name, breakAfter: breakAfter, cooldown: cooldown, logger: b.logger, state: breakerClosed}
+	b.monitors = append(b.monitors, m)
+	return m, nil
+}
+
+// SetLogger sends the breaker messages of the backends monitored from now
+// on to logger
+func (b *BackendMonitors) SetLogger(logger *log.Logger) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.logger = logger
+}
+
+// Infos returns the health of every backend
+func (b *BackendMonitors) Infos() []BackendHealthInfo {
+	b.mu.Lock()
+	monitors := append([]*MonitoredStorage(nil), b.monitors...)
+	b.mu.Unlock()
+	infos := make([]BackendHealthInfo, 0, len(monitors))
+	for _, m := range monitors {
+		infos = append(infos, m.Info())
+	}
+	return infos
+}
+
+// Run probes every backend at every interval, so idle backends still show
+// whether they are reachable and an open breaker gets its trial call
+func (b *BackendMonitors) Run(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+		b.mu.Lock()
+		monitors := append([]*MonitoredStorage(nil), b.monitors...)
+		b.mu.Unlock()
+		for _, m := range monitors {
+			m.Exists(degradedProbeHash)
+		}
+	}
+}
+
+// Handler for /admin/backends
+func (s *Server) listBackends(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	s.writeList(w, r, storageMonitors.Infos(), "name", "name")
+}
+
+// writeBackendMetrics adds the backend health to /metrics
+func writeBackendMetrics(p *promWriter) {
+	infos := storageMonitors.Infos()
+	p.family("turbo_storage_backend_up", "gauge", "1 if the last call to the backend succeeded and its circuit breaker is closed.")
+	for _, info := range infos {
+		up := 0.0
+		if info.Reachable {
+			up = 1
+		}
+		p.sample("turbo_storage_backend_up", up, "backend", info.Name)
+	}
+	p.family("turbo_storage_backend_consecutive_failures", "gauge", "Calls to the backend that failed since the last success.")
+	for _, info := range infos {
+		p.sample("turbo_storage_backend_consecutive_failures", float64(info.ConsecutiveFailures), "backend", info.Name)
+	}
+	p.family("turbo_storage_backend_breaker_state", "gauge", "State of the backend's circuit breaker, 1 for the current one.")
+	for _, info := range infos {
+		for _, state := range []string{breakerClosed, breakerOpen, breakerHalfOpen} {
+			current := 0.0
+			if info.Breaker == state {
+				current = 1
+			}
+			p.sample("turbo_storage_backend_breaker_state", current, "backend", info.Name, "state", state)
+		}
+	}
+	for _, counter := range []struct {
+		name, help string
+		value      func(BackendHealthInfo) int64
+	}{
+		{"turbo_storage_backend_calls_total", "Calls made to the backend.", func(i BackendHealthInfo) int64 { return i.Calls }},
+		{"turbo_storage_backend_failures_total", "Calls to the backend that failed.", func(i BackendHealthInfo) int64 { return i.Failures }},
+		{"turbo_storage_backend_rejected_total", "Calls failed fast by the open circuit breaker.", func(i BackendHealthInfo) int64 { return i.Rejected }},
+	} {
+		p.family(counter.name, "counter", counter.help)
+		for _, info := range infos {
+			p.sample(counter.name, float64(counter.value(info)), "backend", info.Name)
+		}
+	}
+	p.family("turbo_storage_backend_latency_seconds", "gauge", "Latency of recent calls to the backend, without stores.")
+	for _, info := range infos {
+		p.sample("turbo_storage_backend_latency_seconds", info.LatencyP50Ms/1000, "backend", info.Name, "quantile", "0.5")
+		p.sample("turbo_storage_backend_latency_seconds", info.LatencyP99Ms/1000, "backend", info.Name, "quantile", "0.99")
+	}
+}
@@ -0,0 +1,150 @@
+package cachesrv
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/bitechdev/go-turbo-cachesrv/storage"
+)
+
+// newStorageFromEnv creates the main artifact storage selected by
+// TURBO_STORAGE_BACKEND, optionally behind a hot tier. Server state such as
+// the metadata index always stays in the local cache directory.
+func newStorageFromEnv(cacheDir string) (Storage, error) {
+	backend := envString("TURBO_STORAGE_BACKEND", "fs")
+	primary, err := newBackend("TURBO_", backend, cacheDir)
+	if err != nil {
+		return nil, err
+	}
+	if primary, err = storageMonitors.Monitor(backend, primary); err != nil {
+		return nil, err
+	}
+	if backend == "fs" {
+		return withStorageTimeout(primary)
+	}
+
+	// Remote backends can get a local hot tier in front of them
+	hotDir := getenv("TURBO_HOT_CACHE_DIR")
+	if hotDir == "" {
+		return withStorageTimeout(primary)
+	}
+	hot, err := storage.NewFileSystem(hotDir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialize hot tier: %w", err)
+	}
+	hot.UseTmpfile(getenv("TURBO_FS_TMPFILE") == "true")
+	if err := configureMmap(hot); err != nil {
+		return nil, err
+	}
+	hotMaxSize, err := envSize("TURBO_HOT_CACHE_MAX_SIZE", 0)
+	if err != nil {
+		return nil, err
+	}
+	monitoredHot, err := storageMonitors.Monitor("hot", hot)
+	if err != nil {
+		return nil, err
+	}
+	tiered, err := NewTieredStorage(monitoredHot, primary, hotMaxSize)
+	if err != nil {
+		return nil, err
+	}
+	return withStorageTimeout(tiered)
+}
+
+// The built-in backends register like any other, so TURBO_STORAGE_BACKEND
+// only ever looks a name up in the storage registry
+func init() {
+	storage.Register("fs", newFileSystemFromEnv)
+	for _, name := range []string{"swift", "radosgw"} {
+		storage.Register(name, func(prefix, dir string) (Storage, error) { return newSwiftStorageFromEnv(prefix, name) })
+	}
+	storage.Register("oss", func(prefix, dir string) (Storage, error) { return newOSSStorageFromEnv(prefix) })
+	storage.Register("b2", func(prefix, dir string) (Storage, error) { return newB2StorageFromEnv(prefix, dir) })
+	storage.Register("s3", func(prefix, dir string) (Storage, error) { return newS3StorageFromEnv(prefix, dir) })
+	storage.Register("gcs", func(prefix, dir string) (Storage, error) { return newGCSStorageFromEnv(prefix) })
+}
+
+// newFileSystemFromEnv opens the filesystem backend in dir with the TURBO_FS_
+// settings
+func newFileSystemFromEnv(prefix, dir string) (Storage, error) {
+	fs, err := storage.NewFileSystem(dir)
+	if err != nil {
+		return nil, err
+	}
+	fs.UseTmpfile(getenv("TURBO_FS_TMPFILE") == "true")
+	if err := configureMmap(fs); err != nil {
+		return nil, err
+	}
+	if err := configureLayout(fs); err != nil {
+		return nil, err
+	}
+	return fs, nil
+}
+
+// newBackend creates a storage backend configured by the environment
+// variables starting with prefix, e.g. TURBO_SWIFT_CONTAINER for "TURBO_"
+func newBackend(prefix, backend, dir string) (Storage, error) {
+	open, ok := storage.Lookup(backend)
+	if !ok {
+		return nil, fmt.Errorf("unknown storage backend %q (expected %s)", backend, strings.Join(storage.Registered(), ", "))
+	}
+	return open(prefix, dir)
+}
+
+// describeArtifact passes the team and tags of an artifact about to be stored
+// to backends that want them; Store has no room for them
+func describeArtifact(target Storage, hash string, info ArtifactDetails) {
+	if d, ok := unwrapStorage(target).(interface {
+		Describe(hash string, info ArtifactDetails)
+	}); ok {
+		d.Describe(hash, info)
+	}
+}
+
+// configureLayout applies TURBO_FS_LAYOUT to a filesystem backend
+func configureLayout(fs *storage.FileSystem) error {
+	layout, err := storage.ParseLayout(envString("TURBO_FS_LAYOUT", "flat"))
+	if err != nil {
+		return fmt.Errorf("invalid TURBO_FS_LAYOUT: %w", err)
+	}
+	return fs.SetLayout(layout)
+}
+
+// configureMmap applies TURBO_FS_MMAP and TURBO_FS_MMAP_MIN_SIZE
+func configureMmap(fs *storage.FileSystem) error {
+	if getenv("TURBO_FS_MMAP") == "false" {
+		return nil
+	}
+	minSize, err := envSize("TURBO_FS_MMAP_MIN_SIZE", 16<<20)
+	if err != nil {
+		return err
+	}
+	fs.UseMmap(minSize)
+	return nil
+}
+
+// requireEnv returns the values of the given variables, failing on the first
+// one that is unset
+func requireEnv(names ...string) ([]string, error) {
+	values := make([]string, len(names))
+	for i, name := range names {
+		values[i] = getenv(name)
+		if values[i] == "" {
+			return nil, fmt.Errorf("%s is required", name)
+		}
+	}
+	return values, nil
+}
+
+// decodeJSONResponse decodes a successful JSON response and closes its body
+func decodeJSONResponse(resp *http.Response, v any) error {
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("unexpected response %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
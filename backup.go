@@ -0,0 +1,522 @@
+package cachesrv
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bitechdev/go-turbo-cachesrv/storage"
+)
+
+// BackupEntry is an artifact as recorded by a backup. The digest of the
+// artifact's metadata is the one of the backed up blob.
+type BackupEntry struct {
+	ArtifactMeta
+	// SHA256 repeats a sha256 digest for backup tooling that predates other
+	// algorithms; manifests from before digests were recorded only have this
+	SHA256 string `json:"sha256,omitempty"`
+	// Backup is the backup holding the blob: this one, or for an artifact
+	// unchanged since the base of an incremental the one it was copied in
+	Backup string `json:"backup"`
+}
+
+// digest returns the content digest of the blob as "<algorithm>:<hex>"
+func (e *BackupEntry) digest() string {
+	if e.Digest == "" && e.SHA256 != "" {
+		return digestSHA256 + ":" + e.SHA256
+	}
+	return e.Digest
+}
+
+// BackupManifest is a point-in-time snapshot of the metadata index plus the
+// checksum of every blob. Entries are only included in the detailed view.
+// An incremental lists every artifact too, but only holds the blobs that are
+// new or changed since its base; Changed and ChangedBytes count those.
+type BackupManifest struct {
+	ID           string        `json:"id"`
+	Base         string        `json:"base,omitempty"`
+	Status       string        `json:"status"`
+	Error        string        `json:"error,omitempty"`
+	CreatedAt    time.Time     `json:"createdAt"`
+	CompletedAt  *time.Time    `json:"completedAt,omitempty"`
+	Pinned       bool          `json:"pinned"`
+	Artifacts    int           `json:"artifacts"`
+	Bytes        int64         `json:"bytes"`
+	Skipped      int           `json:"skipped"`
+	Changed      int           `json:"changed"`
+	ChangedBytes int64         `json:"changedBytes"`
+	Entries      []BackupEntry `json:"entries,omitempty"`
+}
+
+const (
+	backupRunning  = "running"
+	backupReady    = "ready"
+	backupFailed   = "failed"
+	backupReleased = "released"
+)
+
+var (
+	errBackupNotFound = errors.New("backup not found")
+	errBackupRunning  = errors.New("a backup is already running")
+	errBackupNotReady = errors.New("backup is not ready")
+	errBaseIncomplete = errors.New("base backup did not complete")
+)
+
+// BackupManager takes online backups without stopping traffic. The metadata
+// is copied under the index lock, so it is consistent as of one instant.
+// Blobs on filesystem storage are then pinned with hard links under
+// .backups/<id>, which keeps their contents until the backup is released even
+// if they are evicted or replaced meanwhile; other backends are read live and
+// an artifact gone before it was checksummed is skipped. Backup tooling reads
+// the manifest and copies the blobs from the export endpoint.
+type BackupManager struct {
+	dir     string
+	index   *MetadataIndex
+	classes []*SizeClass
+	limiter *IOLimiter
+	notify  *Notifications
+	logger  *log.Logger
+	// digest is the algorithm for artifacts not recorded with one
+	digest string
+
+	mu      sync.Mutex
+	running bool
+}
+
+func NewBackupManager(dir string, index *MetadataIndex, classes []*SizeClass, limiter *IOLimiter, digest string, notify *Notifications, logger *log.Logger) (*BackupManager, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create backup directory: %w", err)
+	}
+	b := &BackupManager{dir: dir, index: index, classes: classes, limiter: limiter, digest: digest, notify: notify, logger: logger}
+
+	// A backup running during a restart can't be resumed
+	backups, err := b.List()
+	if err != nil {
+		return nil, err
+	}
+	for _, m := range backups {
+		if m.Status != backupRunning {
+			continue
+		}
+		b.release(m.ID)
+		m.Status = backupFailed
+		m.Error = "interrupted by a restart"
+		if err := b.save(&m); err != nil {
+			return nil, err
+		}
+	}
+	return b, nil
+}
+
+// Create snapshots the index and pins and checksums its blobs in the
+// background; the returned summary is running until that completes. With a
+// base, only artifacts new or changed since the base are pinned and hashed.
+func (b *BackupManager) Create(base string) (BackupManifest, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.running {
+		return BackupManifest{}, errBackupRunning
+	}
+	var previous map[string]BackupEntry
+	if base != "" {
+		m, err := b.Get(base)
+		if err != nil {
+			return BackupManifest{}, err
+		}
+		if m.Status != backupReady && m.Status != backupReleased {
+			return BackupManifest{}, errBaseIncomplete
+		}
+		previous = make(map[string]BackupEntry, len(m.Entries))
+		for _, e := range m.Entries {
+			previous[e.Hash] = e
+		}
+	}
+	suffix, err := randomHex(4)
+	if err != nil {
+		return BackupManifest{}, err
+	}
+	now := time.Now().UTC()
+	m := &BackupManifest{
+		ID:        now.Format("20060102T150405Z") + "-" + suffix,
+		Base:      base,
+		Status:    backupRunning,
+		CreatedAt: now,
+	}
+	for _, meta := range b.index.All() {
+		m.Entries = append(m.Entries, BackupEntry{ArtifactMeta: meta})
+	}
+	if err := b.save(m); err != nil {
+		return BackupManifest{}, err
+	}
+	summary := *m
+	summary.Entries = nil
+	b.running = true
+	go b.run(m, previous)
+	return summary, nil
+}
+
+func (b *BackupManager) run(m *BackupManifest, previous map[string]BackupEntry) {
+	start := time.Now()
+	err := b.checksum(m, previous)
+	now := time.Now().UTC()
+	m.CompletedAt = &now
+	if err != nil {
+		m.Status = backupFailed
+		m.Error = err.Error()
+		b.release(m.ID)
+		b.logger.Printf("Backup %s failed: %v", m.ID, err)
+		b.notify.Send(eventBackupFailed, severityCritical, fmt.Sprintf("backup %s failed: %v", m.ID, err), nil)
+	} else {
+		m.Status = backupReady
+		b.logger.Printf("Backup %s ready: %d artifacts, %d bytes, %d changed (%d bytes), %d skipped in %v",
+			m.ID, m.Artifacts, m.Bytes, m.Changed, m.ChangedBytes, m.Skipped, time.Since(start).Round(time.Millisecond))
+	}
+	if err := b.save(m); err != nil {
+		b.logger.Printf("Failed to save backup %s: %v", m.ID, err)
+	}
+	b.mu.Lock()
+	b.running = false
+	b.mu.Unlock()
+}
+
+// checksum pins and hashes every entry not unchanged since the base,
+// dropping those already gone
+func (b *BackupManager) checksum(m *BackupManifest, previous map[string]BackupEntry) error {
+	m.Pinned = true
+	kept := m.Entries[:0]
+	for _, e := range m.Entries {
+		if p, ok := previous[e.Hash]; ok && p.Size == e.Size && p.Class == e.Class && p.CreatedAt.Equal(e.CreatedAt) {
+			e.Digest, e.SHA256 = p.digest(), p.SHA256
+			e.Backup = p.Backup
+			kept = append(kept, e)
+			m.Artifacts++
+			m.Bytes += e.Size
+			continue
+		}
+		digest, err := b.pinAndHash(m, &e)
+		if errors.Is(err, errArtifactNotFound) {
+			m.Skipped++
+			continue
+		}
+		if errors.Is(err, errDigestMismatch) {
+			b.logger.Printf("Backup %s skipped %s: %v", m.ID, e.Hash, err)
+			m.Skipped++
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("failed to back up %s: %w", e.Hash, err)
+		}
+		e.Digest = digest
+		if algorithm, sum, _ := parseDigest(digest); algorithm == digestSHA256 {
+			e.SHA256 = sum
+		}
+		e.Backup = m.ID
+		kept = append(kept, e)
+		m.Artifacts++
+		m.Bytes += e.Size
+		m.Changed++
+		m.ChangedBytes += e.Size
+	}
+	m.Entries = kept
+	return nil
+}
+
+func (b *BackupManager) pinAndHash(m *BackupManifest, e *BackupEntry) (string, error) {
+	class := findClass(b.classes, e.Class)
+	var reader io.ReadCloser
+	var size int64
+	var err error
+	if fs, ok := unwrapStorage(class.Storage).(*storage.FileSystem); ok {
+		if err := fs.Pin(e.Hash, m.ID); err != nil {
+			return "", err
+		}
+		reader, size, err = fs.GetPinned(e.Hash, m.ID)
+	} else {
+		m.Pinned = false
+		reader, size, err = class.Storage.Get(e.Hash)
+	}
+	if err != nil {
+		return "", err
+	}
+	defer reader.Close()
+	if size != e.Size {
+		// Replaced by another upload since the snapshot
+		return "", errArtifactNotFound
+	}
+	// Hash with the algorithm the upload was recorded with, which also
+	// catches blobs damaged since
+	algorithm := b.digest
+	if e.Digest != "" {
+		if algorithm, _, err = parseDigest(e.Digest); err != nil {
+			return "", err
+		}
+	}
+	h, err := newDigest(algorithm)
+	if err != nil {
+		return "", err
+	}
+	if _, err := io.Copy(h, &limitedReader{ctx: context.Background(), r: reader, limiter: b.limiter}); err != nil {
+		return "", err
+	}
+	digest := formatDigest(algorithm, h)
+	if e.Digest != "" && digest != e.Digest {
+		return "", fmt.Errorf("%w: %s, recorded %s", errDigestMismatch, digest, e.Digest)
+	}
+	return digest, nil
+}
+
+// Open returns a blob of a backup as it was when the backup was taken
+func (b *BackupManager) Open(id, hash string) (io.ReadCloser, *BackupEntry, error) {
+	m, err := b.Get(id)
+	if err != nil {
+		return nil, nil, err
+	}
+	if m.Status != backupReady {
+		return nil, nil, errBackupNotReady
+	}
+	var entry *BackupEntry
+	for i := range m.Entries {
+		// Blobs unchanged since the base are exported from the backup holding them
+		if m.Entries[i].Hash == hash && m.Entries[i].Backup == id {
+			entry = &m.Entries[i]
+			break
+		}
+	}
+	if entry == nil {
+		return nil, nil, errArtifactNotFound
+	}
+	class := findClass(b.classes, entry.Class)
+	var reader io.ReadCloser
+	var size int64
+	if fs, ok := unwrapStorage(class.Storage).(*storage.FileSystem); ok && m.Pinned {
+		reader, size, err = fs.GetPinned(hash, id)
+	} else {
+		reader, size, err = class.Storage.Get(hash)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	if size != entry.Size {
+		reader.Close()
+		return nil, nil, errArtifactNotFound
+	}
+	return reader, entry, nil
+}
+
+// held returns the entries whose blobs this backup holds
+func (m *BackupManifest) held() []BackupEntry {
+	var entries []BackupEntry
+	for _, e := range m.Entries {
+		if e.Backup == m.ID {
+			entries = append(entries, e)
+		}
+	}
+	return entries
+}
+
+// Release drops the pinned blobs of a backup once it has been copied,
+// keeping its manifest
+func (b *BackupManager) Release(id string) (*BackupManifest, error) {
+	m, err := b.Get(id)
+	if err != nil {
+		return nil, err
+	}
+	if m.Status == backupRunning {
+		return nil, errBackupRunning
+	}
+	b.release(id)
+	if m.Status == backupReady {
+		m.Status = backupReleased
+	}
+	return m, b.save(m)
+}
+
+// Delete releases a backup and removes its manifest
+func (b *BackupManager) Delete(id string) error {
+	m, err := b.Get(id)
+	if err != nil {
+		return err
+	}
+	if m.Status == backupRunning {
+		return errBackupRunning
+	}
+	b.release(id)
+	if err := os.Remove(b.path(id)); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to delete backup: %w", err)
+	}
+	return nil
+}
+
+func (b *BackupManager) release(id string) {
+	for _, c := range b.classes {
+		if fs, ok := unwrapStorage(c.Storage).(*storage.FileSystem); ok {
+			if err := fs.Unpin(id); err != nil {
+				b.logger.Printf("Failed to release backup %s: %v", id, err)
+			}
+		}
+	}
+}
+
+// Get loads a manifest with its entries
+func (b *BackupManager) Get(id string) (*BackupManifest, error) {
+	if !validHash(id) {
+		return nil, errBackupNotFound
+	}
+	data, err := os.ReadFile(b.path(id))
+	if os.IsNotExist(err) {
+		return nil, errBackupNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read backup: %w", err)
+	}
+	var m BackupManifest
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, fmt.Errorf("failed to decode backup %s: %w", id, err)
+	}
+	return &m, nil
+}
+
+// List returns every backup without entries, oldest first
+func (b *BackupManager) List() ([]BackupManifest, error) {
+	files, err := filepath.Glob(filepath.Join(b.dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	backups := make([]BackupManifest, 0, len(files))
+	for _, file := range files {
+		m, err := b.Get(strings.TrimSuffix(filepath.Base(file), ".json"))
+		if err != nil {
+			return nil, err
+		}
+		m.Entries = nil
+		backups = append(backups, *m)
+	}
+	sort.Slice(backups, func(i, j int) bool { return backups[i].CreatedAt.Before(backups[j].CreatedAt) })
+	return backups, nil
+}
+
+func (b *BackupManager) save(m *BackupManifest) error {
+	data, err := json.Marshal(m)
+	if err != nil {
+		return fmt.Errorf("failed to encode backup: %w", err)
+	}
+	return writeFileAtomic(b.path(m.ID), data, 0644)
+}
+
+func (b *BackupManager) path(id string) string {
+	return filepath.Join(b.dir, id+".json")
+}
+
+// Handler for /admin/backups
+func (s *Server) handleBackups(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		backups, err := s.backups.List()
+		if err != nil {
+			s.logger.Printf("Failed to list backups: %v", err)
+			http.Error(w, "Failed to list backups", http.StatusInternalServerError)
+			return
+		}
+		s.writeList(w, r, backups, "createdAt", "id")
+	case http.MethodPost:
+		m, err := s.backups.Create(r.URL.Query().Get("base"))
+		if errors.Is(err, errBackupRunning) {
+			http.Error(w, "Backup already running", http.StatusConflict)
+			return
+		}
+		if errors.Is(err, errBackupNotFound) || errors.Is(err, errBaseIncomplete) {
+			http.Error(w, "Base backup not found or incomplete", http.StatusBadRequest)
+			return
+		}
+		if err != nil {
+			s.logger.Printf("Failed to create backup: %v", err)
+			http.Error(w, "Failed to create backup", http.StatusInternalServerError)
+			return
+		}
+		if m.Base != "" {
+			s.logger.Printf("Backup %s started, incremental to %s", m.ID, m.Base)
+		} else {
+			s.logger.Printf("Backup %s started", m.ID)
+		}
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(m)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// Handler for /admin/backups/{id}, /admin/backups/{id}/release and
+// /admin/backups/{id}/artifacts/{hash}
+func (s *Server) handleBackup(w http.ResponseWriter, r *http.Request) {
+	id, rest, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/admin/backups/"), "/")
+	var err error
+	switch {
+	case rest == "" && r.Method == http.MethodGet:
+		var m *BackupManifest
+		if m, err = s.backups.Get(id); err == nil {
+			if r.URL.Query().Get("changed") == "true" {
+				m.Entries = m.held()
+			}
+			json.NewEncoder(w).Encode(m)
+			return
+		}
+	case rest == "" && r.Method == http.MethodDelete:
+		if err = s.backups.Delete(id); err == nil {
+			s.logger.Printf("Backup %s deleted", id)
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+	case rest == "release" && r.Method == http.MethodPost:
+		var m *BackupManifest
+		if m, err = s.backups.Release(id); err == nil {
+			s.logger.Printf("Backup %s released", id)
+			m.Entries = nil
+			json.NewEncoder(w).Encode(m)
+			return
+		}
+	case strings.HasPrefix(rest, "artifacts/") && r.Method == http.MethodGet:
+		var reader io.ReadCloser
+		var entry *BackupEntry
+		if reader, entry, err = s.backups.Open(id, strings.TrimPrefix(rest, "artifacts/")); err == nil {
+			defer reader.Close()
+			w.Header().Set("Content-Type", "application/octet-stream")
+			w.Header().Set("Content-Length", fmt.Sprintf("%d", entry.Size))
+			w.Header().Set("X-Artifact-Digest", entry.digest())
+			if entry.SHA256 != "" {
+				w.Header().Set("X-Artifact-Sha256", entry.SHA256)
+			}
+			if _, err := io.Copy(w, reader); err != nil {
+				s.logger.Printf("Error exporting %s from backup %s: %v", entry.Hash, id, err)
+			}
+			return
+		}
+	case rest == "" || rest == "release" || strings.HasPrefix(rest, "artifacts/"):
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	default:
+		http.NotFound(w, r)
+		return
+	}
+
+	switch {
+	case errors.Is(err, errBackupNotFound):
+		http.Error(w, "Backup not found", http.StatusNotFound)
+	case errors.Is(err, errArtifactNotFound):
+		http.Error(w, "Artifact not in backup", http.StatusNotFound)
+	case errors.Is(err, errBackupRunning), errors.Is(err, errBackupNotReady):
+		http.Error(w, "Backup is not ready", http.StatusConflict)
+	default:
+		s.logger.Printf("Backup %s request failed: %v", id, err)
+		http.Error(w, "Backup request failed", http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,155 @@
+package cachesrv
+
+import (
+	"errors"
+	"io"
+	"log"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bitechdev/go-turbo-cachesrv/storage"
+)
+
+// waitForBackup polls a backup until it is no longer running
+func waitForBackup(t *testing.T, b *BackupManager, id string) *BackupManifest {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		m, err := b.Get(id)
+		if err != nil {
+			t.Fatalf("Get %s: %v", id, err)
+		}
+		if m.Status != backupRunning {
+			return m
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("backup %s still running", id)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestIncrementalBackup(t *testing.T) {
+	dir := t.TempDir()
+	fs, err := storage.NewFileSystem(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	idx := newJournaledIndex(t, dir, fs)
+	defer idx.journal.Close()
+	put := func(hash, content string, at time.Time) {
+		t.Helper()
+		if err := fs.Store(hash, strings.NewReader(content)); err != nil {
+			t.Fatalf("Store %s: %v", hash, err)
+		}
+		idx.Put(&ArtifactMeta{Hash: hash, Size: int64(len(content)), Class: defaultClass, CreatedAt: at})
+	}
+	start := time.Now().Add(-time.Hour)
+	put("aaaa", "unchanged", start)
+	put("bbbb", "old", start)
+	put("cccc", "deleted", start)
+
+	classes := []*SizeClass{{Name: defaultClass, Storage: fs}}
+	b, err := NewBackupManager(t.TempDir(), idx, classes, nil, digestSHA256, nil, log.New(io.Discard, "", 0))
+	if err != nil {
+		t.Fatalf("NewBackupManager: %v", err)
+	}
+	summary, err := b.Create("")
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	full := waitForBackup(t, b, summary.ID)
+	if full.Status != backupReady || full.Artifacts != 3 || full.Changed != 3 {
+		t.Fatalf("full backup = %+v, want 3 artifacts, all changed", full)
+	}
+
+	put("bbbb", "replaced", start.Add(time.Minute))
+	idx.Delete("cccc")
+	if err := fs.Delete("cccc"); err != nil {
+		t.Fatal(err)
+	}
+	put("dddd", "new", start.Add(time.Minute))
+
+	summary, err = b.Create(full.ID)
+	if err != nil {
+		t.Fatalf("Create incremental: %v", err)
+	}
+	incr := waitForBackup(t, b, summary.ID)
+	if incr.Status != backupReady || incr.Base != full.ID {
+		t.Fatalf("incremental = %+v, want ready on base %s", incr, full.ID)
+	}
+	if incr.Artifacts != 3 || incr.Bytes != 20 || incr.Changed != 2 || incr.ChangedBytes != 11 {
+		t.Errorf("incremental counts %d artifacts, %d bytes, %d changed (%d bytes), want 3, 20, 2 (11)",
+			incr.Artifacts, incr.Bytes, incr.Changed, incr.ChangedBytes)
+	}
+
+	tests := []struct {
+		backup *BackupManifest
+		hash   string
+		holder string
+		want   string
+	}{
+		{full, "aaaa", full.ID, "unchanged"},
+		{full, "bbbb", full.ID, "old"},
+		{full, "cccc", full.ID, "deleted"},
+		{incr, "aaaa", full.ID, ""},
+		{incr, "bbbb", incr.ID, "replaced"},
+		{incr, "cccc", "", ""},
+		{incr, "dddd", incr.ID, "new"},
+	}
+	for _, tt := range tests {
+		name := tt.hash + " in the full backup"
+		if tt.backup == incr {
+			name = tt.hash + " in the incremental"
+		}
+		t.Run(name, func(t *testing.T) {
+			holder := ""
+			for _, e := range tt.backup.Entries {
+				if e.Hash == tt.hash {
+					holder = e.Backup
+				}
+			}
+			if holder != tt.holder {
+				t.Errorf("held by %q, want %q", holder, tt.holder)
+			}
+			// Only the backup holding a blob exports it, as pinned when it ran
+			reader, _, err := b.Open(tt.backup.ID, tt.hash)
+			if tt.want == "" {
+				if !errors.Is(err, errArtifactNotFound) {
+					t.Errorf("Open error = %v, want %v", err, errArtifactNotFound)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Open: %v", err)
+			}
+			defer reader.Close()
+			if data, _ := io.ReadAll(reader); string(data) != tt.want {
+				t.Errorf("Open = %q, want %q", data, tt.want)
+			}
+		})
+	}
+
+	// Unchanged artifacts keep the digest of the backup holding them
+	digests := make(map[string]string)
+	for _, e := range full.Entries {
+		digests[e.Hash] = e.digest()
+	}
+	for _, e := range incr.Entries {
+		if e.Hash == "aaaa" && (e.digest() == "" || e.digest() != digests["aaaa"]) {
+			t.Errorf("unchanged digest = %q, want %q", e.digest(), digests["aaaa"])
+		}
+	}
+
+	if _, err := b.Create("20990101T000000Z-0000"); !errors.Is(err, errBackupNotFound) {
+		t.Errorf("Create on an unknown base error = %v, want %v", err, errBackupNotFound)
+	}
+	failed := &BackupManifest{ID: "20250101T000000Z-dead", Status: backupFailed}
+	if err := b.save(failed); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.Create(failed.ID); !errors.Is(err, errBaseIncomplete) {
+		t.Errorf("Create on a failed base error = %v, want %v", err, errBaseIncomplete)
+	}
+}
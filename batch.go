@@ -0,0 +1,438 @@
+package cachesrv
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A batch upload carries several artifacts in one request, either as a tar
+// whose entries are named by hash or as multipart/form-data with one part
+// per hash. Each artifact goes through the same checks as a PUT of its own,
+// with the request's headers overridden by the entry's. Batch downloads
+// answer with the same formats, each artifact served as a GET of its own.
+
+// BatchResult reports what happened to one artifact of a batch
+type BatchResult struct {
+	Hash   string `json:"hash"`
+	Status int    `json:"status"`
+	Error  string `json:"error,omitempty"`
+	// Code is the code of a rejected upload
+	Code string `json:"code,omitempty"`
+}
+
+// BatchResponse is the body of a batch upload response
+type BatchResponse struct {
+	Results []BatchResult `json:"results"`
+}
+
+// PAX records of tar entries standing in for per-artifact headers
+const (
+	paxDuration = "TURBO.duration"
+	paxTags     = "TURBO.tags"
+	paxVariant  = "TURBO.variant"
+)
+
+// batchRecorder captures the response to one artifact of a batch. It
+// unwraps to the batch's writer, so cancelling the transfer cuts off the
+// batch.
+type batchRecorder struct {
+	outer  http.ResponseWriter
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (br *batchRecorder) Header() http.Header { return br.header }
+
+func (br *batchRecorder) WriteHeader(code int) {
+	if br.status == 0 {
+		br.status = code
+	}
+}
+
+func (br *batchRecorder) Write(b []byte) (int, error) {
+	if br.status == 0 {
+		br.status = http.StatusOK
+	}
+	return br.body.Write(b)
+}
+
+func (br *batchRecorder) Unwrap() http.ResponseWriter { return br.outer }
+
+// Handler for POST /v8/artifacts/batch
+func (s *Server) uploadBatch(w http.ResponseWriter, r *http.Request) {
+	mediaType, params, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil {
+		http.Error(w, "Content-Type required", http.StatusUnsupportedMediaType)
+		return
+	}
+
+	var results []BatchResult
+	switch mediaType {
+	case "application/x-tar":
+		results, err = s.uploadTarBatch(w, r)
+	case "multipart/form-data":
+		results, err = s.uploadMultipartBatch(w, r, params["boundary"])
+	default:
+		http.Error(w, "Unsupported batch format (expected application/x-tar or multipart/form-data)", http.StatusUnsupportedMediaType)
+		return
+	}
+	if err != nil {
+		s.logger.Printf("Batch upload failed after %d artifacts: %v", len(results), err)
+		if tooLarge(err) {
+			http.Error(w, "Batch too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		if uploadAborted(r, err) {
+			http.Error(w, "Upload incomplete", http.StatusBadRequest)
+			return
+		}
+		http.Error(w, "Invalid batch", http.StatusBadRequest)
+		return
+	}
+
+	stored := 0
+	for _, result := range results {
+		if result.Status == http.StatusAccepted {
+			stored++
+		}
+	}
+	s.logger.Printf("Batch upload stored %d of %d artifacts", stored, len(results))
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(BatchResponse{Results: results})
+}
+
+func (s *Server) uploadTarBatch(w http.ResponseWriter, r *http.Request) ([]BatchResult, error) {
+	var results []BatchResult
+	tr := tar.NewReader(r.Body)
+	for {
+		entry, err := tr.Next()
+		if err == io.EOF {
+			return results, nil
+		}
+		if err != nil {
+			return results, err
+		}
+		if entry.Typeflag != tar.TypeReg {
+			continue
+		}
+		header := http.Header{}
+		if v, ok := entry.PAXRecords[paxDuration]; ok {
+			header.Set("X-Artifact-Duration", v)
+		}
+		if v, ok := entry.PAXRecords[paxTags]; ok {
+			header.Set(tagsHeader, v)
+		}
+		if v, ok := entry.PAXRecords[paxVariant]; ok {
+			header.Set(variantHeader, v)
+		}
+		results = append(results, s.uploadBatchEntry(w, r, len(results), entry.Name, header, tr, entry.Size))
+	}
+}
+
+func (s *Server) uploadMultipartBatch(w http.ResponseWriter, r *http.Request, boundary string) ([]BatchResult, error) {
+	if boundary == "" {
+		return nil, errors.New("no multipart boundary")
+	}
+	var results []BatchResult
+	mr := multipart.NewReader(r.Body, boundary)
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			return results, nil
+		}
+		if err != nil {
+			return results, err
+		}
+		hash := part.FormName()
+		header := http.Header{}
+		for _, name := range []string{"X-Artifact-Duration", tagsHeader, variantHeader, "If-Match", "If-None-Match"} {
+			if v := part.Header.Get(name); v != "" {
+				header.Set(name, v)
+			}
+		}
+
+		// Parts don't carry their size unless the client sends it; the
+		// others are spooled to find out
+		if size, err := strconv.ParseInt(part.Header.Get("Content-Length"), 10, 64); err == nil && size >= 0 {
+			results = append(results, s.uploadBatchEntry(w, r, len(results), hash, header, part, size))
+			continue
+		}
+		spooled, size, err := s.spoolBatchPart(part)
+		if err != nil {
+			return results, err
+		}
+		results = append(results, s.uploadBatchEntry(w, r, len(results), hash, header, spooled, size))
+		spooled.Close()
+		os.Remove(spooled.Name())
+	}
+}
+
+// spoolBatchPart writes a part to a temporary file, stopping one byte past
+// TURBO_MAX_ARTIFACT_SIZE so the upload is refused as too large
+func (s *Server) spoolBatchPart(part io.Reader) (*os.File, int64, error) {
+	dir := ""
+	if s.spool != nil {
+		dir = s.spool.dir
+	}
+	file, err := os.CreateTemp(dir, ".batch-*")
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to create spool file: %w", err)
+	}
+	if s.maxArtifactSize > 0 {
+		part = io.LimitReader(part, s.maxArtifactSize+1)
+	}
+	size, err := io.Copy(file, part)
+	if err == nil {
+		_, err = file.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return nil, 0, err
+	}
+	return file, size, nil
+}
+
+// uploadBatchEntry uploads the i-th artifact of a batch as if it were PUT on
+// its own, reading exactly size bytes of body
+func (s *Server) uploadBatchEntry(w http.ResponseWriter, r *http.Request, i int, hash string, header http.Header, body io.Reader, size int64) BatchResult {
+	result := BatchResult{Hash: hash}
+	if i >= s.maxBatch {
+		result.Status = http.StatusRequestEntityTooLarge
+		result.Error = fmt.Sprintf("Too many artifacts in batch (max %d)", s.maxBatch)
+		return result
+	}
+	if strings.Contains(hash, "/") {
+		result.Status = http.StatusBadRequest
+		result.Error = "Invalid artifact hash"
+		return result
+	}
+
+	req := r.Clone(r.Context())
+	req.Method = http.MethodPut
+	req.URL.Path = "/v8/artifacts/" + hash
+	req.URL.RawPath = ""
+	req.Pattern = "PUT " + artifactRoute
+	req.SetPathValue("hash", hash)
+	req.Header = r.Header.Clone()
+	for _, name := range []string{"Content-Type", "X-Artifact-Duration", tagsHeader, variantHeader} {
+		req.Header.Del(name)
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	req.Header.Set("Content-Length", strconv.FormatInt(size, 10))
+	req.ContentLength = size
+	req.Body = io.NopCloser(io.LimitReader(body, size))
+
+	rec := &batchRecorder{outer: w, header: http.Header{}}
+	s.handleArtifact(rec, req)
+	result.Status = rec.status
+	if result.Status == 0 {
+		result.Status = http.StatusOK
+	}
+	if rejection, ok := rejectionOf(rec.body.Bytes()); ok {
+		result.Error, result.Code = rejection.Message, rejection.Code
+	} else if result.Status >= 300 {
+		result.Error = strings.TrimSpace(rec.body.String())
+	}
+	// Skip whatever the upload didn't read, so the next entry starts
+	// where it should
+	io.Copy(io.Discard, req.Body)
+	return result
+}
+
+// missingHeader is the trailer of a batch download listing the hashes it
+// didn't serve
+const missingHeader = "X-Artifact-Missing"
+
+// batchEntry writes the response to one artifact of a batch download into
+// the batch. A found artifact is streamed into its entry as it is read;
+// any other response is kept aside and the artifact left out.
+type batchEntry struct {
+	outer  http.ResponseWriter
+	header http.Header
+	status int
+	// start opens the entry of an artifact of the given size
+	start func(size int64, header http.Header) (io.Writer, error)
+	out   io.Writer
+	size  int64
+	n     int64
+	err   error
+	body  bytes.Buffer
+}
+
+func (be *batchEntry) Header() http.Header { return be.header }
+
+func (be *batchEntry) WriteHeader(code int) {
+	if be.status != 0 {
+		return
+	}
+	be.status = code
+	if code != http.StatusOK {
+		return
+	}
+	// Artifacts of unknown size are buffered and written once complete
+	if size, err := strconv.ParseInt(be.header.Get("Content-Length"), 10, 64); err == nil && size >= 0 {
+		be.size = size
+		if be.out, be.err = be.start(size, be.header); be.err != nil {
+			be.out = errWriter{be.err}
+		}
+	}
+}
+
+func (be *batchEntry) Write(b []byte) (int, error) {
+	if be.status == 0 {
+		be.WriteHeader(http.StatusOK)
+	}
+	if be.out != nil {
+		n, err := be.out.Write(b)
+		be.n += int64(n)
+		return n, err
+	}
+	return be.body.Write(b)
+}
+
+func (be *batchEntry) Unwrap() http.ResponseWriter { return be.outer }
+
+// finish writes a buffered artifact and reports whether the artifact is in
+// the batch
+func (be *batchEntry) finish() (bool, error) {
+	if be.status == 0 {
+		be.status = http.StatusOK
+	}
+	if be.status != http.StatusOK {
+		return false, nil
+	}
+	if be.err != nil {
+		return false, be.err
+	}
+	if be.out != nil && be.n != be.size {
+		return false, fmt.Errorf("wrote %d of %d bytes", be.n, be.size)
+	}
+	if be.out == nil {
+		out, err := be.start(int64(be.body.Len()), be.header)
+		if err != nil {
+			return false, err
+		}
+		if _, err := out.Write(be.body.Bytes()); err != nil {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+type errWriter struct{ err error }
+
+func (ew errWriter) Write([]byte) (int, error) { return 0, ew.err }
+
+// Handler for GET /v8/artifacts/batch
+func (s *Server) downloadBatch(w http.ResponseWriter, r *http.Request) {
+	hashes := parseTags(r.URL.Query().Get("hashes"))
+	if len(hashes) == 0 {
+		http.Error(w, "No hashes given", http.StatusBadRequest)
+		return
+	}
+	if len(hashes) > s.maxBatch {
+		http.Error(w, fmt.Sprintf("Too many artifacts in batch (max %d)", s.maxBatch), http.StatusRequestEntityTooLarge)
+		return
+	}
+	for _, hash := range hashes {
+		if strings.Contains(hash, "/") {
+			http.Error(w, "Invalid artifact hash", http.StatusBadRequest)
+			return
+		}
+	}
+
+	// Entries are opened for the artifact being served and closed when the
+	// next one opens or the batch ends
+	var start func(hash string, size int64, header http.Header) (io.Writer, error)
+	var closeBatch func() error
+	w.Header().Set("Trailer", missingHeader)
+	if accepts(r, "multipart/mixed") {
+		mw := multipart.NewWriter(w)
+		w.Header().Set("Content-Type", "multipart/mixed; boundary="+mw.Boundary())
+		start = func(hash string, size int64, header http.Header) (io.Writer, error) {
+			part := textproto.MIMEHeader{
+				"Content-Type":        {"application/octet-stream"},
+				"Content-Disposition": {mime.FormatMediaType("attachment", map[string]string{"filename": hash})},
+				"Content-Length":      {strconv.FormatInt(size, 10)},
+			}
+			if etag := header.Get("ETag"); etag != "" {
+				part.Set("ETag", etag)
+			}
+			if digest := header.Get(digestHeader); digest != "" {
+				part.Set(digestHeader, digest)
+			}
+			return mw.CreatePart(part)
+		}
+		closeBatch = mw.Close
+	} else {
+		tw := tar.NewWriter(w)
+		w.Header().Set("Content-Type", "application/x-tar")
+		start = func(hash string, size int64, header http.Header) (io.Writer, error) {
+			err := tw.WriteHeader(&tar.Header{
+				Typeflag: tar.TypeReg,
+				Name:     hash,
+				Size:     size,
+				Mode:     0644,
+				ModTime:  time.Now(),
+			})
+			return tw, err
+		}
+		closeBatch = tw.Close
+	}
+
+	var missing []string
+	for _, hash := range hashes {
+		req := r.Clone(r.Context())
+		req.URL.Path = "/v8/artifacts/" + hash
+		req.URL.RawPath = ""
+		req.Pattern = "GET " + artifactRoute
+		req.SetPathValue("hash", hash)
+		// Entries need their Content-Length more than a digest trailer
+		req.Header.Del("Te")
+		be := &batchEntry{outer: w, header: http.Header{}}
+		be.start = func(size int64, header http.Header) (io.Writer, error) { return start(hash, size, header) }
+		s.handleArtifact(be, req)
+		found, err := be.finish()
+		if err != nil {
+			// The entries already sent can't be taken back; cut the
+			// connection so the client doesn't take the batch for whole
+			s.logger.Printf("Batch download failed at %s: %v", hash, err)
+			panic(http.ErrAbortHandler)
+		}
+		if !found {
+			missing = append(missing, hash)
+		}
+	}
+	if err := closeBatch(); err != nil {
+		s.logger.Printf("Batch download failed: %v", err)
+		panic(http.ErrAbortHandler)
+	}
+	w.Header().Set(missingHeader, strings.Join(missing, ","))
+	s.logger.Printf("Batch download served %d of %d artifacts", len(hashes)-len(missing), len(hashes))
+}
+
+// accepts reports whether the request's Accept header names mediaType
+func accepts(r *http.Request, mediaType string) bool {
+	for _, accepted := range strings.Split(r.Header.Get("Accept"), ",") {
+		if t, _, err := mime.ParseMediaType(accepted); err == nil && t == mediaType {
+			return true
+		}
+	}
+	return false
+}
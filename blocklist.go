@@ -0,0 +1,353 @@
+package cachesrv
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Notification events of the blocklist
+const (
+	eventArtifactBlocked   = "artifact_blocked"
+	eventArtifactUnblocked = "artifact_unblocked"
+)
+
+// BlockedArtifact is a hash that must never be served or accepted again,
+// for every variant, say after a bad artifact corrupted downstream builds
+type BlockedArtifact struct {
+	Hash      string    `json:"hash"`
+	Reason    string    `json:"reason,omitempty"`
+	BlockedBy string    `json:"blockedBy"`
+	BlockedAt time.Time `json:"blockedAt"`
+
+	// Refused counts the requests turned away since the server started, to
+	// find the builds still asking for it
+	Refused       int64     `json:"refused"`
+	LastRefusedAt time.Time `json:"lastRefusedAt,omitempty"`
+}
+
+// BlockAuditEntry is one change to the blocklist
+type BlockAuditEntry struct {
+	Time   time.Time `json:"time"`
+	Action string    `json:"action"`
+	Hash   string    `json:"hash"`
+	Reason string    `json:"reason,omitempty"`
+	By     string    `json:"by"`
+}
+
+// Blocklist holds the blocked hashes, persisted so a restart during an
+// incident doesn't serve them again. Every change is appended to an audit
+// log that is never rewritten.
+type Blocklist struct {
+	mu        sync.RWMutex
+	path      string
+	auditPath string
+	entries   map[string]*BlockedArtifact
+}
+
+func NewBlocklist(path, auditPath string) (*Blocklist, error) {
+	b := &Blocklist{path: path, auditPath: auditPath, entries: make(map[string]*BlockedArtifact)}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return b, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read blocklist: %w", err)
+	}
+	var saved []*BlockedArtifact
+	if err := json.Unmarshal(data, &saved); err != nil {
+		return nil, fmt.Errorf("failed to parse blocklist: %w", err)
+	}
+	for _, entry := range saved {
+		b.entries[entry.Hash] = entry
+	}
+	return b, nil
+}
+
+// Block adds a hash, or updates the reason of one already blocked
+func (b *Blocklist) Block(hash, reason, by string) (BlockedArtifact, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := time.Now().UTC()
+	entry, ok := b.entries[hash]
+	if !ok {
+		entry = &BlockedArtifact{Hash: hash, BlockedAt: now}
+		b.entries[hash] = entry
+	}
+	entry.Reason = reason
+	entry.BlockedBy = by
+	if err := b.save(); err != nil {
+		return BlockedArtifact{}, err
+	}
+	return *entry, b.audit(BlockAuditEntry{Time: now, Action: "block", Hash: hash, Reason: reason, By: by})
+}
+
+// Unblock removes a hash, reporting whether it was blocked
+func (b *Blocklist) Unblock(hash, reason, by string) (bool, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, ok := b.entries[hash]; !ok {
+		return false, nil
+	}
+	delete(b.entries, hash)
+	if err := b.save(); err != nil {
+		return true, err
+	}
+	return true, b.audit(BlockAuditEntry{Time: time.Now().UTC(), Action: "unblock", Hash: hash, Reason: reason, By: by})
+}
+
+// Refuse reports whether requests for an artifact key, plain or a variant,
+// must be turned away, counting the refusal
+func (b *Blocklist) Refuse(key string) bool {
+	if b == nil {
+		return false
+	}
+	hash, _, _ := strings.Cut(key, variantSeparator)
+	b.mu.RLock()
+	_, ok := b.entries[hash]
+	b.mu.RUnlock()
+	if !ok {
+		return false
+	}
+	b.mu.Lock()
+	if entry, ok := b.entries[hash]; ok {
+		entry.Refused++
+		entry.LastRefusedAt = time.Now().UTC()
+	}
+	b.mu.Unlock()
+	return true
+}
+
+// Get returns a blocked hash
+func (b *Blocklist) Get(hash string) (BlockedArtifact, bool) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	entry, ok := b.entries[hash]
+	if !ok {
+		return BlockedArtifact{}, false
+	}
+	return *entry, true
+}
+
+// List returns the blocked hashes, most recently blocked first
+func (b *Blocklist) List() []BlockedArtifact {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	list := make([]BlockedArtifact, 0, len(b.entries))
+	for _, entry := range b.entries {
+		list = append(list, *entry)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].BlockedAt.After(list[j].BlockedAt) })
+	return list
+}
+
+// History returns the audit entries of a hash, oldest first, or of every
+// hash when hash is empty
+func (b *Blocklist) History(hash string) ([]BlockAuditEntry, error) {
+	file, err := os.Open(b.auditPath)
+	if os.IsNotExist(err) {
+		return []BlockAuditEntry{}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read blocklist audit log: %w", err)
+	}
+	defer file.Close()
+	history := make([]BlockAuditEntry, 0)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var entry BlockAuditEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			continue
+		}
+		if hash == "" || entry.Hash == hash {
+			history = append(history, entry)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read blocklist audit log: %w", err)
+	}
+	return history, nil
+}
+
+// save writes the blocklist atomically; callers must hold the lock
+func (b *Blocklist) save() error {
+	list := make([]*BlockedArtifact, 0, len(b.entries))
+	for _, entry := range b.entries {
+		list = append(list, entry)
+	}
+	data, err := json.MarshalIndent(list, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode blocklist: %w", err)
+	}
+	return writeFileAtomic(b.path, data, 0644)
+}
+
+// audit appends an entry to the audit log and syncs it; callers must hold
+// the lock
+func (b *Blocklist) audit(entry BlockAuditEntry) error {
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return fmt.Errorf("failed to encode audit entry: %w", err)
+	}
+	file, err := os.OpenFile(b.auditPath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open blocklist audit log: %w", err)
+	}
+	defer file.Close()
+	if _, err := file.Write(append(line, '\n')); err != nil {
+		return fmt.Errorf("failed to write blocklist audit log: %w", err)
+	}
+	return file.Sync()
+}
+
+// refuseBlocked answers requests for a blocked artifact with 410 Gone; it
+// returns true once the response has been written
+func (s *Server) refuseBlocked(w http.ResponseWriter, r *http.Request, key string) bool {
+	if !s.blocklist.Refuse(key) {
+		return false
+	}
+	host, _, _ := net.SplitHostPort(r.RemoteAddr)
+	s.logger.Printf("Refused %s of blocked artifact %s (team %q, client %s)", r.Method, key, teamOf(r), host)
+	http.Error(w, "Artifact is blocked", http.StatusGone)
+	return true
+}
+
+// adminActor names the caller of an admin request for audit trails
+func adminActor(r *http.Request) string {
+	if username, _, ok := r.BasicAuth(); ok {
+		return username
+	}
+	host, _, _ := net.SplitHostPort(r.RemoteAddr)
+	return "admin token from " + host
+}
+
+// BlockRequest is the body of POST /admin/blocklist
+type BlockRequest struct {
+	Hash   string `json:"hash"`
+	Reason string `json:"reason"`
+}
+
+// BlockResponse reports a block and the copies it removed
+type BlockResponse struct {
+	BlockedArtifact
+	Purged *PurgeReport `json:"purged"`
+}
+
+// Handler for /admin/blocklist
+func (s *Server) handleBlocklist(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		if r.URL.Query().Get("audit") == "true" {
+			history, err := s.blocklist.History("")
+			if err != nil {
+				s.logger.Printf("Failed to read blocklist audit log: %v", err)
+				http.Error(w, "Failed to read audit log", http.StatusInternalServerError)
+				return
+			}
+			s.writeList(w, r, history, "time", "time", "hash", "action")
+			return
+		}
+		s.writeList(w, r, s.blocklist.List(), "-blockedAt", "hash")
+	case http.MethodPost:
+		s.blockArtifact(w, r)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// blockArtifact blocks a hash and then removes every stored variant of it,
+// leaving tombstones for federated peers. Retained compliance uploads stay
+// stored but are refused like the rest.
+func (s *Server) blockArtifact(w http.ResponseWriter, r *http.Request) {
+	var req BlockRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || !validHash(req.Hash) {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if strings.Contains(req.Hash, variantSeparator) {
+		http.Error(w, "Block the plain hash, it covers every variant", http.StatusBadRequest)
+		return
+	}
+	if req.Reason == "" {
+		http.Error(w, "A reason is required", http.StatusBadRequest)
+		return
+	}
+
+	by := adminActor(r)
+	entry, err := s.blocklist.Block(req.Hash, req.Reason, by)
+	if err != nil {
+		s.logger.Printf("Failed to save blocklist: %v", err)
+		http.Error(w, "Failed to save blocklist", http.StatusInternalServerError)
+		return
+	}
+
+	var matches []ArtifactMeta
+	for _, m := range s.index.Find(nil) {
+		if m.Hash == req.Hash || strings.HasPrefix(m.Hash, req.Hash+variantSeparator) {
+			matches = append(matches, m)
+		}
+	}
+	report := purgeArtifacts(context.Background(), nil, s.index, s.classes, matches, false, s.logger)
+	if err := s.federation.Bury(report); err != nil {
+		s.logger.Printf("Failed to record tombstones: %v", err)
+	}
+	s.logger.Printf("Blocked artifact %s by %s, removed %d copies: %s", req.Hash, by, report.Count, req.Reason)
+	s.notify.Send(eventArtifactBlocked, severityWarning,
+		fmt.Sprintf("artifact %s blocked by %s: %s", req.Hash, by, req.Reason), entry)
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(BlockResponse{BlockedArtifact: entry, Purged: report})
+}
+
+// Handler for /admin/blocklist/<hash>
+func (s *Server) handleBlockedArtifact(w http.ResponseWriter, r *http.Request) {
+	hash := strings.TrimPrefix(r.URL.Path, "/admin/blocklist/")
+	switch r.Method {
+	case http.MethodGet:
+		entry, ok := s.blocklist.Get(hash)
+		history, err := s.blocklist.History(hash)
+		if err != nil {
+			s.logger.Printf("Failed to read blocklist audit log: %v", err)
+			http.Error(w, "Failed to read audit log", http.StatusInternalServerError)
+			return
+		}
+		if !ok && len(history) == 0 {
+			http.Error(w, "Artifact is not blocked", http.StatusNotFound)
+			return
+		}
+		response := struct {
+			Blocked *BlockedArtifact  `json:"blocked"`
+			History []BlockAuditEntry `json:"history"`
+		}{History: history}
+		if ok {
+			response.Blocked = &entry
+		}
+		json.NewEncoder(w).Encode(response)
+	case http.MethodDelete:
+		by := adminActor(r)
+		reason := r.URL.Query().Get("reason")
+		found, err := s.blocklist.Unblock(hash, reason, by)
+		if err != nil {
+			s.logger.Printf("Failed to save blocklist: %v", err)
+			http.Error(w, "Failed to save blocklist", http.StatusInternalServerError)
+			return
+		}
+		if !found {
+			http.Error(w, "Artifact is not blocked", http.StatusNotFound)
+			return
+		}
+		s.logger.Printf("Unblocked artifact %s by %s: %s", hash, by, reason)
+		s.notify.Send(eventArtifactUnblocked, severityInfo,
+			fmt.Sprintf("artifact %s unblocked by %s: %s", hash, by, reason), nil)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,157 @@
+package cachesrv
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"strings"
+	"sync"
+	"time"
+)
+
+var bloomMagic = []byte("TBF1")
+
+// BloomFilter is a set summary with no false negatives. Bit i of the k bit
+// positions of a key is (h1 + i*h2) mod m, where h1 and h2 are the first two
+// little-endian uint64 of the key's SHA-256.
+type BloomFilter struct {
+	k    uint32
+	m    uint64
+	bits []byte
+}
+
+// NewBloomFilter sizes a filter for n keys at the given false positive rate
+func NewBloomFilter(n int, falsePositive float64) *BloomFilter {
+	if n < 1 {
+		n = 1
+	}
+	m := uint64(math.Ceil(-float64(n) * math.Log(falsePositive) / (math.Ln2 * math.Ln2)))
+	m = (m + 7) / 8 * 8
+	k := uint32(math.Max(1, math.Round(float64(m)/float64(n)*math.Ln2)))
+	return &BloomFilter{k: k, m: m, bits: make([]byte, m/8)}
+}
+
+func (b *BloomFilter) positions(key string, visit func(bit uint64) bool) bool {
+	sum := sha256.Sum256([]byte(key))
+	h1 := binary.LittleEndian.Uint64(sum[0:8])
+	h2 := binary.LittleEndian.Uint64(sum[8:16])
+	for i := uint64(0); i < uint64(b.k); i++ {
+		if !visit((h1 + i*h2) % b.m) {
+			return false
+		}
+	}
+	return true
+}
+
+func (b *BloomFilter) Add(key string) {
+	b.positions(key, func(bit uint64) bool {
+		b.bits[bit/8] |= 1 << (bit % 8)
+		return true
+	})
+}
+
+// Test reports whether key may be in the set; false means definitely not
+func (b *BloomFilter) Test(key string) bool {
+	return b.positions(key, func(bit uint64) bool {
+		return b.bits[bit/8]&(1<<(bit%8)) != 0
+	})
+}
+
+// Encode writes the gzip-compressed filter: the magic "TBF1", k as uint32
+// and m as uint64 (both big-endian), then the m bits
+func (b *BloomFilter) Encode(w io.Writer) error {
+	zw := gzip.NewWriter(w)
+	var header [16]byte
+	copy(header[:4], bloomMagic)
+	binary.BigEndian.PutUint32(header[4:8], b.k)
+	binary.BigEndian.PutUint64(header[8:16], b.m)
+	if _, err := zw.Write(header[:]); err != nil {
+		return err
+	}
+	if _, err := zw.Write(b.bits); err != nil {
+		return err
+	}
+	return zw.Close()
+}
+
+// ReadBloomFilter parses a filter written by Encode
+func ReadBloomFilter(r io.Reader) (*BloomFilter, error) {
+	zr, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read bloom filter: %w", err)
+	}
+	var header [16]byte
+	if _, err := io.ReadFull(zr, header[:]); err != nil {
+		return nil, fmt.Errorf("failed to read bloom filter: %w", err)
+	}
+	if !bytes.Equal(header[:4], bloomMagic) {
+		return nil, errors.New("failed to read bloom filter: bad magic")
+	}
+	b := &BloomFilter{k: binary.BigEndian.Uint32(header[4:8]), m: binary.BigEndian.Uint64(header[8:16])}
+	if b.k == 0 || b.m == 0 || b.m%8 != 0 || b.m > 1<<36 {
+		return nil, errors.New("failed to read bloom filter: bad size")
+	}
+	b.bits = make([]byte, b.m/8)
+	if _, err := io.ReadFull(zr, b.bits); err != nil {
+		return nil, fmt.Errorf("failed to read bloom filter: %w", err)
+	}
+	return b, nil
+}
+
+// HashSummary caches a bloom filter of the indexed hashes, rebuilt at most
+// every summaryMaxAge so frequent polling doesn't walk the index each time.
+// With team namespaces each team gets a filter of its own artifacts.
+type HashSummary struct {
+	mu      sync.Mutex
+	filters map[string]*summaryFilter
+}
+
+type summaryFilter struct {
+	filter *BloomFilter
+	built  time.Time
+}
+
+const (
+	// summaryFalsePositive is the rate at which a summary claims an artifact
+	// that isn't stored, costing one wasted request
+	summaryFalsePositive = 0.01
+	summaryMaxAge        = 10 * time.Second
+)
+
+// Filter returns the current filter of a team's namespace, "" for all
+// hashes, and when it was built
+func (h *HashSummary) Filter(index *MetadataIndex, namespace string) (*BloomFilter, time.Time) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.filters == nil {
+		h.filters = make(map[string]*summaryFilter)
+	}
+	f, ok := h.filters[namespace]
+	if !ok || time.Since(f.built) > summaryMaxAge {
+		var hashes []string
+		for _, hash := range index.Hashes() {
+			if namespace == "" {
+				hashes = append(hashes, hash)
+			} else if plain, ok := strings.CutSuffix(hash, teamSeparator+namespace); ok {
+				hashes = append(hashes, plain)
+			}
+		}
+		f = &summaryFilter{filter: NewBloomFilter(len(hashes), summaryFalsePositive), built: time.Now()}
+		for _, hash := range hashes {
+			f.filter.Add(hash)
+		}
+		// Filters of teams that stopped asking go with the next rebuild
+		for name, other := range h.filters {
+			if time.Since(other.built) > summaryMaxAge {
+				delete(h.filters, name)
+			}
+		}
+		h.filters[namespace] = f
+	}
+	return f.filter, f.built
+}
@@ -0,0 +1,190 @@
+package cachesrv
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const callbackHeader = "X-Turbo-Callback-Url"
+
+var errCallbackNotAllowed = errors.New("callback host not allowed")
+
+// UploadCallback is posted to the callback URL once an upload is durable or
+// has failed
+type UploadCallback struct {
+	Hash   string    `json:"hash"`
+	Team   string    `json:"team,omitempty"`
+	Size   int64     `json:"size"`
+	Status string    `json:"status"` // persisted or failed
+	Error  string    `json:"error,omitempty"`
+	Time   time.Time `json:"time"`
+}
+
+type callbackJob struct {
+	url     string
+	event   UploadCallback
+	storage Storage
+}
+
+// CallbackNotifier tells CI systems when uploads are really persisted. The
+// stored artifact is checked again before the callback is sent, so a job
+// waiting on it can rely on a following download succeeding.
+type CallbackNotifier struct {
+	client       *http.Client
+	defaultURL   string
+	allowedHosts map[string]bool
+	secret       []byte
+	queue        chan callbackJob
+	logger       *log.Logger
+}
+
+func NewCallbackNotifier(defaultURL string, allowedHosts []string, secret []byte, logger *log.Logger) *CallbackNotifier {
+	n := &CallbackNotifier{
+		client:       &http.Client{Timeout: 10 * time.Second},
+		defaultURL:   defaultURL,
+		allowedHosts: make(map[string]bool),
+		secret:       secret,
+		queue:        make(chan callbackJob, 1000),
+		logger:       logger,
+	}
+	for _, host := range allowedHosts {
+		n.allowedHosts[strings.ToLower(strings.TrimSpace(host))] = true
+	}
+	go n.run()
+	return n
+}
+
+// Pending returns the number of callbacks waiting to be sent and how many fit
+func (n *CallbackNotifier) Pending() (int, int) {
+	return len(n.queue), cap(n.queue)
+}
+
+// Target returns the callback URL for an upload: the request's own callback
+// header if its host is allowed, otherwise the configured default
+func (n *CallbackNotifier) Target(r *http.Request) (string, error) {
+	raw := r.Header.Get(callbackHeader)
+	if raw == "" {
+		return n.defaultURL, nil
+	}
+	// Only allowlisted hosts, so clients can't make the server call internal services
+	u, err := url.Parse(raw)
+	if err != nil || (u.Scheme != "https" && u.Scheme != "http") || !n.allowedHosts[strings.ToLower(u.Hostname())] {
+		return "", errCallbackNotAllowed
+	}
+	return raw, nil
+}
+
+// Persisted queues a callback that is sent once the artifact in storage has
+// been verified to have the expected size
+func (n *CallbackNotifier) Persisted(target string, storage Storage, event UploadCallback) {
+	event.Status = "persisted"
+	n.enqueue(callbackJob{url: target, event: event, storage: storage})
+}
+
+// Failed queues a callback reporting a failed upload
+func (n *CallbackNotifier) Failed(target string, event UploadCallback, cause error) {
+	event.Status = "failed"
+	event.Error = cause.Error()
+	n.enqueue(callbackJob{url: target, event: event})
+}
+
+func (n *CallbackNotifier) enqueue(job callbackJob) {
+	if job.url == "" {
+		return
+	}
+	job.event.Time = time.Now()
+	select {
+	case n.queue <- job:
+	default:
+		n.logger.Printf("Callback queue full, dropping callback for %s", job.event.Hash)
+	}
+}
+
+func (n *CallbackNotifier) run() {
+	for job := range n.queue {
+		if job.storage != nil {
+			if err := verifyStored(job.storage, job.event.Hash, job.event.Size); err != nil {
+				job.event.Status = "failed"
+				job.event.Error = err.Error()
+			}
+		}
+		if err := n.send(job); err != nil {
+			n.logger.Printf("Upload callback for %s to %s failed: %v", job.event.Hash, job.url, err)
+		}
+	}
+}
+
+func verifyStored(storage Storage, hash string, size int64) error {
+	reader, stored, err := storage.Get(hash)
+	if err != nil {
+		return fmt.Errorf("verification failed: %w", err)
+	}
+	reader.Close()
+	if stored != size {
+		return fmt.Errorf("verification failed: stored %d bytes, expected %d", stored, size)
+	}
+	return nil
+}
+
+// send posts the callback, retrying with backoff on errors and 5xx responses
+func (n *CallbackNotifier) send(job callbackJob) error {
+	payload, err := json.Marshal(job.event)
+	if err != nil {
+		return err
+	}
+
+	var lastErr error
+	for attempt, backoff := 0, time.Second; attempt < 3; attempt, backoff = attempt+1, backoff*4 {
+		if attempt > 0 {
+			time.Sleep(backoff)
+		}
+		req, err := http.NewRequest(http.MethodPost, job.url, bytes.NewReader(payload))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		if len(n.secret) > 0 {
+			mac := hmac.New(sha256.New, n.secret)
+			mac.Write(payload)
+			req.Header.Set("X-Turbo-Callback-Signature", hex.EncodeToString(mac.Sum(nil)))
+		}
+
+		resp, err := n.client.Do(req)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		resp.Body.Close()
+		if resp.StatusCode >= 500 {
+			lastErr = fmt.Errorf("unexpected response %s", resp.Status)
+			continue
+		}
+		if resp.StatusCode >= 400 {
+			return fmt.Errorf("unexpected response %s", resp.Status)
+		}
+		return nil
+	}
+	return lastErr
+}
+
+func newCallbackNotifierFromEnv(logger *log.Logger) *CallbackNotifier {
+	defaultURL := getenv("TURBO_UPLOAD_CALLBACK_URL")
+	var allowed []string
+	if hosts := getenv("TURBO_UPLOAD_CALLBACK_HOSTS"); hosts != "" {
+		allowed = strings.Split(hosts, ",")
+	}
+	if defaultURL == "" && len(allowed) == 0 {
+		return nil
+	}
+	return NewCallbackNotifier(defaultURL, allowed, []byte(getenv("TURBO_UPLOAD_CALLBACK_SECRET")), logger)
+}
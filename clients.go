@@ -0,0 +1,188 @@
+package cachesrv
+
+import (
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Turbo identifies itself as "turbo <version> <toolchain> <os> <arch>", e.g.
+// "turbo 1.13.2 go1.21.5 linux amd64" or "turbo 2.1.3 rust darwin aarch64".
+// Client usage is counted per team and client version since startup, so
+// old clients with known bugs can be found and their teams asked to upgrade.
+
+const unknownClient = "(unknown)"
+
+// otherClients collects requests once maxClientUsage combinations are known,
+// so made-up user agents can't grow the table without bound
+const (
+	otherClients   = "(other)"
+	maxClientUsage = 10000
+)
+
+// ClientInfo is what a user agent says about the client
+type ClientInfo struct {
+	Client  string `json:"client"`
+	Version string `json:"version,omitempty"`
+	OS      string `json:"os,omitempty"`
+	Arch    string `json:"arch,omitempty"`
+}
+
+// parseUserAgent reads the turbo user agent, falling back to the product
+// token ("curl/8.5.0") of other clients
+func parseUserAgent(ua string) ClientInfo {
+	fields := strings.Fields(ua)
+	if len(fields) == 0 {
+		return ClientInfo{Client: unknownClient}
+	}
+	var info ClientInfo
+	if fields[0] == "turbo" && len(fields) >= 2 {
+		info = ClientInfo{Client: "turbo", Version: fields[1]}
+		if len(fields) >= 5 {
+			info.OS, info.Arch = fields[len(fields)-2], fields[len(fields)-1]
+		}
+	} else {
+		name, version, _ := strings.Cut(fields[0], "/")
+		info = ClientInfo{Client: name, Version: version}
+	}
+	info.Client = truncate(info.Client, 64)
+	info.Version = truncate(info.Version, 64)
+	info.OS = truncate(info.OS, 32)
+	info.Arch = truncate(info.Arch, 32)
+	return info
+}
+
+func truncate(s string, n int) string {
+	if len(s) > n {
+		return s[:n]
+	}
+	return s
+}
+
+// ClientUsage counts the requests of one client version by one team
+type ClientUsage struct {
+	Tenant string `json:"tenant,omitempty"`
+	Team   string `json:"team,omitempty"`
+	ClientInfo
+	Requests  int64     `json:"requests"`
+	Uploads   int64     `json:"uploads"`
+	Downloads int64     `json:"downloads"`
+	Errors    int64     `json:"errors"`
+	FirstSeen time.Time `json:"firstSeen"`
+	LastSeen  time.Time `json:"lastSeen"`
+}
+
+type clientKey struct {
+	tenant, team string
+	ClientInfo
+}
+
+// ClientStats aggregates requests by tenant, team and client since startup
+type ClientStats struct {
+	mu    sync.Mutex
+	usage map[clientKey]*ClientUsage
+}
+
+func NewClientStats() *ClientStats {
+	return &ClientStats{usage: make(map[clientKey]*ClientUsage)}
+}
+
+// Record counts a cache API request once it has been answered
+func (cs *ClientStats) Record(tenant string, r *http.Request, status int) {
+	key := clientKey{tenant: tenant, team: teamOf(r), ClientInfo: parseUserAgent(r.UserAgent())}
+	now := time.Now()
+
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	u, ok := cs.usage[key]
+	if !ok && len(cs.usage) >= maxClientUsage {
+		key = clientKey{tenant: tenant, ClientInfo: ClientInfo{Client: otherClients}}
+		u, ok = cs.usage[key]
+	}
+	if !ok {
+		u = &ClientUsage{Tenant: key.tenant, Team: key.team, ClientInfo: key.ClientInfo, FirstSeen: now}
+		cs.usage[key] = u
+	}
+	u.Requests++
+	u.LastSeen = now
+	if route(r) == artifactRoute {
+		switch {
+		case r.Method == http.MethodPut:
+			u.Uploads++
+		case r.Method == http.MethodGet:
+			u.Downloads++
+		}
+	}
+	if status >= 400 {
+		u.Errors++
+	}
+}
+
+// Breakdown sums the usage over the fields not in by, which holds JSON
+// field names such as "version"; an empty by keeps every combination
+func (cs *ClientStats) Breakdown(by map[string]bool) []ClientUsage {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	groups := make(map[clientKey]*ClientUsage)
+	for key, u := range cs.usage {
+		if len(by) > 0 {
+			key = clientKey{ClientInfo: ClientInfo{Client: key.Client}}
+			if by["tenant"] {
+				key.tenant = u.Tenant
+			}
+			if by["team"] {
+				key.team = u.Team
+			}
+			if by["version"] {
+				key.Version = u.Version
+			}
+			if by["os"] {
+				key.OS = u.OS
+			}
+			if by["arch"] {
+				key.Arch = u.Arch
+			}
+		}
+		g, ok := groups[key]
+		if !ok {
+			g = &ClientUsage{Tenant: key.tenant, Team: key.team, ClientInfo: key.ClientInfo, FirstSeen: u.FirstSeen}
+			groups[key] = g
+		}
+		g.Requests += u.Requests
+		g.Uploads += u.Uploads
+		g.Downloads += u.Downloads
+		g.Errors += u.Errors
+		if u.FirstSeen.Before(g.FirstSeen) {
+			g.FirstSeen = u.FirstSeen
+		}
+		if u.LastSeen.After(g.LastSeen) {
+			g.LastSeen = u.LastSeen
+		}
+	}
+	result := make([]ClientUsage, 0, len(groups))
+	for _, g := range groups {
+		result = append(result, *g)
+	}
+	return result
+}
+
+// Handler for /admin/clients; by=version,os sums over the other fields,
+// the client name is always kept
+func (s *Server) listClients(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	by := make(map[string]bool)
+	for _, field := range parseTags(r.URL.Query().Get("by")) {
+		switch field {
+		case "tenant", "team", "client", "version", "os", "arch":
+			by[field] = true
+		default:
+			http.Error(w, "Unknown breakdown field "+field, http.StatusBadRequest)
+			return
+		}
+	}
+	s.writeList(w, r, s.clients.Breakdown(by), "-requests", "tenant", "team", "client", "version", "os", "arch")
+}
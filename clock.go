@@ -0,0 +1,14 @@
+package cachesrv
+
+import "time"
+
+// Clock tells the time to the code that decides what the cache keeps:
+// upload and download times in the index, eviction, expiry and retention.
+// The simulator substitutes a clock it advances itself.
+type Clock interface {
+	Now() time.Time
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time { return time.Now() }
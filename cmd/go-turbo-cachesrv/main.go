@@ -0,0 +1,8 @@
+// Command go-turbo-cachesrv is a Turborepo remote cache server
+package main
+
+import cachesrv "github.com/bitechdev/go-turbo-cachesrv"
+
+func main() {
+	cachesrv.Main()
+}
@@ -0,0 +1,51 @@
+package cachesrv
+
+import (
+	"fmt"
+	"path"
+	"time"
+)
+
+// Uploads carrying a compliance tag are write-once until their retention
+// ends: the server refuses to replace them, and eviction, expiry, purges,
+// maintenance scans and partition drops leave them alone. Backends that can
+// enforce it themselves do so as well: S3 with Object Lock, the filesystem
+// by making the file read-only. The digest recorded on upload and the
+// verification scans then show the artifact is still what was uploaded.
+
+// Compliance picks the uploads that are retained and for how long
+type Compliance struct {
+	patterns  []string
+	retention time.Duration
+}
+
+// RetainUntil returns when the retention of an upload with the given tags
+// ends, or the zero time if it isn't retained
+func (c *Compliance) RetainUntil(tags []string, now time.Time) time.Time {
+	if c == nil || !matchTags(c.patterns, tags) {
+		return time.Time{}
+	}
+	return now.Add(c.retention).UTC().Truncate(time.Second)
+}
+
+// newComplianceFromEnv reads TURBO_COMPLIANCE_TAGS and
+// TURBO_COMPLIANCE_RETENTION; no tags disables retention
+func newComplianceFromEnv() (*Compliance, error) {
+	patterns := parseTags(getenv("TURBO_COMPLIANCE_TAGS"))
+	if len(patterns) == 0 {
+		return nil, nil
+	}
+	for _, p := range patterns {
+		if _, err := path.Match(p, ""); err != nil {
+			return nil, fmt.Errorf("invalid TURBO_COMPLIANCE_TAGS pattern %q: %w", p, err)
+		}
+	}
+	retention, err := envDuration("TURBO_COMPLIANCE_RETENTION", 90*24*time.Hour)
+	if err != nil {
+		return nil, err
+	}
+	if retention <= 0 {
+		return nil, fmt.Errorf("TURBO_COMPLIANCE_RETENTION must be positive")
+	}
+	return &Compliance{patterns: patterns, retention: retention}, nil
+}
@@ -0,0 +1,115 @@
+package cachesrv
+
+import (
+	"context"
+	"net/http"
+	"strings"
+)
+
+// Uploads honour If-Match and If-None-Match, so tools orchestrating the
+// cache can create an artifact only if it is absent, or replace one only if
+// it is still the copy they saw. An artifact's ETag is its content digest.
+// Conditional uploads of a hash hold its lock from the check until the
+// upload is recorded, so of two racing "If-None-Match: *" uploads exactly
+// one succeeds; unconditional uploads, turbo's own, don't wait for it.
+
+// hashLock serializes the conditional uploads of one hash
+type hashLock struct {
+	held chan struct{}
+	refs int
+}
+
+// LockHash waits until no other conditional upload of hash holds its lock,
+// or ctx is done, and returns the function releasing it
+func (idx *MetadataIndex) LockHash(ctx context.Context, hash string) (func(), error) {
+	idx.mu.Lock()
+	l := idx.locks[hash]
+	if l == nil {
+		l = &hashLock{held: make(chan struct{}, 1)}
+		idx.locks[hash] = l
+	}
+	l.refs++
+	idx.mu.Unlock()
+
+	release := func() {
+		idx.mu.Lock()
+		defer idx.mu.Unlock()
+		if l.refs--; l.refs == 0 {
+			delete(idx.locks, hash)
+		}
+	}
+	select {
+	case l.held <- struct{}{}:
+	case <-ctx.Done():
+		release()
+		return nil, ctx.Err()
+	}
+	return func() {
+		<-l.held
+		release()
+	}, nil
+}
+
+// conditional reports whether a request carries preconditions
+func conditional(r *http.Request) bool {
+	return r.Header.Get("If-Match") != "" || r.Header.Get("If-None-Match") != ""
+}
+
+// artifactETag returns the ETag of an upload, "" for uploads recorded
+// without a digest
+func artifactETag(m ArtifactMeta) string {
+	if m.Digest == "" {
+		return ""
+	}
+	return `"` + m.Digest + `"`
+}
+
+// preconditionsMet evaluates If-Match, then If-None-Match, against the
+// stored artifact the way RFC 9110 does for a PUT
+func (s *Server) preconditionsMet(r *http.Request, hash string) (bool, error) {
+	current, exists := s.index.Get(hash)
+	if !exists {
+		// Also count copies written before the index knew of them
+		var err error
+		if exists, err = s.storageFor(hash).Exists(hash); err != nil {
+			return false, err
+		}
+	}
+	etag := artifactETag(current)
+
+	if header := r.Header.Get("If-Match"); header != "" {
+		if !exists || !matchETag(header, etag, false) {
+			return false, nil
+		}
+	}
+	if header := r.Header.Get("If-None-Match"); header != "" {
+		if exists && matchETag(header, etag, true) {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// matchETag reports whether a list of entity tags, or "*", matches etag.
+// If-Match compares strongly, so weak tags never match it.
+func matchETag(header, etag string, weak bool) bool {
+	if strings.TrimSpace(header) == "*" {
+		return true
+	}
+	if etag == "" {
+		return false
+	}
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimSpace(tag)
+		if strings.HasPrefix(tag, "W/") {
+			if !weak {
+				continue
+			}
+			tag = tag[2:]
+		}
+		if tag == etag {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,206 @@
+package cachesrv
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+)
+
+// cloner is implemented by backends that can copy an artifact to a new hash
+// without its bytes passing through the server: reflinks on the filesystem,
+// CopyObject on S3
+type cloner interface {
+	Clone(src, dst string) error
+}
+
+// ArtifactRef names an artifact of a tenant, the default one when empty
+type ArtifactRef struct {
+	Tenant string `json:"tenant,omitempty"`
+	Hash   string `json:"hash"`
+}
+
+// CopyRequest is the body of POST /admin/artifacts/copy
+type CopyRequest struct {
+	From ArtifactRef `json:"from"`
+	To   ArtifactRef `json:"to"`
+	// Team owns the copy, the source's team when empty
+	Team string `json:"team,omitempty"`
+	// Replace allows overwriting an existing artifact at the destination
+	Replace bool `json:"replace,omitempty"`
+}
+
+// CopyResponse reports a copy; Cloned is set when the backend copied it
+// without streaming the bytes
+type CopyResponse struct {
+	From   ArtifactRef `json:"from"`
+	To     ArtifactRef `json:"to"`
+	Team   string      `json:"team"`
+	Size   int64       `json:"size"`
+	Cloned bool        `json:"cloned"`
+}
+
+// Handler for /admin/artifacts/copy
+func (s *Server) copyArtifact(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var req CopyRequest
+	if !s.decodeBody(w, r, &req) {
+		return
+	}
+	if !validHash(req.From.Hash) || !validHash(req.To.Hash) {
+		http.Error(w, "Invalid artifact hash", http.StatusBadRequest)
+		return
+	}
+	src, dst := s.tenantOrDefault(req.From.Tenant), s.tenantOrDefault(req.To.Tenant)
+	if src == nil || dst == nil {
+		http.Error(w, "Unknown tenant", http.StatusNotFound)
+		return
+	}
+	if src == dst && req.From.Hash == req.To.Hash {
+		http.Error(w, "Source and destination are the same", http.StatusBadRequest)
+		return
+	}
+	for _, hash := range []string{req.From.Hash, req.To.Hash} {
+		if _, blocked := s.blocklist.Get(hash); blocked {
+			http.Error(w, "Artifact is blocked", http.StatusGone)
+			return
+		}
+	}
+
+	source, ok := src.index.Get(req.From.Hash)
+	if !ok {
+		http.Error(w, "Artifact not found", http.StatusNotFound)
+		return
+	}
+	team := req.Team
+	if team == "" {
+		team = source.Team
+	}
+	class := dst.classFor(source.Size)
+	reservation, err := dst.quotas.Reserve(team, req.To.Hash, class.Name, source.Size)
+	if errors.Is(err, errStorageFull) && class.Evictor != nil {
+		class.Evictor.Evict(source.Size, 1)
+		reservation, err = dst.quotas.Reserve(team, req.To.Hash, class.Name, source.Size)
+	}
+	if errors.Is(err, errStorageFull) {
+		http.Error(w, "Cache is full, uploads are paused", http.StatusInsufficientStorage)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Team quota exceeded", http.StatusForbidden)
+		return
+	}
+	defer reservation.Release()
+	dst.index.StartUpload(req.To.Hash)
+	defer dst.index.FinishUpload(req.To.Hash)
+
+	now := dst.index.clock.Now()
+	previous, replacing := dst.index.Get(req.To.Hash)
+	if replacing && !req.Replace {
+		http.Error(w, "Artifact exists", http.StatusConflict)
+		return
+	}
+	if replacing && previous.retained(now) {
+		http.Error(w, "Artifact is retained", http.StatusConflict)
+		return
+	}
+
+	retainUntil := dst.compliance.RetainUntil(source.Tags, now)
+	describeArtifact(class.Storage, req.To.Hash, ArtifactDetails{Team: team, Tags: source.Tags, RetainUntil: retainUntil})
+	start := time.Now()
+	digest, cloned, err := copyBetween(src.classByName(source.Class).Storage, req.From.Hash, class.Storage, req.To.Hash, dst)
+	if err != nil {
+		s.logger.Printf("Copy of %s to %s failed: %v", req.From.Hash, req.To.Hash, err)
+		if errors.Is(err, errArtifactNotFound) {
+			http.Error(w, "Artifact not found", http.StatusNotFound)
+			return
+		}
+		http.Error(w, "Failed to copy artifact", http.StatusInternalServerError)
+		return
+	}
+	if cloned {
+		digest = source.Digest
+	}
+
+	dst.index.Put(&ArtifactMeta{
+		Hash:       req.To.Hash,
+		Size:       source.Size,
+		Digest:     digest,
+		Team:       team,
+		DurationMs: source.DurationMs,
+		Tags:       source.Tags,
+		Metadata:   source.Metadata,
+		Class:      class.Name,
+		CreatedAt:  now,
+
+		RetainUntil: retainUntil,
+	})
+	if replacing && previous.Class != class.Name {
+		if err := dst.classByName(previous.Class).Storage.Delete(req.To.Hash); err != nil {
+			s.logger.Printf("Failed to remove previous copy of %s: %v", req.To.Hash, err)
+		}
+	}
+	if class.Evictor != nil {
+		class.Evictor.Notify()
+	}
+	if dst.archive != nil && dst.archive.Matches(source.Tags) {
+		dst.archive.Enqueue(req.To.Hash, class.Storage)
+	}
+	s.logger.Printf("Copied %s to %s (%d bytes, team %q, cloned %t) in %v by %s",
+		refLabel(req.From), refLabel(req.To), source.Size, team, cloned, time.Since(start).Round(time.Millisecond), adminActor(r))
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(CopyResponse{From: req.From, To: req.To, Team: team, Size: source.Size, Cloned: cloned})
+}
+
+// copyBetween copies an artifact, cloning it when both hashes live on the
+// same backend and it can, and streaming it through the server otherwise.
+// It returns the digest of a streamed copy, computed on the way.
+func copyBetween(from Storage, src string, to Storage, dst string, target *Server) (string, bool, error) {
+	if unwrapStorage(from) == unwrapStorage(to) {
+		if c, ok := unwrapStorage(to).(cloner); ok {
+			if err := c.Clone(src, dst); err == nil {
+				return "", true, nil
+			} else if errors.Is(err, errArtifactNotFound) {
+				return "", false, err
+			}
+		}
+	}
+	reader, size, err := from.Get(src)
+	if err != nil {
+		return "", false, err
+	}
+	defer reader.Close()
+	algorithm, digest := target.contentHash()
+	content := &countingReader{ReadCloser: reader}
+	if err := to.Store(dst, io.TeeReader(content, digest)); err != nil {
+		return "", false, err
+	}
+	if content.n != size {
+		to.Delete(dst)
+		return "", false, fmt.Errorf("read %d of %d bytes", content.n, size)
+	}
+	return formatDigest(algorithm, digest), false, nil
+}
+
+// tenantOrDefault returns the server of a tenant, s for the default one
+func (s *Server) tenantOrDefault(name string) *Server {
+	if name == "" {
+		return s
+	}
+	return s.tenantByName(name)
+}
+
+// refLabel names an artifact in log messages
+func refLabel(ref ArtifactRef) string {
+	if ref.Tenant == "" {
+		return ref.Hash
+	}
+	return ref.Tenant + "/" + ref.Hash
+}
@@ -0,0 +1,337 @@
+package cachesrv
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	_ "embed"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+//go:embed dashboard.html
+var dashboardHTML []byte
+
+const loginFormHTML = `<!DOCTYPE html>
+<html lang="en">
+<head><meta charset="utf-8"><title>Turbo Cache Server - Login</title></head>
+<body style="font-family: system-ui, sans-serif; margin: 2rem;">
+<h1>Turbo Cache Server</h1>
+<form method="post" action="/dashboard/login">
+  <p><label>Username <input name="username" autocomplete="username" required></label></p>
+  <p><label>Password <input name="password" type="password" autocomplete="current-password" required></label></p>
+  <p><button type="submit">Log in</button></p>
+</form>
+</body>
+</html>
+`
+
+const (
+	sessionCookie = "turbo_session"
+	stateCookie   = "turbo_oauth_state"
+)
+
+// Dashboard serves the embedded web UI to users who logged in through a
+// LoginProvider or, for LDAP, a password form
+type Dashboard struct {
+	server     *Server
+	provider   LoginProvider
+	passwords  PasswordAuthenticator
+	secret     []byte
+	sessionTTL time.Duration
+	secure     bool
+}
+
+type dashboardSession struct {
+	User    string `json:"user"`
+	Role    Role   `json:"role"`
+	Expires int64  `json:"exp"`
+}
+
+func NewDashboard(server *Server, provider LoginProvider, passwords PasswordAuthenticator, secret []byte, sessionTTL time.Duration, secure bool) *Dashboard {
+	return &Dashboard{
+		server:     server,
+		provider:   provider,
+		passwords:  passwords,
+		secret:     secret,
+		sessionTTL: sessionTTL,
+		secure:     secure,
+	}
+}
+
+func (d *Dashboard) Register(mux *http.ServeMux) {
+	mux.HandleFunc("/dashboard/", d.requireSession(d.index))
+	mux.HandleFunc("/dashboard/login", d.login)
+	mux.HandleFunc("/dashboard/callback", d.callback)
+	mux.HandleFunc("/dashboard/logout", d.logout)
+	mux.HandleFunc("/dashboard/api/tokens", d.requireSession(d.server.listTokens))
+}
+
+// Middleware to require a valid dashboard session cookie
+func (d *Dashboard) requireSession(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		session, err := d.readSession(r)
+		if err != nil {
+			if strings.HasPrefix(r.URL.Path, "/dashboard/api/") {
+				http.Error(w, "Unauthorized", http.StatusUnauthorized)
+				return
+			}
+			http.Redirect(w, r, "/dashboard/login", http.StatusFound)
+			return
+		}
+
+		if strings.HasPrefix(r.URL.Path, "/dashboard/api/") {
+			w.Header().Set("Content-Type", "application/json")
+		}
+
+		d.server.logger.Printf("Dashboard request: %s %s (user %s, %s)", r.Method, r.URL.Path, session.User, session.Role)
+		next(w, r)
+	}
+}
+
+// Handler for /dashboard/
+func (d *Dashboard) index(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write(dashboardHTML)
+}
+
+// Handler for /dashboard/login
+func (d *Dashboard) login(w http.ResponseWriter, r *http.Request) {
+	if d.passwords != nil {
+		d.passwordLogin(w, r)
+		return
+	}
+
+	state, err := randomHex(16)
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     stateCookie,
+		Value:    state,
+		Path:     "/dashboard/",
+		MaxAge:   int((10 * time.Minute).Seconds()),
+		HttpOnly: true,
+		Secure:   d.secure,
+		SameSite: http.SameSiteLaxMode,
+	})
+	http.Redirect(w, r, d.provider.AuthCodeURL(state), http.StatusFound)
+}
+
+// Handler for /dashboard/callback
+func (d *Dashboard) callback(w http.ResponseWriter, r *http.Request) {
+	if d.provider == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	state, err := r.Cookie(stateCookie)
+	if err != nil || state.Value == "" || state.Value != r.URL.Query().Get("state") {
+		http.Error(w, "Invalid login state", http.StatusBadRequest)
+		return
+	}
+	http.SetCookie(w, &http.Cookie{Name: stateCookie, Path: "/dashboard/", MaxAge: -1})
+
+	identity, err := d.provider.Authenticate(r.Context(), r.URL.Query().Get("code"))
+	if errors.Is(err, errNotAuthorized) {
+		d.server.logger.Printf("Dashboard login denied for %s", identity.User)
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	if err != nil {
+		d.server.logger.Printf("Dashboard login failed: %v", err)
+		http.Error(w, "Login failed", http.StatusBadGateway)
+		return
+	}
+
+	d.startSession(w, r, identity)
+}
+
+// passwordLogin renders the login form and checks submitted credentials
+func (d *Dashboard) passwordLogin(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Write([]byte(loginFormHTML))
+		return
+	case http.MethodPost:
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	user := r.PostFormValue("username")
+	groups, err := d.passwords.AuthenticatePassword(r.Context(), user, r.PostFormValue("password"))
+	switch {
+	case errors.Is(err, errInvalidCredentials):
+		d.server.logger.Printf("Dashboard login failed for %s: %v", user, err)
+		http.Error(w, "Invalid username or password", http.StatusUnauthorized)
+		return
+	case errors.Is(err, errNotAuthorized):
+		d.server.logger.Printf("Dashboard login denied for %s", user)
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	case err != nil:
+		d.server.logger.Printf("Dashboard login failed for %s: %v", user, err)
+		http.Error(w, "Login failed", http.StatusBadGateway)
+		return
+	}
+
+	d.startSession(w, r, Identity{User: user, Groups: groups})
+}
+
+func (d *Dashboard) startSession(w http.ResponseWriter, r *http.Request, identity Identity) {
+	role := d.server.roles.IdentityRole(identity.User, identity.Groups)
+	if role == roleNone {
+		d.server.logger.Printf("Dashboard login denied for %s: no admin role", identity.User)
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	value, err := d.signSession(dashboardSession{
+		User:    identity.User,
+		Role:    role,
+		Expires: time.Now().Add(d.sessionTTL).Unix(),
+	})
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	d.server.logger.Printf("Dashboard login for %s (%s)", identity.User, role)
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookie,
+		Value:    value,
+		Path:     "/dashboard/",
+		MaxAge:   int(d.sessionTTL.Seconds()),
+		HttpOnly: true,
+		Secure:   d.secure || r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+	http.Redirect(w, r, "/dashboard/", http.StatusFound)
+}
+
+// Handler for /dashboard/logout
+func (d *Dashboard) logout(w http.ResponseWriter, r *http.Request) {
+	http.SetCookie(w, &http.Cookie{Name: sessionCookie, Path: "/dashboard/", MaxAge: -1})
+	http.Redirect(w, r, "/dashboard/login", http.StatusFound)
+}
+
+func (d *Dashboard) signSession(s dashboardSession) (string, error) {
+	payload, err := json.Marshal(s)
+	if err != nil {
+		return "", err
+	}
+	encoded := base64.RawURLEncoding.EncodeToString(payload)
+	return encoded + "." + d.sign(encoded), nil
+}
+
+func (d *Dashboard) readSession(r *http.Request) (*dashboardSession, error) {
+	cookie, err := r.Cookie(sessionCookie)
+	if err != nil {
+		return nil, err
+	}
+
+	encoded, sig, ok := strings.Cut(cookie.Value, ".")
+	if !ok || !hmac.Equal([]byte(sig), []byte(d.sign(encoded))) {
+		return nil, fmt.Errorf("invalid session signature")
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, err
+	}
+	var s dashboardSession
+	if err := json.Unmarshal(payload, &s); err != nil {
+		return nil, err
+	}
+	if time.Now().Unix() > s.Expires {
+		return nil, fmt.Errorf("session expired")
+	}
+	// Sessions from before roles existed have to log in again
+	if s.Role < roleViewer {
+		return nil, fmt.Errorf("session has no role")
+	}
+	return &s, nil
+}
+
+func (d *Dashboard) sign(value string) string {
+	mac := hmac.New(sha256.New, d.secret)
+	mac.Write([]byte(value))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// newDashboardFromEnv configures the dashboard from TURBO_DASHBOARD_AUTH and
+// related variables; it returns nil when the dashboard is disabled
+func newDashboardFromEnv(server *Server) (*Dashboard, error) {
+	mode := getenv("TURBO_DASHBOARD_AUTH")
+	if mode == "" {
+		return nil, nil
+	}
+
+	secret := []byte(getenv("TURBO_SESSION_SECRET"))
+	if len(secret) == 0 {
+		// Sessions will not survive a restart, which only means logging in again
+		random, err := randomHex(32)
+		if err != nil {
+			return nil, err
+		}
+		secret = []byte(random)
+	}
+
+	sessionTTL, err := envDuration("TURBO_SESSION_TTL", 12*time.Hour)
+	if err != nil {
+		return nil, err
+	}
+
+	if mode == "ldap" {
+		if server.ldap == nil {
+			return nil, fmt.Errorf("TURBO_LDAP_URL is required for ldap dashboard login")
+		}
+		return NewDashboard(server, nil, server.ldap, secret, sessionTTL, false), nil
+	}
+
+	clientID := getenv("TURBO_OAUTH_CLIENT_ID")
+	clientSecret := getenv("TURBO_OAUTH_CLIENT_SECRET")
+	redirectURL := getenv("TURBO_OAUTH_REDIRECT_URL")
+	if clientID == "" || clientSecret == "" || redirectURL == "" {
+		return nil, fmt.Errorf("TURBO_OAUTH_CLIENT_ID, TURBO_OAUTH_CLIENT_SECRET and TURBO_OAUTH_REDIRECT_URL are required for the dashboard")
+	}
+
+	var provider LoginProvider
+	switch mode {
+	case "github":
+		org := getenv("TURBO_GITHUB_ORG")
+		if org == "" {
+			return nil, fmt.Errorf("TURBO_GITHUB_ORG is required for github dashboard login")
+		}
+		provider = NewGitHubProvider(clientID, clientSecret, redirectURL, org, getenv("TURBO_GITHUB_TEAM"))
+	case "oidc":
+		issuer := getenv("TURBO_OIDC_ISSUER")
+		if issuer == "" {
+			return nil, fmt.Errorf("TURBO_OIDC_ISSUER is required for oidc dashboard login")
+		}
+		var groups []string
+		if v := getenv("TURBO_OIDC_GROUPS"); v != "" {
+			groups = strings.Split(v, ",")
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		p, err := NewOIDCProvider(ctx, issuer, clientID, clientSecret, redirectURL,
+			envString("TURBO_OIDC_GROUPS_CLAIM", "groups"), groups)
+		if err != nil {
+			return nil, err
+		}
+		provider = p
+	default:
+		return nil, fmt.Errorf("unknown TURBO_DASHBOARD_AUTH %q (expected github, oidc or ldap)", mode)
+	}
+
+	return NewDashboard(server, provider, nil, secret, sessionTTL, strings.HasPrefix(redirectURL, "https://")), nil
+}
@@ -0,0 +1,119 @@
+package cachesrv
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// degradedProbeHash is looked up to check whether storage has recovered
+const degradedProbeHash = "turbo-cache-health-probe"
+
+// StorageHealth switches the server to pass-through mode after repeated
+// storage failures: artifact reads miss and uploads are accepted but
+// discarded, so CI builds proceed uncached instead of failing on 500s. A
+// background probe switches back once storage answers again.
+type StorageHealth struct {
+	mu        sync.Mutex
+	threshold int
+	failures  int
+	degraded  bool
+	since     time.Time
+	putStatus int
+	notify    *Notifications
+	logger    *log.Logger
+}
+
+func NewStorageHealth(threshold, putStatus int, notify *Notifications, logger *log.Logger) *StorageHealth {
+	return &StorageHealth{threshold: threshold, putStatus: putStatus, notify: notify, logger: logger}
+}
+
+// Degraded reports whether the server is in pass-through mode
+func (h *StorageHealth) Degraded() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.degraded
+}
+
+// Record accounts the outcome of a storage operation; a missing artifact
+// counts as success
+func (h *StorageHealth) Record(err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if err == nil || errors.Is(err, errArtifactNotFound) {
+		h.failures = 0
+		return
+	}
+	h.failures++
+	if !h.degraded && h.failures >= h.threshold {
+		h.degraded = true
+		h.since = time.Now()
+		h.logger.Printf("Storage failed %d times in a row, entering pass-through mode: %v", h.failures, err)
+		h.notify.Send(eventStorageDegraded, severityCritical,
+			fmt.Sprintf("storage failed %d times in a row, serving uncached: %v", h.failures, err), nil)
+	}
+}
+
+// Run probes storage at every interval while degraded and leaves
+// pass-through mode once the probe succeeds
+func (h *StorageHealth) Run(probe func() error, interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+		if !h.Degraded() {
+			continue
+		}
+		if err := probe(); err != nil {
+			continue
+		}
+		h.mu.Lock()
+		h.degraded = false
+		h.failures = 0
+		h.logger.Printf("Storage recovered, leaving pass-through mode after %v", time.Since(h.since).Round(time.Second))
+		h.notify.Send(eventStorageRecovered, severityInfo,
+			fmt.Sprintf("storage recovered after %v in pass-through mode", time.Since(h.since).Round(time.Second)), nil)
+		h.mu.Unlock()
+	}
+}
+
+// probeStorage checks that every size class answers
+func (s *Server) probeStorage() error {
+	for _, c := range s.classes {
+		if _, err := c.Storage.Exists(degradedProbeHash); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// recordStorageResult feeds a storage outcome into pass-through detection
+func (s *Server) recordStorageResult(err error) {
+	if s.health != nil {
+		s.health.Record(err)
+	}
+}
+
+// passThrough answers an artifact request without touching storage
+func (s *Server) passThrough(w http.ResponseWriter, r *http.Request, hash string) {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		http.Error(w, "Artifact not found", http.StatusNotFound)
+	case http.MethodPut:
+		io.Copy(io.Discard, r.Body)
+		s.logger.Printf("Upload for hash %s discarded in pass-through mode", hash)
+		w.WriteHeader(s.health.putStatus)
+		json.NewEncoder(w).Encode(UploadResponse{URLs: []string{}})
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,106 @@
+package cachesrv
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"net/http"
+	"strings"
+
+	"lukechampine.com/blake3"
+)
+
+// Content digest algorithms. Digests are stored as "<algorithm>:<hex>", so
+// artifacts hashed before a change of TURBO_CONTENT_DIGEST keep verifying
+// with the algorithm they were recorded with.
+const (
+	digestSHA256 = "sha256"
+	digestBLAKE3 = "blake3"
+)
+
+var errDigestMismatch = errors.New("content does not match its digest")
+
+// Downloads carry the recorded digest of an artifact in digestHeader. A
+// client sending "TE: trailers" also gets the digest of the bytes actually
+// sent in the sentDigestHeader trailer, so it can check the artifact end to
+// end without asking again.
+const (
+	digestHeader     = "X-Artifact-Digest"
+	sentDigestHeader = "X-Artifact-Sent-Digest"
+)
+
+// newDigest returns a hash for a content digest algorithm
+func newDigest(algorithm string) (hash.Hash, error) {
+	switch algorithm {
+	case digestSHA256:
+		return sha256.New(), nil
+	case digestBLAKE3:
+		return blake3.New(32, nil), nil
+	}
+	return nil, fmt.Errorf("unknown digest algorithm %q (expected sha256 or blake3)", algorithm)
+}
+
+func formatDigest(algorithm string, h hash.Hash) string {
+	return algorithm + ":" + hex.EncodeToString(h.Sum(nil))
+}
+
+// parseDigest splits a stored digest into its algorithm and hex sum
+func parseDigest(digest string) (string, string, error) {
+	algorithm, sum, ok := strings.Cut(digest, ":")
+	if !ok || sum == "" {
+		return "", "", fmt.Errorf("invalid digest %q", digest)
+	}
+	if _, err := newDigest(algorithm); err != nil {
+		return "", "", err
+	}
+	return algorithm, sum, nil
+}
+
+// digestAlgorithmFromEnv reads TURBO_CONTENT_DIGEST
+func digestAlgorithmFromEnv() (string, error) {
+	algorithm := envString("TURBO_CONTENT_DIGEST", digestSHA256)
+	if _, err := newDigest(algorithm); err != nil {
+		return "", fmt.Errorf("invalid TURBO_CONTENT_DIGEST: %w", err)
+	}
+	return algorithm, nil
+}
+
+// contentHash returns the configured algorithm and a hash for it
+func (s *Server) contentHash() (string, hash.Hash) {
+	algorithm := s.digest
+	if algorithm == "" {
+		algorithm = digestSHA256
+	}
+	h, err := newDigest(algorithm)
+	if err != nil {
+		// Checked at startup
+		panic(err)
+	}
+	return algorithm, h
+}
+
+// sentDigest returns a hash for the digest trailer of a download, in the
+// algorithm the artifact was recorded with, or nil if the client doesn't
+// accept trailers
+func (s *Server) sentDigest(r *http.Request, m ArtifactMeta) (string, hash.Hash) {
+	if !acceptsTrailers(r) {
+		return "", nil
+	}
+	if algorithm, _, err := parseDigest(m.Digest); err == nil {
+		h, _ := newDigest(algorithm)
+		return algorithm, h
+	}
+	return s.contentHash()
+}
+
+// acceptsTrailers reports whether a request's TE header lists trailers
+func acceptsTrailers(r *http.Request) bool {
+	for _, te := range strings.Split(r.Header.Get("Te"), ",") {
+		if strings.EqualFold(strings.TrimSpace(te), "trailers") {
+			return true
+		}
+	}
+	return false
+}
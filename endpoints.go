@@ -0,0 +1,93 @@
+package cachesrv
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Requests are grouped by what they do, and each group gets its own time
+// limit and body limit: an upload of a large artifact may take many minutes
+// where a query should be over in seconds.
+const (
+	endpointUpload   = "upload"   // PUT of artifacts, batch uploads
+	endpointDownload = "download" // GET and HEAD of artifacts, batch downloads
+	endpointAPI      = "api"      // the JSON endpoints
+	endpointAdmin    = "admin"    // /admin
+)
+
+// EndpointLimit bounds the requests of an endpoint group; zero means no
+// limit
+type EndpointLimit struct {
+	// Timeout covers the whole request: reading the body, the work, and
+	// writing the response. Past it the connection is closed.
+	Timeout time.Duration
+	MaxBody int64
+}
+
+func endpointLimitsFromEnv() (map[string]EndpointLimit, error) {
+	limits := make(map[string]EndpointLimit)
+	for _, group := range []struct {
+		name, timeoutKey, bodyKey string
+		timeout                   time.Duration
+		body                      int64
+	}{
+		{endpointUpload, "TURBO_UPLOAD_TIMEOUT", "TURBO_MAX_UPLOAD_BODY", 0, 0},
+		{endpointDownload, "TURBO_DOWNLOAD_TIMEOUT", "", 0, 0},
+		{endpointAPI, "TURBO_API_TIMEOUT", "", 30 * time.Second, 0},
+		{endpointAdmin, "TURBO_ADMIN_TIMEOUT", "TURBO_MAX_ADMIN_BODY", 0, 0},
+	} {
+		var limit EndpointLimit
+		var err error
+		if limit.Timeout, err = envDuration(group.timeoutKey, group.timeout); err != nil {
+			return nil, err
+		}
+		if group.bodyKey != "" {
+			if limit.MaxBody, err = envSize(group.bodyKey, group.body); err != nil {
+				return nil, err
+			}
+		}
+		limits[group.name] = limit
+	}
+	return limits, nil
+}
+
+// endpointGroup tells which group a request belongs to
+func endpointGroup(r *http.Request) string {
+	switch {
+	case strings.HasPrefix(r.URL.Path, "/admin/"):
+		return endpointAdmin
+	case route(r) == artifactRoute, route(r) == "/v8/artifacts/batch":
+		if r.Method == http.MethodPut || r.Method == http.MethodPost {
+			return endpointUpload
+		}
+		return endpointDownload
+	}
+	return endpointAPI
+}
+
+// limitRequest applies the limits of the request's group. The returned
+// function releases the timer and must be called when the request is done.
+func (s *Server) limitRequest(w http.ResponseWriter, r *http.Request) (*http.Request, func()) {
+	limit := s.endpointLimits[endpointGroup(r)]
+	if limit.MaxBody > 0 {
+		r.Body = http.MaxBytesReader(w, r.Body, limit.MaxBody)
+	}
+	if limit.Timeout <= 0 {
+		return r, func() {}
+	}
+	// The deadlines stop transfers the handler is blocked in; the context
+	// stops the waits and storage calls that watch it
+	deadline := time.Now().Add(limit.Timeout)
+	rc := http.NewResponseController(w)
+	rc.SetReadDeadline(deadline)
+	rc.SetWriteDeadline(deadline)
+	ctx, cancel := context.WithDeadline(r.Context(), deadline)
+	return r.WithContext(ctx), func() {
+		cancel()
+		// The server resets the read deadline for the next request on the
+		// connection, but not the write deadline
+		rc.SetWriteDeadline(time.Time{})
+	}
+}
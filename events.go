@@ -0,0 +1,123 @@
+package cachesrv
+
+import (
+	"fmt"
+	"sync"
+)
+
+const (
+	eventSourceLocal  = "LOCAL"
+	eventSourceRemote = "REMOTE"
+	eventHit          = "HIT"
+	eventMiss         = "MISS"
+)
+
+// EventError reports why a single entry of an events batch was rejected
+type EventError struct {
+	Index   int    `json:"index"`
+	Hash    string `json:"hash,omitempty"`
+	Message string `json:"message"`
+}
+
+type EventsResponse struct {
+	Accepted int          `json:"accepted"`
+	Errors   []EventError `json:"errors,omitempty"`
+}
+
+// Validate checks an event against the remote cache spec
+func (e *ArtifactEvent) Validate() error {
+	if e.SessionID == "" {
+		return fmt.Errorf("sessionId is required")
+	}
+	if e.Source != eventSourceLocal && e.Source != eventSourceRemote {
+		return fmt.Errorf("source must be %s or %s", eventSourceLocal, eventSourceRemote)
+	}
+	if e.Event != eventHit && e.Event != eventMiss {
+		return fmt.Errorf("event must be %s or %s", eventHit, eventMiss)
+	}
+	if !validHash(e.Hash) {
+		return fmt.Errorf("invalid hash")
+	}
+	if e.Duration < 0 {
+		return fmt.Errorf("duration must not be negative")
+	}
+	return nil
+}
+
+// EventCount tallies the cache events reported for one artifact
+type EventCount struct {
+	Hits        int64   `json:"hits"`
+	Misses      int64   `json:"misses"`
+	TimeSavedMs float64 `json:"timeSavedMs"`
+}
+
+// otherEvents collects the events of new teams and hashes once maxEventCounts
+// are counted, so made-up hashes can't grow the table without bound
+const (
+	otherEvents    = "(other)"
+	maxEventCounts = 100000
+)
+
+// EventStats aggregates recorded events per team and artifact since startup
+type EventStats struct {
+	mu      sync.Mutex
+	counts  map[string]map[string]*EventCount
+	entries int
+}
+
+func NewEventStats() *EventStats {
+	return &EventStats{counts: make(map[string]map[string]*EventCount)}
+}
+
+func (es *EventStats) Record(team string, e *ArtifactEvent) {
+	es.mu.Lock()
+	defer es.mu.Unlock()
+	full := es.entries >= maxEventCounts
+	byHash, ok := es.counts[team]
+	if !ok && full {
+		team = otherEvents
+		byHash, ok = es.counts[team]
+	}
+	if !ok {
+		byHash = make(map[string]*EventCount)
+		es.counts[team] = byHash
+	}
+	hash := e.Hash
+	c, ok := byHash[hash]
+	if !ok && full {
+		hash = otherEvents
+		c, ok = byHash[hash]
+	}
+	if !ok {
+		c = &EventCount{}
+		byHash[hash] = c
+		es.entries++
+	}
+	if e.Event == eventHit {
+		c.Hits++
+		// Turbo reports the time the hit saved as the duration
+		c.TimeSavedMs += e.Duration
+	} else {
+		c.Misses++
+	}
+}
+
+// Snapshot copies the counts of a team, or of all teams if team is empty
+func (es *EventStats) Snapshot(team string) map[string]EventCount {
+	es.mu.Lock()
+	defer es.mu.Unlock()
+	result := make(map[string]EventCount)
+	for t, byHash := range es.counts {
+		if team != "" && t != team {
+			continue
+		}
+		for hash, c := range byHash {
+			sum := result[hash]
+			sum.Hits += c.Hits
+			sum.Misses += c.Misses
+			sum.TimeSavedMs += c.TimeSavedMs
+			result[hash] = sum
+		}
+	}
+	return result
+}
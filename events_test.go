@@ -0,0 +1,47 @@
+package cachesrv
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestEventStatsBounded(t *testing.T) {
+	es := NewEventStats()
+	for i := 0; i < maxEventCounts; i++ {
+		es.Record("web", &ArtifactEvent{Hash: fmt.Sprintf("%08x", i), Event: eventMiss})
+	}
+	tests := []struct {
+		name  string
+		team  string
+		hash  string
+		event string
+		want  string
+	}{
+		{"known hash", "web", "00000001", eventHit, "00000001"},
+		{"new hash", "web", "ffffffff", eventHit, otherEvents},
+		{"another new hash", "web", "fffffffe", eventMiss, otherEvents},
+		{"new team", "api", "00000001", eventHit, otherEvents},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			es.Record(tt.team, &ArtifactEvent{Hash: tt.hash, Event: tt.event, Duration: 10})
+			if _, ok := es.Snapshot("")[tt.want]; !ok {
+				t.Errorf("no count for %s", tt.want)
+			}
+		})
+	}
+
+	if es.entries > maxEventCounts+2 {
+		t.Errorf("%d counts, want at most %d", es.entries, maxEventCounts+2)
+	}
+	other := es.Snapshot("web")[otherEvents]
+	if other.Hits != 1 || other.Misses != 1 || other.TimeSavedMs != 10 {
+		t.Errorf("web (other) = %+v, want one hit saving 10ms and one miss", other)
+	}
+	if known := es.Snapshot("web")["00000001"]; known.Hits != 1 || known.Misses != 1 {
+		t.Errorf("known hash = %+v, want one hit and one miss", known)
+	}
+	if _, ok := es.counts["api"]; ok {
+		t.Error("new team counted on its own once the table is full")
+	}
+}
@@ -0,0 +1,263 @@
+package cachesrv
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"sort"
+	"sync"
+	"time"
+)
+
+// EvictionPolicy decides which artifacts go first when the cache is over budget
+type EvictionPolicy interface {
+	Name() string
+	// Score ranks an artifact's worth keeping; the lowest scores are evicted first
+	Score(m *ArtifactMeta, now time.Time) float64
+}
+
+// LRUPolicy evicts the least recently accessed artifacts first
+type LRUPolicy struct{}
+
+func (LRUPolicy) Name() string { return "lru" }
+
+func (LRUPolicy) Score(m *ArtifactMeta, now time.Time) float64 {
+	return float64(m.lastUsed().UnixNano())
+}
+
+// DurationPolicy prefers keeping artifacts that are expensive to rebuild. An
+// artifact's value is its recorded task duration per MB, decayed by how long
+// it has gone unused, so big artifacts of quick tasks are evicted first while
+// expensive but long-forgotten ones still age out eventually.
+type DurationPolicy struct{}
+
+func (DurationPolicy) Name() string { return "duration" }
+
+func (DurationPolicy) Score(m *ArtifactMeta, now time.Time) float64 {
+	mb := float64(m.Size)/(1<<20) + 0.001
+	idleHours := now.Sub(m.lastUsed()).Hours()
+	if idleHours < 0 {
+		idleHours = 0
+	}
+	return (m.DurationMs + 1) / mb / (1 + idleHours)
+}
+
+// LFUPolicy evicts the least frequently downloaded artifacts first, breaking
+// ties by recency
+type LFUPolicy struct{}
+
+func (LFUPolicy) Name() string { return "lfu" }
+
+func (LFUPolicy) Score(m *ArtifactMeta, now time.Time) float64 {
+	// Unix seconds scaled below 1 keep the hit count dominant
+	return float64(m.Hits) + float64(m.lastUsed().Unix())/1e10
+}
+
+// LRFUPolicy combines frequency and recency: the hit count is halved for
+// every half-life the artifact has gone unused, so artifacts fetched
+// regularly but rarely (weekly release builds) outlive one-off uploads
+// without old favourites staying forever
+type LRFUPolicy struct {
+	HalfLife time.Duration
+}
+
+func (LRFUPolicy) Name() string { return "lrfu" }
+
+func (p LRFUPolicy) Score(m *ArtifactMeta, now time.Time) float64 {
+	idle := now.Sub(m.lastUsed())
+	if idle < 0 {
+		idle = 0
+	}
+	return float64(m.Hits+1) * math.Exp2(-float64(idle)/float64(p.HalfLife))
+}
+
+func evictionPolicyByName(name string, halfLife time.Duration) (EvictionPolicy, error) {
+	switch name {
+	case "lru":
+		return LRUPolicy{}, nil
+	case "lfu":
+		return LFUPolicy{}, nil
+	case "lrfu":
+		return LRFUPolicy{HalfLife: halfLife}, nil
+	case "duration":
+		return DurationPolicy{}, nil
+	default:
+		return nil, fmt.Errorf("unknown eviction policy %q (expected lru, lfu, lrfu or duration)", name)
+	}
+}
+
+// Evictor deletes artifacts of one size class chosen by a policy once the
+// class grows past its budget, until usage is back below the target fraction
+// of the budget
+type Evictor struct {
+	class   string
+	index   *MetadataIndex
+	storage Storage
+	policy  EvictionPolicy
+	budget  ClassBudget
+	target  float64
+	logger  *log.Logger
+	trigger chan struct{}
+	mu      sync.Mutex
+}
+
+func NewEvictor(class string, index *MetadataIndex, storage Storage, policy EvictionPolicy, budget ClassBudget, target float64, logger *log.Logger) *Evictor {
+	return &Evictor{
+		class:   class,
+		index:   index,
+		storage: storage,
+		policy:  policy,
+		budget:  budget,
+		target:  target,
+		logger:  logger,
+		trigger: make(chan struct{}, 1),
+	}
+}
+
+// SetBudget changes the budget and target, for a reload; a pass runs soon
+// after if the cache is now over the budget
+func (e *Evictor) SetBudget(budget ClassBudget, target float64) {
+	e.mu.Lock()
+	e.budget, e.target = budget, target
+	e.mu.Unlock()
+	e.Notify()
+}
+
+// Notify asks for an eviction pass without blocking the caller
+func (e *Evictor) Notify() {
+	select {
+	case e.trigger <- struct{}{}:
+	default:
+	}
+}
+
+// Run performs eviction passes when notified and at every interval
+func (e *Evictor) Run(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-e.trigger:
+		case <-stop:
+			return
+		}
+		e.Evict(0, 0)
+	}
+}
+
+// Evict makes room for extraFiles more artifacts totalling extraBytes: once
+// usage plus the extra exceeds the budget, artifacts are removed until it is
+// under the target again. It returns how many artifacts and bytes were freed.
+func (e *Evictor) Evict(extraBytes, extraFiles int64) (int, int64) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if !e.budget.exceeded(e.index.ClassSize(e.class)+extraBytes, e.index.ClassCount(e.class)+extraFiles) {
+		return 0, 0
+	}
+	goal := e.budget.scaled(e.target)
+
+	now := e.index.clock.Now()
+	candidates := e.index.Snapshot(e.class)
+	sort.Slice(candidates, func(i, j int) bool {
+		si, sj := e.policy.Score(&candidates[i], now), e.policy.Score(&candidates[j], now)
+		if si != sj {
+			return si < sj
+		}
+		// Ties go by hash so the same index always evicts the same artifacts
+		return candidates[i].Hash < candidates[j].Hash
+	})
+
+	var count int
+	var freed int64
+	for i := range candidates {
+		if !goal.exceeded(e.index.ClassSize(e.class)+extraBytes, e.index.ClassCount(e.class)+extraFiles) {
+			break
+		}
+		m := &candidates[i]
+		// Skip artifacts that were re-uploaded since the snapshot
+		if !e.index.DeleteIfUnchanged(m) {
+			continue
+		}
+		if err := e.storage.Delete(m.Hash); err != nil {
+			e.logger.Printf("Eviction of %s failed: %v", m.Hash, err)
+			continue
+		}
+		count++
+		freed += m.Size
+	}
+
+	if count > 0 {
+		e.logger.Printf("Evicted %d artifacts (%d bytes) from %s using %s policy",
+			count, freed, classLabel(e.class), e.policy.Name())
+	}
+	return count, freed
+}
+
+// Expirer deletes artifacts that have gone unused for longer than a retention
+// period, regardless of how much room is left
+type Expirer struct {
+	index   *MetadataIndex
+	classes []*SizeClass
+	logger  *log.Logger
+
+	mu     sync.Mutex
+	maxAge time.Duration // 0 = keep everything
+}
+
+func NewExpirer(index *MetadataIndex, classes []*SizeClass, maxAge time.Duration, logger *log.Logger) *Expirer {
+	return &Expirer{index: index, classes: classes, maxAge: maxAge, logger: logger}
+}
+
+// SetMaxAge changes the retention period, for a reload
+func (e *Expirer) SetMaxAge(maxAge time.Duration) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.maxAge = maxAge
+}
+
+// Run expires artifacts at every interval until stop is closed
+func (e *Expirer) Run(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+		e.Expire()
+	}
+}
+
+// Expire removes every artifact last used before the retention period and
+// returns how many artifacts and bytes were freed
+func (e *Expirer) Expire() (int, int64) {
+	e.mu.Lock()
+	maxAge := e.maxAge
+	e.mu.Unlock()
+	if maxAge <= 0 {
+		return 0, 0
+	}
+	cutoff := e.index.clock.Now().Add(-maxAge)
+	var count int
+	var freed int64
+	for _, c := range e.classes {
+		for _, m := range e.index.Snapshot(c.Name) {
+			if !m.lastUsed().Before(cutoff) || !e.index.DeleteIfUnchanged(&m) {
+				continue
+			}
+			if err := c.Storage.Delete(m.Hash); err != nil {
+				e.logger.Printf("Expiry of %s failed: %v", m.Hash, err)
+				continue
+			}
+			count++
+			freed += m.Size
+		}
+	}
+	if count > 0 {
+		e.logger.Printf("Expired %d artifacts (%d bytes) unused for %v", count, freed, maxAge)
+	}
+	return count, freed
+}
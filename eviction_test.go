@@ -0,0 +1,120 @@
+package cachesrv
+
+import (
+	"io"
+	"log"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/bitechdev/go-turbo-cachesrv/storage"
+)
+
+func TestEvictorPolicyOrder(t *testing.T) {
+	now := time.Date(2025, 6, 1, 12, 0, 0, 0, time.UTC)
+	ago := func(d time.Duration) time.Time { return now.Add(-d) }
+	artifacts := []ArtifactMeta{
+		{Hash: "0001", Size: 1 << 10, DurationMs: 1000, CreatedAt: ago(48 * time.Hour)},
+		{Hash: "0002", Size: 1 << 10, DurationMs: 1000, CreatedAt: ago(time.Hour)},
+		{Hash: "0003", Size: 1 << 10, DurationMs: 1000, CreatedAt: ago(48 * time.Hour), LastAccess: ago(24 * time.Hour), Hits: 10},
+		{Hash: "0004", Size: 1 << 10, DurationMs: 600000, CreatedAt: ago(30 * time.Hour)},
+		{Hash: "0005", Size: 50 << 10, DurationMs: 1000, CreatedAt: ago(2 * time.Hour), LastAccess: ago(2 * time.Hour), Hits: 1},
+	}
+	tests := []struct {
+		name    string
+		policy  EvictionPolicy
+		evicted []string
+	}{
+		// Oldest use first
+		{"lru", LRUPolicy{}, []string{"0001", "0003", "0004"}},
+		// Fewest hits first, the oldest of equally used ones before the others
+		{"lfu", LFUPolicy{}, []string{"0001", "0002", "0004"}},
+		// The popular artifact outlives fresher one-off uploads while a day
+		// of idling only halves its hits...
+		{"lrfu day", LRFUPolicy{HalfLife: 24 * time.Hour}, []string{"0001", "0002", "0004"}},
+		// ...but not once an hour halves them
+		{"lrfu hour", LRFUPolicy{HalfLife: time.Hour}, []string{"0001", "0003", "0004"}},
+		// Cheap to rebuild per MB first: the big artifact of a quick task goes
+		// before older ones, the expensive one stays despite its age
+		{"duration", DurationPolicy{}, []string{"0001", "0003", "0005"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			fs, err := storage.NewFileSystem(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			idx := newJournaledIndex(t, dir, fs)
+			defer idx.journal.Close()
+			idx.clock = &simClock{now: now}
+			for _, m := range artifacts {
+				storeArtifact(t, fs, idx, m)
+			}
+
+			// Over a budget of 4 files, evict down to half of it
+			e := NewEvictor(defaultClass, idx, fs, tt.policy, ClassBudget{MaxFiles: 4}, 0.5, log.New(io.Discard, "", 0))
+			count, _ := e.Evict(0, 0)
+			var evicted []string
+			for _, m := range artifacts {
+				if _, ok := idx.Get(m.Hash); !ok {
+					evicted = append(evicted, m.Hash)
+					if ok, _ := fs.Exists(m.Hash); ok {
+						t.Errorf("%s evicted from the index but still stored", m.Hash)
+					}
+				}
+			}
+			if count != 3 || !slices.Equal(evicted, tt.evicted) {
+				t.Errorf("evicted %d: %v, want %v", count, evicted, tt.evicted)
+			}
+			if count, _ := e.Evict(0, 0); count != 0 {
+				t.Errorf("second pass evicted %d within the budget", count)
+			}
+		})
+	}
+}
+
+func TestEvictorSizeBudget(t *testing.T) {
+	dir := t.TempDir()
+	fs, err := storage.NewFileSystem(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	idx := newJournaledIndex(t, dir, fs)
+	defer idx.journal.Close()
+	now := time.Date(2025, 6, 1, 12, 0, 0, 0, time.UTC)
+	idx.clock = &simClock{now: now}
+	for i, hash := range []string{"0001", "0002", "0003", "0004", "0005"} {
+		storeArtifact(t, fs, idx, ArtifactMeta{Hash: hash, Size: 200, CreatedAt: now.Add(time.Duration(i-10) * time.Hour)})
+	}
+	// A download makes the oldest upload the most recently used
+	idx.Touch("0001")
+
+	// TURBO_CACHE_MAX_SIZE=1000 is full but not exceeded
+	e := NewEvictor(defaultClass, idx, fs, LRUPolicy{}, ClassBudget{MaxSize: 1000}, 0.9, log.New(io.Discard, "", 0))
+	if count, _ := e.Evict(0, 0); count != 0 {
+		t.Fatalf("evicted %d at the budget, want none", count)
+	}
+	// Room for a 300 byte upload takes evicting down to 90% of the budget
+	count, freed := e.Evict(300, 1)
+	if count != 2 || freed != 400 {
+		t.Errorf("Evict = %d artifacts, %d bytes, want 2 and 400", count, freed)
+	}
+	for _, tt := range []struct {
+		hash string
+		kept bool
+	}{
+		{"0001", true},
+		{"0002", false},
+		{"0003", false},
+		{"0004", true},
+		{"0005", true},
+	} {
+		if _, ok := idx.Get(tt.hash); ok != tt.kept {
+			t.Errorf("%s kept = %v, want %v", tt.hash, ok, tt.kept)
+		}
+	}
+	if size := idx.ClassSize(defaultClass); size != 600 {
+		t.Errorf("class size = %d, want 600", size)
+	}
+}
@@ -0,0 +1,214 @@
+package cachesrv
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Replica is another cache server of a federated deployment
+type Replica struct {
+	Region string
+	URL    string
+}
+
+type regionNet struct {
+	region string
+	net    *net.IPNet
+}
+
+// Federation redirects downloads of artifacts this server doesn't hold to
+// the replica nearest to the client, so artifacts are fetched directly from
+// another region instead of being proxied through this one. Replicas share a
+// key: the redirect carries a short-lived presigned URL, because clients drop
+// the Authorization header when following a redirect to another host.
+type Federation struct {
+	replicas     []Replica
+	regionHeader string
+	networks     []regionNet
+	key          []byte
+	urlTTL       time.Duration
+	client       *http.Client
+	// transfer downloads artifacts from peers when fetch is set
+	transfer *http.Client
+	fetch    bool
+
+	mu          sync.Mutex
+	inventories map[string]*BloomFilter
+
+	tombstones *Tombstones
+}
+
+// Locate looks for the requested artifact on the replicas, nearest first, and
+// returns a presigned URL to download it from the first one that has it
+func (f *Federation) Locate(r *http.Request, key string) (string, bool) {
+	if f.tombstones.Buried(key, time.Now()) {
+		return "", false
+	}
+	for _, replica := range f.candidates(f.clientRegion(r)) {
+		// Skip peers whose inventory rules the artifact out
+		if inventory := f.inventory(replica); inventory != nil && !inventory.Test(key) {
+			continue
+		}
+		probe, err := http.NewRequest(http.MethodHead, f.presign(replica, http.MethodHead, r), nil)
+		if err != nil {
+			continue
+		}
+		if variant := r.Header.Get(variantHeader); variant != "" {
+			probe.Header.Set(variantHeader, variant)
+		}
+		resp, err := f.client.Do(probe)
+		if err != nil {
+			continue
+		}
+		resp.Body.Close()
+		if resp.StatusCode == http.StatusOK {
+			return f.presign(replica, http.MethodGet, r), true
+		}
+	}
+	return "", false
+}
+
+// VerifyPresigned reports whether a download carries a valid, unexpired
+// presigned URL issued by a replica
+func (f *Federation) VerifyPresigned(r *http.Request) bool {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return false
+	}
+	query := r.URL.Query()
+	expires, err := strconv.ParseInt(query.Get("expires"), 10, 64)
+	if err != nil || time.Now().Unix() > expires {
+		return false
+	}
+	expected := f.signature(r.Method, r.URL.Path, query.Get("expires"))
+	return hmac.Equal([]byte(query.Get("sig")), []byte(expected))
+}
+
+// presigned reports whether a request came through a replica redirect
+func presigned(r *http.Request) bool {
+	return r.URL.Query().Get("sig") != ""
+}
+
+// presign builds the replica URL for the same artifact request
+func (f *Federation) presign(replica Replica, method string, r *http.Request) string {
+	return f.presignPath(replica, method, r.URL.Path, r.URL.Query())
+}
+
+func (f *Federation) presignPath(replica Replica, method, path string, query url.Values) string {
+	expires := strconv.FormatInt(time.Now().Add(f.urlTTL).Unix(), 10)
+	query.Set("expires", expires)
+	query.Set("sig", f.signature(method, path, expires))
+	return strings.TrimSuffix(replica.URL, "/") + path + "?" + query.Encode()
+}
+
+func (f *Federation) signature(method, path, expires string) string {
+	mac := hmac.New(sha256.New, f.key)
+	mac.Write([]byte(method + "\n" + path + "\n" + expires))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// clientRegion takes the region from the region header, or else from the
+// network the client address belongs to
+func (f *Federation) clientRegion(r *http.Request) string {
+	if region := r.Header.Get(f.regionHeader); region != "" {
+		return region
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return ""
+	}
+	ip := net.ParseIP(host)
+	for _, n := range f.networks {
+		if ip != nil && n.net.Contains(ip) {
+			return n.region
+		}
+	}
+	return ""
+}
+
+// candidates orders the replicas for a client: its own region first, then
+// the rest in configured order
+func (f *Federation) candidates(region string) []Replica {
+	ordered := make([]Replica, 0, len(f.replicas))
+	for _, replica := range f.replicas {
+		if region != "" && replica.Region == region {
+			ordered = append(ordered, replica)
+		}
+	}
+	for _, replica := range f.replicas {
+		if region == "" || replica.Region != region {
+			ordered = append(ordered, replica)
+		}
+	}
+	return ordered
+}
+
+// newFederationFromEnv configures replica redirects from TURBO_REPLICAS, or
+// returns nil if no replicas are configured
+func newFederationFromEnv() (*Federation, error) {
+	spec := getenv("TURBO_REPLICAS")
+	if spec == "" {
+		return nil, nil
+	}
+	key := getenv("TURBO_FEDERATION_KEY")
+	if key == "" {
+		return nil, fmt.Errorf("TURBO_FEDERATION_KEY is required with TURBO_REPLICAS")
+	}
+	urlTTL, err := envDuration("TURBO_REPLICA_URL_TTL", 5*time.Minute)
+	if err != nil {
+		return nil, err
+	}
+	probeTimeout, err := envDuration("TURBO_REPLICA_PROBE_TIMEOUT", 2*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	f := &Federation{
+		regionHeader: envString("TURBO_REGION_HEADER", "X-Turbo-Region"),
+		key:          []byte(key),
+		urlTTL:       urlTTL,
+		client: &http.Client{
+			Timeout: probeTimeout,
+			// A replica must answer the probe itself
+			CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+		},
+		transfer:    &http.Client{},
+		fetch:       getenv("TURBO_PEER_FETCH") == "true",
+		inventories: make(map[string]*BloomFilter),
+	}
+
+	for _, entry := range strings.Split(spec, ",") {
+		region, rawURL, ok := strings.Cut(strings.TrimSpace(entry), "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid TURBO_REPLICAS entry %q, expected region=url", entry)
+		}
+		if u, err := url.Parse(rawURL); err != nil || u.Host == "" {
+			return nil, fmt.Errorf("invalid replica URL %q", rawURL)
+		}
+		f.replicas = append(f.replicas, Replica{Region: region, URL: rawURL})
+	}
+
+	if cidrs := getenv("TURBO_REGION_CIDRS"); cidrs != "" {
+		for _, entry := range strings.Split(cidrs, ",") {
+			region, list, ok := strings.Cut(strings.TrimSpace(entry), "=")
+			if !ok {
+				return nil, fmt.Errorf("invalid TURBO_REGION_CIDRS entry %q, expected region=cidr;cidr", entry)
+			}
+			for _, cidr := range strings.Split(list, ";") {
+				_, network, err := net.ParseCIDR(strings.TrimSpace(cidr))
+				if err != nil {
+					return nil, fmt.Errorf("invalid TURBO_REGION_CIDRS: %w", err)
+				}
+				f.networks = append(f.networks, regionNet{region: region, net: network})
+			}
+		}
+	}
+	return f, nil
+}
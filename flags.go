@@ -0,0 +1,255 @@
+package cachesrv
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Feature flags let behaviour that is still being proven be turned on for
+// some tenants or teams, or a share of teams, before everyone gets it. Code
+// checks a flag with s.flags.Enabled(name, s.tenant, team); the flags it
+// knows are listed in knownFlags.
+
+// knownFlags maps the flags the server checks to what they turn on
+var knownFlags = map[string]string{
+	flagPeerFetch: "Fetch missing artifacts from peer replicas, as TURBO_PEER_FETCH=true does for everyone",
+}
+
+const flagPeerFetch = "peer-fetch"
+
+// FeatureFlag decides who gets a behaviour. Overrides for a team come
+// first, then those for its tenant, then the percentage, then Enabled.
+type FeatureFlag struct {
+	Name        string `json:"name"`
+	Description string `json:"description,omitempty"`
+	Enabled     bool   `json:"enabled"`
+	// Percent enables the flag for that share of teams, picked by a hash of
+	// the flag, tenant and team so a team keeps its answer
+	Percent int `json:"percent,omitempty"`
+	// Tenants overrides the flag for tenants, "" being the default tenant
+	Tenants map[string]bool `json:"tenants,omitempty"`
+	// Teams overrides the flag for teams, keyed "tenant/team"
+	Teams     map[string]bool `json:"teams,omitempty"`
+	UpdatedAt time.Time       `json:"updatedAt,omitempty"`
+}
+
+// enabled evaluates the flag for a team of a tenant
+func (f *FeatureFlag) enabled(tenant, team string) bool {
+	if on, ok := f.Teams[tenant+"/"+team]; ok {
+		return on
+	}
+	if on, ok := f.Tenants[tenant]; ok {
+		return on
+	}
+	if f.Percent > 0 {
+		h := fnv.New32a()
+		h.Write([]byte(f.Name + "/" + tenant + "/" + team))
+		if int(h.Sum32()%100) < f.Percent {
+			return true
+		}
+	}
+	return f.Enabled
+}
+
+// FeatureFlags holds the flag settings: defaults from TURBO_FEATURE_FLAGS,
+// replaced by those set through the admin API, which are persisted
+type FeatureFlags struct {
+	mu       sync.RWMutex
+	path     string
+	defaults map[string]FeatureFlag
+	flags    map[string]FeatureFlag
+}
+
+func NewFeatureFlags(path string, defaults map[string]FeatureFlag) (*FeatureFlags, error) {
+	f := &FeatureFlags{path: path, defaults: defaults, flags: make(map[string]FeatureFlag)}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return f, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read feature flags: %w", err)
+	}
+	var saved []FeatureFlag
+	if err := json.Unmarshal(data, &saved); err != nil {
+		return nil, fmt.Errorf("failed to parse feature flags: %w", err)
+	}
+	for _, flag := range saved {
+		// Flags the server no longer checks are dropped on the next save
+		if _, ok := knownFlags[flag.Name]; ok {
+			f.flags[flag.Name] = flag
+		}
+	}
+	return f, nil
+}
+
+// parseFeatureFlags reads TURBO_FEATURE_FLAGS, e.g. "peer-fetch=25%" or
+// "peer-fetch=on"
+func parseFeatureFlags(spec string) (map[string]FeatureFlag, error) {
+	defaults := make(map[string]FeatureFlag)
+	for _, entry := range parseTags(spec) {
+		name, value, _ := strings.Cut(entry, "=")
+		if _, ok := knownFlags[name]; !ok {
+			return nil, fmt.Errorf("unknown feature flag %q", name)
+		}
+		flag := FeatureFlag{Name: name}
+		switch {
+		case value == "on":
+			flag.Enabled = true
+		case value == "off":
+		case strings.HasSuffix(value, "%"):
+			percent, err := strconv.Atoi(strings.TrimSuffix(value, "%"))
+			if err != nil || percent < 0 || percent > 100 {
+				return nil, fmt.Errorf("invalid percentage for feature flag %s: %q", name, value)
+			}
+			flag.Percent = percent
+		default:
+			return nil, fmt.Errorf("invalid feature flag entry %q (expected name=on, name=off or name=<percent>%%)", entry)
+		}
+		defaults[name] = flag
+	}
+	return defaults, nil
+}
+
+// Enabled reports whether a flag is on for a team of a tenant
+func (f *FeatureFlags) Enabled(name, tenant, team string) bool {
+	if f == nil {
+		return false
+	}
+	flag, ok := f.get(name)
+	return ok && flag.enabled(tenant, team)
+}
+
+func (f *FeatureFlags) get(name string) (FeatureFlag, bool) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	if flag, ok := f.flags[name]; ok {
+		return flag, true
+	}
+	flag, ok := f.defaults[name]
+	return flag, ok
+}
+
+// Get returns the setting of a known flag, off if it was never set
+func (f *FeatureFlags) Get(name string) FeatureFlag {
+	flag, ok := f.get(name)
+	if !ok {
+		flag = FeatureFlag{Name: name}
+	}
+	flag.Description = knownFlags[name]
+	return flag
+}
+
+// Set replaces the setting of a known flag
+func (f *FeatureFlags) Set(flag FeatureFlag) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	flag.Description = ""
+	flag.UpdatedAt = time.Now()
+	f.flags[flag.Name] = flag
+	return f.save()
+}
+
+// Reset goes back to the TURBO_FEATURE_FLAGS setting of a flag
+func (f *FeatureFlags) Reset(name string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.flags, name)
+	return f.save()
+}
+
+// List returns every known flag ordered by name
+func (f *FeatureFlags) List() []FeatureFlag {
+	list := make([]FeatureFlag, 0, len(knownFlags))
+	for name := range knownFlags {
+		list = append(list, f.Get(name))
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list
+}
+
+// save writes the flags set through the API atomically; callers must hold
+// the lock
+func (f *FeatureFlags) save() error {
+	list := make([]FeatureFlag, 0, len(f.flags))
+	for _, flag := range f.flags {
+		list = append(list, flag)
+	}
+	data, err := json.MarshalIndent(list, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode feature flags: %w", err)
+	}
+	return writeFileAtomic(f.path, data, 0644)
+}
+
+// Handler for /admin/flags
+func (s *Server) listFlags(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	s.writeList(w, r, s.flags.List(), "name", "name")
+}
+
+// Handler for /admin/flags/{name}. GET with tenant and team parameters also
+// reports whether the flag is on for them, PUT replaces the setting and
+// DELETE goes back to the TURBO_FEATURE_FLAGS one.
+func (s *Server) handleFlag(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(r.URL.Path, "/admin/flags/")
+	if _, ok := knownFlags[name]; !ok {
+		http.Error(w, "Unknown feature flag", http.StatusNotFound)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		q := r.URL.Query()
+		if !q.Has("tenant") && !q.Has("team") {
+			json.NewEncoder(w).Encode(s.flags.Get(name))
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]any{
+			"name":    name,
+			"tenant":  q.Get("tenant"),
+			"team":    q.Get("team"),
+			"enabled": s.flags.Enabled(name, q.Get("tenant"), q.Get("team")),
+		})
+	case http.MethodPut:
+		var flag FeatureFlag
+		if err := json.NewDecoder(r.Body).Decode(&flag); err != nil || flag.Percent < 0 || flag.Percent > 100 {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		for tenant := range flag.Tenants {
+			if tenant != "" && s.tenantByName(tenant) == nil {
+				http.Error(w, "Unknown tenant", http.StatusNotFound)
+				return
+			}
+		}
+		flag.Name = name
+		if err := s.flags.Set(flag); err != nil {
+			s.logger.Printf("Failed to save feature flag: %v", err)
+			http.Error(w, "Failed to save feature flag", http.StatusInternalServerError)
+			return
+		}
+		s.logger.Printf("Feature flag %s set: enabled=%t percent=%d tenants=%v teams=%v",
+			name, flag.Enabled, flag.Percent, flag.Tenants, flag.Teams)
+		json.NewEncoder(w).Encode(s.flags.Get(name))
+	case http.MethodDelete:
+		if err := s.flags.Reset(name); err != nil {
+			s.logger.Printf("Failed to save feature flag: %v", err)
+			http.Error(w, "Failed to save feature flag", http.StatusInternalServerError)
+			return
+		}
+		s.logger.Printf("Feature flag %s reset", name)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,368 @@
+package cachesrv
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	gcsEndpoint      = "https://storage.googleapis.com"
+	gcsScope         = "https://www.googleapis.com/auth/devstorage.read_write"
+	gcsMetadataToken = "http://metadata.google.internal/computeMetadata/v1/instance/service-accounts/default/token"
+)
+
+// GCSStorage stores artifacts in a Google Cloud Storage bucket using the JSON
+// API. Uploads are streamed as simple media uploads, so nothing is spooled.
+type GCSStorage struct {
+	client   *http.Client
+	endpoint string
+	bucket   string
+	prefix   string
+	// tokens is nil for unauthenticated access, as the emulators expect
+	tokens *gcsCachedToken
+}
+
+// gcsTokenSource returns an OAuth access token and when it expires
+type gcsTokenSource interface {
+	token(client *http.Client) (string, time.Time, error)
+}
+
+// gcsServiceAccount signs a JWT with the key of a service account and trades
+// it for an access token
+type gcsServiceAccount struct {
+	email    string
+	key      *rsa.PrivateKey
+	tokenURI string
+}
+
+// gcsMetadataServer asks the metadata server of a GCE VM, GKE pod or Cloud
+// Run service for a token of its attached service account
+type gcsMetadataServer struct{}
+
+// gcsCachedToken reuses a token until shortly before it expires
+type gcsCachedToken struct {
+	source gcsTokenSource
+
+	mu      sync.Mutex
+	current string
+	expiry  time.Time
+}
+
+func NewGCSStorage(endpoint, bucket, prefix string, tokens gcsTokenSource) (*GCSStorage, error) {
+	if endpoint == "" {
+		endpoint = gcsEndpoint
+	}
+	g := &GCSStorage{
+		client:   &http.Client{},
+		endpoint: strings.TrimSuffix(endpoint, "/"),
+		bucket:   bucket,
+		prefix:   prefix,
+	}
+	if tokens != nil {
+		g.tokens = &gcsCachedToken{source: tokens}
+	}
+	if err := g.check(); err != nil {
+		return nil, err
+	}
+	return g, nil
+}
+
+// loadGCSServiceAccount reads a service account key file as downloaded from
+// the console
+func loadGCSServiceAccount(path string) (*gcsServiceAccount, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read credentials: %w", err)
+	}
+	var file struct {
+		Type        string `json:"type"`
+		ClientEmail string `json:"client_email"`
+		PrivateKey  string `json:"private_key"`
+		TokenURI    string `json:"token_uri"`
+	}
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("failed to parse credentials: %w", err)
+	}
+	if file.Type != "service_account" {
+		return nil, fmt.Errorf("credentials %s are not a service account key", path)
+	}
+	block, _ := pem.Decode([]byte(file.PrivateKey))
+	if block == nil {
+		return nil, fmt.Errorf("credentials %s have no private key", path)
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse private key: %w", err)
+	}
+	key, ok := parsed.(*rsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("private key of %s is not an RSA key", path)
+	}
+	if file.TokenURI == "" {
+		file.TokenURI = "https://oauth2.googleapis.com/token"
+	}
+	return &gcsServiceAccount{email: file.ClientEmail, key: key, tokenURI: file.TokenURI}, nil
+}
+
+func (sa *gcsServiceAccount) token(client *http.Client) (string, time.Time, error) {
+	now := time.Now()
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT"})
+	claims, _ := json.Marshal(map[string]any{
+		"iss":   sa.email,
+		"scope": gcsScope,
+		"aud":   sa.tokenURI,
+		"iat":   now.Unix(),
+		"exp":   now.Add(time.Hour).Unix(),
+	})
+	unsigned := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(claims)
+	digest := sha256.Sum256([]byte(unsigned))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, sa.key, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", time.Time{}, fmt.Errorf("failed to sign token request: %w", err)
+	}
+	assertion := unsigned + "." + base64.RawURLEncoding.EncodeToString(signature)
+
+	resp, err := client.PostForm(sa.tokenURI, url.Values{
+		"grant_type": {"urn:ietf:params:oauth:grant-type:jwt-bearer"},
+		"assertion":  {assertion},
+	})
+	if err != nil {
+		return "", time.Time{}, fmt.Errorf("token request failed: %w", err)
+	}
+	return decodeGCSToken(resp, now)
+}
+
+func (gcsMetadataServer) token(client *http.Client) (string, time.Time, error) {
+	now := time.Now()
+	req, err := http.NewRequest(http.MethodGet, gcsMetadataToken, nil)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	req.Header.Set("Metadata-Flavor", "Google")
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", time.Time{}, fmt.Errorf("metadata server token request failed: %w", err)
+	}
+	return decodeGCSToken(resp, now)
+}
+
+func decodeGCSToken(resp *http.Response, now time.Time) (string, time.Time, error) {
+	var token struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int64  `json:"expires_in"`
+	}
+	if err := decodeJSONResponse(resp, &token); err != nil {
+		return "", time.Time{}, fmt.Errorf("token request failed: %w", err)
+	}
+	return token.AccessToken, now.Add(time.Duration(token.ExpiresIn) * time.Second), nil
+}
+
+func (c *gcsCachedToken) token(client *http.Client) (string, time.Time, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.current != "" && time.Until(c.expiry) > time.Minute {
+		return c.current, c.expiry, nil
+	}
+	token, expiry, err := c.source.token(client)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	c.current, c.expiry = token, expiry
+	return token, expiry, nil
+}
+
+// invalidate drops a token the API rejected
+func (c *gcsCachedToken) invalidate() {
+	c.mu.Lock()
+	c.current = ""
+	c.mu.Unlock()
+}
+
+// check fails at startup rather than on the first upload if the bucket or
+// credentials are wrong
+func (g *GCSStorage) check() error {
+	resp, err := g.do(http.MethodGet, "/storage/v1/b/"+url.PathEscape(g.bucket), url.Values{"fields": {"name"}}, nil)
+	if err != nil {
+		return fmt.Errorf("failed to access bucket: %w", err)
+	}
+	var bucket struct{}
+	if err := decodeJSONResponse(resp, &bucket); err != nil {
+		return fmt.Errorf("failed to access bucket %s: %w", g.bucket, err)
+	}
+	return nil
+}
+
+// objectPath is the JSON API path of an artifact; the object name is a
+// single escaped path segment
+func (g *GCSStorage) objectPath(hash string) string {
+	return "/storage/v1/b/" + url.PathEscape(g.bucket) + "/o/" + url.PathEscape(g.prefix+hash)
+}
+
+// do sends an authorized request. Requests without a body are retried once
+// with a new token if the current one was rejected.
+func (g *GCSStorage) do(method, path string, query url.Values, body io.Reader) (*http.Response, error) {
+	for attempt := 0; ; attempt++ {
+		u := g.endpoint + path
+		if len(query) > 0 {
+			u += "?" + query.Encode()
+		}
+		req, err := http.NewRequest(method, u, body)
+		if err != nil {
+			return nil, err
+		}
+		if body != nil {
+			req.Header.Set("Content-Type", "application/octet-stream")
+		}
+		if g.tokens != nil {
+			token, _, err := g.tokens.token(g.client)
+			if err != nil {
+				return nil, err
+			}
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := g.client.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode == http.StatusUnauthorized && g.tokens != nil && body == nil && attempt == 0 {
+			resp.Body.Close()
+			g.tokens.invalidate()
+			continue
+		}
+		return resp, nil
+	}
+}
+
+func (g *GCSStorage) Store(hash string, data io.Reader) error {
+	query := url.Values{"uploadType": {"media"}, "name": {g.prefix + hash}}
+	resp, err := g.do(http.MethodPost, "/upload/storage/v1/b/"+url.PathEscape(g.bucket)+"/o", query, data)
+	if err != nil {
+		return fmt.Errorf("failed to upload object: %w", err)
+	}
+	var uploaded struct{}
+	if err := decodeJSONResponse(resp, &uploaded); err != nil {
+		return fmt.Errorf("failed to upload object: %w", err)
+	}
+	return nil
+}
+
+func (g *GCSStorage) Get(hash string) (io.ReadCloser, int64, error) {
+	resp, err := g.do(http.MethodGet, g.objectPath(hash), url.Values{"alt": {"media"}}, nil)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to download object: %w", err)
+	}
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return resp.Body, resp.ContentLength, nil
+	case http.StatusNotFound:
+		resp.Body.Close()
+		return nil, 0, errArtifactNotFound
+	default:
+		resp.Body.Close()
+		return nil, 0, fmt.Errorf("failed to download object: %s", resp.Status)
+	}
+}
+
+func (g *GCSStorage) Exists(hash string) (bool, error) {
+	resp, err := g.do(http.MethodGet, g.objectPath(hash), url.Values{"fields": {"name"}}, nil)
+	if err != nil {
+		return false, fmt.Errorf("failed to check object: %w", err)
+	}
+	resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return true, nil
+	case http.StatusNotFound:
+		return false, nil
+	default:
+		return false, fmt.Errorf("failed to check object: %s", resp.Status)
+	}
+}
+
+func (g *GCSStorage) Delete(hash string) error {
+	resp, err := g.do(http.MethodDelete, g.objectPath(hash), nil, nil)
+	if err != nil {
+		return fmt.Errorf("failed to delete object: %w", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusNotFound {
+		return fmt.Errorf("failed to delete object: %s", resp.Status)
+	}
+	return nil
+}
+
+// List pages through the objects directly under the prefix
+func (g *GCSStorage) List() ([]ArtifactStat, error) {
+	var artifacts []ArtifactStat
+	query := url.Values{
+		"prefix":    {g.prefix},
+		"delimiter": {"/"},
+		"fields":    {"items(name,size,updated),nextPageToken"},
+	}
+	for {
+		resp, err := g.do(http.MethodGet, "/storage/v1/b/"+url.PathEscape(g.bucket)+"/o", query, nil)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list bucket: %w", err)
+		}
+		var page struct {
+			Items []struct {
+				Name    string    `json:"name"`
+				Size    string    `json:"size"`
+				Updated time.Time `json:"updated"`
+			} `json:"items"`
+			NextPageToken string `json:"nextPageToken"`
+		}
+		if err := decodeJSONResponse(resp, &page); err != nil {
+			return nil, fmt.Errorf("failed to list bucket: %w", err)
+		}
+		for _, item := range page.Items {
+			hash := strings.TrimPrefix(item.Name, g.prefix)
+			if hash == "" || strings.HasPrefix(hash, ".") {
+				continue
+			}
+			size, _ := strconv.ParseInt(item.Size, 10, 64)
+			artifacts = append(artifacts, ArtifactStat{Hash: hash, Size: size, ModTime: item.Updated})
+		}
+		if page.NextPageToken == "" {
+			return artifacts, nil
+		}
+		query.Set("pageToken", page.NextPageToken)
+	}
+}
+
+// newGCSStorageFromEnv reads GCS_BUCKET, GCS_PREFIX, GCS_ENDPOINT and
+// GCS_CREDENTIALS: a service account key file, "metadata" for the metadata
+// server or "none"; it defaults to GOOGLE_APPLICATION_CREDENTIALS, else the
+// metadata server
+func newGCSStorageFromEnv(prefix string) (*GCSStorage, error) {
+	values, err := requireEnv(prefix + "GCS_BUCKET")
+	if err != nil {
+		return nil, err
+	}
+	var tokens gcsTokenSource
+	switch credentials := envString(prefix+"GCS_CREDENTIALS", getenv("GOOGLE_APPLICATION_CREDENTIALS")); credentials {
+	case "", "metadata":
+		tokens = gcsMetadataServer{}
+	case "none":
+	default:
+		if tokens, err = loadGCSServiceAccount(credentials); err != nil {
+			return nil, err
+		}
+	}
+	return NewGCSStorage(getenv(prefix+"GCS_ENDPOINT"), values[0], envString(prefix+"GCS_PREFIX", ""), tokens)
+}
@@ -1,3 +1,17 @@
 module github.com/bitechdev/go-turbo-cachesrv
 
 go 1.23.2
+
+require (
+	github.com/go-ldap/ldap/v3 v3.4.10
+	golang.org/x/crypto v0.31.0
+	golang.org/x/sys v0.28.0
+	lukechampine.com/blake3 v1.4.1
+)
+
+require (
+	github.com/Azure/go-ntlmssp v0.0.0-20221128193559-754e69321358 // indirect
+	github.com/go-asn1-ber/asn1-ber v1.5.7 // indirect
+	github.com/google/uuid v1.6.0 // indirect
+	github.com/klauspost/cpuid/v2 v2.0.9 // indirect
+)
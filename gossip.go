@@ -0,0 +1,155 @@
+package cachesrv
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const inventoryPath = "/v8/federation/inventory"
+
+// Gossip pulls the inventory of every peer at each interval, so misses only
+// probe peers that likely hold the artifact. A peer whose inventory can't be
+// fetched is probed as if it had everything. The peers' tombstones come
+// along, and apply is called with each one that is new here.
+func (f *Federation) Gossip(interval time.Duration, apply func(Tombstone), logger *log.Logger, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		for _, replica := range f.replicas {
+			inventory, err := f.fetchInventory(replica)
+			f.mu.Lock()
+			if err != nil {
+				delete(f.inventories, replica.URL)
+			} else {
+				f.inventories[replica.URL] = inventory
+			}
+			f.mu.Unlock()
+			if err != nil {
+				logger.Printf("Failed to fetch inventory of %s: %v", replica.URL, err)
+			}
+
+			received, err := f.fetchTombstones(replica)
+			if err != nil {
+				logger.Printf("Failed to fetch tombstones of %s: %v", replica.URL, err)
+				continue
+			}
+			fresh, err := f.tombstones.Merge(received, replica.URL, time.Now())
+			if err != nil {
+				logger.Printf("Failed to record tombstones of %s: %v", replica.URL, err)
+			}
+			for _, stone := range fresh {
+				apply(stone)
+			}
+		}
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+	}
+}
+
+func (f *Federation) fetchInventory(replica Replica) (*BloomFilter, error) {
+	resp, err := f.client.Get(f.presignPath(replica, http.MethodGet, inventoryPath, url.Values{}))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected response %s", resp.Status)
+	}
+	return ReadBloomFilter(resp.Body)
+}
+
+// inventory returns the last inventory received from a peer, or nil
+func (f *Federation) inventory(replica Replica) *BloomFilter {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.inventories[replica.URL]
+}
+
+// Handler for /v8/federation/inventory
+func (s *Server) getInventory(w http.ResponseWriter, r *http.Request) {
+	if s.federation == nil {
+		http.NotFound(w, r)
+		return
+	}
+	if !s.federation.VerifyPresigned(r) {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	filter, _ := s.summary.Filter(s.index, "")
+	w.Header().Set("Content-Type", "application/octet-stream")
+	if err := filter.Encode(w); err != nil {
+		s.logger.Printf("Failed to send inventory: %v", err)
+	}
+}
+
+// fetchFromPeer copies an artifact missing locally from the nearest peer
+// holding it, so later requests are served from this node
+func (s *Server) fetchFromPeer(r *http.Request, hash string) (err error) {
+	location, ok := s.federation.Locate(r, hash)
+	if !ok {
+		return errArtifactNotFound
+	}
+	ctx, span := s.tracer.Start(r.Context(), "peer fetch", spanClient)
+	span.SetAttr("turbo.artifact.hash", hash)
+	span.SetAttr("url.full", location[:strings.Index(location, "?")])
+	defer func() { span.End(err) }()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, location, nil)
+	if err != nil {
+		return fmt.Errorf("failed to fetch from peer: %w", err)
+	}
+	s.tracer.Inject(ctx, req.Header)
+	resp, err := s.federation.transfer.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to fetch from peer: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.ContentLength < 0 {
+		return fmt.Errorf("failed to fetch from peer: %s", resp.Status)
+	}
+	if s.maxArtifactSize > 0 && resp.ContentLength > s.maxArtifactSize {
+		return fmt.Errorf("failed to fetch from peer: %d bytes, limit is %d", resp.ContentLength, s.maxArtifactSize)
+	}
+
+	team := teamOf(r)
+	class := s.classFor(resp.ContentLength)
+	reservation, err := s.quotas.Reserve(team, hash, class.Name, resp.ContentLength)
+	if err != nil {
+		return err
+	}
+	defer reservation.Release()
+	s.index.StartUpload(hash)
+	defer s.index.FinishUpload(hash)
+
+	body := &countingReader{ReadCloser: resp.Body}
+	algorithm, digest := s.contentHash()
+	describeArtifact(class.Storage, hash, ArtifactDetails{Team: team})
+	err = class.Storage.Store(hash, io.TeeReader(body, digest))
+	if err == nil && body.n != resp.ContentLength {
+		class.Storage.Delete(hash)
+		err = errors.New("truncated response")
+	}
+	if err != nil {
+		return fmt.Errorf("failed to fetch from peer: %w", err)
+	}
+	s.index.Put(&ArtifactMeta{
+		Hash:      hash,
+		Size:      body.n,
+		Digest:    formatDigest(algorithm, digest),
+		Team:      team,
+		Class:     class.Name,
+		CreatedAt: s.index.clock.Now(),
+	})
+	if class.Evictor != nil {
+		class.Evictor.Notify()
+	}
+	return nil
+}
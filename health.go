@@ -0,0 +1,135 @@
+package cachesrv
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// readinessProbeHash is written, read back and deleted to check that storage
+// takes uploads
+const readinessProbeHash = "turbo-cache-readiness-probe"
+
+// readinessCacheFor is how long a probe result answers /readyz, so probes of
+// several kubelets and load balancers don't each write to storage
+const readinessCacheFor = 2 * time.Second
+
+// Readiness checks that the server can store artifacts and remembers the
+// outcome briefly
+type Readiness struct {
+	probe   func() error
+	timeout time.Duration
+	logger  *log.Logger
+
+	mu      sync.Mutex
+	checked time.Time
+	err     error
+}
+
+func NewReadiness(probe func() error, timeout time.Duration, logger *log.Logger) *Readiness {
+	return &Readiness{probe: probe, timeout: timeout, logger: logger}
+}
+
+// Check returns why the server isn't ready, or nil
+func (rd *Readiness) Check() error {
+	rd.mu.Lock()
+	defer rd.mu.Unlock()
+	if !rd.checked.IsZero() && time.Since(rd.checked) < readinessCacheFor {
+		return rd.err
+	}
+
+	done := make(chan error, 1)
+	go func() { done <- rd.probe() }()
+	var err error
+	select {
+	case err = <-done:
+	case <-time.After(rd.timeout):
+		// The probe goes on in the background; a hung volume is exactly
+		// what readiness should report
+		err = fmt.Errorf("no answer within %v", rd.timeout)
+	}
+
+	// Only changes are logged
+	if err != nil && rd.err == nil {
+		rd.logger.Printf("Readiness check failed: %v", err)
+	} else if err == nil && rd.err != nil {
+		rd.logger.Printf("Readiness check passed again")
+	}
+	rd.checked, rd.err = time.Now(), err
+	return err
+}
+
+// probeWritable stores, reads back and deletes a probe artifact on every
+// storage of the server and its tenants
+func (s *Server) probeWritable() error {
+	probed := make(map[Storage]bool)
+	for _, t := range append([]*Server{s}, s.tenants...) {
+		for _, class := range t.classes {
+			if probed[unwrapStorage(class.Storage)] {
+				continue
+			}
+			probed[unwrapStorage(class.Storage)] = true
+			// A replica only needs to read
+			if _, ok := class.Storage.(*ReadOnlyStorage); ok {
+				if _, err := class.Storage.Exists(readinessProbeHash); err != nil {
+					return fmt.Errorf("%s storage: %w", t.labelClass(class.Name), err)
+				}
+				continue
+			}
+			if err := writeProbe(class.Storage); err != nil {
+				return fmt.Errorf("%s storage: %w", t.labelClass(class.Name), err)
+			}
+		}
+	}
+	return nil
+}
+
+func writeProbe(st Storage) error {
+	content := []byte(time.Now().UTC().Format(time.RFC3339Nano))
+	if err := st.Store(readinessProbeHash, bytes.NewReader(content)); err != nil {
+		return fmt.Errorf("failed to write probe: %w", err)
+	}
+	defer st.Delete(readinessProbeHash)
+	reader, _, err := st.Get(readinessProbeHash)
+	if err != nil {
+		return fmt.Errorf("failed to read probe: %w", err)
+	}
+	defer reader.Close()
+	read, err := io.ReadAll(reader)
+	if err != nil {
+		return fmt.Errorf("failed to read probe: %w", err)
+	}
+	if !bytes.Equal(read, content) {
+		return errors.New("probe read back differs from what was written")
+	}
+	return nil
+}
+
+// labelClass names a tenant's size class in messages
+func (s *Server) labelClass(class string) string {
+	if s.tenant == "" {
+		return orDefault(class)
+	}
+	return s.tenant + "/" + orDefault(class)
+}
+
+// Handler for /healthz
+func (s *Server) getHealth(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Write([]byte("ok\n"))
+}
+
+// Handler for /readyz
+func (s *Server) getReadiness(w http.ResponseWriter, r *http.Request) {
+	if err := s.readiness.Check(); err != nil {
+		http.Error(w, "Not ready: "+err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Write([]byte("ok\n"))
+}
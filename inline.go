@@ -0,0 +1,109 @@
+package cachesrv
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// Artifacts up to TURBO_INLINE_ARTIFACT_SIZE are kept inside the metadata
+// index instead of a file each: their bytes are held in memory, saved with
+// the index snapshot and journaled like the rest of their metadata. A cache
+// of millions of 200 byte artifacts then needs no inodes for them, and
+// eviction and expiry delete them without touching the filesystem.
+
+// defaultInlineBudget bounds the memory inline artifacts take unless
+// TURBO_INLINE_CACHE_MAX_SIZE says otherwise
+const defaultInlineBudget = 64 << 20
+
+// InlineStorage is the storage of the inline size class
+type InlineStorage struct {
+	limit int64
+
+	mu    sync.RWMutex
+	blobs map[string]inlineBlob
+	// index journals the blobs; NewMetadataIndex sets it and loads the
+	// blobs it saved
+	index *MetadataIndex
+}
+
+type inlineBlob struct {
+	data   []byte
+	stored time.Time
+}
+
+func NewInlineStorage(limit int64) *InlineStorage {
+	return &InlineStorage{limit: limit, blobs: make(map[string]inlineBlob)}
+}
+
+func (s *InlineStorage) Store(hash string, data io.Reader) error {
+	blob, err := io.ReadAll(io.LimitReader(data, s.limit+1))
+	if err != nil {
+		return err
+	}
+	if int64(len(blob)) > s.limit {
+		return fmt.Errorf("artifact %s is larger than the inline limit of %s", hash, formatSize(s.limit))
+	}
+	s.mu.Lock()
+	s.blobs[hash] = inlineBlob{data: blob, stored: time.Now()}
+	s.mu.Unlock()
+	if s.index != nil {
+		s.index.journalBlob(journalRecord{Op: "blob", Hash: hash, Inline: blob})
+	}
+	return nil
+}
+
+func (s *InlineStorage) Get(hash string) (io.ReadCloser, int64, error) {
+	s.mu.RLock()
+	blob, ok := s.blobs[hash]
+	s.mu.RUnlock()
+	if !ok {
+		return nil, 0, errArtifactNotFound
+	}
+	return io.NopCloser(bytes.NewReader(blob.data)), int64(len(blob.data)), nil
+}
+
+func (s *InlineStorage) Exists(hash string) (bool, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	_, ok := s.blobs[hash]
+	return ok, nil
+}
+
+func (s *InlineStorage) Delete(hash string) error {
+	s.mu.Lock()
+	_, ok := s.blobs[hash]
+	delete(s.blobs, hash)
+	s.mu.Unlock()
+	if ok && s.index != nil {
+		s.index.journalBlob(journalRecord{Op: "deleteBlob", Hash: hash})
+	}
+	return nil
+}
+
+func (s *InlineStorage) List() ([]ArtifactStat, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	stats := make([]ArtifactStat, 0, len(s.blobs))
+	for hash, blob := range s.blobs {
+		stats = append(stats, ArtifactStat{Hash: hash, Size: int64(len(blob.data)), ModTime: blob.stored})
+	}
+	return stats, nil
+}
+
+// blob returns the bytes of an artifact for the index snapshot
+func (s *InlineStorage) blob(hash string) ([]byte, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	blob, ok := s.blobs[hash]
+	return blob.data, ok
+}
+
+// restore puts back a blob loaded with the index
+func (s *InlineStorage) restore(hash string, data []byte, stored time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.blobs[hash] = inlineBlob{data: data, stored: stored}
+}
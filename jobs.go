@@ -0,0 +1,336 @@
+package cachesrv
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Job states
+const (
+	jobQueued    = "queued"
+	jobRunning   = "running"
+	jobSucceeded = "succeeded"
+	jobFailed    = "failed"
+	jobCancelled = "cancelled"
+)
+
+const (
+	// maxJobLogLines caps the log kept per job; older lines are dropped
+	maxJobLogLines = 1000
+	// maxFinishedJobs is how many finished jobs are kept for inspection
+	maxFinishedJobs = 100
+)
+
+var (
+	errJobNotFound  = errors.New("job not found")
+	errJobQueueFull = errors.New("job queue is full")
+	errJobFinished  = errors.New("job already finished")
+)
+
+// JobStatus is the state of a background admin operation
+type JobStatus struct {
+	ID         string     `json:"id"`
+	Kind       string     `json:"kind"`
+	Status     string     `json:"status"`
+	CreatedAt  time.Time  `json:"createdAt"`
+	StartedAt  *time.Time `json:"startedAt,omitempty"`
+	FinishedAt *time.Time `json:"finishedAt,omitempty"`
+	Done       int64      `json:"done"`
+	Total      int64      `json:"total"`
+	Error      string     `json:"error,omitempty"`
+	Result     any        `json:"result,omitempty"`
+	Log        []string   `json:"log,omitempty"`
+}
+
+// JobFunc is the work of a job; it reports progress through the job and
+// stops when the context is cancelled
+type JobFunc func(ctx context.Context, job *Job) (any, error)
+
+// Job is one queued or running admin operation. Long operations take a
+// *Job to report progress on; a nil Job reports nothing.
+type Job struct {
+	fn     JobFunc
+	ctx    context.Context
+	cancel context.CancelFunc
+	logger *log.Logger
+
+	mu     sync.Mutex
+	status JobStatus
+}
+
+// AddTotal grows the amount of work the job expects
+func (j *Job) AddTotal(n int) {
+	if j == nil {
+		return
+	}
+	j.mu.Lock()
+	j.status.Total += int64(n)
+	j.mu.Unlock()
+}
+
+// Advance records finished work
+func (j *Job) Advance(n int) {
+	if j == nil {
+		return
+	}
+	j.mu.Lock()
+	j.status.Done += int64(n)
+	j.mu.Unlock()
+}
+
+// Logf adds a line to the job's log and the server log
+func (j *Job) Logf(format string, args ...any) {
+	if j == nil {
+		return
+	}
+	line := fmt.Sprintf(format, args...)
+	j.logger.Printf("Job %s: %s", j.status.ID, line)
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.status.Log = append(j.status.Log, time.Now().UTC().Format(time.RFC3339)+" "+line)
+	if len(j.status.Log) > maxJobLogLines {
+		j.status.Log = j.status.Log[len(j.status.Log)-maxJobLogLines:]
+	}
+}
+
+func (j *Job) snapshot(withLog bool) JobStatus {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	status := j.status
+	if withLog {
+		status.Log = append([]string(nil), j.status.Log...)
+	} else {
+		status.Log = nil
+	}
+	return status
+}
+
+// finish moves the job into a final state unless it already is in one
+func (j *Job) finish(state string, result any, err error) bool {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.status.Status != jobQueued && j.status.Status != jobRunning {
+		return false
+	}
+	now := time.Now().UTC()
+	j.status.Status = state
+	j.status.FinishedAt = &now
+	j.status.Result = result
+	if err != nil {
+		j.status.Error = err.Error()
+	}
+	return true
+}
+
+// JobQueue runs admin operations in the background on a fixed number of
+// workers. Jobs live in memory; a restart forgets them.
+type JobQueue struct {
+	queue  chan *Job
+	logger *log.Logger
+
+	mu   sync.Mutex
+	jobs map[string]*Job
+	// finished holds the IDs of finished jobs, oldest first
+	finished []string
+}
+
+func NewJobQueue(workers, size int, logger *log.Logger) *JobQueue {
+	q := &JobQueue{
+		queue:  make(chan *Job, size),
+		logger: logger,
+		jobs:   make(map[string]*Job),
+	}
+	for i := 0; i < max(workers, 1); i++ {
+		go q.work()
+	}
+	return q
+}
+
+// Pending returns the number of jobs waiting for a worker and how many fit
+func (q *JobQueue) Pending() (int, int) {
+	return len(q.queue), cap(q.queue)
+}
+
+// Submit queues a job and returns its initial status
+func (q *JobQueue) Submit(kind string, fn JobFunc) (JobStatus, error) {
+	id, err := randomHex(8)
+	if err != nil {
+		return JobStatus{}, err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	job := &Job{
+		fn:     fn,
+		ctx:    ctx,
+		cancel: cancel,
+		logger: q.logger,
+		status: JobStatus{ID: id, Kind: kind, Status: jobQueued, CreatedAt: time.Now().UTC()},
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	select {
+	case q.queue <- job:
+	default:
+		cancel()
+		return JobStatus{}, errJobQueueFull
+	}
+	q.jobs[id] = job
+	return job.snapshot(false), nil
+}
+
+func (q *JobQueue) work() {
+	for job := range q.queue {
+		q.run(job)
+	}
+}
+
+func (q *JobQueue) run(job *Job) {
+	defer job.cancel()
+	job.mu.Lock()
+	if job.status.Status != jobQueued {
+		// Cancelled while waiting
+		job.mu.Unlock()
+		return
+	}
+	now := time.Now().UTC()
+	job.status.Status = jobRunning
+	job.status.StartedAt = &now
+	job.mu.Unlock()
+
+	result, err := job.fn(job.ctx, job)
+	state := jobSucceeded
+	switch {
+	case job.ctx.Err() != nil:
+		state, err = jobCancelled, nil
+	case err != nil:
+		job.Logf("failed: %v", err)
+		state = jobFailed
+	}
+	if job.finish(state, result, err) {
+		q.retire(job)
+	}
+}
+
+// retire keeps the job for inspection, forgetting the oldest finished jobs
+func (q *JobQueue) retire(job *Job) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.finished = append(q.finished, job.status.ID)
+	for len(q.finished) > maxFinishedJobs {
+		delete(q.jobs, q.finished[0])
+		q.finished = q.finished[1:]
+	}
+}
+
+// Get returns a job's status including its log
+func (q *JobQueue) Get(id string) (JobStatus, error) {
+	q.mu.Lock()
+	job, ok := q.jobs[id]
+	q.mu.Unlock()
+	if !ok {
+		return JobStatus{}, errJobNotFound
+	}
+	return job.snapshot(true), nil
+}
+
+// List returns every known job without logs
+func (q *JobQueue) List() []JobStatus {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	list := make([]JobStatus, 0, len(q.jobs))
+	for _, job := range q.jobs {
+		list = append(list, job.snapshot(false))
+	}
+	return list
+}
+
+// Cancel stops a running job or drops a queued one
+func (q *JobQueue) Cancel(id string) (JobStatus, error) {
+	q.mu.Lock()
+	job, ok := q.jobs[id]
+	q.mu.Unlock()
+	if !ok {
+		return JobStatus{}, errJobNotFound
+	}
+
+	job.mu.Lock()
+	state := job.status.Status
+	job.mu.Unlock()
+	switch state {
+	case jobQueued:
+		// The job may just have started, so stop it as well
+		job.cancel()
+		if job.finish(jobCancelled, nil, nil) {
+			q.retire(job)
+		}
+	case jobRunning:
+		job.Logf("cancelled")
+		job.cancel()
+	default:
+		return job.snapshot(false), errJobFinished
+	}
+	return job.snapshot(false), nil
+}
+
+// startJob submits fn as a job and answers 202 with its status, for
+// endpoints that take async=true
+func (s *Server) startJob(w http.ResponseWriter, kind string, fn JobFunc) {
+	status, err := s.jobs.Submit(kind, fn)
+	if errors.Is(err, errJobQueueFull) {
+		http.Error(w, "Job queue is full", http.StatusServiceUnavailable)
+		return
+	}
+	if err != nil {
+		s.logger.Printf("Failed to queue %s job: %v", kind, err)
+		http.Error(w, "Failed to queue job", http.StatusInternalServerError)
+		return
+	}
+	s.logger.Printf("Job %s queued: %s", status.ID, kind)
+	w.Header().Set("Location", "/admin/jobs/"+status.ID)
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(status)
+}
+
+func asyncRequested(r *http.Request) bool {
+	return r.URL.Query().Get("async") == "true"
+}
+
+// Handler for /admin/jobs
+func (s *Server) listJobs(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	s.writeList(w, r, s.jobs.List(), "-createdAt", "id")
+}
+
+// Handler for /admin/jobs/{id}
+func (s *Server) handleJob(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, "/admin/jobs/")
+	var status JobStatus
+	var err error
+	switch r.Method {
+	case http.MethodGet:
+		status, err = s.jobs.Get(id)
+	case http.MethodDelete:
+		status, err = s.jobs.Cancel(id)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	switch {
+	case errors.Is(err, errJobNotFound):
+		http.Error(w, "Job not found", http.StatusNotFound)
+	case errors.Is(err, errJobFinished):
+		http.Error(w, "Job already finished", http.StatusConflict)
+	default:
+		json.NewEncoder(w).Encode(status)
+	}
+}
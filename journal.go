@@ -0,0 +1,178 @@
+package cachesrv
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// The metadata index is snapshotted every few seconds; with the journal
+// enabled every change in between is also appended to a write-ahead log, so a
+// crash loses no team attribution, tags or hit counts. Each snapshot starts a
+// new journal generation (index.json.wal.<n>) and removes the generations it
+// covers once written. Records carry the full entry, so replaying a generation
+// that a snapshot already contains is harmless. Inline artifacts journal their
+// bytes in a blob record when stored, before the put of their entry.
+
+type journalRecord struct {
+	Op   string        `json:"op"`
+	Meta *ArtifactMeta `json:"meta,omitempty"`
+	Hash string        `json:"hash,omitempty"`
+	// Inline holds the bytes of an inline artifact in blob records
+	Inline []byte `json:"inline,omitempty"`
+}
+
+// journalGenerations lists the journal generations next to an index, oldest first
+func journalGenerations(path string) ([]int, error) {
+	matches, err := filepath.Glob(path + ".wal.*")
+	if err != nil {
+		return nil, err
+	}
+	var gens []int
+	for _, match := range matches {
+		gen, err := strconv.Atoi(strings.TrimPrefix(match, path+".wal."))
+		if err == nil {
+			gens = append(gens, gen)
+		}
+	}
+	sort.Ints(gens)
+	return gens, nil
+}
+
+func journalPath(path string, gen int) string {
+	return fmt.Sprintf("%s.wal.%d", path, gen)
+}
+
+// replayJournal applies every journal generation to the loaded entries and
+// returns the number of records applied and the next free generation. A torn
+// record at the end of a generation, left by a crash mid-write, ends its replay.
+func (idx *MetadataIndex) replayJournal(known map[string]*ArtifactMeta, blobs map[string][]byte) (int, int, error) {
+	gens, err := journalGenerations(idx.path)
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to list metadata journal: %w", err)
+	}
+	applied, next := 0, 1
+	for _, gen := range gens {
+		next = gen + 1
+		f, err := os.Open(journalPath(idx.path, gen))
+		if err != nil {
+			return 0, 0, fmt.Errorf("failed to read metadata journal: %w", err)
+		}
+		scanner := bufio.NewScanner(f)
+		scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+		for scanner.Scan() {
+			var rec journalRecord
+			if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+				idx.logger.Printf("Ignoring torn record at the end of %s", f.Name())
+				break
+			}
+			switch rec.Op {
+			case "put":
+				if rec.Meta != nil {
+					known[rec.Meta.Hash] = rec.Meta
+				}
+			case "delete":
+				delete(known, rec.Hash)
+			case "blob":
+				blobs[rec.Hash] = rec.Inline
+			case "deleteBlob":
+				delete(blobs, rec.Hash)
+			}
+			applied++
+		}
+		err = scanner.Err()
+		f.Close()
+		if err != nil {
+			return 0, 0, fmt.Errorf("failed to read metadata journal: %w", err)
+		}
+	}
+	return applied, next, nil
+}
+
+// EnableJournal starts logging every change to the write-ahead journal
+func (idx *MetadataIndex) EnableJournal() error {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	return idx.openJournal()
+}
+
+// openJournal starts the current journal generation; callers must hold the lock
+func (idx *MetadataIndex) openJournal() error {
+	f, err := os.OpenFile(journalPath(idx.path, idx.journalGen), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open metadata journal: %w", err)
+	}
+	idx.journal = f
+	return nil
+}
+
+// rotateJournal moves on to the next generation before a snapshot and returns
+// the first generation the snapshot doesn't cover; callers must hold the lock
+func (idx *MetadataIndex) rotateJournal() int {
+	if idx.journal == nil {
+		return idx.journalGen
+	}
+	idx.journal.Close()
+	idx.journalGen++
+	if err := idx.openJournal(); err != nil {
+		idx.logger.Printf("Metadata journal disabled: %v", err)
+		idx.journal = nil
+	}
+	return idx.journalGen
+}
+
+// pruneJournal removes the generations before keep once a snapshot holds them
+func (idx *MetadataIndex) pruneJournal(keep int) {
+	gens, err := journalGenerations(idx.path)
+	if err != nil {
+		return
+	}
+	for _, gen := range gens {
+		if gen < keep {
+			os.Remove(journalPath(idx.path, gen))
+		}
+	}
+}
+
+// record appends a change to the journal; callers must hold the lock. Uploads
+// and deletions are synced to disk, access updates are not: losing the last
+// few hit counts in a power failure is harmless.
+func (idx *MetadataIndex) record(rec journalRecord, sync bool) {
+	if idx.journal == nil {
+		return
+	}
+	data, err := json.Marshal(rec)
+	if err != nil {
+		idx.logger.Printf("Failed to encode metadata journal record: %v", err)
+		return
+	}
+	if _, err := idx.journal.Write(append(data, '\n')); err != nil {
+		idx.logger.Printf("Failed to write metadata journal: %v", err)
+		return
+	}
+	if sync {
+		if err := idx.journal.Sync(); err != nil {
+			idx.logger.Printf("Failed to sync metadata journal: %v", err)
+		}
+	}
+}
+
+// journalBlob records the bytes of an inline artifact or their deletion
+func (idx *MetadataIndex) journalBlob(rec journalRecord) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	idx.record(rec, true)
+}
+
+// journalFromEnv enables the journal of an index if TURBO_METADATA_WAL is set
+func journalFromEnv(idx *MetadataIndex) error {
+	if getenv("TURBO_METADATA_WAL") != "true" {
+		return nil
+	}
+	return idx.EnableJournal()
+}
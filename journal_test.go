@@ -0,0 +1,112 @@
+package cachesrv
+
+import (
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bitechdev/go-turbo-cachesrv/storage"
+)
+
+// newJournaledIndex opens the index of dir with the journal enabled
+func newJournaledIndex(t *testing.T, dir string, fs *storage.FileSystem) *MetadataIndex {
+	t.Helper()
+	idx, err := NewMetadataIndex(filepath.Join(dir, ".meta", "index.json"), map[string]Storage{defaultClass: fs}, log.New(io.Discard, "", 0))
+	if err != nil {
+		t.Fatalf("NewMetadataIndex: %v", err)
+	}
+	if err := idx.EnableJournal(); err != nil {
+		t.Fatalf("EnableJournal: %v", err)
+	}
+	return idx
+}
+
+func storeArtifact(t *testing.T, fs *storage.FileSystem, idx *MetadataIndex, m ArtifactMeta) {
+	t.Helper()
+	if err := fs.Store(m.Hash, strings.NewReader(strings.Repeat("x", int(m.Size)))); err != nil {
+		t.Fatalf("Store %s: %v", m.Hash, err)
+	}
+	m.Class = defaultClass
+	idx.Put(&m)
+}
+
+func TestJournalReplayAfterCrash(t *testing.T) {
+	dir := t.TempDir()
+	fs, err := storage.NewFileSystem(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	retain := time.Now().Add(time.Hour).UTC().Truncate(time.Second)
+
+	idx := newJournaledIndex(t, dir, fs)
+	storeArtifact(t, fs, idx, ArtifactMeta{Hash: "aaaa", Size: 3, Team: "web", Tags: []string{"release"}})
+	storeArtifact(t, fs, idx, ArtifactMeta{Hash: "bbbb", Size: 4, Team: "api"})
+	if err := idx.Save(); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+	// Changes after the last snapshot are only in the journal
+	storeArtifact(t, fs, idx, ArtifactMeta{Hash: "cccc", Size: 5, Team: "web", RetainUntil: retain})
+	storeArtifact(t, fs, idx, ArtifactMeta{Hash: "aaaa", Size: 3, Team: "web", Tags: []string{"release", "v2"}})
+	idx.Touch("bbbb")
+	idx.Delete("bbbb")
+	if err := fs.Delete("bbbb"); err != nil {
+		t.Fatal(err)
+	}
+	// The crash tears the record being written
+	idx.journal.Write([]byte(`{"op":"put","meta":{"hash":"dd`))
+	idx.journal.Close()
+
+	gens, err := journalGenerations(idx.path)
+	if err != nil || len(gens) != 1 {
+		t.Fatalf("journal generations after a snapshot = %v, %v, want only the current one", gens, err)
+	}
+
+	replayed := newJournaledIndex(t, dir, fs)
+	defer replayed.journal.Close()
+	tests := []struct {
+		hash   string
+		found  bool
+		team   string
+		tags   []string
+		retain time.Time
+	}{
+		{"aaaa", true, "web", []string{"release", "v2"}, time.Time{}},
+		{"bbbb", false, "", nil, time.Time{}},
+		{"cccc", true, "web", nil, retain},
+		{"dddd", false, "", nil, time.Time{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.hash, func(t *testing.T) {
+			m, found := replayed.Get(tt.hash)
+			if found != tt.found {
+				t.Fatalf("found = %v, want %v", found, tt.found)
+			}
+			if !found {
+				return
+			}
+			if m.Team != tt.team || !slices.Equal(m.Tags, tt.tags) || !m.RetainUntil.Equal(tt.retain) {
+				t.Errorf("replayed %+v, want team %q, tags %q, retain until %v", m, tt.team, tt.tags, tt.retain)
+			}
+		})
+	}
+	if used := replayed.TeamUsage("web"); used != 8 {
+		t.Errorf("web usage = %d, want 8", used)
+	}
+
+	// The next snapshot covers the replayed journal, which can then go
+	if err := replayed.Save(); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+	gens, _ = journalGenerations(replayed.path)
+	if len(gens) != 1 || gens[0] != replayed.journalGen {
+		t.Errorf("journal generations = %v, want only %d", gens, replayed.journalGen)
+	}
+	if _, err := os.Stat(replayed.path); err != nil {
+		t.Errorf("snapshot: %v", err)
+	}
+}
@@ -0,0 +1,445 @@
+package cachesrv
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+// With TURBO_JWT_ISSUER the server also accepts JWTs signed by an OpenID
+// Connect issuer, such as the ID tokens GitHub Actions or Keycloak hand to CI
+// jobs, in place of a token from the tokens file. The job then needs no
+// long-lived secret: it asks its issuer for a token with the server's
+// audience and sends it as its bearer token. Claims decide which tokens are
+// accepted, which team a token is for and whether it may write.
+
+var errInvalidJWT = errors.New("invalid JWT")
+
+// jwksMinRefresh keeps tokens with unknown key IDs from fetching the
+// issuer's keys on every request
+const jwksMinRefresh = time.Minute
+
+// jwtID is the Token.ID of every JWT, so their usage adds up in one place
+const jwtID = "jwt"
+
+// ClaimRule requires each claim to match one of its path.Match patterns
+type ClaimRule map[string][]string
+
+// parseClaimRule reads claim=pattern pairs separated by commas
+func parseClaimRule(name, raw string) (ClaimRule, error) {
+	if raw == "" {
+		return nil, nil
+	}
+	rule := make(ClaimRule)
+	for _, entry := range strings.Split(raw, ",") {
+		claim, pattern, ok := strings.Cut(strings.TrimSpace(entry), "=")
+		if !ok || claim == "" {
+			return nil, fmt.Errorf("invalid %s entry %q (expected claim=pattern)", name, entry)
+		}
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid pattern in %s entry %q: %w", name, entry, err)
+		}
+		rule[claim] = append(rule[claim], pattern)
+	}
+	return rule, nil
+}
+
+func (rule ClaimRule) Matches(claims map[string]any) bool {
+	for claim, patterns := range rule {
+		value, ok := claimString(claims, claim)
+		if !ok || !matchesAny(patterns, value) {
+			return false
+		}
+	}
+	return true
+}
+
+func matchesAny(patterns []string, value string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, value); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// claimString returns a claim that is a string, number or boolean as text
+func claimString(claims map[string]any, name string) (string, bool) {
+	switch v := claims[name].(type) {
+	case string:
+		return v, true
+	case float64, bool:
+		return fmt.Sprint(v), true
+	}
+	return "", false
+}
+
+// JWTVerifier checks JWTs against the keys of an issuer and turns their
+// claims into a Token
+type JWTVerifier struct {
+	issuer   string
+	audience string
+	jwksURL  string
+	leeway   time.Duration
+	// claims must match for a JWT to be accepted
+	claims ClaimRule
+	// writeClaims, when set, must also match for a JWT to write; other
+	// JWTs are read-only
+	writeClaims ClaimRule
+	teamClaim   string
+	// teams maps values of teamClaim to teams; unmapped values are refused
+	// when it is set
+	teams  map[string]string
+	client *http.Client
+	logger *log.Logger
+
+	mu      sync.Mutex
+	keys    map[string]crypto.PublicKey
+	fetched time.Time
+}
+
+// jwtVerifierFromEnv returns nil when TURBO_JWT_ISSUER is not set
+func jwtVerifierFromEnv(logger *log.Logger) (*JWTVerifier, error) {
+	issuer := getenv("TURBO_JWT_ISSUER")
+	if issuer == "" {
+		return nil, nil
+	}
+	v := &JWTVerifier{
+		issuer:    issuer,
+		audience:  getenv("TURBO_JWT_AUDIENCE"),
+		jwksURL:   getenv("TURBO_JWT_JWKS_URL"),
+		teamClaim: getenv("TURBO_JWT_TEAM_CLAIM"),
+		client:    &http.Client{Timeout: 10 * time.Second},
+		logger:    logger,
+	}
+	if v.audience == "" {
+		return nil, fmt.Errorf("TURBO_JWT_AUDIENCE is required with TURBO_JWT_ISSUER")
+	}
+	var err error
+	if v.leeway, err = envDuration("TURBO_JWT_LEEWAY", time.Minute); err != nil {
+		return nil, err
+	}
+	if v.claims, err = parseClaimRule("TURBO_JWT_CLAIMS", getenv("TURBO_JWT_CLAIMS")); err != nil {
+		return nil, err
+	}
+	if v.writeClaims, err = parseClaimRule("TURBO_JWT_WRITE_CLAIMS", getenv("TURBO_JWT_WRITE_CLAIMS")); err != nil {
+		return nil, err
+	}
+	if raw := getenv("TURBO_JWT_TEAMS"); raw != "" {
+		if v.teamClaim == "" {
+			return nil, fmt.Errorf("TURBO_JWT_TEAMS needs TURBO_JWT_TEAM_CLAIM")
+		}
+		v.teams = make(map[string]string)
+		for _, entry := range strings.Split(raw, ",") {
+			value, team, ok := strings.Cut(strings.TrimSpace(entry), "=")
+			if !ok || value == "" || team == "" {
+				return nil, fmt.Errorf("invalid TURBO_JWT_TEAMS entry %q (expected value=team)", entry)
+			}
+			v.teams[value] = team
+		}
+	}
+	// Issuers such as GitHub sign tokens for any audience their users ask
+	// for, so the audience alone doesn't say whose jobs they are
+	if len(v.claims) == 0 && v.teams == nil {
+		return nil, fmt.Errorf("TURBO_JWT_CLAIMS or TURBO_JWT_TEAMS is required to say whose JWTs are accepted")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if v.jwksURL == "" {
+		if v.jwksURL, err = v.discover(ctx); err != nil {
+			return nil, err
+		}
+	}
+	if err := v.refresh(ctx); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+// discover looks the issuer's key set up in its OpenID configuration
+func (v *JWTVerifier) discover(ctx context.Context) (string, error) {
+	var discovery struct {
+		JWKSURI string `json:"jwks_uri"`
+	}
+	wellKnown := strings.TrimSuffix(v.issuer, "/") + "/.well-known/openid-configuration"
+	if err := v.getJSON(ctx, wellKnown, &discovery); err != nil {
+		return "", fmt.Errorf("failed to load OIDC discovery document: %w", err)
+	}
+	if discovery.JWKSURI == "" {
+		return "", fmt.Errorf("OIDC discovery document of %s has no jwks_uri", v.issuer)
+	}
+	return discovery.JWKSURI, nil
+}
+
+func (v *JWTVerifier) getJSON(ctx context.Context, rawURL string, out any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, rawURL, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	resp, err := v.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %d from %s", resp.StatusCode, rawURL)
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// refresh fetches the issuer's signing keys
+func (v *JWTVerifier) refresh(ctx context.Context) error {
+	var set struct {
+		Keys []json.RawMessage `json:"keys"`
+	}
+	if err := v.getJSON(ctx, v.jwksURL, &set); err != nil {
+		return fmt.Errorf("failed to load JWKS: %w", err)
+	}
+	keys := make(map[string]crypto.PublicKey, len(set.Keys))
+	for _, raw := range set.Keys {
+		kid, key, err := parseJWK(raw)
+		if err != nil {
+			// Keys of other types or uses don't stop the rest from working
+			v.logger.Printf("Ignoring key %q of %s: %v", kid, v.jwksURL, err)
+			continue
+		}
+		keys[kid] = key
+	}
+	v.mu.Lock()
+	v.keys = keys
+	v.fetched = time.Now()
+	v.mu.Unlock()
+	return nil
+}
+
+func parseJWK(raw json.RawMessage) (string, crypto.PublicKey, error) {
+	var jwk struct {
+		Kid string `json:"kid"`
+		Kty string `json:"kty"`
+		Use string `json:"use"`
+		N   string `json:"n"`
+		E   string `json:"e"`
+		Crv string `json:"crv"`
+		X   string `json:"x"`
+		Y   string `json:"y"`
+	}
+	if err := json.Unmarshal(raw, &jwk); err != nil {
+		return "", nil, err
+	}
+	if jwk.Use != "" && jwk.Use != "sig" {
+		return jwk.Kid, nil, fmt.Errorf("key is for %q", jwk.Use)
+	}
+	decode := func(s string) *big.Int {
+		b, err := base64.RawURLEncoding.DecodeString(s)
+		if err != nil || len(b) == 0 {
+			return nil
+		}
+		return new(big.Int).SetBytes(b)
+	}
+	switch jwk.Kty {
+	case "RSA":
+		n, e := decode(jwk.N), decode(jwk.E)
+		if n == nil || e == nil || !e.IsInt64() {
+			return jwk.Kid, nil, errors.New("invalid RSA key")
+		}
+		return jwk.Kid, &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch jwk.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		default:
+			return jwk.Kid, nil, fmt.Errorf("unsupported curve %q", jwk.Crv)
+		}
+		x, y := decode(jwk.X), decode(jwk.Y)
+		if x == nil || y == nil {
+			return jwk.Kid, nil, errors.New("invalid EC key")
+		}
+		return jwk.Kid, &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	}
+	return jwk.Kid, nil, fmt.Errorf("unsupported key type %q", jwk.Kty)
+}
+
+// key returns the signing key with an ID, fetching the keys again if it is
+// unknown, as issuers rotate them
+func (v *JWTVerifier) key(ctx context.Context, kid string) (crypto.PublicKey, error) {
+	v.mu.Lock()
+	key, ok := v.keys[kid]
+	stale := !ok && time.Since(v.fetched) >= jwksMinRefresh
+	if stale {
+		v.fetched = time.Now()
+	}
+	v.mu.Unlock()
+	if ok {
+		return key, nil
+	}
+	if stale {
+		if err := v.refresh(ctx); err != nil {
+			v.logger.Printf("Failed to refresh the keys of %s: %v", v.issuer, err)
+		}
+		v.mu.Lock()
+		key, ok = v.keys[kid]
+		v.mu.Unlock()
+		if ok {
+			return key, nil
+		}
+	}
+	return nil, fmt.Errorf("%w: unknown key %q", errInvalidJWT, kid)
+}
+
+// isJWT tells a JWT from an opaque token by its shape
+func isJWT(value string) bool {
+	return strings.HasPrefix(value, "eyJ") && strings.Count(value, ".") == 2
+}
+
+// Verify checks a JWT's signature and claims and returns the token it
+// stands for
+func (v *JWTVerifier) Verify(ctx context.Context, value string) (*Token, error) {
+	parts := strings.Split(value, ".")
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, fmt.Errorf("%w: bad header", errInvalidJWT)
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("%w: bad signature", errInvalidJWT)
+	}
+	key, err := v.key(ctx, header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	if err := verifySignature(header.Alg, key, parts[0]+"."+parts[1], signature); err != nil {
+		return nil, fmt.Errorf("%w: %v", errInvalidJWT, err)
+	}
+
+	var claims map[string]any
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, fmt.Errorf("%w: bad claims", errInvalidJWT)
+	}
+	if err := v.checkClaims(claims, time.Now()); err != nil {
+		return nil, err
+	}
+	sub, _ := claimString(claims, "sub")
+	token := &Token{ID: jwtID, Name: "jwt:" + sub, Scope: scopeReadWrite}
+	if exp, ok := claims["exp"].(float64); ok {
+		expires := time.Unix(int64(exp), 0)
+		token.ExpiresAt = &expires
+	}
+	if v.writeClaims != nil && !v.writeClaims.Matches(claims) {
+		token.Scope = scopeRead
+	}
+	if v.teamClaim != "" {
+		value, _ := claimString(claims, v.teamClaim)
+		team := value
+		if v.teams != nil {
+			team = v.teams[value]
+		}
+		if team == "" {
+			return nil, fmt.Errorf("%w: no team for %s %q", errInvalidJWT, v.teamClaim, value)
+		}
+		token.Teams = []string{team}
+	}
+	return token, nil
+}
+
+func (v *JWTVerifier) checkClaims(claims map[string]any, now time.Time) error {
+	if iss, _ := claims["iss"].(string); iss != v.issuer {
+		return fmt.Errorf("%w: issuer %q", errInvalidJWT, iss)
+	}
+	if !audienceHas(claims["aud"], v.audience) {
+		return fmt.Errorf("%w: audience is not %q", errInvalidJWT, v.audience)
+	}
+	exp, ok := claims["exp"].(float64)
+	if !ok {
+		return fmt.Errorf("%w: no expiry", errInvalidJWT)
+	}
+	if now.After(time.Unix(int64(exp), 0).Add(v.leeway)) {
+		return fmt.Errorf("%w: expired", errInvalidJWT)
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && now.Add(v.leeway).Before(time.Unix(int64(nbf), 0)) {
+		return fmt.Errorf("%w: not valid yet", errInvalidJWT)
+	}
+	if !v.claims.Matches(claims) {
+		return fmt.Errorf("%w: claims not accepted", errInvalidJWT)
+	}
+	return nil
+}
+
+func audienceHas(aud any, audience string) bool {
+	switch aud := aud.(type) {
+	case string:
+		return aud == audience
+	case []any:
+		for _, a := range aud {
+			if a == audience {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func decodeSegment(segment string, v any) error {
+	b, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+func verifySignature(alg string, key crypto.PublicKey, signed string, signature []byte) error {
+	var hash crypto.Hash
+	switch alg[min(2, len(alg)):] {
+	case "256":
+		hash = crypto.SHA256
+	case "384":
+		hash = crypto.SHA384
+	case "512":
+		hash = crypto.SHA512
+	default:
+		return fmt.Errorf("unsupported algorithm %q", alg)
+	}
+	h := hash.New()
+	h.Write([]byte(signed))
+	digest := h.Sum(nil)
+
+	switch key := key.(type) {
+	case *rsa.PublicKey:
+		if !strings.HasPrefix(alg, "RS") {
+			return fmt.Errorf("algorithm %q does not fit an RSA key", alg)
+		}
+		return rsa.VerifyPKCS1v15(key, hash, digest, signature)
+	case *ecdsa.PublicKey:
+		size := (key.Curve.Params().BitSize + 7) / 8
+		if !strings.HasPrefix(alg, "ES") || len(signature) != 2*size {
+			return fmt.Errorf("algorithm %q does not fit an EC key", alg)
+		}
+		r := new(big.Int).SetBytes(signature[:size])
+		s := new(big.Int).SetBytes(signature[size:])
+		if !ecdsa.Verify(key, digest, r, s) {
+			return errors.New("signature mismatch")
+		}
+		return nil
+	}
+	return fmt.Errorf("unsupported key type %T", key)
+}
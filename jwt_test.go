@@ -0,0 +1,196 @@
+package cachesrv
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+	"time"
+)
+
+// signJWT signs claims with an ES256 key
+func signJWT(t *testing.T, key *ecdsa.PrivateKey, header, claims map[string]any) string {
+	t.Helper()
+	segment := func(v any) string {
+		data, err := json.Marshal(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return base64.RawURLEncoding.EncodeToString(data)
+	}
+	signed := segment(header) + "." + segment(claims)
+	digest := sha256.Sum256([]byte(signed))
+	r, s, err := ecdsa.Sign(rand.Reader, key, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	signature := make([]byte, 64)
+	r.FillBytes(signature[:32])
+	s.FillBytes(signature[32:])
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func TestClaimRule(t *testing.T) {
+	rule, err := parseClaimRule("TURBO_JWT_CLAIMS", "repository_owner=acme, repository=acme/web,repository=acme/api-*,run_attempt=1")
+	if err != nil {
+		t.Fatalf("parseClaimRule: %v", err)
+	}
+	tests := []struct {
+		name   string
+		claims map[string]any
+		want   bool
+	}{
+		{"every claim matches", map[string]any{"repository_owner": "acme", "repository": "acme/web", "run_attempt": float64(1)}, true},
+		{"second pattern of a claim", map[string]any{"repository_owner": "acme", "repository": "acme/api-gateway", "run_attempt": float64(1)}, true},
+		{"one claim doesn't match", map[string]any{"repository_owner": "acme", "repository": "acme/docs", "run_attempt": float64(1)}, false},
+		{"pattern doesn't cross slashes", map[string]any{"repository_owner": "acme", "repository": "acme/api-x/y", "run_attempt": float64(1)}, false},
+		{"missing claim", map[string]any{"repository_owner": "acme", "repository": "acme/web"}, false},
+		{"claim of another type", map[string]any{"repository_owner": []any{"acme"}, "repository": "acme/web", "run_attempt": float64(1)}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := rule.Matches(tt.claims); got != tt.want {
+				t.Errorf("Matches = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	for _, raw := range []string{"repository", "=acme", "repository=[acme"} {
+		if _, err := parseClaimRule("TURBO_JWT_CLAIMS", raw); err == nil {
+			t.Errorf("parseClaimRule(%q) succeeded, want an error", raw)
+		}
+	}
+	if rule, err := parseClaimRule("TURBO_JWT_CLAIMS", ""); err != nil || !rule.Matches(nil) {
+		t.Errorf("empty rule = %v, %v, want one matching anything", rule, err)
+	}
+}
+
+func TestJWTVerifier(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v := &JWTVerifier{
+		issuer:      "https://token.actions.example.com",
+		audience:    "turbo-cache",
+		jwksURL:     "http://127.0.0.1:0/jwks",
+		leeway:      time.Minute,
+		claims:      ClaimRule{"repository_owner": {"acme"}},
+		writeClaims: ClaimRule{"ref": {"refs/heads/main"}},
+		teamClaim:   "repository",
+		teams:       map[string]string{"acme/web": "web"},
+		client:      &http.Client{Timeout: time.Second},
+		logger:      log.New(io.Discard, "", 0),
+		keys:        map[string]crypto.PublicKey{"k1": &key.PublicKey},
+		fetched:     time.Now(),
+	}
+	now := time.Now().Unix()
+	valid := func() map[string]any {
+		return map[string]any{
+			"iss":              v.issuer,
+			"aud":              v.audience,
+			"sub":              "repo:acme/web:ref:refs/heads/main",
+			"exp":              now + 300,
+			"nbf":              now - 10,
+			"repository_owner": "acme",
+			"repository":       "acme/web",
+			"ref":              "refs/heads/main",
+		}
+	}
+	tests := []struct {
+		name   string
+		change func(header, claims map[string]any)
+		key    *ecdsa.PrivateKey
+		scope  string
+		err    bool
+	}{
+		{"valid", func(h, c map[string]any) {}, key, scopeReadWrite, false},
+		{"audience list", func(h, c map[string]any) { c["aud"] = []string{"other", "turbo-cache"} }, key, scopeReadWrite, false},
+		{"expired within the leeway", func(h, c map[string]any) { c["exp"] = now - 30 }, key, scopeReadWrite, false},
+		{"other branch reads only", func(h, c map[string]any) { c["ref"] = "refs/heads/feature" }, key, scopeRead, false},
+		{"other issuer", func(h, c map[string]any) { c["iss"] = "https://evil.example.com" }, key, "", true},
+		{"other audience", func(h, c map[string]any) { c["aud"] = "other" }, key, "", true},
+		{"expired", func(h, c map[string]any) { c["exp"] = now - 120 }, key, "", true},
+		{"no expiry", func(h, c map[string]any) { delete(c, "exp") }, key, "", true},
+		{"not valid yet", func(h, c map[string]any) { c["nbf"] = now + 120 }, key, "", true},
+		{"other owner", func(h, c map[string]any) { c["repository_owner"] = "evil" }, key, "", true},
+		{"unmapped team", func(h, c map[string]any) { c["repository"] = "acme/docs" }, key, "", true},
+		{"other signing key", func(h, c map[string]any) {}, other, "", true},
+		{"unknown key id", func(h, c map[string]any) { h["kid"] = "k2" }, key, "", true},
+		{"algorithm of another key type", func(h, c map[string]any) { h["alg"] = "RS256" }, key, "", true},
+		{"no algorithm", func(h, c map[string]any) { h["alg"] = "none" }, key, "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			header, claims := map[string]any{"alg": "ES256", "kid": "k1", "typ": "JWT"}, valid()
+			tt.change(header, claims)
+			value := signJWT(t, tt.key, header, claims)
+			if !isJWT(value) {
+				t.Fatalf("isJWT(%q) = false", value)
+			}
+			token, err := v.Verify(context.Background(), value)
+			if tt.err {
+				if !errors.Is(err, errInvalidJWT) {
+					t.Errorf("Verify error = %v, want %v", err, errInvalidJWT)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Verify: %v", err)
+			}
+			if token.Scope != tt.scope || !slices.Equal(token.Teams, []string{"web"}) || token.ExpiresAt == nil {
+				t.Errorf("token = %+v, want scope %s for team web with an expiry", token, tt.scope)
+			}
+		})
+	}
+}
+
+func TestJWTVerifierFromEnv(t *testing.T) {
+	jwks := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"keys": [{"kid": "k1", "kty": "EC", "crv": "P-256", "x": "AQ", "y": "AQ"}, {"kid": "enc", "kty": "RSA", "use": "enc"}]}`))
+	}))
+	defer jwks.Close()
+	tests := []struct {
+		name    string
+		env     map[string]string
+		wantErr bool
+	}{
+		{"claims", map[string]string{"TURBO_JWT_AUDIENCE": "turbo-cache", "TURBO_JWT_CLAIMS": "repository_owner=acme"}, false},
+		{"teams", map[string]string{"TURBO_JWT_AUDIENCE": "turbo-cache", "TURBO_JWT_TEAM_CLAIM": "repository", "TURBO_JWT_TEAMS": "acme/web=web"}, false},
+		{"without audience", map[string]string{"TURBO_JWT_CLAIMS": "repository_owner=acme"}, true},
+		{"any job of the issuer", map[string]string{"TURBO_JWT_AUDIENCE": "turbo-cache"}, true},
+		{"teams without a team claim", map[string]string{"TURBO_JWT_AUDIENCE": "turbo-cache", "TURBO_JWT_TEAMS": "acme/web=web"}, true},
+		{"invalid team mapping", map[string]string{"TURBO_JWT_AUDIENCE": "turbo-cache", "TURBO_JWT_TEAM_CLAIM": "repository", "TURBO_JWT_TEAMS": "acme/web"}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("TURBO_JWT_ISSUER", "https://token.actions.example.com")
+			t.Setenv("TURBO_JWT_JWKS_URL", jwks.URL)
+			for k, v := range tt.env {
+				t.Setenv(k, v)
+			}
+			v, err := jwtVerifierFromEnv(log.New(io.Discard, "", 0))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("jwtVerifierFromEnv error = %v, want error %v", err, tt.wantErr)
+			}
+			if v != nil && len(v.keys) != 1 {
+				t.Errorf("loaded keys %v, want only the signing key", v.keys)
+			}
+		})
+	}
+}
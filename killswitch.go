@@ -0,0 +1,158 @@
+package cachesrv
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// AccessSwitch disables reads and/or writes for a tenant, or for one team when
+// Team is set. The default tenant has an empty name.
+type AccessSwitch struct {
+	Tenant string    `json:"tenant,omitempty"`
+	Team   string    `json:"team,omitempty"`
+	Reads  bool      `json:"reads"`
+	Writes bool      `json:"writes"`
+	Reason string    `json:"reason,omitempty"`
+	Since  time.Time `json:"since"`
+}
+
+func (a *AccessSwitch) key() string {
+	return a.Tenant + "/" + a.Team
+}
+
+// KillSwitches holds the active access switches, persisted so that a restart
+// during an incident doesn't silently re-enable a tenant
+type KillSwitches struct {
+	mu       sync.RWMutex
+	path     string
+	switches map[string]AccessSwitch
+}
+
+func NewKillSwitches(path string) (*KillSwitches, error) {
+	k := &KillSwitches{path: path, switches: make(map[string]AccessSwitch)}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return k, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read kill switches: %w", err)
+	}
+	var saved []AccessSwitch
+	if err := json.Unmarshal(data, &saved); err != nil {
+		return nil, fmt.Errorf("failed to parse kill switches: %w", err)
+	}
+	for _, a := range saved {
+		k.switches[a.key()] = a
+	}
+	return k, nil
+}
+
+// Set adds or replaces a switch; one that disables nothing removes it
+func (k *KillSwitches) Set(a AccessSwitch) error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if !a.Reads && !a.Writes {
+		delete(k.switches, a.key())
+	} else {
+		a.Since = time.Now()
+		k.switches[a.key()] = a
+	}
+	return k.save()
+}
+
+// Blocked reports the switch denying a read or write for a team of a
+// tenant, checking the team's own switch before the tenant-wide one
+func (k *KillSwitches) Blocked(tenant, team string, write bool) (AccessSwitch, bool) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	for _, key := range []string{tenant + "/" + team, tenant + "/"} {
+		if a, ok := k.switches[key]; ok && ((write && a.Writes) || (!write && a.Reads)) {
+			return a, true
+		}
+	}
+	return AccessSwitch{}, false
+}
+
+// List returns the active switches ordered by tenant and team
+func (k *KillSwitches) List() []AccessSwitch {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	list := make([]AccessSwitch, 0, len(k.switches))
+	for _, a := range k.switches {
+		list = append(list, a)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].key() < list[j].key() })
+	return list
+}
+
+// save writes the switches atomically; callers must hold the lock
+func (k *KillSwitches) save() error {
+	list := make([]AccessSwitch, 0, len(k.switches))
+	for _, a := range k.switches {
+		list = append(list, a)
+	}
+	data, err := json.MarshalIndent(list, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode kill switches: %w", err)
+	}
+	return writeFileAtomic(k.path, data, 0644)
+}
+
+// checkAccess rejects requests of a disabled tenant or team; it returns false
+// once the response has been written
+func (s *Server) checkAccess(w http.ResponseWriter, r *http.Request) bool {
+	write := r.Method != http.MethodGet && r.Method != http.MethodHead
+	a, blocked := s.switches.Blocked(s.tenant, teamOf(r), write)
+	if !blocked {
+		return true
+	}
+	s.logger.Printf("Request blocked by kill switch for tenant %q team %q: %s", a.Tenant, a.Team, a.Reason)
+	if write {
+		http.Error(w, "Uploads are disabled for this team", http.StatusForbidden)
+	} else {
+		http.Error(w, "Remote caching is disabled for this team", http.StatusForbidden)
+	}
+	return false
+}
+
+// Handler for /admin/killswitch
+func (s *Server) handleKillSwitch(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		s.writeList(w, r, s.switches.List(), "since", "tenant", "team")
+	case http.MethodPost:
+		var a AccessSwitch
+		if err := json.NewDecoder(r.Body).Decode(&a); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		if a.Tenant != "" && s.tenantByName(a.Tenant) == nil {
+			http.Error(w, "Unknown tenant", http.StatusNotFound)
+			return
+		}
+		if err := s.switches.Set(a); err != nil {
+			s.logger.Printf("Failed to save kill switch: %v", err)
+			http.Error(w, "Failed to save kill switch", http.StatusInternalServerError)
+			return
+		}
+		s.logger.Printf("Kill switch for tenant %q team %q set: reads disabled=%t writes disabled=%t (%s)",
+			a.Tenant, a.Team, a.Reads, a.Writes, a.Reason)
+		json.NewEncoder(w).Encode(s.switches.List())
+	case http.MethodDelete:
+		a := AccessSwitch{Tenant: r.URL.Query().Get("tenant"), Team: r.URL.Query().Get("team")}
+		if err := s.switches.Set(a); err != nil {
+			s.logger.Printf("Failed to save kill switch: %v", err)
+			http.Error(w, "Failed to save kill switch", http.StatusInternalServerError)
+			return
+		}
+		s.logger.Printf("Kill switch for tenant %q team %q cleared", a.Tenant, a.Team)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,209 @@
+package cachesrv
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/go-ldap/ldap/v3"
+)
+
+var errInvalidCredentials = errors.New("invalid username or password")
+
+// PasswordAuthenticator verifies a human's username and password and returns
+// the groups they are in
+type PasswordAuthenticator interface {
+	AuthenticatePassword(ctx context.Context, username, password string) ([]string, error)
+}
+
+// ldapServer is the LDAP server and service account shared by password
+// logins and the team directory
+type ldapServer struct {
+	url          string
+	startTLS     bool
+	bindDN       string
+	bindPassword string
+	timeout      time.Duration
+}
+
+func ldapServerFromEnv() ldapServer {
+	return ldapServer{
+		url:          getenv("TURBO_LDAP_URL"),
+		startTLS:     getenv("TURBO_LDAP_STARTTLS") == "true",
+		bindDN:       getenv("TURBO_LDAP_BIND_DN"),
+		bindPassword: getenv("TURBO_LDAP_BIND_PASSWORD"),
+		timeout:      10 * time.Second,
+	}
+}
+
+// dial connects to the server and binds as the service account, if any
+func (l ldapServer) dial() (*ldap.Conn, error) {
+	conn, err := ldap.DialURL(l.url, ldap.DialWithDialer(&net.Dialer{Timeout: l.timeout}))
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to LDAP: %w", err)
+	}
+	conn.SetTimeout(l.timeout)
+
+	if l.startTLS {
+		u, err := url.Parse(l.url)
+		if err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("invalid LDAP URL: %w", err)
+		}
+		if err := conn.StartTLS(&tls.Config{ServerName: u.Hostname(), MinVersion: tls.VersionTLS12}); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("failed to start TLS with LDAP: %w", err)
+		}
+	}
+
+	if l.bindDN != "" {
+		if err := conn.Bind(l.bindDN, l.bindPassword); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("failed to bind LDAP service account: %w", err)
+		}
+	}
+	return conn, nil
+}
+
+// LDAPAuthenticator checks credentials by binding as the user against an LDAP
+// or Active Directory server and requiring membership of a group
+type LDAPAuthenticator struct {
+	ldapServer
+	baseDN       string
+	userFilter   string
+	groupDN      string
+	nestedGroups bool
+	// group is groupDN parsed; groupBase holds the groups that are mapped
+	// onto roles
+	group     *ldap.DN
+	groupBase *ldap.DN
+}
+
+// newLDAPAuthenticatorFromEnv returns nil when TURBO_LDAP_URL is not set
+func newLDAPAuthenticatorFromEnv() (*LDAPAuthenticator, error) {
+	server := ldapServerFromEnv()
+	if server.url == "" {
+		return nil, nil
+	}
+
+	a := &LDAPAuthenticator{
+		ldapServer:   server,
+		baseDN:       getenv("TURBO_LDAP_BASE_DN"),
+		userFilter:   envString("TURBO_LDAP_USER_FILTER", "(sAMAccountName=%s)"),
+		groupDN:      getenv("TURBO_LDAP_GROUP_DN"),
+		nestedGroups: getenv("TURBO_LDAP_NESTED_GROUPS") == "true",
+	}
+	if a.baseDN == "" || a.groupDN == "" {
+		return nil, fmt.Errorf("TURBO_LDAP_BASE_DN and TURBO_LDAP_GROUP_DN are required for LDAP authentication")
+	}
+	if !strings.Contains(a.userFilter, "%s") {
+		return nil, fmt.Errorf("TURBO_LDAP_USER_FILTER must contain %%s for the username")
+	}
+	var err error
+	if a.group, err = ldap.ParseDN(a.groupDN); err != nil || len(a.group.RDNs) == 0 {
+		return nil, fmt.Errorf("invalid TURBO_LDAP_GROUP_DN %q: %v", a.groupDN, err)
+	}
+	if base := getenv("TURBO_LDAP_GROUP_BASE_DN"); base != "" {
+		if a.groupBase, err = ldap.ParseDN(base); err != nil {
+			return nil, fmt.Errorf("invalid TURBO_LDAP_GROUP_BASE_DN %q: %w", base, err)
+		}
+	} else {
+		a.groupBase = &ldap.DN{RDNs: a.group.RDNs[1:]}
+	}
+	return a, nil
+}
+
+// AuthenticatePassword returns the common names of the user's groups directly
+// under the group base, which TURBO_ADMIN_GROUP_ROLES maps onto roles. With
+// nested groups those include the groups inherited through other groups.
+func (a *LDAPAuthenticator) AuthenticatePassword(ctx context.Context, username, password string) ([]string, error) {
+	// An empty password would be an unauthenticated bind, which most servers accept
+	if username == "" || password == "" {
+		return nil, errInvalidCredentials
+	}
+
+	conn, err := a.dial()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	filter := fmt.Sprintf(a.userFilter, ldap.EscapeFilter(username))
+	if a.nestedGroups {
+		// LDAP_MATCHING_RULE_IN_CHAIN makes Active Directory resolve nested groups
+		filter = fmt.Sprintf("(&%s(memberOf:%s:=%s))", filter, ldapInChain, ldap.EscapeFilter(a.groupDN))
+	}
+
+	result, err := conn.Search(ldap.NewSearchRequest(
+		a.baseDN, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 2, int(a.timeout.Seconds()), false,
+		filter, []string{"dn", "memberOf"}, nil,
+	))
+	if err != nil {
+		return nil, fmt.Errorf("failed to search LDAP: %w", err)
+	}
+	if len(result.Entries) != 1 {
+		return nil, errInvalidCredentials
+	}
+	entry := result.Entries[0]
+
+	if err := conn.Bind(entry.DN, password); err != nil {
+		if ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
+			return nil, errInvalidCredentials
+		}
+		return nil, fmt.Errorf("failed to bind LDAP user: %w", err)
+	}
+
+	if a.nestedGroups {
+		result, err := conn.Search(ldap.NewSearchRequest(
+			a.baseDN, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 0, int(a.timeout.Seconds()), false,
+			fmt.Sprintf("(member:%s:=%s)", ldapInChain, ldap.EscapeFilter(entry.DN)), []string{"dn"}, nil,
+		))
+		if err != nil {
+			return nil, fmt.Errorf("failed to search LDAP groups: %w", err)
+		}
+		groups := make([]string, 0, len(result.Entries))
+		for _, group := range result.Entries {
+			if name, ok := ldapGroupName(group.DN, a.groupBase); ok {
+				groups = append(groups, name)
+			}
+		}
+		return groups, nil
+	}
+	member := false
+	var groups []string
+	for _, group := range entry.GetAttributeValues("memberOf") {
+		if dn, err := ldap.ParseDN(group); err == nil && dn.EqualFold(a.group) {
+			member = true
+		}
+		if name, ok := ldapGroupName(group, a.groupBase); ok {
+			groups = append(groups, name)
+		}
+	}
+	if !member {
+		return nil, errNotAuthorized
+	}
+	return groups, nil
+}
+
+// ldapInChain is LDAP_MATCHING_RULE_IN_CHAIN
+const ldapInChain = "1.2.840.113556.1.4.1941"
+
+// ldapGroupName returns the value of the RDN of a group directly under base,
+// usually its CN, since DNs can't be written in the comma separated role
+// mappings. Groups elsewhere aren't named: a "cn=sre" anyone may create under
+// another OU must not get the role of the real one.
+func ldapGroupName(dn string, base *ldap.DN) (string, bool) {
+	parsed, err := ldap.ParseDN(dn)
+	if err != nil || len(parsed.RDNs) != len(base.RDNs)+1 || len(parsed.RDNs[0].Attributes) != 1 {
+		return "", false
+	}
+	if !(&ldap.DN{RDNs: parsed.RDNs[1:]}).EqualFold(base) {
+		return "", false
+	}
+	return parsed.RDNs[0].Attributes[0].Value, true
+}
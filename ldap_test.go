@@ -0,0 +1,88 @@
+package cachesrv
+
+import (
+	"testing"
+
+	"github.com/go-ldap/ldap/v3"
+)
+
+func TestLDAPGroupName(t *testing.T) {
+	base, err := ldap.ParseDN("ou=Groups,dc=example,dc=com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		dn     string
+		want   string
+		mapped bool
+	}{
+		{"cn=build-admins,ou=groups,dc=example,dc=com", "build-admins", true},
+		{"CN=SRE Team,OU=Groups,DC=Example,DC=com", "SRE Team", true},
+		{`cn=a\,b,ou=groups,dc=example,dc=com`, "a,b", true},
+		{"cn=sre, ou=groups, dc=example, dc=com", "sre", true},
+		{"cn=sre,ou=contractors,dc=example,dc=com", "", false},
+		{"cn=sre,ou=groups,dc=example,dc=com,dc=evil", "", false},
+		{"cn=sre,ou=team,ou=groups,dc=example,dc=com", "", false},
+		{"cn=sre+ou=x,ou=groups,dc=example,dc=com", "", false},
+		{"ou=groups,dc=example,dc=com", "", false},
+		{"not a dn", "", false},
+	}
+	for _, tt := range tests {
+		got, mapped := ldapGroupName(tt.dn, base)
+		if got != tt.want || mapped != tt.mapped {
+			t.Errorf("ldapGroupName(%q) = %q, %v, want %q, %v", tt.dn, got, mapped, tt.want, tt.mapped)
+		}
+	}
+}
+
+func TestLDAPAuthenticatorFromEnv(t *testing.T) {
+	tests := []struct {
+		name    string
+		env     map[string]string
+		enabled bool
+		wantErr bool
+	}{
+		{"disabled", map[string]string{}, false, false},
+		{"complete", map[string]string{
+			"TURBO_LDAP_BASE_DN":  "dc=example,dc=com",
+			"TURBO_LDAP_GROUP_DN": "cn=build-admins,dc=example,dc=com",
+		}, true, false},
+		{"without group", map[string]string{
+			"TURBO_LDAP_BASE_DN": "dc=example,dc=com",
+		}, false, true},
+		{"invalid group", map[string]string{
+			"TURBO_LDAP_BASE_DN":  "dc=example,dc=com",
+			"TURBO_LDAP_GROUP_DN": "build-admins",
+		}, false, true},
+		{"invalid group base", map[string]string{
+			"TURBO_LDAP_BASE_DN":       "dc=example,dc=com",
+			"TURBO_LDAP_GROUP_DN":      "cn=build-admins,dc=example,dc=com",
+			"TURBO_LDAP_GROUP_BASE_DN": "groups",
+		}, false, true},
+		{"filter without username", map[string]string{
+			"TURBO_LDAP_BASE_DN":     "dc=example,dc=com",
+			"TURBO_LDAP_GROUP_DN":    "cn=build-admins,dc=example,dc=com",
+			"TURBO_LDAP_USER_FILTER": "(uid=admin)",
+		}, false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if len(tt.env) > 0 {
+				t.Setenv("TURBO_LDAP_URL", "ldaps://ldap.example.com")
+			}
+			for k, v := range tt.env {
+				t.Setenv(k, v)
+			}
+			a, err := newLDAPAuthenticatorFromEnv()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("newLDAPAuthenticatorFromEnv error = %v, want error %v", err, tt.wantErr)
+			}
+			if (a != nil) != tt.enabled {
+				t.Errorf("newLDAPAuthenticatorFromEnv enabled = %v, want %v", a != nil, tt.enabled)
+			}
+			if a != nil && a.groupBase.String() != "dc=example,dc=com" {
+				t.Errorf("group base = %s, want the parent of the group", a.groupBase)
+			}
+		})
+	}
+}
@@ -0,0 +1,15 @@
+//go:build !unix
+
+package cachesrv
+
+// lockFile doesn't lock where flock is unavailable; servers there must not
+// share a state directory while upgrading
+func lockFile(path string) (func(), error) {
+	return func() {}, nil
+}
+
+// syncDir does nothing where directories can't be synced; renames there are
+// as durable as the filesystem makes them
+func syncDir(dir string) error {
+	return nil
+}
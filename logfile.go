@@ -0,0 +1,127 @@
+package cachesrv
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// rotatedSuffix is the time layout appended to rotated log files; it sorts
+// in the order the files were rotated
+const rotatedSuffix = "20060102-150405.000"
+
+// LogFile is an append-only log file that rotates itself once it reaches a
+// size or age, keeping a number of rotated files, and can be reopened after
+// an external logrotate moved it away
+type LogFile struct {
+	path    string
+	maxSize int64         // 0 = no size limit
+	maxAge  time.Duration // 0 = no age limit
+	keep    int           // rotated files kept, 0 = all
+
+	mu     sync.Mutex
+	file   *os.File
+	size   int64
+	opened time.Time
+}
+
+func OpenLogFile(path string, maxSize int64, maxAge time.Duration, keep int) (*LogFile, error) {
+	lf := &LogFile{path: path, maxSize: maxSize, maxAge: maxAge, keep: keep}
+	if err := lf.open(); err != nil {
+		return nil, err
+	}
+	return lf, nil
+}
+
+func (lf *LogFile) open() error {
+	file, err := os.OpenFile(lf.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open log file: %w", err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("failed to stat log file: %w", err)
+	}
+	lf.file, lf.size, lf.opened = file, info.Size(), time.Now()
+	return nil
+}
+
+func (lf *LogFile) Write(p []byte) (int, error) {
+	lf.mu.Lock()
+	defer lf.mu.Unlock()
+	if lf.due(int64(len(p))) {
+		if err := lf.rotate(); err != nil {
+			// Keep logging to the old file rather than losing lines
+			fmt.Fprintf(os.Stderr, "Failed to rotate log file: %v\n", err)
+		}
+	}
+	n, err := lf.file.Write(p)
+	lf.size += int64(n)
+	return n, err
+}
+
+// due reports whether writing n more bytes should go to a new file
+func (lf *LogFile) due(n int64) bool {
+	if lf.size == 0 {
+		return false
+	}
+	return (lf.maxSize > 0 && lf.size+n > lf.maxSize) || (lf.maxAge > 0 && time.Since(lf.opened) >= lf.maxAge)
+}
+
+func (lf *LogFile) rotate() error {
+	rotated := lf.path + "." + time.Now().Format(rotatedSuffix)
+	if err := os.Rename(lf.path, rotated); err != nil {
+		// Reset the age so a file that can't be moved isn't retried on
+		// every line
+		lf.opened = time.Now()
+		return err
+	}
+	previous := lf.file
+	if err := lf.open(); err != nil {
+		// The old file is still open under its new name
+		return err
+	}
+	previous.Close()
+	return lf.prune()
+}
+
+// prune removes the oldest rotated files beyond the ones kept
+func (lf *LogFile) prune() error {
+	if lf.keep <= 0 {
+		return nil
+	}
+	rotated, err := filepath.Glob(lf.path + ".*")
+	if err != nil {
+		return err
+	}
+	var own []string
+	for _, name := range rotated {
+		if _, err := time.Parse(rotatedSuffix, name[len(lf.path)+1:]); err == nil {
+			own = append(own, name)
+		}
+	}
+	sort.Strings(own)
+	for len(own) > lf.keep {
+		if err := os.Remove(own[0]); err != nil {
+			return err
+		}
+		own = own[1:]
+	}
+	return nil
+}
+
+// Reopen closes the file and opens the path again, for SIGHUP after an
+// external rotation
+func (lf *LogFile) Reopen() error {
+	lf.mu.Lock()
+	defer lf.mu.Unlock()
+	previous := lf.file
+	if err := lf.open(); err != nil {
+		return err
+	}
+	return previous.Close()
+}
@@ -0,0 +1,118 @@
+package cachesrv
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Logs are written by slog, as text or JSON lines (TURBO_LOG_FORMAT), from
+// TURBO_LOG_LEVEL up. Requests are logged with their fields as attributes.
+// The *log.Logger the components are handed writes through logBridge, which
+// takes the tenant from a tenant logger's prefix and the level from the
+// wording of the message.
+
+func newLogHandler(w io.Writer) (slog.Handler, error) {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(envString("TURBO_LOG_LEVEL", "info"))); err != nil {
+		return nil, fmt.Errorf("invalid TURBO_LOG_LEVEL: %w", err)
+	}
+	opts := &slog.HandlerOptions{Level: level}
+	switch format := envString("TURBO_LOG_FORMAT", "text"); format {
+	case "text":
+		return slog.NewTextHandler(w, opts), nil
+	case "json":
+		return slog.NewJSONHandler(w, opts), nil
+	default:
+		return nil, fmt.Errorf("unknown TURBO_LOG_FORMAT %q (expected text or json)", format)
+	}
+}
+
+// logBridge turns each line of a *log.Logger into a record
+type logBridge struct {
+	handler slog.Handler
+}
+
+func (b *logBridge) Write(p []byte) (int, error) {
+	msg := strings.TrimSuffix(string(p), "\n")
+	var attrs []slog.Attr
+	if strings.HasPrefix(msg, "[") {
+		if tenant, rest, ok := strings.Cut(msg[1:], "] "); ok {
+			attrs = append(attrs, slog.String("tenant", tenant))
+			msg = rest
+		}
+	}
+	level := messageLevel(msg)
+	if !b.handler.Enabled(context.Background(), level) {
+		return len(p), nil
+	}
+	record := slog.NewRecord(time.Now(), level, msg, 0)
+	record.AddAttrs(attrs...)
+	return len(p), b.handler.Handle(context.Background(), record)
+}
+
+// messageLevel guesses the level of a plain log message: failures are
+// errors, refusals and overload warnings
+func messageLevel(msg string) slog.Level {
+	switch {
+	case strings.HasPrefix(msg, "Failed"), strings.HasPrefix(msg, "Error"), strings.HasPrefix(msg, "FAILED"),
+		strings.Contains(msg, " failed"), strings.Contains(msg, "corrupt"):
+		return slog.LevelError
+	case strings.HasPrefix(msg, "Upload rejected"), strings.HasPrefix(msg, "Refused"), strings.HasPrefix(msg, "Request blocked"),
+		strings.HasPrefix(msg, "Shedding"), strings.HasPrefix(msg, "Lowered"), strings.HasPrefix(msg, "Anomaly"), strings.HasPrefix(msg, "Ignoring setting"),
+		strings.Contains(msg, "queue full"), strings.Contains(msg, "denied"), strings.Contains(msg, "still in use"):
+		return slog.LevelWarn
+	}
+	return slog.LevelInfo
+}
+
+// requestLog collects the fields of a request's log record
+type requestLog struct {
+	start  time.Time
+	w      *loggingResponseWriter
+	tenant string
+	token  string
+	user   string
+	role   string
+	reason string
+	in     *countingReader
+}
+
+// log writes the record of a finished request: server errors at error
+// level, everything else at info
+func (rl *requestLog) log(logger *slog.Logger, msg string, r *http.Request, span *Span) {
+	level := slog.LevelInfo
+	if rl.w.statusCode >= 500 {
+		level = slog.LevelError
+	}
+	if !logger.Enabled(r.Context(), level) {
+		return
+	}
+	host, _, _ := net.SplitHostPort(r.RemoteAddr)
+	attrs := []slog.Attr{
+		slog.String("method", r.Method),
+		slog.String("path", r.URL.Path),
+		slog.Int("status", rl.w.statusCode),
+		slog.Int64("bytes", rl.w.bytes),
+		slog.Float64("duration_ms", float64(time.Since(rl.start).Microseconds())/1000),
+		slog.String("remote_ip", host),
+	}
+	if hash := r.PathValue("hash"); hash != "" {
+		attrs = append(attrs, slog.String("hash", hash))
+	}
+	if rl.in != nil && rl.in.n > 0 {
+		attrs = append(attrs, slog.Int64("bytes_in", rl.in.n))
+	}
+	for _, field := range [][2]string{{"tenant", rl.tenant}, {"team", teamOf(r)}, {"token", rl.token}, {"user", rl.user}, {"role", rl.role},
+		{"reason", rl.reason}, {"trace_id", span.TraceID()}} {
+		if field[1] != "" {
+			attrs = append(attrs, slog.String(field[0], field[1]))
+		}
+	}
+	logger.LogAttrs(r.Context(), level, msg, attrs...)
+}
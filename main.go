@@ -1,15 +1,24 @@
-package main
+// Package cachesrv is a Turborepo remote cache server. The go-turbo-cachesrv
+// command runs it; other programs can embed it by registering their storage
+// backends with the storage package and calling Main.
+package cachesrv
 
 import (
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
 	"io"
 	"log"
+	"log/slog"
 	"net/http"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"time"
+
+	"github.com/bitechdev/go-turbo-cachesrv/storage"
 )
 
 // Types for request/response structures
@@ -36,214 +45,1206 @@ type ArtifactInfo struct {
 	Error          *struct {
 		Message string `json:"message"`
 	} `json:"error,omitempty"`
+
+	// Metadata holds the captured request headers, see TURBO_METADATA_HEADERS
+	Metadata map[string]string `json:"metadata,omitempty"`
+
+	// The rest is only filled in for queries with ?details=true
+	Team       string     `json:"team,omitempty"`
+	Tags       []string   `json:"tags,omitempty"`
+	UploadedAt *time.Time `json:"uploadedAt,omitempty"`
+	LastAccess *time.Time `json:"lastAccess,omitempty"`
+	Hits       int64      `json:"hits,omitempty"`
 }
 
 type ArtifactQueryRequest struct {
 	Hashes []string `json:"hashes"`
 }
 
-// FileSystemStorage implements artifact storage using the local filesystem
-type FileSystemStorage struct {
-	basePath string
+// The storage interface and the filesystem backend live in the storage package;
+// the server code refers to them by these names
+type (
+	Storage         = storage.Storage
+	ArtifactStat    = storage.ArtifactStat
+	ArtifactDetails = storage.ArtifactDetails
+)
+
+var errArtifactNotFound = storage.ErrArtifactNotFound
+
+// Server struct to hold dependencies
+type Server struct {
+	classes         []*SizeClass
+	index           *MetadataIndex
+	quotas          *QuotaManager
+	logger          *log.Logger
+	slogger         *slog.Logger
+	roles           *AdminRoles
+	tokens          *TokenStore
+	rotationOverlap time.Duration
+	ldap            PasswordAuthenticator
+	signatures      *RequestVerifier
+	jwt             *JWTVerifier
+	maxEventBatch   int
+	// maxBatch caps the artifacts of one batch upload or download
+	maxBatch        int
+	maxArtifactSize int64
+	maxRequestBody  int64
+	scanner         *Scanner
+	digest          string
+	jobs            *JobQueue
+	transfers       *Transfers
+	spool           *UploadSpool
+	prefetch        *Prefetcher
+	rehydrateMode   string
+	rehydrateRetry  time.Duration
+	teamCleanup     bool
+	teams           *TeamDirectory
+	uploadPolicies  []UploadPolicy
+	primary         *Primary
+	teamNamespaces  bool
+	clientAuth      string
+	callbacks       *CallbackNotifier
+	archive         *ArchiveMirror
+	compliance      *Compliance
+	runs            *RunStore
+	events          *EventStats
+	clients         *ClientStats
+	metrics         *CacheMetrics
+	requests        *RequestMetrics
+	tracer          *Tracer
+	switches        *KillSwitches
+	blocklist       *Blocklist
+	flags           *FeatureFlags
+	health          *StorageHealth
+	endpointLimits  map[string]EndpointLimit
+	readiness       *Readiness
+	// metadataHeaders are the lower-case request headers kept as artifact metadata
+	metadataHeaders []string
+	federation      *Federation
+	uploadLimit     *AdaptiveLimit
+	downloadLimit   *AdaptiveLimit
+	priorities      *PriorityClasses
+	summary         HashSummary
+	backups         *BackupManager
+	notify          *Notifications
+	restores        *RestoreSessions
+
+	// tenants are the organizations of TURBO_TENANTS_FILE; tenant servers
+	// have their name set and a request limiter
+	tenants []*Server
+	tenant  string
+	limiter *RequestLimiter
+	expirer *Expirer
+}
+
+// Custom logging middleware
+type loggingResponseWriter struct {
+	http.ResponseWriter
+	statusCode int
+	bytes      int64
+}
+
+func newLoggingResponseWriter(w http.ResponseWriter) *loggingResponseWriter {
+	return &loggingResponseWriter{w, http.StatusOK, 0}
+}
+
+func (lrw *loggingResponseWriter) WriteHeader(code int) {
+	lrw.statusCode = code
+	lrw.ResponseWriter.WriteHeader(code)
+}
+
+func (lrw *loggingResponseWriter) Write(b []byte) (int, error) {
+	n, err := lrw.ResponseWriter.Write(b)
+	lrw.bytes += int64(n)
+	return n, err
+}
+
+func (lrw *loggingResponseWriter) Unwrap() http.ResponseWriter { return lrw.ResponseWriter }
+
+// countingReader tracks how many request body bytes a handler consumed
+type countingReader struct {
+	io.ReadCloser
+	n int64
+}
+
+func (cr *countingReader) Read(p []byte) (int, error) {
+	n, err := cr.ReadCloser.Read(p)
+	cr.n += int64(n)
+	return n, err
+}
+
+// fullReader fails with io.ErrUnexpectedEOF when the body ends before its
+// announced size, so storage never commits a short artifact
+type fullReader struct {
+	r         io.Reader
+	remaining int64
 }
 
-func NewFileSystemStorage(basePath string) (*FileSystemStorage, error) {
-	// Create base directory if it doesn't exist
-	if err := os.MkdirAll(basePath, 0755); err != nil {
-		return nil, fmt.Errorf("failed to create storage directory: %w", err)
+func (fr *fullReader) Read(p []byte) (int, error) {
+	n, err := fr.r.Read(p)
+	fr.remaining -= int64(n)
+	if err == io.EOF && fr.remaining > 0 {
+		err = io.ErrUnexpectedEOF
 	}
-	return &FileSystemStorage{basePath: basePath}, nil
+	return n, err
 }
 
-func (fs *FileSystemStorage) Store(hash string, data io.Reader) error {
-	path := filepath.Join(fs.basePath, hash)
-	file, err := os.Create(path)
-	if err != nil {
-		return fmt.Errorf("failed to create file: %w", err)
+// artifactRoute is the path pattern of single artifacts
+const artifactRoute = "/v8/artifacts/{hash}"
+
+// route returns the path pattern a request was routed by, without its
+// method
+func route(r *http.Request) string {
+	if _, path, ok := strings.Cut(r.Pattern, " "); ok {
+		return path
 	}
-	defer file.Close()
+	return r.Pattern
+}
+
+// tooLarge reports whether reading a request body failed because it grew
+// past its limit
+func tooLarge(err error) bool {
+	var maxBytes *http.MaxBytesError
+	return errors.As(err, &maxBytes)
+}
 
-	if _, err := io.Copy(file, data); err != nil {
-		os.Remove(path) // Clean up on error
-		return fmt.Errorf("failed to write file: %w", err)
+// decodeBody decodes a JSON request body of at most TURBO_MAX_REQUEST_BODY
+// bytes; it returns false once it has answered a bad or oversized body
+func (s *Server) decodeBody(w http.ResponseWriter, r *http.Request, v any) bool {
+	err := json.NewDecoder(http.MaxBytesReader(w, r.Body, s.maxRequestBody)).Decode(v)
+	if tooLarge(err) {
+		http.Error(w, "Request body too large", http.StatusRequestEntityTooLarge)
+		return false
 	}
-	return nil
+	if err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return false
+	}
+	return true
 }
 
-func (fs *FileSystemStorage) Get(hash string) (io.ReadCloser, int64, error) {
-	path := filepath.Join(fs.basePath, hash)
-	file, err := os.Open(path)
+// uploadAborted reports whether an upload failed because the client went
+// away, sent fewer bytes than its Content-Length or was cancelled by an admin
+func uploadAborted(r *http.Request, err error) bool {
+	return err != nil && (r.Context().Err() != nil || errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, errTransferCancelled))
+}
+
+// Main runs the server, or its soak and simulate subcommands, configured by
+// os.Args and the environment like the go-turbo-cachesrv command. It only
+// returns when the server stops.
+func Main() {
+	if len(os.Args) > 1 && os.Args[1] == "soak" {
+		os.Exit(runSoak(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "simulate" {
+		os.Exit(runSimulation(os.Args[2:]))
+	}
+	printOnly, err := configure(os.Args[1:])
+	if err == flag.ErrHelp {
+		os.Exit(0)
+	}
 	if err != nil {
-		if os.IsNotExist(err) {
-			return nil, 0, fmt.Errorf("artifact not found")
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	if printOnly {
+		writeConfig(os.Stdout)
+		os.Exit(0)
+	}
+	fmt.Println("Starting server...")
+	// Get configuration from environment variables
+	storagePath := getenv("TURBO_CACHE_DIR")
+	if storagePath == "" {
+		storagePath = "./turbo-cache" // Default path
+	}
+
+	// Until the configured logger is set up, errors are logged as text records
+	// on stdout
+	logger := log.New(&logBridge{handler: slog.NewTextHandler(os.Stdout, nil)}, "", 0)
+	var logOut io.Writer = os.Stdout
+	var logFile *LogFile
+	if logPath := getenv("TURBO_LOG_FILE"); logPath != "" {
+		logMaxSize, err := envSize("TURBO_LOG_MAX_SIZE", 0)
+		if err != nil {
+			logger.Fatal(err)
 		}
-		return nil, 0, fmt.Errorf("failed to open file: %w", err)
+		logMaxAge, err := envDuration("TURBO_LOG_MAX_AGE", 0)
+		if err != nil {
+			logger.Fatal(err)
+		}
+		logKeep, err := envInt("TURBO_LOG_KEEP", 7)
+		if err != nil {
+			logger.Fatal(err)
+		}
+		if logFile, err = OpenLogFile(logPath, logMaxSize, logMaxAge, logKeep); err != nil {
+			logger.Fatal(err)
+		}
+		logOut = logFile
+	}
+	handler, err := newLogHandler(logOut)
+	if err != nil {
+		logger.Fatal(err)
+	}
+	slogger := slog.New(handler)
+	logger = log.New(&logBridge{handler: handler}, "", 0)
+	storageMonitors.SetLogger(logger)
+	proxy, err := proxyFromEnv(logger)
+	if err != nil {
+		logger.Fatal(err)
+	}
+	if proxy != nil {
+		serveProxy(proxy, logger)
+		return
 	}
 
-	info, err := file.Stat()
+	authToken := getenv("TURBO_AUTH_TOKEN")
+	if authToken == "" {
+		logger.Fatal("TURBO_AUTH_TOKEN environment variable is required")
+	}
+	primary, err := newStorageFromEnv(storagePath)
+	if err != nil {
+		logger.Fatal("Failed to initialize storage:", err)
+	}
+	maxSize, err := envSize("TURBO_CACHE_MAX_SIZE", 0)
+	if err != nil {
+		logger.Fatal(err)
+	}
+	maxFiles, err := envInt("TURBO_CACHE_MAX_FILES", 0)
 	if err != nil {
-		file.Close()
-		return nil, 0, fmt.Errorf("failed to get file info: %w", err)
+		logger.Fatal(err)
 	}
+	classes := []*SizeClass{{
+		Name:    defaultClass,
+		Storage: primary,
+		Budget:  ClassBudget{MaxSize: maxSize, MaxFiles: int64(maxFiles)},
+	}}
 
-	return file, info.Size(), nil
-}
+	// Small artifacts optionally get their own area and budget
+	smallLimit, err := envSize("TURBO_SMALL_ARTIFACT_SIZE", 0)
+	if err != nil {
+		logger.Fatal(err)
+	}
+	if smallLimit > 0 {
+		smallStorage, err := storage.NewFileSystem(envString("TURBO_SMALL_CACHE_DIR", filepath.Join(storagePath, ".small")))
+		if err != nil {
+			logger.Fatal("Failed to initialize small artifact storage:", err)
+		}
+		smallStorage.UseTmpfile(getenv("TURBO_FS_TMPFILE") == "true")
+		monitoredSmall, err := storageMonitors.Monitor("small", smallStorage)
+		if err != nil {
+			logger.Fatal(err)
+		}
+		smallMaxSize, err := envSize("TURBO_SMALL_CACHE_MAX_SIZE", 0)
+		if err != nil {
+			logger.Fatal(err)
+		}
+		smallMaxFiles, err := envInt("TURBO_SMALL_CACHE_MAX_FILES", 0)
+		if err != nil {
+			logger.Fatal(err)
+		}
+		classes = append([]*SizeClass{{
+			Name:            smallClass,
+			MaxArtifactSize: smallLimit,
+			Storage:         monitoredSmall,
+			Budget:          ClassBudget{MaxSize: smallMaxSize, MaxFiles: int64(smallMaxFiles)},
+		}}, classes...)
+	}
 
-func (fs *FileSystemStorage) Exists(hash string) (bool, error) {
-	path := filepath.Join(fs.basePath, hash)
-	_, err := os.Stat(path)
-	if err == nil {
-		return true, nil
+	// A replica forwards writes to its primary and never writes to storage
+	replicaOf, err := primaryFromEnv(logger)
+	if err != nil {
+		logger.Fatal(err)
 	}
-	if os.IsNotExist(err) {
-		return false, nil
+	if replicaOf != nil {
+		logger.Printf("Running as a replica of %s, forwarding writes there", replicaOf.url.Redacted())
 	}
-	return false, err
-}
 
-// Server struct to hold dependencies
-type Server struct {
-	storage *FileSystemStorage
-	logger  *log.Logger
-	token   string
-}
+	// The smallest artifacts optionally live in the metadata index itself
+	inlineLimit, err := envSize("TURBO_INLINE_ARTIFACT_SIZE", 0)
+	if err != nil {
+		logger.Fatal(err)
+	}
+	if inlineLimit > 0 && replicaOf != nil {
+		logger.Printf("Ignoring setting TURBO_INLINE_ARTIFACT_SIZE: inline artifacts are only kept by the primary")
+	} else if inlineLimit > 0 {
+		inlineBudget, err := classBudgetFromEnv("TURBO_INLINE_CACHE_", defaultInlineBudget)
+		if err != nil {
+			logger.Fatal(err)
+		}
+		classes = append([]*SizeClass{{
+			Name:            inlineClass,
+			MaxArtifactSize: inlineLimit,
+			Storage:         NewInlineStorage(inlineLimit),
+			Budget:          inlineBudget,
+		}}, classes...)
+	}
 
-// Custom logging middleware
-type loggingResponseWriter struct {
-	http.ResponseWriter
-	statusCode int
-}
+	if replicaOf != nil {
+		for _, c := range classes {
+			c.Storage = &ReadOnlyStorage{inner: c.Storage}
+		}
+	}
 
-func newLoggingResponseWriter(w http.ResponseWriter) *loggingResponseWriter {
-	return &loggingResponseWriter{w, http.StatusOK}
-}
+	storages := make(map[string]Storage)
+	budgets := make(map[string]ClassBudget)
+	for _, c := range classes {
+		storages[c.Name] = c.Storage
+		budgets[c.Name] = c.Budget
+	}
+
+	// The storage of a replica is the primary's to migrate and clean up
+	if replicaOf == nil {
+		stateEnv := &migrationEnv{stateDir: storagePath, classes: classes, logger: logger}
+		if err := runMigrations(stateEnv); err != nil {
+			logger.Fatal(err)
+		}
+		// Uploads interrupted by a crash leave their temp files behind
+		if err := removeStaleTempFiles(stateEnv); err != nil {
+			logger.Fatal(err)
+		}
+	}
+	index, err := NewMetadataIndex(filepath.Join(storagePath, ".meta", "index.json"), storages, logger)
+	if err != nil {
+		logger.Fatal("Failed to load metadata index:", err)
+	}
+	if err := journalFromEnv(index); err != nil {
+		logger.Fatal(err)
+	}
+	go index.Run(10*time.Second, nil)
+
+	defaultQuota, err := envSize("TURBO_TEAM_QUOTA", 0)
+	if err != nil {
+		logger.Fatal(err)
+	}
+	teamQuotas, err := parseSizeMap(getenv("TURBO_TEAM_QUOTAS"))
+	if err != nil {
+		logger.Fatal("Invalid TURBO_TEAM_QUOTAS:", err)
+	}
+	teams, err := newTeamDirectoryFromEnv(logger)
+	if err != nil {
+		logger.Fatal(err)
+	}
+
+	expiryWarning, err := envDuration("TURBO_TOKEN_EXPIRY_WARNING", 7*24*time.Hour)
+	if err != nil {
+		logger.Fatal(err)
+	}
+	rotationOverlap, err := envDuration("TURBO_TOKEN_ROTATION_OVERLAP", 24*time.Hour)
+	if err != nil {
+		logger.Fatal(err)
+	}
+
+	// Tokens created through the admin API are kept with the metadata
+	// unless a tokens file is configured
+	tokens, err := NewTokenStore(envString("TURBO_TOKENS_FILE", filepath.Join(storagePath, ".meta", "tokens.json")), expiryWarning, logger)
+	if err != nil {
+		logger.Fatal("Failed to load tokens:", err)
+	}
+	tokens.AddStatic("default", authToken)
+
+	// The admin keys are deliberately separate from artifact tokens so a leaked
+	// CI token can't be used to manage the server
+	roles, err := newAdminRolesFromEnv(getenv("TURBO_ADMIN_TOKEN"), authToken)
+	if err != nil {
+		logger.Fatal(err)
+	}
+
+	maxEventBatch, err := envInt("TURBO_EVENTS_MAX_BATCH", 1000)
+	if err != nil {
+		logger.Fatal(err)
+	}
+	maxBatch, err := envInt("TURBO_BATCH_MAX_ARTIFACTS", 100)
+	if err != nil {
+		logger.Fatal(err)
+	}
+	rehydrateMode, err := parseRehydrateMode(getenv("TURBO_REHYDRATE_ASYNC"))
+	if err != nil {
+		logger.Fatal(err)
+	}
+	rehydrateRetry, err := envDuration("TURBO_REHYDRATE_RETRY_AFTER", 5*time.Second)
+	if err != nil {
+		logger.Fatal(err)
+	}
+	maxArtifactSize, err := envSize("TURBO_MAX_ARTIFACT_SIZE", 0)
+	if err != nil {
+		logger.Fatal(err)
+	}
+	maxRequestBody, err := envSize("TURBO_MAX_REQUEST_BODY", 4<<20)
+	if err != nil {
+		logger.Fatal(err)
+	}
+	endpointLimits, err := endpointLimitsFromEnv()
+	if err != nil {
+		logger.Fatal(err)
+	}
+	readHeaderTimeout, err := envDuration("TURBO_READ_HEADER_TIMEOUT", 10*time.Second)
+	if err != nil {
+		logger.Fatal(err)
+	}
+	idleTimeout, err := envDuration("TURBO_IDLE_TIMEOUT", 2*time.Minute)
+	if err != nil {
+		logger.Fatal(err)
+	}
+	digest, err := digestAlgorithmFromEnv()
+	if err != nil {
+		logger.Fatal(err)
+	}
+
+	server := &Server{
+		classes:         classes,
+		index:           index,
+		quotas:          NewQuotaManager(index, budgets, defaultQuota, teamQuotas, teams),
+		logger:          logger,
+		slogger:         slogger,
+		roles:           roles,
+		tokens:          tokens,
+		rotationOverlap: rotationOverlap,
+		maxEventBatch:   maxEventBatch,
+		maxBatch:        maxBatch,
+		rehydrateMode:   rehydrateMode,
+		rehydrateRetry:  rehydrateRetry,
+		teamCleanup:     getenv("TURBO_TEAM_CLEANUP") == "true",
+		teamNamespaces:  getenv("TURBO_TEAM_NAMESPACES") == "true",
+		teams:           teams,
+		primary:         replicaOf,
+		maxArtifactSize: maxArtifactSize,
+		maxRequestBody:  maxRequestBody,
+		endpointLimits:  endpointLimits,
+		digest:          digest,
+		events:          NewEventStats(),
+		clients:         NewClientStats(),
+	}
+
+	server.notify, err = newNotificationsFromEnv(logger)
+	if err != nil {
+		logger.Fatal(err)
+	}
+	anomalyInterval, err := envDuration("TURBO_ANOMALY_INTERVAL", time.Minute)
+	if err != nil {
+		logger.Fatal(err)
+	}
+	anomalyBaseline, err := envDuration("TURBO_ANOMALY_BASELINE", time.Hour)
+	if err != nil {
+		logger.Fatal(err)
+	}
+	hitRateDrop, err := envFloat("TURBO_ANOMALY_HIT_RATE_DROP", 0.3)
+	if err != nil {
+		logger.Fatal(err)
+	}
+	spikeFactor, err := envFloat("TURBO_ANOMALY_SPIKE_FACTOR", 3)
+	if err != nil {
+		logger.Fatal(err)
+	}
+	alertCooldown, err := envDuration("TURBO_ALERT_COOLDOWN", 30*time.Minute)
+	if err != nil {
+		logger.Fatal(err)
+	}
+	server.metrics = NewCacheMetrics(0)
+	server.requests = NewRequestMetrics()
+	server.tracer, err = newTracerFromEnv(logger)
+	if err != nil {
+		logger.Fatal(err)
+	}
+	if server.tracer != nil {
+		logger.Printf("Exporting traces to %s", server.tracer.endpoint)
+		go server.tracer.Run(nil)
+	}
+	if anomalyInterval > 0 {
+		server.metrics = NewCacheMetrics(int(anomalyBaseline / anomalyInterval))
+		detector := NewAnomalyDetector(server.metrics, server.notify, hitRateDrop, spikeFactor, alertCooldown, logger)
+		go detector.Run(anomalyInterval, nil)
+	}
+
+	if policyName := getenv("TURBO_EVICTION_POLICY"); policyName != "" && replicaOf != nil {
+		logger.Printf("Ignoring setting TURBO_EVICTION_POLICY: the primary evicts for its replicas")
+	} else if policyName != "" {
+		halfLife, err := envDuration("TURBO_EVICTION_HALF_LIFE", 7*24*time.Hour)
+		if err != nil {
+			logger.Fatal(err)
+		}
+		policy, err := evictionPolicyByName(policyName, halfLife)
+		if err != nil {
+			logger.Fatal(err)
+		}
+		target, err := envFloat("TURBO_EVICTION_TARGET", 0.9)
+		if err != nil {
+			logger.Fatal(err)
+		}
+		evicting := false
+		for _, c := range classes {
+			if !c.Budget.limited() {
+				continue
+			}
+			c.Evictor = NewEvictor(c.Name, index, c.Storage, policy, c.Budget, target, logger)
+			go c.Evictor.Run(time.Minute, nil)
+			evicting = true
+		}
+		if !evicting {
+			logger.Fatal("TURBO_EVICTION_POLICY requires a size or file count budget such as TURBO_CACHE_MAX_SIZE")
+		}
+	}
+
+	// Artifacts unused for longer than the TTL are deleted whatever the budget
+	ttl, err := envDuration("TURBO_CACHE_TTL", 0)
+	if err != nil {
+		logger.Fatal(err)
+	}
+	ttlInterval, err := envDuration("TURBO_CACHE_TTL_INTERVAL", time.Hour)
+	if err != nil {
+		logger.Fatal(err)
+	}
+	if ttl > 0 && replicaOf != nil {
+		logger.Printf("Ignoring setting TURBO_CACHE_TTL: the primary expires artifacts for its replicas")
+	} else if ttl > 0 {
+		logger.Printf("Deleting artifacts unused for %v, checking every %v", ttl, ttlInterval)
+	}
+	// The expirer runs without a TTL too, so a reload can set one
+	server.expirer = NewExpirer(index, classes, ttl, logger)
+	if replicaOf == nil {
+		go server.expirer.Run(ttlInterval, nil)
+	}
+
+	switch mode := envString("TURBO_UPLOAD_MODE", "stream"); mode {
+	case "stream":
+	case "spool":
+		server.spool, err = NewUploadSpool(envString("TURBO_UPLOAD_SPOOL_DIR", filepath.Join(storagePath, ".spool")))
+		if err != nil {
+			logger.Fatal(err)
+		}
+	default:
+		logger.Fatalf("Unknown TURBO_UPLOAD_MODE %q (expected stream or spool)", mode)
+	}
+
+	server.callbacks = newCallbackNotifierFromEnv(logger)
+	policy, err := newWebhookPolicyFromEnv(logger)
+	if err != nil {
+		logger.Fatal(err)
+	}
+	if policy != nil {
+		server.uploadPolicies = append(server.uploadPolicies, policy)
+	}
+
+	server.runs, err = NewRunStore(filepath.Join(storagePath, ".runs"), logger)
+	if err != nil {
+		logger.Fatal("Failed to load run summaries:", err)
+	}
+
+	server.archive, err = newArchiveMirrorFromEnv(storagePath, logger)
+	if err != nil {
+		logger.Fatal(err)
+	}
+
+	server.compliance, err = newComplianceFromEnv()
+	if err != nil {
+		logger.Fatal(err)
+	}
+
+	prefetchWorkers, err := envInt("TURBO_PREFETCH_WORKERS", 4)
+	if err != nil {
+		logger.Fatal(err)
+	}
+	server.prefetch = NewPrefetcher(server.stageArtifact, prefetchWorkers, 10000, logger)
+
+	scanInterval, err := envDuration("TURBO_SCAN_INTERVAL", time.Hour)
+	if err != nil {
+		logger.Fatal(err)
+	}
+	verifyEvery, err := envInt("TURBO_SCAN_VERIFY_EVERY", 0)
+	if err != nil {
+		logger.Fatal(err)
+	}
+	scanWorkers, err := envInt("TURBO_SCAN_WORKERS", 4)
+	if err != nil {
+		logger.Fatal(err)
+	}
+	scanMBps, err := envFloat("TURBO_SCAN_MAX_MBPS", 0)
+	if err != nil {
+		logger.Fatal(err)
+	}
+	scanIOPS, err := envFloat("TURBO_SCAN_MAX_IOPS", 0)
+	if err != nil {
+		logger.Fatal(err)
+	}
+	server.scanner = NewScanner(index, classes, NewIOLimiter(scanMBps*(1<<20), scanIOPS), scanWorkers, logger)
+
+	// Upload and verification concurrency, lowered while storage is slower
+	// than the target latency per MB
+	adaptiveLatency, err := envDuration("TURBO_ADAPTIVE_LATENCY", 0)
+	if err != nil {
+		logger.Fatal(err)
+	}
+	maxUploads, err := envInt("TURBO_MAX_CONCURRENT_UPLOADS", 0)
+	if err != nil {
+		logger.Fatal(err)
+	}
+	minUploads, err := envInt("TURBO_MIN_CONCURRENT_UPLOADS", 4)
+	if err != nil {
+		logger.Fatal(err)
+	}
+	if adaptiveLatency > 0 && maxUploads == 0 {
+		maxUploads = 64
+	}
+	if maxUploads > 0 {
+		server.uploadLimit = NewAdaptiveLimit("uploads", minUploads, maxUploads, adaptiveLatency, logger)
+	}
+	maxDownloads, err := envInt("TURBO_MAX_CONCURRENT_DOWNLOADS", 0)
+	if err != nil {
+		logger.Fatal(err)
+	}
+	minDownloads, err := envInt("TURBO_MIN_CONCURRENT_DOWNLOADS", 16)
+	if err != nil {
+		logger.Fatal(err)
+	}
+	if maxDownloads > 0 {
+		server.downloadLimit = NewAdaptiveLimit("downloads", minDownloads, maxDownloads, adaptiveLatency, logger)
+	}
+	server.priorities, err = newPriorityClassesFromEnv()
+	if err != nil {
+		logger.Fatal(err)
+	}
+	if err := server.priorities.check(tokens); err != nil {
+		logger.Fatal(err)
+	}
+	shedDepth, err := envInt("TURBO_SHED_QUEUE_DEPTH", 0)
+	if err != nil {
+		logger.Fatal(err)
+	}
+	server.uploadLimit.ShedAt(shedDepth, server.priorities)
+	server.downloadLimit.ShedAt(shedDepth, server.priorities)
+	if adaptiveLatency > 0 {
+		server.scanner.limit = NewAdaptiveLimit("scan", 1, scanWorkers, adaptiveLatency, logger)
+	}
+	server.backups, err = NewBackupManager(filepath.Join(storagePath, ".meta", "backups"), index, classes, server.scanner.limiter, digest, server.notify, logger)
+	if err != nil {
+		logger.Fatal(err)
+	}
+	server.restores, err = NewRestoreSessions(filepath.Join(storagePath, ".meta", "restore"))
+	if err != nil {
+		logger.Fatal(err)
+	}
+	if scanInterval > 0 {
+		go server.scanner.Run(scanInterval, verifyEvery, nil)
+	}
+	jobWorkers, err := envInt("TURBO_JOB_WORKERS", 1)
+	if err != nil {
+		logger.Fatal(err)
+	}
+	server.jobs = NewJobQueue(jobWorkers, 100, logger)
+
+	progressInterval, err := envDuration("TURBO_TRANSFER_PROGRESS_INTERVAL", 30*time.Second)
+	if err != nil {
+		logger.Fatal(err)
+	}
+	progressMinSize, err := envSize("TURBO_TRANSFER_PROGRESS_MIN_SIZE", 100<<20)
+	if err != nil {
+		logger.Fatal(err)
+	}
+	server.transfers = NewTransfers(progressMinSize, logger)
+	if progressInterval > 0 {
+		go server.transfers.Run(progressInterval, nil)
+	}
+
+	ldapAuth, err := newLDAPAuthenticatorFromEnv()
+	if err != nil {
+		logger.Fatal("Failed to configure LDAP:", err)
+	}
+	if ldapAuth != nil {
+		server.ldap = ldapAuth
+	}
+	if key := getenv("TURBO_REQUEST_SIGNING_KEY"); key != "" {
+		window, err := envDuration("TURBO_REQUEST_SIGNING_WINDOW", 5*time.Minute)
+		if err != nil {
+			logger.Fatal(err)
+		}
+		server.signatures = NewRequestVerifier([]byte(key), window)
+	}
+	server.jwt, err = jwtVerifierFromEnv(logger)
+	if err != nil {
+		logger.Fatal("Failed to configure JWT authentication:", err)
+	}
+	if !roles.Enabled() && ldapAuth == nil {
+		logger.Printf("Admin API disabled: set TURBO_ADMIN_TOKEN or TURBO_LDAP_URL to enable it")
+	}
+
+	server.federation, err = newFederationFromEnv()
+	if err != nil {
+		logger.Fatal(err)
+	}
+	if server.federation != nil {
+		tombstoneTTL, err := envDuration("TURBO_TOMBSTONE_TTL", 7*24*time.Hour)
+		if err != nil {
+			logger.Fatal(err)
+		}
+		server.federation.tombstones, err = NewTombstones(filepath.Join(storagePath, ".meta", "tombstones.json"), tombstoneTTL)
+		if err != nil {
+			logger.Fatal(err)
+		}
+		gossipInterval, err := envDuration("TURBO_GOSSIP_INTERVAL", 30*time.Second)
+		if err != nil {
+			logger.Fatal(err)
+		}
+		if gossipInterval > 0 {
+			go server.federation.Gossip(gossipInterval, server.applyTombstone, logger, nil)
+		}
+	}
+	server.metadataHeaders = parseHeaderList(getenv("TURBO_METADATA_HEADERS"))
+
+	switch mode := envString("TURBO_DEGRADED_MODE", "off"); mode {
+	case "off":
+	case "passthrough":
+		failures, err := envInt("TURBO_DEGRADED_AFTER", 5)
+		if err != nil {
+			logger.Fatal(err)
+		}
+		putStatus, err := envInt("TURBO_DEGRADED_PUT_STATUS", http.StatusOK)
+		if err != nil {
+			logger.Fatal(err)
+		}
+		probeInterval, err := envDuration("TURBO_DEGRADED_PROBE_INTERVAL", 10*time.Second)
+		if err != nil {
+			logger.Fatal(err)
+		}
+		server.health = NewStorageHealth(failures, putStatus, server.notify, logger)
+		go server.health.Run(server.probeStorage, probeInterval, nil)
+	default:
+		logger.Fatalf("Unknown TURBO_DEGRADED_MODE %q (expected off or passthrough)", mode)
+	}
+
+	backendProbeInterval, err := envDuration("TURBO_BACKEND_PROBE_INTERVAL", 30*time.Second)
+	if err != nil {
+		logger.Fatal(err)
+	}
+	if backendProbeInterval > 0 {
+		go storageMonitors.Run(backendProbeInterval, nil)
+	}
 
-func (lrw *loggingResponseWriter) WriteHeader(code int) {
-	lrw.statusCode = code
-	lrw.ResponseWriter.WriteHeader(code)
-}
+	readinessTimeout, err := envDuration("TURBO_READINESS_TIMEOUT", 5*time.Second)
+	if err != nil {
+		logger.Fatal(err)
+	}
+	server.readiness = NewReadiness(server.probeWritable, readinessTimeout, logger)
 
-func main() {
-	fmt.Println("Starting server...")
-	// Get configuration from environment variables
-	storagePath := os.Getenv("TURBO_CACHE_DIR")
-	if storagePath == "" {
-		storagePath = "./turbo-cache" // Default path
+	server.switches, err = NewKillSwitches(filepath.Join(storagePath, ".meta", "killswitches.json"))
+	if err != nil {
+		logger.Fatal(err)
+	}
+	server.blocklist, err = NewBlocklist(filepath.Join(storagePath, ".meta", "blocklist.json"), filepath.Join(storagePath, ".meta", "blocklist-audit.jsonl"))
+	if err != nil {
+		logger.Fatal(err)
 	}
 
-	authToken := os.Getenv("TURBO_AUTH_TOKEN")
-	if authToken == "" {
-		log.Fatal("TURBO_AUTH_TOKEN environment variable is required")
+	flagDefaults, err := parseFeatureFlags(getenv("TURBO_FEATURE_FLAGS"))
+	if err != nil {
+		logger.Fatal("Invalid TURBO_FEATURE_FLAGS:", err)
+	}
+	server.flags, err = NewFeatureFlags(filepath.Join(storagePath, ".meta", "featureflags.json"), flagDefaults)
+	if err != nil {
+		logger.Fatal(err)
 	}
 
-	logPath := os.Getenv("TURBO_LOG_FILE")
-	var logger *log.Logger
-	if logPath != "" {
-		logFile, err := os.OpenFile(logPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	tenantsFile := getenv("TURBO_TENANTS_FILE")
+	if tenantsFile != "" {
+		server.tenants, err = loadTenants(tenantsFile, storagePath, server)
 		if err != nil {
-			log.Fatal("Failed to open log file:", err)
+			logger.Fatal(err)
 		}
-		logger = log.New(logFile, "", log.LstdFlags)
-	} else {
-		logger = log.New(os.Stdout, "", log.LstdFlags)
+		logger.Printf("Serving %d tenants in addition to the default one", len(server.tenants))
 	}
-
-	storage, err := NewFileSystemStorage(storagePath)
+	watchInterval, err := envDuration("TURBO_CONFIG_WATCH_INTERVAL", 0)
 	if err != nil {
-		logger.Fatal("Failed to initialize storage:", err)
+		logger.Fatal(err)
 	}
-
-	server := &Server{
-		storage: storage,
-		logger:  logger,
-		token:   authToken,
+	reloader := NewReloader(server, tenantsFile, logFile)
+	tlsConfig, certs, err := tlsConfigFromEnv()
+	if err != nil {
+		logger.Fatal(err)
+	}
+	reloader.certs = certs
+	acmeConfig, acmeManager, err := acmeConfigFromEnv(storagePath, logger)
+	if err != nil {
+		logger.Fatal(err)
+	}
+	if acmeManager != nil {
+		tlsConfig = acmeConfig
+		go acmeManager.Run(nil)
 	}
+	if server.clientAuth, _, err = clientAuthFromEnv(); err != nil {
+		logger.Fatal(err)
+	}
+	if server.clientAuth != "" && tlsConfig == nil {
+		logger.Fatal("TURBO_TLS_CLIENT_CA needs TLS: set TURBO_TLS_CERT or TURBO_ACME_DOMAIN")
+	}
+	go reloader.Run(watchInterval, nil)
 
 	// Setup routes
-	http.HandleFunc("/v8/artifacts/events", server.handleAuth(server.recordEvents))
-	http.HandleFunc("/v8/artifacts/status", server.handleAuth(server.getStatus))
-	http.HandleFunc("/v8/artifacts/", server.handleAuth(server.handleArtifact))
-	http.HandleFunc("/v8/artifacts", server.handleAuth(server.queryArtifacts))
-
-	server.logger.Printf("Starting server on :8080")
-	fmt.Println("Starting server on :8080")
-	if err := http.ListenAndServe(":8080", nil); err != nil {
+	http.HandleFunc("/healthz", server.getHealth)
+	http.HandleFunc("/readyz", server.getReadiness)
+	// The mux answers other methods with 405 and paths it doesn't know,
+	// such as /v8/artifacts/ without a hash, with 404. GET also routes HEAD.
+	http.HandleFunc("POST /v8/artifacts/events", server.handleAuth((*Server).recordEvents))
+	http.HandleFunc("GET /v8/artifacts/status", server.handleAuth((*Server).getStatus))
+	http.HandleFunc("GET /v8/artifacts/summary", server.handleAuth((*Server).getSummary))
+	http.HandleFunc("POST /v8/artifacts/prefetch", server.handleAuth((*Server).prefetchArtifacts))
+	http.HandleFunc("GET /v8/artifacts/batch", server.handleAuth((*Server).downloadBatch))
+	http.HandleFunc("POST /v8/artifacts/batch", server.handleAuth((*Server).uploadBatch))
+	http.HandleFunc("GET "+artifactRoute, server.handleAuth((*Server).handleArtifact))
+	http.HandleFunc("PUT "+artifactRoute, server.handleAuth((*Server).handleArtifact))
+	http.HandleFunc("POST /v8/artifacts", server.handleAuth((*Server).queryArtifacts))
+	http.HandleFunc("GET /v8/federation/inventory", server.getInventory)
+	http.HandleFunc("GET /v8/federation/tombstones", server.getTombstones)
+	http.HandleFunc("GET /v8/runs", server.handleAuth((*Server).listRuns))
+	http.HandleFunc("POST /v8/runs", server.handleAuth((*Server).ingestRun))
+	http.HandleFunc("GET /v8/team/artifacts", server.handleAuth((*Server).listTeamArtifacts))
+	http.HandleFunc("DELETE /v8/team/artifacts/{hash}", server.handleAuth((*Server).deleteTeamArtifact))
+	http.HandleFunc("GET /v8/team/usage", server.handleAuth((*Server).getTeamUsage))
+	http.HandleFunc("GET /v8/stats/tasks", server.handleAuth((*Server).getTaskStats))
+	http.HandleFunc("GET /v8/runs/{id}", server.handleAuth((*Server).getRun))
+	http.HandleFunc("GET /v8/runs/{id}/{view}", server.handleAuth((*Server).getRun))
+	http.HandleFunc("/admin/tokens", server.handleAdminAuth(roleAdmin, server.handleTokens))
+	http.HandleFunc("/admin/tokens/", server.handleAdminAuth(roleAdmin, server.handleToken))
+	http.HandleFunc("/admin/tokens/rotate", server.handleAdminAuth(roleAdmin, server.rotateToken))
+	http.HandleFunc("/admin/quotas", server.handleAdminAuth(roleAdmin, server.getQuota))
+	http.HandleFunc("/admin/scan", server.handleAdminAuth(roleOperator, server.runScan))
+	http.HandleFunc("/admin/artifacts", server.handleAdminAuth(roleOperator, server.findArtifacts))
+	http.HandleFunc("/admin/artifacts/copy", server.handleAdminAuth(roleOperator, server.copyArtifact))
+	http.HandleFunc("/admin/tenants", server.handleAdminAuth(roleAdmin, server.listTenants))
+	http.HandleFunc("/admin/killswitch", server.handleAdminAuth(roleOperator, server.handleKillSwitch))
+	http.HandleFunc("/admin/flags", server.handleAdminAuth(roleAdmin, server.listFlags))
+	http.HandleFunc("/admin/flags/", server.handleAdminAuth(roleAdmin, server.handleFlag))
+	http.HandleFunc("/admin/backups", server.handleAdminAuth(roleOperator, server.handleBackups))
+	http.HandleFunc("/admin/backups/", server.handleAdminAuth(roleOperator, server.handleBackup))
+	http.HandleFunc("/admin/restores", server.handleAdminAuth(roleOperator, server.startRestore))
+	http.HandleFunc("/admin/restores/", server.handleAdminAuth(roleOperator, server.handleRestore))
+	http.HandleFunc("/admin/partitions", server.handleAdminAuth(roleOperator, server.listPartitions))
+	http.HandleFunc("/admin/partitions/", server.handleAdminAuth(roleOperator, server.dropPartition))
+	http.HandleFunc("/admin/clients", server.handleAdminAuth(roleOperator, server.listClients))
+	http.HandleFunc("/admin/limits", server.handleAdminAuth(roleOperator, server.listLimits))
+	http.HandleFunc("/admin/queues", server.handleAdminAuth(roleOperator, server.listQueues))
+	http.HandleFunc("/admin/tombstones", server.handleAdminAuth(roleOperator, server.listTombstones))
+	http.HandleFunc("/admin/blocklist", server.handleAdminAuth(roleOperator, server.handleBlocklist))
+	http.HandleFunc("/admin/blocklist/", server.handleAdminAuth(roleOperator, server.handleBlockedArtifact))
+	http.HandleFunc("/admin/transfers", server.handleAdminAuth(roleOperator, server.listTransfers))
+	http.HandleFunc("/admin/transfers/", server.handleAdminAuth(roleOperator, server.handleTransfer))
+	http.HandleFunc("/admin/jobs", server.handleAdminAuth(roleOperator, server.listJobs))
+	http.HandleFunc("/admin/jobs/", server.handleAdminAuth(roleOperator, server.handleJob))
+	http.HandleFunc("/admin/backends", server.handleAdminAuth(roleViewer, server.listBackends))
+	http.HandleFunc("/admin/metrics/history", server.handleAdminAuth(roleAdmin, server.getMetricsHistory))
+	http.HandleFunc("/metrics", server.handleAdminAuth(roleViewer, server.getPrometheusMetrics))
+	if addr := getenv("TURBO_METRICS_ADDR"); addr != "" {
+		go server.serveMetrics(addr)
+	}
+
+	dashboard, err := newDashboardFromEnv(server)
+	if err != nil {
+		logger.Fatal("Failed to configure dashboard:", err)
+	}
+	if dashboard != nil {
+		dashboard.Register(http.DefaultServeMux)
+	}
+
+	listen := envString("TURBO_LISTEN", ":8080")
+	reportUnusedSettings(server.logger)
+	httpServer := &http.Server{Addr: listen, ReadHeaderTimeout: readHeaderTimeout, IdleTimeout: idleTimeout, ErrorLog: logger}
+	if tlsConfig == nil {
+		server.logger.Printf("Starting server on %s", listen)
+		fmt.Println("Starting server on", listen)
+		err = httpServer.ListenAndServe()
+	} else {
+		if addr := getenv("TURBO_TLS_REDIRECT_ADDR"); addr != "" {
+			redirects := redirectToHTTPS(listen)
+			if acmeManager != nil {
+				redirects = acmeManager.HTTPHandler(redirects)
+			}
+			go server.serveRedirects(addr, redirects)
+		}
+		server.logger.Printf("Starting server on %s with TLS", listen)
+		fmt.Println("Starting server on", listen, "with TLS")
+		httpServer.TLSConfig = tlsConfig
+		err = httpServer.ListenAndServeTLS("", "")
+	}
+	if err != nil {
 		server.logger.Fatal(err)
 	}
 }
 
 // Middleware to handle authentication
-func (s *Server) handleAuth(next http.HandlerFunc) http.HandlerFunc {
+func (s *Server) handleAuth(next func(*Server, http.ResponseWriter, *http.Request)) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		start := time.Now()
 		lrw := newLoggingResponseWriter(w)
+		rl := &requestLog{start: time.Now(), w: lrw}
+		r, release := s.limitRequest(lrw, r)
+		defer release()
+		served := s
+		ctx, span := s.tracer.Start(s.tracer.Extract(r), r.Method+" "+route(r), spanServer)
+		r = r.WithContext(ctx)
+		defer func() {
+			s.requests.Observe(served.tenant, r, lrw.statusCode, time.Since(rl.start))
+			span.SetAttr("http.request.method", r.Method)
+			span.SetAttr("http.route", route(r))
+			span.SetAttr("url.path", r.URL.Path)
+			span.SetAttr("http.response.status_code", lrw.statusCode)
+			span.SetAttr("turbo.tenant", orDefault(served.tenant))
+			span.SetAttr("turbo.team", teamOf(r))
+			span.End(statusError(lrw.statusCode))
+			rl.tenant = served.tenant
+			rl.log(s.slogger, "request", r, span)
+		}()
 
-		// Log request
-		s.logger.Printf("Request: %s %s", r.Method, r.URL.Path)
+		// Replicas redirect downloads here with a presigned URL instead of a token
+		if s.federation != nil && presigned(r) && strings.HasPrefix(r.URL.Path, "/v8/artifacts/") {
+			rl.token = "presigned"
+			if !s.federation.VerifyPresigned(r) {
+				rl.reason = "invalid presigned URL"
+				http.Error(lrw, "Unauthorized", http.StatusUnauthorized)
+				return
+			}
+			r = r.WithContext(withPriority(r.Context(), s.priorities.Rank("")))
+			if s.checkAccess(lrw, r) {
+				next(s, lrw, r)
+			}
+			return
+		}
 
+		_, authSpan := s.tracer.Start(r.Context(), "auth", spanInternal)
 		auth := r.Header.Get("Authorization")
-		if !strings.HasPrefix(auth, "Bearer ") {
+		cert := clientCertificate(r)
+		if cert == nil && (s.clientAuth == clientCertOnly || s.clientAuth == clientCertBoth) {
+			rl.reason = "no client certificate"
+			authSpan.End(errors.New(rl.reason))
+			http.Error(lrw, "Client certificate required", http.StatusUnauthorized)
+			return
+		}
+		if (cert == nil || s.clientAuth == clientCertBoth) && !strings.HasPrefix(auth, "Bearer ") {
+			rl.reason = "no bearer token"
+			authSpan.End(errors.New(rl.reason))
 			http.Error(lrw, "Unauthorized", http.StatusUnauthorized)
-			s.logger.Printf("Response: %d Unauthorized (no bearer token) - %v",
-				http.StatusUnauthorized, time.Since(start))
 			return
 		}
 
-		token := strings.TrimPrefix(auth, "Bearer ")
-		if token != s.token {
+		// The token, or the token named by the client certificate, decides
+		// which tenant serves the request
+		var target *Server
+		var token *Token
+		var err error
+		if cert != nil && s.clientAuth != clientCertBoth {
+			target, token, err = s.resolveTokenName(cert.Subject.CommonName)
+		} else {
+			bearer := strings.TrimPrefix(auth, "Bearer ")
+			if s.jwt != nil && isJWT(bearer) {
+				target = s
+				token, err = s.jwt.Verify(r.Context(), bearer)
+			} else {
+				target, token, err = s.resolveTenant(bearer)
+			}
+			if err == nil && cert != nil && token.Name != cert.Subject.CommonName {
+				err = errTokenUnknown
+			}
+		}
+		if err != nil {
+			rl.reason = "invalid token"
+			if cert != nil {
+				rl.reason = fmt.Sprintf("no token for client certificate %q", cert.Subject.CommonName)
+			}
+			if errors.Is(err, errTokenExpired) {
+				rl.reason = fmt.Sprintf("token %s expired", token.Name)
+			}
+			if errors.Is(err, errInvalidJWT) {
+				rl.reason = err.Error()
+			}
+			authSpan.End(errors.New(rl.reason))
 			http.Error(lrw, "Unauthorized", http.StatusUnauthorized)
-			s.logger.Printf("Response: %d Unauthorized (invalid token) - %v",
-				http.StatusUnauthorized, time.Since(start))
+			return
+		}
+		served = target
+		rl.token = token.Name
+		if !token.canWrite() && isCacheWrite(r) {
+			rl.reason = fmt.Sprintf("token %s is read-only", token.Name)
+			authSpan.End(errors.New(rl.reason))
+			if route(r) == artifactRoute {
+				target.refuseUpload(lrw, r.PathValue("hash"), rejectUpload(http.StatusForbidden, "read_only_token", "the token %s can only read from the cache", token.Name))
+			} else {
+				http.Error(lrw, "Token is read-only", http.StatusForbidden)
+			}
+			return
+		}
+
+		if s.signatures != nil {
+			if err := s.signatures.Verify(r); err != nil {
+				rl.reason = err.Error()
+				authSpan.End(err)
+				http.Error(lrw, "Unauthorized", http.StatusUnauthorized)
+				return
+			}
+		}
+
+		if target.limiter != nil && !target.limiter.Allow() {
+			rl.reason = "rate limit exceeded"
+			authSpan.End(errors.New(rl.reason))
+			w.Header().Set("Retry-After", "1")
+			http.Error(lrw, "Rate limit exceeded", http.StatusTooManyRequests)
+			return
+		}
+
+		authSpan.SetAttr("turbo.token", token.Name)
+		authSpan.End(nil)
+
+		body := &countingReader{ReadCloser: r.Body}
+		r.Body = body
+		rl.in = body
+		r = r.WithContext(withToken(withPriority(r.Context(), s.priorities.Rank(token.Priority)), token))
+
+		var known bool
+		if r, known = target.resolveTeam(lrw, r); !known {
+			rl.reason = "team not resolved"
+			return
+		}
+		if !token.allowsTeam(teamOf(r)) {
+			rl.reason = fmt.Sprintf("token %s not allowed for team %q", token.Name, teamOf(r))
+			http.Error(lrw, "Token not allowed for this team", http.StatusForbidden)
 			return
 		}
 
-		next(lrw, r)
+		// The status endpoint reports a disabled team instead of failing
+		if r.URL.Path == "/v8/artifacts/status" || target.checkAccess(lrw, r) {
+			if target.primary != nil && isCacheWrite(r) {
+				target.primary.Forward(lrw, r)
+			} else {
+				next(target, lrw, r)
+			}
+		}
 
-		// Log response
-		s.logger.Printf("Response: %d %s - %v",
-			lrw.statusCode, http.StatusText(lrw.statusCode), time.Since(start))
+		target.tokens.RecordUsage(token, r, lrw.statusCode, body.n, lrw.bytes)
+		s.clients.Record(target.tenant, r, lrw.statusCode)
 	}
 }
 
 // Handler for /v8/artifacts/events
 func (s *Server) recordEvents(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodPost {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	var events []ArtifactEvent
+	if !s.decodeBody(w, r, &events) {
 		return
 	}
-
-	var events []ArtifactEvent
-	if err := json.NewDecoder(r.Body).Decode(&events); err != nil {
-		http.Error(w, "Invalid request body", http.StatusBadRequest)
+	if len(events) > s.maxEventBatch {
+		http.Error(w, fmt.Sprintf("Too many events in batch (max %d)", s.maxEventBatch),
+			http.StatusRequestEntityTooLarge)
 		return
 	}
 
-	// Log events
-	for _, event := range events {
-		s.logger.Printf("Cache event: %s %s %s (duration: %.2f)",
-			event.Hash, event.Source, event.Event, event.Duration)
+	// Log valid events, collect errors for the rest
+	team := teamOf(r)
+	var response EventsResponse
+	for i, event := range events {
+		if err := event.Validate(); err != nil {
+			response.Errors = append(response.Errors, EventError{
+				Index:   i,
+				Hash:    event.Hash,
+				Message: err.Error(),
+			})
+			continue
+		}
+		response.Accepted++
+		s.events.Record(team, &event)
+		s.logger.Printf("Cache event: %s %s %s (team: %q, duration: %.2f)",
+			event.Hash, event.Source, event.Event, team, event.Duration)
 	}
 
-	w.WriteHeader(http.StatusOK)
+	w.Header().Set("Content-Type", "application/json")
+	if len(response.Errors) > 0 {
+		s.logger.Printf("Rejected %d of %d cache events", len(response.Errors), len(events))
+		w.WriteHeader(http.StatusBadRequest)
+	} else {
+		w.WriteHeader(http.StatusOK)
+	}
+	json.NewEncoder(w).Encode(response)
 }
 
 // Handler for /v8/artifacts/status
 func (s *Server) getStatus(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodGet {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-		return
-	}
-
 	response := StatusResponse{
 		Status: "enabled",
 	}
+	// Reads keep working while over budget, only uploads are refused
+	if s.quotas.OverBudget() {
+		response.Status = "over_limit"
+	}
+	if _, blocked := s.switches.Blocked(s.tenant, teamOf(r), false); blocked {
+		response.Status = "disabled"
+	}
 
 	json.NewEncoder(w).Encode(response)
 }
 
+// Handler for /v8/artifacts/summary
+func (s *Server) getSummary(w http.ResponseWriter, r *http.Request) {
+	namespace := ""
+	if s.teamNamespaces {
+		namespace = teamOf(r)
+	}
+	filter, built := s.summary.Filter(s.index, namespace)
+	etag := fmt.Sprintf(`"%x"`, built.UnixNano())
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Cache-Control", fmt.Sprintf("private, max-age=%d", int(summaryMaxAge.Seconds())))
+	if r.Header.Get("If-None-Match") == etag {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	if err := filter.Encode(w); err != nil {
+		s.logger.Printf("Failed to send summary: %v", err)
+	}
+}
+
+// validHash accepts turbo's hashes while keeping them safe to use as file
+// names: only ASCII letters, digits, '-' and '_'
+func validHash(hash string) bool {
+	if hash == "" || len(hash) > 128 {
+		return false
+	}
+	for _, c := range hash {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9', c == '-', c == '_':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// teamOf returns the team a request acts on behalf of, as sent by turbo
+func teamOf(r *http.Request) string {
+	if team, ok := r.Context().Value(teamKey{}).(string); ok {
+		return team
+	}
+	if team := r.URL.Query().Get("teamId"); team != "" {
+		return team
+	}
+	return r.URL.Query().Get("slug")
+}
+
 // Handler for /v8/artifacts/{hash}
 func (s *Server) handleArtifact(w http.ResponseWriter, r *http.Request) {
-	hash := strings.TrimPrefix(r.URL.Path, "/v8/artifacts/")
+	hash := r.PathValue("hash")
+	if !validHash(hash) {
+		http.Error(w, "Invalid artifact hash", http.StatusBadRequest)
+		return
+	}
+	hash, err := variantKey(hash, r)
+	if err != nil {
+		http.Error(w, "Invalid artifact variant", http.StatusBadRequest)
+		return
+	}
+	if hash, err = s.namespaced(hash, r); err != nil {
+		http.Error(w, "Invalid team", http.StatusBadRequest)
+		return
+	}
+	if s.refuseBlocked(w, r, hash) {
+		return
+	}
+
+	if s.health != nil && s.health.Degraded() {
+		s.passThrough(w, r, hash)
+		return
+	}
 
 	switch r.Method {
 	case http.MethodGet:
@@ -252,25 +1253,127 @@ func (s *Server) handleArtifact(w http.ResponseWriter, r *http.Request) {
 		s.uploadArtifact(w, r, hash)
 	case http.MethodHead:
 		s.checkArtifact(w, r, hash)
-	default:
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 	}
 }
 
 func (s *Server) downloadArtifact(w http.ResponseWriter, r *http.Request, hash string) {
-	reader, size, err := s.storage.Get(hash)
+	if s.rehydrating(w, r, hash) {
+		return
+	}
+	_, wait := s.tracer.Start(r.Context(), "download slot", spanInternal)
+	slot, err := s.downloadLimit.Acquire(r.Context())
+	wait.End(err)
+	if err != nil {
+		refuseBusy(w, err)
+		return
+	}
+	// The slot goes back with the time spent in storage, not the time the
+	// client took to read
+	var storageTime time.Duration
+	var moved int64
+	var storageErr error
+	defer func() { slot.Done(storageTime, moved, errors.Is(storageErr, errStorageTimeout)) }()
+
+	_, span := s.tracer.Start(r.Context(), "storage get", spanInternal)
+	span.SetAttr("turbo.artifact.hash", hash)
+	defer func() {
+		span.SetAttr("turbo.artifact.size", moved)
+		span.End(storageErr)
+	}()
+	start := time.Now()
+	reader, size, err := s.storageFor(hash).Get(hash)
+	storageTime, storageErr = time.Since(start), err
+	s.recordStorageResult(err)
+	if err != nil && s.archive != nil {
+		// Archived artifacts stay available after eviction
+		reader, size, err = s.archive.Get(hash)
+	}
+	if err != nil {
+		// Fetch it from a peer or send the client there, rather than proxying
+		if s.federation != nil && !presigned(r) {
+			if s.federation.fetch || s.flags.Enabled(flagPeerFetch, s.tenant, teamOf(r)) {
+				if fetchErr := s.fetchFromPeer(r, hash); fetchErr == nil {
+					reader, size, err = s.storageFor(hash).Get(hash)
+				} else if !errors.Is(fetchErr, errArtifactNotFound) {
+					s.logger.Printf("Fetching %s from peers failed: %v", hash, fetchErr)
+				}
+			} else if location, ok := s.federation.Locate(r, hash); ok {
+				s.logger.Printf("Redirecting download of %s to %s", hash, location[:strings.Index(location, "?")])
+				http.Redirect(w, r, location, http.StatusTemporaryRedirect)
+				return
+			}
+		}
+	}
+	if err != nil && s.primary != nil && s.primary.forwardMisses {
+		s.logger.Printf("Cache miss for %s, asking the primary: %v", hash, err)
+		s.metrics.RecordMiss()
+		s.primary.Forward(w, r)
+		return
+	}
 	if err != nil {
-		s.logger.Printf("Download failed for hash %s: %v", hash, err)
+		s.logger.Printf("Cache miss for %s: %v", hash, err)
+		s.metrics.RecordMiss()
 		http.Error(w, "Artifact not found", http.StatusNotFound)
 		return
 	}
 	defer reader.Close()
+	s.index.Touch(hash)
+	s.metrics.RecordHit()
 
-	w.Header().Set("Content-Length", fmt.Sprintf("%d", size))
+	m, _ := s.index.Get(hash)
 	w.Header().Set("Content-Type", "application/octet-stream")
+	if m.Digest != "" {
+		w.Header().Set("ETag", artifactETag(m))
+		w.Header().Set(digestHeader, m.Digest)
+	}
+	// Clients asking for trailers get the digest of what was sent as well
+	algorithm, sent := s.sentDigest(r, m)
+	if sent != nil {
+		w.Header().Set("Trailer", sentDigestHeader)
+	}
+	// HTTP/1.1 only sends trailers after a chunked body
+	if sent == nil || r.ProtoMajor >= 2 {
+		w.Header().Set("Content-Length", fmt.Sprintf("%d", size))
+	}
 
-	if _, err := io.Copy(w, reader); err != nil {
+	transfer := s.transfers.Start(transferDownload, hash, w, r, size)
+	defer s.transfers.Finish(transfer)
+	var out io.Writer = &transferWriter{w: w, transfer: transfer}
+	if sent != nil {
+		out = io.MultiWriter(out, sent)
+	}
+	timed := &timedReader{r: reader}
+	var n int64
+	if storage.Mapped(reader) {
+		// A mapped file is written to the client without reads to time; its
+		// page faults count as time spent on the client
+		n, err = reader.(io.WriterTo).WriteTo(out)
+	} else {
+		n, err = io.Copy(out, timed)
+	}
+	storageTime += timed.spent
+	moved, storageErr = n, err
+	s.metrics.RecordDownload(n)
+	if err == nil && sent != nil && n != size {
+		// Without a Content-Length the client would take what it got for
+		// the whole artifact
+		s.logger.Printf("Error streaming artifact %s: sent %d of %d bytes", hash, n, size)
+		panic(http.ErrAbortHandler)
+	}
+	if err == nil && sent != nil {
+		digest := formatDigest(algorithm, sent)
+		w.Header().Set(sentDigestHeader, digest)
+		if m.Digest != "" && digest != m.Digest {
+			s.logger.Printf("Failed to verify artifact %s while sending it: %v: %s, recorded %s", hash, errDigestMismatch, digest, m.Digest)
+		}
+	}
+	if err != nil {
 		s.logger.Printf("Error streaming artifact %s: %v", hash, err)
+		if errors.Is(err, errStorageTimeout) {
+			// Reset the connection so the client can't mistake a stalled
+			// download for a complete one
+			panic(http.ErrAbortHandler)
+		}
 		return
 	}
 }
@@ -281,12 +1384,227 @@ func (s *Server) uploadArtifact(w http.ResponseWriter, r *http.Request, hash str
 		http.Error(w, "Content-Length required", http.StatusBadRequest)
 		return
 	}
+	size, err := strconv.ParseInt(contentLength, 10, 64)
+	if err != nil || size < 0 {
+		http.Error(w, "Invalid Content-Length", http.StatusBadRequest)
+		return
+	}
+	if s.maxArtifactSize > 0 && size > s.maxArtifactSize {
+		s.refuseUpload(w, hash, rejectUpload(http.StatusRequestEntityTooLarge, "artifact_too_large",
+			"artifact of %s exceeds the %s size limit", formatSize(size), formatSize(s.maxArtifactSize)))
+		return
+	}
+	if s.maxArtifactSize > 0 {
+		// The server stops at Content-Length already; this also holds for
+		// bodies it can't bound that way
+		r.Body = http.MaxBytesReader(w, r.Body, s.maxArtifactSize)
+	}
+
+	if conditional(r) {
+		unlock, err := s.index.LockHash(r.Context(), hash)
+		if err != nil {
+			http.Error(w, "Server busy", http.StatusServiceUnavailable)
+			return
+		}
+		defer unlock()
+		met, err := s.preconditionsMet(r, hash)
+		if err != nil {
+			s.logger.Printf("Error checking artifact %s: %v", hash, err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		if !met {
+			http.Error(w, "Precondition failed", http.StatusPreconditionFailed)
+			return
+		}
+	}
+
+	team := teamOf(r)
+	var callback string
+	if s.callbacks != nil {
+		if callback, err = s.callbacks.Target(r); err != nil {
+			http.Error(w, "Callback URL not allowed", http.StatusBadRequest)
+			return
+		}
+	}
+	tags := parseTags(r.Header.Get(tagsHeader))
+	if !s.checkUpload(w, r, UploadCheck{Hash: hash, Team: team, Tenant: s.tenant, Size: size, Tags: tags}) {
+		return
+	}
+
+	class := s.classFor(size)
+	reservation, err := s.quotas.Reserve(team, hash, class.Name, size)
+	if errors.Is(err, errStorageFull) && class.Evictor != nil {
+		class.Evictor.Evict(size, 1)
+		reservation, err = s.quotas.Reserve(team, hash, class.Name, size)
+	}
+	if errors.Is(err, errStorageFull) {
+		s.refuseUpload(w, hash, rejectUpload(http.StatusInsufficientStorage, "cache_full", "the cache is full, uploads are paused"))
+		return
+	}
+	if err != nil {
+		used, reserved := s.quotas.Usage(team)
+		s.refuseUpload(w, hash, rejectUpload(http.StatusForbidden, "team_quota_exceeded",
+			"artifact of %s exceeds the %s quota of team %q (%s used)",
+			formatSize(size), formatSize(s.quotas.Limit(team)), team, formatSize(used+reserved)))
+		return
+	}
+	defer reservation.Release()
+	s.index.StartUpload(hash)
+	defer s.index.FinishUpload(hash)
+
+	previous, replacing := s.index.Get(hash)
+	if replacing && previous.retained(s.index.clock.Now()) {
+		s.refuseUpload(w, hash, rejectUpload(http.StatusConflict, "artifact_retained",
+			"artifact is retained until %s and can't be replaced", previous.RetainUntil.Format(time.RFC3339)))
+		return
+	}
+
+	_, wait := s.tracer.Start(r.Context(), "upload slot", spanInternal)
+	slot, err := s.uploadLimit.Acquire(r.Context())
+	wait.End(err)
+	if err != nil {
+		refuseBusy(w, err)
+		return
+	}
+
+	retainUntil := s.compliance.RetainUntil(tags, s.index.clock.Now())
+	transfer := s.transfers.Start(transferUpload, hash, w, r, size)
+	defer s.transfers.Finish(transfer)
+	body := &countingReader{ReadCloser: &transferReader{ReadCloser: r.Body, transfer: transfer}}
+	client := &timedReader{r: body}
+	algorithm, digest := s.contentHash()
+	content := io.TeeReader(&fullReader{r: client, remaining: size}, digest)
 
-	if err := s.storage.Store(hash, r.Body); err != nil {
+	// The slot is given back once the artifact is stored, or when the
+	// upload fails before that
+	stored := time.Now()
+	finish := func(err error) {
+		slot.Done(time.Since(stored)-client.spent, body.n, errors.Is(err, errStorageTimeout))
+		slot = nil
+	}
+	defer func() { finish(nil) }()
+	_, span := s.tracer.Start(r.Context(), "storage store", spanInternal)
+	span.SetAttr("turbo.artifact.hash", hash)
+	span.SetAttr("turbo.artifact.size", size)
+	span.SetAttr("turbo.size_class", orDefault(class.Name))
+	if s.spool != nil {
+		_, spoolSpan := s.tracer.Start(r.Context(), "spool", spanInternal)
+		spooled, spoolErr := s.spool.Spool(content, r, size)
+		spoolSpan.End(spoolErr)
+		if spoolErr != nil {
+			span.End(spoolErr)
+		}
+		if spoolErr != nil && s.callbacks != nil {
+			s.callbacks.Failed(callback, UploadCallback{Hash: hash, Team: team, Size: size}, spoolErr)
+		}
+		if tooLarge(spoolErr) {
+			http.Error(w, "Artifact too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		if uploadAborted(r, spoolErr) {
+			s.logger.Printf("Upload of %s aborted by client after %d of %d bytes", hash, body.n, size)
+			s.metrics.RecordAbortedUpload()
+			http.Error(w, "Upload incomplete", http.StatusBadRequest)
+			return
+		}
+		if errors.Is(spoolErr, errBodyDigest) {
+			s.refuseUpload(w, hash, rejectUpload(http.StatusBadRequest, "body_digest_mismatch", "%v", spoolErr))
+			return
+		}
+		if errors.Is(spoolErr, errUploadInvalid) {
+			s.refuseUpload(w, hash, rejectUpload(http.StatusBadRequest, "invalid_artifact", "%v", spoolErr))
+			return
+		}
+		if spoolErr != nil {
+			s.logger.Printf("Upload failed for hash %s: %v", hash, spoolErr)
+			http.Error(w, "Failed to store artifact", http.StatusInternalServerError)
+			return
+		}
+		defer s.spool.Discard(spooled)
+		describeArtifact(class.Storage, hash, ArtifactDetails{Team: team, Tags: tags, RetainUntil: retainUntil})
+		err = promote(class.Storage, hash, spooled)
+	} else {
+		describeArtifact(class.Storage, hash, ArtifactDetails{Team: team, Tags: tags, RetainUntil: retainUntil})
+		err = class.Storage.Store(hash, content)
+	}
+	span.End(err)
+	finish(err)
+	if err != nil {
+		// Stores are atomic, so a failed write leaves any previous copy, and
+		// one a concurrent upload of the hash just stored, in place
+		if errors.Is(err, errStorageTimeout) {
+			s.recordStorageResult(err)
+			s.logger.Printf("Upload failed for hash %s: %v", hash, err)
+			if s.callbacks != nil {
+				s.callbacks.Failed(callback, UploadCallback{Hash: hash, Team: team, Size: size}, err)
+			}
+			http.Error(w, "Storage timed out", http.StatusServiceUnavailable)
+			return
+		}
+		if tooLarge(err) {
+			s.logger.Printf("Upload of %s exceeded the %d byte limit", hash, s.maxArtifactSize)
+			http.Error(w, "Artifact too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		if errors.Is(err, errBodyDigest) {
+			if s.callbacks != nil {
+				s.callbacks.Failed(callback, UploadCallback{Hash: hash, Team: team, Size: size}, err)
+			}
+			s.refuseUpload(w, hash, rejectUpload(http.StatusBadRequest, "body_digest_mismatch", "%v", err))
+			return
+		}
+		if uploadAborted(r, err) {
+			s.logger.Printf("Upload of %s aborted by client after %d of %d bytes", hash, body.n, size)
+			s.metrics.RecordAbortedUpload()
+			if s.callbacks != nil {
+				s.callbacks.Failed(callback, UploadCallback{Hash: hash, Team: team, Size: size}, err)
+			}
+			http.Error(w, "Upload incomplete", http.StatusBadRequest)
+			return
+		}
+		s.recordStorageResult(err)
 		s.logger.Printf("Upload failed for hash %s: %v", hash, err)
+		if s.callbacks != nil {
+			s.callbacks.Failed(callback, UploadCallback{Hash: hash, Team: team, Size: size}, err)
+		}
 		http.Error(w, "Failed to store artifact", http.StatusInternalServerError)
 		return
 	}
+	s.recordStorageResult(nil)
+
+	// Turbo reports how long the task took to produce the artifact
+	duration, _ := strconv.ParseFloat(r.Header.Get("x-artifact-duration"), 64)
+
+	meta := &ArtifactMeta{
+		Hash:       hash,
+		Size:       body.n,
+		Digest:     formatDigest(algorithm, digest),
+		Team:       team,
+		DurationMs: duration,
+		Tags:       tags,
+		Metadata:   s.captureMetadata(r),
+		Class:      class.Name,
+		CreatedAt:  s.index.clock.Now(),
+
+		RetainUntil: retainUntil,
+	}
+	s.index.Put(meta)
+	if replacing && previous.Class != class.Name {
+		if err := s.classByName(previous.Class).Storage.Delete(hash); err != nil {
+			s.logger.Printf("Failed to remove previous copy of %s: %v", hash, err)
+		}
+	}
+	if class.Evictor != nil {
+		class.Evictor.Notify()
+	}
+	s.metrics.RecordUpload(body.n)
+	if s.archive != nil && s.archive.Matches(tags) {
+		s.archive.Enqueue(hash, class.Storage)
+	}
+	if s.callbacks != nil {
+		s.callbacks.Persisted(callback, class.Storage, UploadCallback{Hash: hash, Team: team, Size: body.n})
+	}
 
 	response := UploadResponse{
 		URLs: []string{
@@ -294,42 +1612,94 @@ func (s *Server) uploadArtifact(w http.ResponseWriter, r *http.Request, hash str
 		},
 	}
 
+	w.Header().Set("ETag", artifactETag(*meta))
 	w.WriteHeader(http.StatusAccepted)
 	json.NewEncoder(w).Encode(response)
 }
 
 func (s *Server) checkArtifact(w http.ResponseWriter, r *http.Request, hash string) {
-	exists, err := s.storage.Exists(hash)
+	_, span := s.tracer.Start(r.Context(), "storage exists", spanInternal)
+	span.SetAttr("turbo.artifact.hash", hash)
+	exists, err := s.storageFor(hash).Exists(hash)
+	s.recordStorageResult(err)
+	if err == nil && !exists && s.archive != nil {
+		exists, err = s.archive.storage.Exists(hash)
+	}
+	span.End(err)
 	if err != nil {
 		s.logger.Printf("Error checking artifact %s: %v", hash, err)
 		http.Error(w, "Internal server error", http.StatusInternalServerError)
 		return
 	}
 
+	if !exists && s.primary != nil && s.primary.forwardMisses {
+		s.primary.Forward(w, r)
+		return
+	}
 	if !exists {
 		http.Error(w, "Artifact not found", http.StatusNotFound)
 		return
 	}
 
+	if m, ok := s.index.Get(hash); ok && m.Digest != "" {
+		w.Header().Set("ETag", artifactETag(m))
+		w.Header().Set(digestHeader, m.Digest)
+	}
 	w.WriteHeader(http.StatusOK)
 }
 
-// Handler for /v8/artifacts (POST - query)
+// Handler for POST /v8/artifacts (query)
 func (s *Server) queryArtifacts(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodPost {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-		return
-	}
-
 	var req ArtifactQueryRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		http.Error(w, "Invalid request body", http.StatusBadRequest)
+	if !s.decodeBody(w, r, &req) {
 		return
 	}
+	details := r.URL.Query().Get("details") == "true"
 
 	response := make(map[string]*ArtifactInfo)
 	for _, hash := range req.Hashes {
-		reader, size, err := s.storage.Get(hash)
+		if !validHash(hash) {
+			response[hash] = &ArtifactInfo{
+				Error: &struct {
+					Message string `json:"message"`
+				}{
+					Message: "Invalid artifact hash",
+				},
+			}
+			continue
+		}
+		key, err := variantKey(hash, r)
+		if err != nil {
+			response[hash] = &ArtifactInfo{
+				Error: &struct {
+					Message string `json:"message"`
+				}{
+					Message: "Invalid artifact variant",
+				},
+			}
+			continue
+		}
+		if key, err = s.namespaced(key, r); err != nil {
+			response[hash] = &ArtifactInfo{
+				Error: &struct {
+					Message string `json:"message"`
+				}{
+					Message: "Invalid team",
+				},
+			}
+			continue
+		}
+		if s.blocklist.Refuse(key) {
+			response[hash] = &ArtifactInfo{
+				Error: &struct {
+					Message string `json:"message"`
+				}{
+					Message: "Artifact is blocked",
+				},
+			}
+			continue
+		}
+		reader, size, err := s.storageFor(key).Get(key)
 		if err != nil {
 			response[hash] = &ArtifactInfo{
 				Error: &struct {
@@ -345,6 +1715,18 @@ func (s *Server) queryArtifacts(w http.ResponseWriter, r *http.Request) {
 		response[hash] = &ArtifactInfo{
 			Size: int(size),
 		}
+		if m, ok := s.index.Get(key); ok {
+			response[hash].Metadata = m.Metadata
+			if details {
+				info := response[hash]
+				info.TaskDurationMs = m.DurationMs
+				info.Team, info.Tags, info.Hits = m.Team, m.Tags, m.Hits
+				info.UploadedAt = &m.CreatedAt
+				if !m.LastAccess.IsZero() {
+					info.LastAccess = &m.LastAccess
+				}
+			}
+		}
 	}
 
 	json.NewEncoder(w).Encode(response)
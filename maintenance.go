@@ -0,0 +1,350 @@
+package cachesrv
+
+import (
+	"context"
+	"errors"
+	"hash"
+	"io"
+	"log"
+	"sync"
+	"time"
+
+	"lukechampine.com/blake3"
+)
+
+// IOLimiter paces background disk I/O to a maximum rate of bytes and
+// operations per second, so maintenance doesn't starve live requests. A nil
+// or zero limiter doesn't limit.
+type IOLimiter struct {
+	bytesPerSec float64
+	opsPerSec   float64
+
+	mu       sync.Mutex
+	nextOp   time.Time
+	nextByte time.Time
+}
+
+func NewIOLimiter(bytesPerSec, opsPerSec float64) *IOLimiter {
+	return &IOLimiter{bytesPerSec: bytesPerSec, opsPerSec: opsPerSec}
+}
+
+// Wait blocks until one operation transferring n bytes may proceed
+func (l *IOLimiter) Wait(ctx context.Context, n int64) error {
+	if l == nil {
+		return nil
+	}
+
+	l.mu.Lock()
+	now := time.Now()
+	at := now
+	if l.opsPerSec > 0 {
+		if l.nextOp.After(at) {
+			at = l.nextOp
+		}
+		l.nextOp = later(now, l.nextOp).Add(time.Duration(float64(time.Second) / l.opsPerSec))
+	}
+	if l.bytesPerSec > 0 && n > 0 {
+		if l.nextByte.After(at) {
+			at = l.nextByte
+		}
+		l.nextByte = later(now, l.nextByte).Add(time.Duration(float64(n) / l.bytesPerSec * float64(time.Second)))
+	}
+	l.mu.Unlock()
+
+	wait := time.Until(at)
+	if wait <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func later(a, b time.Time) time.Time {
+	if a.After(b) {
+		return a
+	}
+	return b
+}
+
+// limitedReader reads through an IOLimiter in chunks
+type limitedReader struct {
+	ctx     context.Context
+	r       io.Reader
+	limiter *IOLimiter
+}
+
+func (lr *limitedReader) Read(p []byte) (int, error) {
+	const chunk = 1 << 20
+	if len(p) > chunk {
+		p = p[:chunk]
+	}
+	if err := lr.limiter.Wait(lr.ctx, int64(len(p))); err != nil {
+		return 0, err
+	}
+	return lr.r.Read(p)
+}
+
+// ScanReport summarizes a maintenance scan
+type ScanReport struct {
+	Scanned  int           `json:"scanned"`
+	Adopted  int           `json:"adopted"`
+	Missing  int           `json:"missing"`
+	Verified int           `json:"verified"`
+	Corrupt  []string      `json:"corrupt,omitempty"`
+	Errors   int           `json:"errors"`
+	Duration time.Duration `json:"durationNs"`
+	// Removed lists the missing and corrupt artifacts dropped from the cache
+	Removed *PurgeReport `json:"removed"`
+}
+
+// Scanner garbage collects the metadata index against the stored files and,
+// when verifying, reads every artifact back to catch truncated files. The
+// work is split into shards processed in parallel, all sharing one IOLimiter.
+type Scanner struct {
+	index   *MetadataIndex
+	classes []*SizeClass
+	limiter *IOLimiter
+	workers int
+	logger  *log.Logger
+	// limit lowers the number of workers verifying at once while storage is
+	// slow, nil to always use all of them
+	limit *AdaptiveLimit
+
+	running sync.Mutex
+}
+
+var errScanRunning = errors.New("a scan is already running")
+
+// scanSettle is how long a file must be untouched before a scan considers it
+const scanSettle = time.Minute
+
+func NewScanner(index *MetadataIndex, classes []*SizeClass, limiter *IOLimiter, workers int, logger *log.Logger) *Scanner {
+	if workers < 1 {
+		workers = 1
+	}
+	return &Scanner{
+		index:   index,
+		classes: classes,
+		limiter: limiter,
+		workers: workers,
+		logger:  logger,
+	}
+}
+
+// Run scans at every interval; verification scans run every verifyEvery-th
+// time, or never if verifyEvery is 0
+func (sc *Scanner) Run(interval time.Duration, verifyEvery int, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for n := 1; ; n++ {
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+		verify := verifyEvery > 0 && n%verifyEvery == 0
+		if _, err := sc.Scan(context.Background(), verify, false, nil); err != nil {
+			sc.logger.Printf("Maintenance scan failed: %v", err)
+		}
+	}
+}
+
+// Scan runs one pass over every size class; a dry run only reports what it
+// would adopt and remove
+func (sc *Scanner) Scan(ctx context.Context, verify, dryRun bool, job *Job) (*ScanReport, error) {
+	if !sc.running.TryLock() {
+		return nil, errScanRunning
+	}
+	defer sc.running.Unlock()
+
+	start := time.Now()
+	report := &ScanReport{Removed: &PurgeReport{DryRun: dryRun, Artifacts: []PurgedArtifact{}}}
+	var mu sync.Mutex
+
+	for _, class := range sc.classes {
+		if err := sc.limiter.Wait(ctx, 0); err != nil {
+			return nil, err
+		}
+		stored, err := class.Storage.List()
+		if err != nil {
+			return nil, err
+		}
+
+		job.AddTotal(len(stored))
+		onDisk := make(map[string]bool, len(stored))
+		for _, a := range stored {
+			onDisk[a.Hash] = true
+		}
+
+		var corrupt []ArtifactMeta
+		var wg sync.WaitGroup
+		for shard := 0; shard < sc.workers; shard++ {
+			wg.Add(1)
+			go func(shard int) {
+				defer wg.Done()
+				for i := shard; i < len(stored); i += sc.workers {
+					if ctx.Err() != nil {
+						return
+					}
+					job.Advance(1)
+					// Files still being written are left to their upload
+					if stored[i].ModTime.After(start.Add(-scanSettle)) {
+						continue
+					}
+					var slot *AdaptiveSlot
+					if verify {
+						var err error
+						if slot, err = sc.limit.Acquire(ctx); err != nil {
+							return
+						}
+					}
+					r := sc.scanOne(ctx, class, stored[i], verify, dryRun)
+					slot.Done(r.storageTime, r.bytes, r.err)
+					mu.Lock()
+					report.add(r)
+					if r.corrupt != nil {
+						corrupt = append(corrupt, *r.corrupt)
+					}
+					mu.Unlock()
+				}
+			}(shard)
+		}
+		wg.Wait()
+
+		// Index entries whose file is gone can't be served and only skew accounting
+		var missing []ArtifactMeta
+		for _, m := range sc.index.Snapshot(class.Name) {
+			if !onDisk[m.Hash] && m.CreatedAt.Before(start) {
+				missing = append(missing, m)
+			}
+		}
+		removed := purgeArtifacts(ctx, job, sc.index, sc.classes, missing, dryRun, sc.logger)
+		report.Missing += removed.Count
+		report.Removed.merge(removed)
+		report.Removed.merge(purgeArtifacts(ctx, job, sc.index, sc.classes, corrupt, dryRun, sc.logger))
+	}
+
+	report.Duration = time.Since(start)
+	if dryRun {
+		return report, ctx.Err()
+	}
+	sc.logger.Printf("Maintenance scan: %d scanned, %d adopted, %d missing, %d verified, %d corrupt, %d errors in %v",
+		report.Scanned, report.Adopted, report.Missing, report.Verified, len(report.Corrupt), report.Errors, report.Duration)
+	return report, ctx.Err()
+}
+
+type scanResult struct {
+	adopted  bool
+	verified bool
+	corrupt  *ArtifactMeta
+	err      bool
+	// storageTime is the time spent reading bytes from storage
+	storageTime time.Duration
+	bytes       int64
+}
+
+func (r *ScanReport) add(res scanResult) {
+	r.Scanned++
+	if res.adopted {
+		r.Adopted++
+	}
+	if res.verified {
+		r.Verified++
+	}
+	if res.corrupt != nil {
+		r.Corrupt = append(r.Corrupt, res.corrupt.Hash)
+	}
+	if res.err {
+		r.Errors++
+	}
+}
+
+func (sc *Scanner) scanOne(ctx context.Context, class *SizeClass, a ArtifactStat, verify, dryRun bool) scanResult {
+	var res scanResult
+
+	m, ok := sc.index.Get(a.Hash)
+	if !ok {
+		// Files nobody indexed (e.g. written before a crash) still count against budgets
+		m = ArtifactMeta{Hash: a.Hash, Size: a.Size, Class: class.Name, CreatedAt: a.ModTime}
+		if !dryRun {
+			sc.index.Put(&m)
+		}
+		res.adopted = true
+	}
+	if !verify {
+		return res
+	}
+
+	if err := sc.limiter.Wait(ctx, 0); err != nil {
+		return res
+	}
+	start := time.Now()
+	reader, _, err := class.Storage.Get(a.Hash)
+	res.storageTime = time.Since(start)
+	if err != nil {
+		sc.logger.Printf("Verification of %s failed: %v", a.Hash, err)
+		res.err = true
+		return res
+	}
+	// BLAKE3 hashes at disk speed, so every scan checks it. Artifacts recorded
+	// with a slower digest are checked against that too, once, and then only
+	// against the BLAKE3 digest of the confirmed content.
+	fast := blake3.New(32, nil)
+	var recorded string
+	var slow hash.Hash
+	writer := io.Writer(fast)
+	if m.VerifyDigest == "" && m.Digest != "" {
+		if recorded, _, err = parseDigest(m.Digest); err == nil && recorded != digestBLAKE3 {
+			slow, _ = newDigest(recorded)
+			writer = io.MultiWriter(fast, slow)
+		}
+	}
+	// Large writes let BLAKE3 hash many chunks at once with SIMD
+	buf := make([]byte, min(max(m.Size, 1), 1<<20))
+	timed := &timedReader{r: reader}
+	n, err := io.CopyBuffer(writer, &limitedReader{ctx: ctx, r: timed, limiter: sc.limiter}, buf)
+	reader.Close()
+	res.storageTime += timed.spent
+	res.bytes = n
+	if err != nil {
+		if ctx.Err() == nil {
+			sc.logger.Printf("Verification of %s failed: %v", a.Hash, err)
+			res.err = true
+		}
+		return res
+	}
+
+	if n != m.Size {
+		sc.logger.Printf("Artifact %s is corrupt: read %d bytes, expected %d", a.Hash, n, m.Size)
+		res.corrupt = &m
+		return res
+	}
+
+	digest := formatDigest(digestBLAKE3, fast)
+	expected := m.VerifyDigest
+	switch {
+	case expected == "" && slow != nil:
+		expected = m.Digest
+		digest = formatDigest(recorded, slow)
+	case expected == "":
+		// Digest is already BLAKE3, or was never recorded and this content is
+		// trusted from now on
+		expected = m.Digest
+	}
+	if expected != "" && digest != expected {
+		sc.logger.Printf("Artifact %s is corrupt: digest %s, expected %s", a.Hash, digest, expected)
+		res.corrupt = &m
+		return res
+	}
+	if m.VerifyDigest == "" && (slow != nil || m.Digest == "") && !dryRun {
+		sc.index.SetVerifyDigest(&m, formatDigest(digestBLAKE3, fast))
+	}
+	res.verified = true
+	return res
+}
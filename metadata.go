@@ -0,0 +1,494 @@
+package cachesrv
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// ArtifactMeta is what the server knows about a stored artifact beyond its bytes
+type ArtifactMeta struct {
+	Hash       string    `json:"hash"`
+	Size       int64     `json:"size"`
+	Digest     string    `json:"digest,omitempty"`
+	Team       string    `json:"team,omitempty"`
+	Class      string    `json:"class,omitempty"`
+	DurationMs float64   `json:"durationMs,omitempty"`
+	Tags       []string  `json:"tags,omitempty"`
+	CreatedAt  time.Time `json:"createdAt"`
+	LastAccess time.Time `json:"lastAccess,omitempty"`
+	Hits       int64     `json:"hits,omitempty"`
+
+	// RetainUntil is when the retention of a compliance upload ends
+	RetainUntil time.Time `json:"retainUntil,omitempty"`
+
+	// Metadata holds the request headers listed in TURBO_METADATA_HEADERS
+	Metadata map[string]string `json:"metadata,omitempty"`
+
+	// VerifyDigest is the BLAKE3 digest verification scans check, recorded by
+	// the first scan that confirmed Digest
+	VerifyDigest string `json:"verifyDigest,omitempty"`
+}
+
+// retained reports whether a compliance upload must still be kept as is
+func (m *ArtifactMeta) retained(now time.Time) bool {
+	return now.Before(m.RetainUntil)
+}
+
+// lastUsed is the last download, or the upload time if never downloaded
+func (m *ArtifactMeta) lastUsed() time.Time {
+	if m.LastAccess.After(m.CreatedAt) {
+		return m.LastAccess
+	}
+	return m.CreatedAt
+}
+
+// MetadataIndex keeps artifact metadata in memory and snapshots it to a JSON
+// file in the background, optionally journaling changes in between. On
+// startup it is reconciled against the storage directory so that files
+// written before a crash are still accounted for.
+type MetadataIndex struct {
+	mu         sync.RWMutex
+	path       string
+	entries    map[string]*ArtifactMeta
+	teamBytes  map[string]int64
+	classBytes map[string]int64
+	classCount map[string]int64
+	total      int64
+	dirty      bool
+	logger     *log.Logger
+	// clock stamps uploads and downloads and is what eviction and expiry
+	// compare those times with; the simulator replaces it
+	clock Clock
+	// uploading counts the writes in flight per hash
+	uploading map[string]int
+	// locks are held by conditional uploads, see LockHash
+	locks map[string]*hashLock
+
+	// journal is the open write-ahead log generation, nil unless enabled
+	journal    *os.File
+	journalGen int
+
+	// inline holds the bytes of the inline size class, nil if it is off
+	inline *InlineStorage
+}
+
+// indexEntry is an entry of the snapshot, with the bytes of an inline artifact
+type indexEntry struct {
+	*ArtifactMeta
+	Inline []byte `json:"inline,omitempty"`
+}
+
+// NewMetadataIndex loads the index and reconciles it with the storage of
+// every size class
+func NewMetadataIndex(path string, storages map[string]Storage, logger *log.Logger) (*MetadataIndex, error) {
+	idx := &MetadataIndex{
+		path:       path,
+		entries:    make(map[string]*ArtifactMeta),
+		teamBytes:  make(map[string]int64),
+		classBytes: make(map[string]int64),
+		classCount: make(map[string]int64),
+		logger:     logger,
+		clock:      systemClock{},
+		uploading:  make(map[string]int),
+		locks:      make(map[string]*hashLock),
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, fmt.Errorf("failed to create metadata directory: %w", err)
+	}
+
+	var saved []indexEntry
+	data, err := os.ReadFile(path)
+	switch {
+	case os.IsNotExist(err):
+	case err != nil:
+		return nil, fmt.Errorf("failed to read metadata index: %w", err)
+	default:
+		if err := json.Unmarshal(data, &saved); err != nil {
+			logger.Printf("Metadata index is corrupt, rebuilding from storage: %v", err)
+			saved = nil
+		}
+	}
+	known := make(map[string]*ArtifactMeta, len(saved))
+	blobs := make(map[string][]byte)
+	for _, e := range saved {
+		if e.ArtifactMeta == nil {
+			continue
+		}
+		known[e.Hash] = e.ArtifactMeta
+		if e.Inline != nil {
+			blobs[e.Hash] = e.Inline
+		}
+	}
+	replayed, next, err := idx.replayJournal(known, blobs)
+	if err != nil {
+		return nil, err
+	}
+	idx.journalGen = next
+	if replayed > 0 {
+		logger.Printf("Replayed %d metadata journal records", replayed)
+		idx.dirty = true
+	}
+
+	for class, storage := range storages {
+		if inline, ok := unwrapStorage(storage).(*InlineStorage); ok {
+			idx.inline = inline
+			inline.index = idx
+			continue
+		}
+		stored, err := storage.List()
+		if err != nil {
+			return nil, err
+		}
+		for _, a := range stored {
+			m, ok := known[a.Hash]
+			if !ok || m.Size != a.Size || m.Class != class {
+				m = &ArtifactMeta{Hash: a.Hash, Size: a.Size, Class: class, CreatedAt: a.ModTime}
+				if prev, ok := known[a.Hash]; ok {
+					m.Team = prev.Team
+				}
+				idx.dirty = true
+			}
+			idx.add(m)
+		}
+	}
+	// Inline artifacts are stored by the index itself: their entries are
+	// kept if the snapshot or the journal has all their bytes
+	if idx.inline != nil {
+		for hash, m := range known {
+			if _, ok := idx.entries[hash]; ok || m.Class != inlineClass {
+				continue
+			}
+			if blob := blobs[hash]; int64(len(blob)) == m.Size {
+				idx.inline.restore(hash, blob, m.CreatedAt)
+				idx.add(m)
+			}
+		}
+	}
+	if len(known) != len(idx.entries) {
+		idx.dirty = true
+	}
+	return idx, nil
+}
+
+// Put records or replaces the metadata for an artifact
+func (idx *MetadataIndex) Put(m *ArtifactMeta) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	idx.remove(m.Hash)
+	idx.add(m)
+	idx.dirty = true
+	idx.record(journalRecord{Op: "put", Meta: m}, true)
+}
+
+// Get returns a copy of an artifact's metadata
+func (idx *MetadataIndex) Get(hash string) (ArtifactMeta, bool) {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+	m, ok := idx.entries[hash]
+	if !ok {
+		return ArtifactMeta{}, false
+	}
+	return *m, true
+}
+
+// Touch records a download of an artifact
+func (idx *MetadataIndex) Touch(hash string) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	if m, ok := idx.entries[hash]; ok {
+		m.LastAccess = idx.clock.Now()
+		m.Hits++
+		idx.dirty = true
+		idx.record(journalRecord{Op: "put", Meta: m}, false)
+	}
+}
+
+// SetVerifyDigest records the verification digest of an artifact if it is
+// still the same upload as m
+func (idx *MetadataIndex) SetVerifyDigest(m *ArtifactMeta, digest string) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	current, ok := idx.entries[m.Hash]
+	if !ok || !current.CreatedAt.Equal(m.CreatedAt) || current.Size != m.Size {
+		return
+	}
+	current.VerifyDigest = digest
+	idx.dirty = true
+	idx.record(journalRecord{Op: "put", Meta: current}, false)
+}
+
+// Snapshot returns a copy of all entries in a size class
+func (idx *MetadataIndex) Snapshot(class string) []ArtifactMeta {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+	entries := make([]ArtifactMeta, 0, len(idx.entries))
+	for _, m := range idx.entries {
+		if m.Class == class {
+			entries = append(entries, *m)
+		}
+	}
+	return entries
+}
+
+// All returns a copy of every entry, consistent as of one instant
+func (idx *MetadataIndex) All() []ArtifactMeta {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+	entries := make([]ArtifactMeta, 0, len(idx.entries))
+	for _, m := range idx.entries {
+		entries = append(entries, *m)
+	}
+	return entries
+}
+
+// Hashes returns the hashes of all indexed artifacts
+func (idx *MetadataIndex) Hashes() []string {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+	hashes := make([]string, 0, len(idx.entries))
+	for hash := range idx.entries {
+		hashes = append(hashes, hash)
+	}
+	return hashes
+}
+
+// Find returns a copy of every entry whose metadata has all the given values
+func (idx *MetadataIndex) Find(metadata map[string]string) []ArtifactMeta {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+	var entries []ArtifactMeta
+	for _, m := range idx.entries {
+		matches := true
+		for key, value := range metadata {
+			if m.Metadata[key] != value {
+				matches = false
+				break
+			}
+		}
+		if matches {
+			entries = append(entries, *m)
+		}
+	}
+	return entries
+}
+
+// StartUpload marks a hash as being written until FinishUpload, keeping
+// its previous upload from eviction, expiry and purges. Those delete the
+// file by hash, so they could remove the new one after it was stored and
+// before it is recorded.
+func (idx *MetadataIndex) StartUpload(hash string) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	idx.uploading[hash]++
+}
+
+func (idx *MetadataIndex) FinishUpload(hash string) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	if idx.uploading[hash]--; idx.uploading[hash] <= 0 {
+		delete(idx.uploading, hash)
+	}
+}
+
+// Uploading counts the uploads received but not yet recorded
+func (idx *MetadataIndex) Uploading() int {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+	uploading := 0
+	for _, n := range idx.uploading {
+		uploading += n
+	}
+	return uploading
+}
+
+// DeleteIfUnchanged forgets an artifact only if it is still the same upload
+// as m, not retained and not being uploaded again, reporting whether it did
+func (idx *MetadataIndex) DeleteIfUnchanged(m *ArtifactMeta) bool {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	current, ok := idx.entries[m.Hash]
+	if !ok || !current.CreatedAt.Equal(m.CreatedAt) || current.Size != m.Size || current.retained(idx.clock.Now()) {
+		return false
+	}
+	if idx.uploading[m.Hash] > 0 {
+		return false
+	}
+	idx.remove(m.Hash)
+	idx.dirty = true
+	idx.record(journalRecord{Op: "delete", Hash: m.Hash}, true)
+	return true
+}
+
+// Delete forgets an artifact
+func (idx *MetadataIndex) Delete(hash string) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	if idx.remove(hash) {
+		idx.dirty = true
+		idx.record(journalRecord{Op: "delete", Hash: hash}, true)
+	}
+}
+
+// TeamUsage returns the stored bytes attributed to a team
+func (idx *MetadataIndex) TeamUsage(team string) int64 {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+	return idx.teamBytes[team]
+}
+
+// ClassSize returns the stored bytes in a size class
+func (idx *MetadataIndex) ClassSize(class string) int64 {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+	return idx.classBytes[class]
+}
+
+// ClassCount returns the number of artifacts in a size class
+func (idx *MetadataIndex) ClassCount(class string) int64 {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+	return idx.classCount[class]
+}
+
+// TotalSize returns the stored bytes across all teams
+func (idx *MetadataIndex) TotalSize() int64 {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+	return idx.total
+}
+
+// Run snapshots the index to disk whenever it changed, until stop is closed
+func (idx *MetadataIndex) Run(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+		if err := idx.Save(); err != nil {
+			idx.logger.Printf("Failed to save metadata index: %v", err)
+		}
+	}
+}
+
+// Save writes the index atomically if it changed since the last save
+func (idx *MetadataIndex) Save() error {
+	idx.mu.Lock()
+	if !idx.dirty {
+		idx.mu.Unlock()
+		return nil
+	}
+	entries := make([]indexEntry, 0, len(idx.entries))
+	for _, m := range idx.entries {
+		copied := *m
+		e := indexEntry{ArtifactMeta: &copied}
+		if m.Class == inlineClass && idx.inline != nil {
+			e.Inline, _ = idx.inline.blob(m.Hash)
+		}
+		entries = append(entries, e)
+	}
+	idx.dirty = false
+	keep := idx.rotateJournal()
+	idx.mu.Unlock()
+
+	data, err := json.Marshal(entries)
+	if err != nil {
+		return fmt.Errorf("failed to encode metadata index: %w", err)
+	}
+	if err := writeFileAtomic(idx.path, data, 0644); err != nil {
+		idx.mu.Lock()
+		idx.dirty = true
+		idx.mu.Unlock()
+		return err
+	}
+	// Only a snapshot that is on disk may replace the journal it covers
+	idx.pruneJournal(keep)
+	return nil
+}
+
+// add and remove keep the per-team and per-class totals in sync; callers must hold the lock
+func (idx *MetadataIndex) add(m *ArtifactMeta) {
+	idx.entries[m.Hash] = m
+	idx.teamBytes[m.Team] += m.Size
+	idx.classBytes[m.Class] += m.Size
+	idx.classCount[m.Class]++
+	idx.total += m.Size
+}
+
+func (idx *MetadataIndex) remove(hash string) bool {
+	m, ok := idx.entries[hash]
+	if !ok {
+		return false
+	}
+	delete(idx.entries, hash)
+	idx.teamBytes[m.Team] -= m.Size
+	idx.classBytes[m.Class] -= m.Size
+	idx.classCount[m.Class]--
+	idx.total -= m.Size
+	return true
+}
+
+// writeFileAtomic replaces path with data via a temp file and rename. Both
+// the file and the rename are synced, so once it returns the new contents
+// survive a power loss, and before that the old ones do.
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+"-*")
+	if err != nil {
+		return fmt.Errorf("failed to create temp file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write %s: %w", path, err)
+	}
+	if err := tmp.Chmod(perm); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write %s: %w", path, err)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to sync %s: %w", path, err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write %s: %w", path, err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("failed to replace %s: %w", path, err)
+	}
+	if err := syncDir(filepath.Dir(path)); err != nil {
+		return fmt.Errorf("failed to sync %s: %w", filepath.Dir(path), err)
+	}
+	return nil
+}
+
+// maxMetadataValue bounds a captured header value so clients can't bloat the index
+const maxMetadataValue = 256
+
+// captureMetadata keeps the allowlisted request headers of an upload
+func (s *Server) captureMetadata(r *http.Request) map[string]string {
+	var metadata map[string]string
+	for _, name := range s.metadataHeaders {
+		value := r.Header.Get(name)
+		if value == "" {
+			continue
+		}
+		if len(value) > maxMetadataValue {
+			value = value[:maxMetadataValue]
+		}
+		if metadata == nil {
+			metadata = make(map[string]string)
+		}
+		metadata[name] = value
+	}
+	return metadata
+}
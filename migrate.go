@@ -0,0 +1,142 @@
+package cachesrv
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/bitechdev/go-turbo-cachesrv/storage"
+)
+
+// The state directory records the version of its metadata and storage
+// layout in .meta/version.json. On startup every migration newer than that
+// runs in order, each recording its version once done, so an upgrade across
+// several releases applies all of them and an interrupted upgrade resumes
+// where it stopped. Migrations must therefore be safe to run again.
+//
+// To change the on-disk format, append a migration with the next version;
+// never edit or reorder released ones.
+
+// migration upgrades the state from the previous version to version
+type migration struct {
+	version     int
+	description string
+	run         func(env *migrationEnv) error
+}
+
+// migrationEnv is what a migration may touch
+type migrationEnv struct {
+	stateDir string
+	// classes are the configured size classes, with their storage
+	classes []*SizeClass
+	logger  *log.Logger
+}
+
+var migrations = []migration{
+	// Temp files left by interrupted uploads used to be removed here once;
+	// uploads can be interrupted at any time, so that is done on every
+	// start instead
+	{1, "record the state version", func(*migrationEnv) error { return nil }},
+}
+
+// stateVersion is the content of .meta/version.json
+type stateVersion struct {
+	Version    int       `json:"version"`
+	MigratedAt time.Time `json:"migratedAt"`
+}
+
+// runMigrations brings the state directory up to the latest version. Servers
+// sharing the directory take an exclusive lock, so only one migrates and the
+// others wait and then find nothing left to do. State written by a newer
+// release is refused because downgrades aren't supported.
+func runMigrations(env *migrationEnv) error {
+	dir := filepath.Join(env.stateDir, ".meta")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("failed to create metadata directory: %w", err)
+	}
+	unlock, err := lockFile(filepath.Join(dir, "migrate.lock"))
+	if err != nil {
+		return fmt.Errorf("failed to lock state directory: %w", err)
+	}
+	defer unlock()
+
+	path := filepath.Join(dir, "version.json")
+	var current stateVersion
+	data, err := os.ReadFile(path)
+	switch {
+	case os.IsNotExist(err):
+	case err != nil:
+		return fmt.Errorf("failed to read state version: %w", err)
+	default:
+		if err := json.Unmarshal(data, &current); err != nil {
+			return fmt.Errorf("failed to parse %s: %w", path, err)
+		}
+	}
+
+	latest := migrations[len(migrations)-1].version
+	if current.Version > latest {
+		return fmt.Errorf("state in %s has version %d, newer than the %d this release supports", env.stateDir, current.Version, latest)
+	}
+	for _, m := range migrations {
+		if m.version <= current.Version {
+			continue
+		}
+		start := time.Now()
+		env.logger.Printf("Migrating state to version %d: %s", m.version, m.description)
+		if err := m.run(env); err != nil {
+			return fmt.Errorf("migration %d failed: %w", m.version, err)
+		}
+		current = stateVersion{Version: m.version, MigratedAt: time.Now().UTC()}
+		data, err := json.MarshalIndent(current, "", "  ")
+		if err != nil {
+			return err
+		}
+		if err := writeFileAtomic(path, data, 0644); err != nil {
+			return fmt.Errorf("failed to record state version: %w", err)
+		}
+		env.logger.Printf("Migrated state to version %d in %v", m.version, time.Since(start))
+	}
+	return nil
+}
+
+// removeStaleTempFiles deletes the hidden ".<hash>-*" and ".upload-*" files
+// that uploads killed mid-write left in filesystem storage. Only files
+// untouched for an hour are removed, since another server sharing the
+// directory may be writing the rest right now. It runs on every start, after
+// the migrations.
+func removeStaleTempFiles(env *migrationEnv) error {
+	cutoff := time.Now().Add(-time.Hour)
+	removed := 0
+	for _, class := range env.classes {
+		fs, ok := unwrapStorage(class.Storage).(*storage.FileSystem)
+		if !ok {
+			continue
+		}
+		entries, err := os.ReadDir(fs.BasePath())
+		if err != nil {
+			return fmt.Errorf("failed to read storage directory: %w", err)
+		}
+		for _, entry := range entries {
+			name := entry.Name()
+			if entry.IsDir() || !strings.HasPrefix(name, ".") || !strings.Contains(name, "-") {
+				continue
+			}
+			info, err := entry.Info()
+			if err != nil || info.ModTime().After(cutoff) {
+				continue
+			}
+			if err := os.Remove(filepath.Join(fs.BasePath(), name)); err != nil && !os.IsNotExist(err) {
+				return fmt.Errorf("failed to remove temp file: %w", err)
+			}
+			removed++
+		}
+	}
+	if removed > 0 {
+		env.logger.Printf("Removed %d stale temp files", removed)
+	}
+	return nil
+}
@@ -0,0 +1,69 @@
+package cachesrv
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// With TURBO_TEAM_NAMESPACES=true every team has artifacts of its own: the
+// storage key carries the teamId (or slug) the artifact was uploaded for,
+// so teams that produce the same hash neither share nor overwrite each
+// other's artifact. Requests without a team use the shared namespace.
+// Tokens can also be limited to some teams with "teams" in the tokens file.
+
+// teamSeparator joins a storage key and its team; variants can't start
+// with the rest of it, so the two don't mix up
+const teamSeparator = variantSeparator + "team-"
+
+var errInvalidTeam = errors.New("invalid team")
+
+// namespaceKey qualifies a storage key with a team, leaving keys that
+// already carry it as they are
+func namespaceKey(key, team string) (string, error) {
+	if team == "" || strings.HasSuffix(key, teamSeparator+team) {
+		return key, nil
+	}
+	if strings.Contains(team, variantSeparator) || !validHash(team) {
+		return "", errInvalidTeam
+	}
+	key += teamSeparator + team
+	if !validHash(key) {
+		return "", errInvalidTeam
+	}
+	return key, nil
+}
+
+// namespaced returns the storage key of a hash for the request's team, or
+// the key unchanged if teams don't have namespaces
+func (s *Server) namespaced(key string, r *http.Request) (string, error) {
+	if !s.teamNamespaces {
+		return key, nil
+	}
+	return namespaceKey(key, teamOf(r))
+}
+
+// allowsTeam reports whether a token may be used for a team
+func (t *Token) allowsTeam(team string) bool {
+	return len(t.Teams) == 0 || slices.Contains(t.Teams, team)
+}
+
+// ownsTeam reports whether a token is limited to teams including this one,
+// which is what acting as the team, rather than merely for it, takes
+func (t *Token) ownsTeam(team string) bool {
+	return team != "" && slices.Contains(t.Teams, team)
+}
+
+type tokenKey struct{}
+
+func withToken(ctx context.Context, token *Token) context.Context {
+	return context.WithValue(ctx, tokenKey{}, token)
+}
+
+// tokenOf returns the token a request was authenticated with, or nil
+func tokenOf(r *http.Request) *Token {
+	token, _ := r.Context().Value(tokenKey{}).(*Token)
+	return token
+}
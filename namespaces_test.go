@@ -0,0 +1,30 @@
+package cachesrv
+
+import "testing"
+
+func TestTokenTeams(t *testing.T) {
+	tests := []struct {
+		name   string
+		teams  []string
+		team   string
+		allows bool
+		owns   bool
+	}{
+		{"unrestricted with team", nil, "web", true, false},
+		{"unrestricted without team", nil, "", true, false},
+		{"listed team", []string{"web", "api"}, "api", true, true},
+		{"other team", []string{"web"}, "api", false, false},
+		{"restricted without team", []string{"web"}, "", false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			token := &Token{Name: "ci", Teams: tt.teams}
+			if got := token.allowsTeam(tt.team); got != tt.allows {
+				t.Errorf("allowsTeam(%q) = %v, want %v", tt.team, got, tt.allows)
+			}
+			if got := token.ownsTeam(tt.team); got != tt.owns {
+				t.Errorf("ownsTeam(%q) = %v, want %v", tt.team, got, tt.owns)
+			}
+		})
+	}
+}
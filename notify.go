@@ -0,0 +1,247 @@
+package cachesrv
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/smtp"
+	"strings"
+	"time"
+)
+
+// Notification severities, lowest first
+const (
+	severityInfo     = "info"
+	severityWarning  = "warning"
+	severityCritical = "critical"
+)
+
+var severityRank = map[string]int{severityInfo: 0, severityWarning: 1, severityCritical: 2}
+
+// Notification events
+const (
+	eventAnomaly          = "anomaly"
+	eventStorageDegraded  = "storage_degraded"
+	eventStorageRecovered = "storage_recovered"
+	eventBackupFailed     = "backup_failed"
+)
+
+// Notification is an operational event worth telling a human about
+type Notification struct {
+	Event    string    `json:"event"`
+	Severity string    `json:"severity"`
+	Message  string    `json:"message"`
+	Time     time.Time `json:"time"`
+	Details  any       `json:"details,omitempty"`
+}
+
+// Notifier delivers notifications to one channel
+type Notifier interface {
+	Notify(n Notification) error
+}
+
+// notifyRoute sends the events and severities a channel subscribed to
+type notifyRoute struct {
+	name        string
+	notifier    Notifier
+	events      map[string]bool
+	minSeverity int
+}
+
+func (r *notifyRoute) wants(n Notification) bool {
+	return (len(r.events) == 0 || r.events[n.Event]) && severityRank[n.Severity] >= r.minSeverity
+}
+
+// Notifications fans events out to the configured channels in the
+// background, so a slow mail server never delays a request. A nil
+// Notifications sends nothing.
+type Notifications struct {
+	routes []*notifyRoute
+	logger *log.Logger
+}
+
+// Send delivers a notification to every channel routed to it
+func (ns *Notifications) Send(event, severity, message string, details any) {
+	if ns == nil {
+		return
+	}
+	n := Notification{Event: event, Severity: severity, Message: message, Time: time.Now().UTC(), Details: details}
+	for _, route := range ns.routes {
+		if !route.wants(n) {
+			continue
+		}
+		go func(route *notifyRoute) {
+			if err := route.notifier.Notify(n); err != nil {
+				ns.logger.Printf("Failed to send %s notification to %s: %v", n.Event, route.name, err)
+			}
+		}(route)
+	}
+}
+
+// WebhookNotifier posts the notification as JSON. The "text" field makes the
+// payload usable with Slack-compatible incoming webhooks.
+type WebhookNotifier struct {
+	url    string
+	client *http.Client
+}
+
+func (wn *WebhookNotifier) Notify(n Notification) error {
+	return postJSON(wn.client, wn.url, struct {
+		Text string `json:"text"`
+		Notification
+	}{Text: "turbo cache: " + n.Message, Notification: n})
+}
+
+// SlackNotifier posts a formatted message to a Slack incoming webhook
+type SlackNotifier struct {
+	url    string
+	client *http.Client
+}
+
+func (sn *SlackNotifier) Notify(n Notification) error {
+	return postJSON(sn.client, sn.url, map[string]string{
+		"text": fmt.Sprintf("*turbo cache %s* (%s): %s", n.Severity, n.Event, n.Message),
+	})
+}
+
+// PagerDutyNotifier triggers a PagerDuty Events API v2 incident,
+// deduplicated per event type; the severities map onto PagerDuty's own
+type PagerDutyNotifier struct {
+	routingKey string
+	url        string
+	client     *http.Client
+}
+
+func (pn *PagerDutyNotifier) Notify(n Notification) error {
+	return postJSON(pn.client, pn.url, map[string]any{
+		"routing_key":  pn.routingKey,
+		"event_action": "trigger",
+		"dedup_key":    "turbo-cache-" + n.Event,
+		"payload": map[string]any{
+			"summary":        "turbo cache: " + n.Message,
+			"source":         "turbo-cache",
+			"severity":       n.Severity,
+			"timestamp":      n.Time.Format(time.RFC3339),
+			"custom_details": n.Details,
+		},
+	})
+}
+
+// EmailNotifier sends a plain text mail through an SMTP relay
+type EmailNotifier struct {
+	addr     string
+	from     string
+	to       []string
+	username string
+	password string
+}
+
+func (en *EmailNotifier) Notify(n Notification) error {
+	var auth smtp.Auth
+	if en.username != "" {
+		host, _, _ := strings.Cut(en.addr, ":")
+		auth = smtp.PlainAuth("", en.username, en.password, host)
+	}
+	var body bytes.Buffer
+	fmt.Fprintf(&body, "From: %s\r\n", en.from)
+	fmt.Fprintf(&body, "To: %s\r\n", strings.Join(en.to, ", "))
+	fmt.Fprintf(&body, "Subject: [turbo cache %s] %s\r\n", n.Severity, n.Event)
+	fmt.Fprintf(&body, "Date: %s\r\n", n.Time.Format(time.RFC1123Z))
+	fmt.Fprintf(&body, "Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	fmt.Fprintf(&body, "%s\r\n", n.Message)
+	if n.Details != nil {
+		if details, err := json.MarshalIndent(n.Details, "", "  "); err == nil {
+			fmt.Fprintf(&body, "\r\n%s\r\n", details)
+		}
+	}
+	return smtp.SendMail(en.addr, auth, en.from, en.to, body.Bytes())
+}
+
+// postJSON posts a JSON payload and fails on non-2xx responses
+func postJSON(client *http.Client, url string, payload any) error {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Post(url, "application/json", bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("unexpected response %s", resp.Status)
+	}
+	return nil
+}
+
+// newNotificationsFromEnv configures the channels listed in
+// TURBO_NOTIFY_CHANNELS, each from TURBO_NOTIFY_<NAME>_* variables.
+// TURBO_ALERT_WEBHOOK_URL remains a webhook channel for every event.
+func newNotificationsFromEnv(logger *log.Logger) (*Notifications, error) {
+	client := &http.Client{Timeout: 10 * time.Second}
+	ns := &Notifications{logger: logger}
+	if url := getenv("TURBO_ALERT_WEBHOOK_URL"); url != "" {
+		ns.routes = append(ns.routes, &notifyRoute{name: "webhook", notifier: &WebhookNotifier{url: url, client: client}})
+	}
+
+	for _, name := range strings.Split(getenv("TURBO_NOTIFY_CHANNELS"), ",") {
+		if name = strings.TrimSpace(name); name == "" {
+			continue
+		}
+		prefix := "TURBO_NOTIFY_" + strings.ToUpper(strings.ReplaceAll(name, "-", "_")) + "_"
+		route := &notifyRoute{name: name}
+		switch kind := getenv(prefix + "TYPE"); kind {
+		case "webhook", "slack":
+			url := getenv(prefix + "URL")
+			if url == "" {
+				return nil, fmt.Errorf("%sURL is required", prefix)
+			}
+			if kind == "slack" {
+				route.notifier = &SlackNotifier{url: url, client: client}
+			} else {
+				route.notifier = &WebhookNotifier{url: url, client: client}
+			}
+		case "pagerduty":
+			values, err := requireEnv(prefix + "ROUTING_KEY")
+			if err != nil {
+				return nil, err
+			}
+			route.notifier = &PagerDutyNotifier{
+				routingKey: values[0],
+				url:        envString(prefix+"URL", "https://events.pagerduty.com/v2/enqueue"),
+				client:     client,
+			}
+		case "email":
+			values, err := requireEnv(prefix+"SMTP_ADDR", prefix+"FROM", prefix+"TO")
+			if err != nil {
+				return nil, err
+			}
+			route.notifier = &EmailNotifier{
+				addr:     values[0],
+				from:     values[1],
+				to:       strings.Split(values[2], ","),
+				username: getenv(prefix + "USERNAME"),
+				password: getenv(prefix + "PASSWORD"),
+			}
+		default:
+			return nil, fmt.Errorf("unknown %sTYPE %q (expected webhook, slack, pagerduty or email)", prefix, kind)
+		}
+
+		if events := getenv(prefix + "EVENTS"); events != "" {
+			route.events = make(map[string]bool)
+			for _, event := range strings.Split(events, ",") {
+				route.events[strings.TrimSpace(event)] = true
+			}
+		}
+		severity := envString(prefix+"MIN_SEVERITY", severityInfo)
+		rank, ok := severityRank[severity]
+		if !ok {
+			return nil, fmt.Errorf("invalid %sMIN_SEVERITY %q (expected info, warning or critical)", prefix, severity)
+		}
+		route.minSeverity = rank
+		ns.routes = append(ns.routes, route)
+	}
+	return ns, nil
+}
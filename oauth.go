@@ -0,0 +1,266 @@
+package cachesrv
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+var errNotAuthorized = errors.New("user is not authorized")
+
+// LoginProvider authenticates humans for the dashboard via an OAuth2 code flow
+type LoginProvider interface {
+	// AuthCodeURL returns the URL the browser is sent to for login
+	AuthCodeURL(state string) string
+	// Authenticate exchanges the callback code and returns the user's identity
+	// once the provider's org/team/group restrictions have been checked
+	Authenticate(ctx context.Context, code string) (Identity, error)
+}
+
+// Identity is a logged in user and the groups the provider reported, which
+// admin roles can be mapped from
+type Identity struct {
+	User   string
+	Groups []string
+}
+
+// oauthConfig holds the client settings shared by all OAuth2 providers
+type oauthConfig struct {
+	clientID     string
+	clientSecret string
+	redirectURL  string
+	authURL      string
+	tokenURL     string
+	scopes       []string
+	client       *http.Client
+}
+
+func (c *oauthConfig) AuthCodeURL(state string) string {
+	v := url.Values{
+		"client_id":     {c.clientID},
+		"redirect_uri":  {c.redirectURL},
+		"response_type": {"code"},
+		"scope":         {strings.Join(c.scopes, " ")},
+		"state":         {state},
+	}
+	return c.authURL + "?" + v.Encode()
+}
+
+// exchange trades an authorization code for an access token
+func (c *oauthConfig) exchange(ctx context.Context, code string) (string, error) {
+	form := url.Values{
+		"client_id":     {c.clientID},
+		"client_secret": {c.clientSecret},
+		"code":          {code},
+		"grant_type":    {"authorization_code"},
+		"redirect_uri":  {c.redirectURL},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.tokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+
+	var resp struct {
+		AccessToken string `json:"access_token"`
+		Error       string `json:"error"`
+	}
+	if err := c.doJSON(req, &resp); err != nil {
+		return "", fmt.Errorf("failed to exchange code: %w", err)
+	}
+	if resp.AccessToken == "" {
+		return "", fmt.Errorf("failed to exchange code: %s", resp.Error)
+	}
+	return resp.AccessToken, nil
+}
+
+// get performs an authenticated GET and returns the status code, decoding JSON bodies on 200
+func (c *oauthConfig) get(ctx context.Context, accessToken, rawURL string, out interface{}) (int, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, rawURL, nil)
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Authorization", "Bearer "+accessToken)
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusOK && out != nil {
+		if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+			return resp.StatusCode, fmt.Errorf("failed to decode %s: %w", rawURL, err)
+		}
+	}
+	return resp.StatusCode, nil
+}
+
+func (c *oauthConfig) doJSON(req *http.Request, out interface{}) error {
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %d from %s", resp.StatusCode, req.URL)
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// GitHubProvider allows members of a GitHub org, optionally limited to one team
+type GitHubProvider struct {
+	oauthConfig
+	apiURL string
+	org    string
+	team   string
+}
+
+func NewGitHubProvider(clientID, clientSecret, redirectURL, org, team string) *GitHubProvider {
+	return &GitHubProvider{
+		oauthConfig: oauthConfig{
+			clientID:     clientID,
+			clientSecret: clientSecret,
+			redirectURL:  redirectURL,
+			authURL:      "https://github.com/login/oauth/authorize",
+			tokenURL:     "https://github.com/login/oauth/access_token",
+			scopes:       []string{"read:org"},
+			client:       &http.Client{Timeout: 10 * time.Second},
+		},
+		apiURL: "https://api.github.com",
+		org:    org,
+		team:   team,
+	}
+}
+
+func (p *GitHubProvider) Authenticate(ctx context.Context, code string) (Identity, error) {
+	accessToken, err := p.exchange(ctx, code)
+	if err != nil {
+		return Identity{}, err
+	}
+
+	var user struct {
+		Login string `json:"login"`
+	}
+	if status, err := p.get(ctx, accessToken, p.apiURL+"/user", &user); err != nil || status != http.StatusOK {
+		return Identity{}, fmt.Errorf("failed to fetch github user (status %d): %v", status, err)
+	}
+
+	if p.team != "" {
+		var membership struct {
+			State string `json:"state"`
+		}
+		path := fmt.Sprintf("%s/orgs/%s/teams/%s/memberships/%s",
+			p.apiURL, url.PathEscape(p.org), url.PathEscape(p.team), url.PathEscape(user.Login))
+		status, err := p.get(ctx, accessToken, path, &membership)
+		if err != nil {
+			return Identity{}, err
+		}
+		if status != http.StatusOK || membership.State != "active" {
+			return Identity{User: user.Login}, errNotAuthorized
+		}
+		return Identity{User: user.Login, Groups: []string{p.team}}, nil
+	}
+
+	path := fmt.Sprintf("%s/orgs/%s/members/%s", p.apiURL, url.PathEscape(p.org), url.PathEscape(user.Login))
+	status, err := p.get(ctx, accessToken, path, nil)
+	if err != nil {
+		return Identity{}, err
+	}
+	if status != http.StatusNoContent {
+		return Identity{User: user.Login}, errNotAuthorized
+	}
+	return Identity{User: user.Login}, nil
+}
+
+// OIDCProvider allows users of a generic OpenID Connect issuer, optionally
+// restricted to members of one of the configured groups
+type OIDCProvider struct {
+	oauthConfig
+	userinfoURL string
+	groupsClaim string
+	groups      []string
+}
+
+func NewOIDCProvider(ctx context.Context, issuer, clientID, clientSecret, redirectURL, groupsClaim string, groups []string) (*OIDCProvider, error) {
+	p := &OIDCProvider{
+		oauthConfig: oauthConfig{
+			clientID:     clientID,
+			clientSecret: clientSecret,
+			redirectURL:  redirectURL,
+			scopes:       []string{"openid", "profile", "email"},
+			client:       &http.Client{Timeout: 10 * time.Second},
+		},
+		groupsClaim: groupsClaim,
+		groups:      groups,
+	}
+	if len(groups) > 0 {
+		p.scopes = append(p.scopes, groupsClaim)
+	}
+
+	var discovery struct {
+		AuthorizationEndpoint string `json:"authorization_endpoint"`
+		TokenEndpoint         string `json:"token_endpoint"`
+		UserinfoEndpoint      string `json:"userinfo_endpoint"`
+	}
+	wellKnown := strings.TrimSuffix(issuer, "/") + "/.well-known/openid-configuration"
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, wellKnown, nil)
+	if err != nil {
+		return nil, err
+	}
+	if err := p.doJSON(req, &discovery); err != nil {
+		return nil, fmt.Errorf("failed to load OIDC discovery document: %w", err)
+	}
+	p.authURL = discovery.AuthorizationEndpoint
+	p.tokenURL = discovery.TokenEndpoint
+	p.userinfoURL = discovery.UserinfoEndpoint
+	return p, nil
+}
+
+func (p *OIDCProvider) Authenticate(ctx context.Context, code string) (Identity, error) {
+	accessToken, err := p.exchange(ctx, code)
+	if err != nil {
+		return Identity{}, err
+	}
+
+	var claims map[string]interface{}
+	if status, err := p.get(ctx, accessToken, p.userinfoURL, &claims); err != nil || status != http.StatusOK {
+		return Identity{}, fmt.Errorf("failed to fetch userinfo (status %d): %v", status, err)
+	}
+
+	user, _ := claims["preferred_username"].(string)
+	if user == "" {
+		user, _ = claims["email"].(string)
+	}
+	if user == "" {
+		user, _ = claims["sub"].(string)
+	}
+
+	identity := Identity{User: user}
+	member, _ := claims[p.groupsClaim].([]interface{})
+	for _, g := range member {
+		if name, ok := g.(string); ok {
+			identity.Groups = append(identity.Groups, name)
+		}
+	}
+
+	if len(p.groups) == 0 {
+		return identity, nil
+	}
+	for _, g := range identity.Groups {
+		for _, allowed := range p.groups {
+			if g == allowed {
+				return identity, nil
+			}
+		}
+	}
+	return identity, errNotAuthorized
+}
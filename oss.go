@@ -0,0 +1,206 @@
+package cachesrv
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// OSSStorage stores artifacts in an Alibaba Cloud OSS bucket, signing
+// requests with OSS's own HMAC-SHA1 scheme
+type OSSStorage struct {
+	client    *http.Client
+	endpoint  string // e.g. https://oss-cn-hangzhou.aliyuncs.com
+	bucket    string
+	keyID     string
+	keySecret string
+	prefix    string
+}
+
+func NewOSSStorage(endpoint, bucket, keyID, keySecret, prefix string) (*OSSStorage, error) {
+	if !strings.Contains(endpoint, "://") {
+		endpoint = "https://" + endpoint
+	}
+	o := &OSSStorage{
+		client:    &http.Client{},
+		endpoint:  strings.TrimSuffix(endpoint, "/"),
+		bucket:    bucket,
+		keyID:     keyID,
+		keySecret: keySecret,
+		prefix:    prefix,
+	}
+
+	// Fail at startup rather than on the first upload if the bucket or keys are wrong
+	resp, err := o.do(http.MethodGet, "", url.Values{"max-keys": {"1"}}, nil, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to access bucket: %w", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to access bucket %s: %s", bucket, resp.Status)
+	}
+	return o, nil
+}
+
+func (o *OSSStorage) Store(hash string, data io.Reader) error {
+	resp, err := o.do(http.MethodPut, o.prefix+hash, nil, data, http.Header{"Content-Type": {"application/octet-stream"}})
+	if err != nil {
+		return fmt.Errorf("failed to upload object: %w", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed to upload object: %s", resp.Status)
+	}
+	return nil
+}
+
+func (o *OSSStorage) Get(hash string) (io.ReadCloser, int64, error) {
+	resp, err := o.do(http.MethodGet, o.prefix+hash, nil, nil, nil)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to download object: %w", err)
+	}
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return resp.Body, resp.ContentLength, nil
+	case http.StatusNotFound:
+		resp.Body.Close()
+		return nil, 0, errArtifactNotFound
+	default:
+		resp.Body.Close()
+		return nil, 0, fmt.Errorf("failed to download object: %s", resp.Status)
+	}
+}
+
+func (o *OSSStorage) Exists(hash string) (bool, error) {
+	resp, err := o.do(http.MethodHead, o.prefix+hash, nil, nil, nil)
+	if err != nil {
+		return false, fmt.Errorf("failed to check object: %w", err)
+	}
+	resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return true, nil
+	case http.StatusNotFound:
+		return false, nil
+	default:
+		return false, fmt.Errorf("failed to check object: %s", resp.Status)
+	}
+}
+
+func (o *OSSStorage) Delete(hash string) error {
+	resp, err := o.do(http.MethodDelete, o.prefix+hash, nil, nil, nil)
+	if err != nil {
+		return fmt.Errorf("failed to delete object: %w", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusNotFound {
+		return fmt.Errorf("failed to delete object: %s", resp.Status)
+	}
+	return nil
+}
+
+// List pages through the bucket with marker-based listing
+func (o *OSSStorage) List() ([]ArtifactStat, error) {
+	var artifacts []ArtifactStat
+	marker := ""
+	for {
+		query := url.Values{"prefix": {o.prefix}, "marker": {marker}, "max-keys": {"1000"}}
+		resp, err := o.do(http.MethodGet, "", query, nil, nil)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list bucket: %w", err)
+		}
+		var page struct {
+			IsTruncated bool   `xml:"IsTruncated"`
+			NextMarker  string `xml:"NextMarker"`
+			Contents    []struct {
+				Key          string    `xml:"Key"`
+				Size         int64     `xml:"Size"`
+				LastModified time.Time `xml:"LastModified"`
+			} `xml:"Contents"`
+		}
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			return nil, fmt.Errorf("failed to list bucket: %s", resp.Status)
+		}
+		err = xml.NewDecoder(resp.Body).Decode(&page)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode bucket listing: %w", err)
+		}
+
+		for _, c := range page.Contents {
+			hash := strings.TrimPrefix(c.Key, o.prefix)
+			if hash == "" || strings.Contains(hash, "/") || strings.HasPrefix(hash, ".") {
+				continue
+			}
+			artifacts = append(artifacts, ArtifactStat{Hash: hash, Size: c.Size, ModTime: c.LastModified})
+		}
+		if !page.IsTruncated {
+			return artifacts, nil
+		}
+		marker = page.NextMarker
+	}
+}
+
+// do sends a signed request using virtual-hosted style URLs
+func (o *OSSStorage) do(method, key string, query url.Values, body io.Reader, header http.Header) (*http.Response, error) {
+	host, err := url.Parse(o.endpoint)
+	if err != nil {
+		return nil, err
+	}
+	target := fmt.Sprintf("%s://%s.%s/%s", host.Scheme, o.bucket, host.Host, key)
+	if len(query) > 0 {
+		target += "?" + query.Encode()
+	}
+
+	req, err := http.NewRequest(method, target, body)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	req.Header.Set("Date", time.Now().UTC().Format(http.TimeFormat))
+	req.Header.Set("Authorization", "OSS "+o.keyID+":"+o.sign(req, key))
+	return o.client.Do(req)
+}
+
+// sign computes the OSS v1 signature. None of the query parameters used here
+// are sub-resources, so the canonical resource is just bucket and key.
+func (o *OSSStorage) sign(req *http.Request, key string) string {
+	var ossHeaders []string
+	for k := range req.Header {
+		if lk := strings.ToLower(k); strings.HasPrefix(lk, "x-oss-") {
+			ossHeaders = append(ossHeaders, lk+":"+req.Header.Get(k)+"\n")
+		}
+	}
+	sort.Strings(ossHeaders)
+
+	toSign := strings.Join([]string{
+		req.Method,
+		req.Header.Get("Content-MD5"),
+		req.Header.Get("Content-Type"),
+		req.Header.Get("Date"),
+		strings.Join(ossHeaders, "") + "/" + o.bucket + "/" + key,
+	}, "\n")
+
+	mac := hmac.New(sha1.New, []byte(o.keySecret))
+	mac.Write([]byte(toSign))
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func newOSSStorageFromEnv(prefix string) (*OSSStorage, error) {
+	values, err := requireEnv(prefix+"OSS_ENDPOINT", prefix+"OSS_BUCKET", prefix+"OSS_ACCESS_KEY_ID", prefix+"OSS_ACCESS_KEY_SECRET")
+	if err != nil {
+		return nil, err
+	}
+	return NewOSSStorage(values[0], values[1], values[2], values[3], envString(prefix+"OSS_PREFIX", ""))
+}
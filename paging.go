@@ -0,0 +1,287 @@
+package cachesrv
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Every admin list endpoint takes the same query parameters:
+//
+//	limit=100                 page size, at most maxPageLimit
+//	cursor=...                nextCursor of the previous page
+//	sort=-createdAt           field to sort by, "-" for descending
+//	filter=team:web,static:true
+//	fields=id,name            only return these fields
+//
+// Fields are the JSON fields of the items. Pages are keyed on the sort value
+// and the fields that uniquely identify an item, so items added or removed
+// between requests don't shift the following pages.
+
+const (
+	defaultPageLimit = 100
+	maxPageLimit     = 1000
+)
+
+// ListPage is the response of every admin list endpoint
+type ListPage struct {
+	Items []map[string]any `json:"items"`
+	// Total counts the items matching the filter across all pages
+	Total      int    `json:"total"`
+	NextCursor string `json:"nextCursor,omitempty"`
+}
+
+// listCursor marks the last item of a page
+type listCursor struct {
+	Sort  string `json:"s"`
+	Value any    `json:"v"`
+	Key   string `json:"k"`
+}
+
+var errInvalidList = errors.New("invalid list parameters")
+
+// listOptions are the parsed list parameters
+type listOptions struct {
+	limit   int
+	sort    string
+	desc    bool
+	filters map[string]string
+	fields  []string
+	cursor  *listCursor
+}
+
+func parseListOptions(r *http.Request, defaultSort string) (*listOptions, error) {
+	q := r.URL.Query()
+	opts := &listOptions{limit: defaultPageLimit, filters: make(map[string]string)}
+	if v := q.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			return nil, fmt.Errorf("%w: limit must be a positive number", errInvalidList)
+		}
+		opts.limit = min(n, maxPageLimit)
+	}
+
+	spec := q.Get("sort")
+	if spec == "" {
+		spec = defaultSort
+	}
+	opts.sort = spec
+	opts.desc = strings.HasPrefix(spec, "-")
+
+	if v := q.Get("filter"); v != "" {
+		for _, pair := range strings.Split(v, ",") {
+			field, value, ok := strings.Cut(pair, ":")
+			if !ok || field == "" {
+				return nil, fmt.Errorf("%w: filter entries are field:value", errInvalidList)
+			}
+			opts.filters[field] = value
+		}
+	}
+	if v := q.Get("fields"); v != "" {
+		opts.fields = strings.Split(v, ",")
+	}
+	if v := q.Get("cursor"); v != "" {
+		data, err := base64.RawURLEncoding.DecodeString(v)
+		var c listCursor
+		if err == nil {
+			err = decodeJSONNumbers(data, &c)
+		}
+		if err != nil || c.Sort != opts.sort {
+			return nil, fmt.Errorf("%w: cursor doesn't belong to this sort order", errInvalidList)
+		}
+		opts.cursor = &c
+	}
+	return opts, nil
+}
+
+// writeList pages items, a slice of JSON-encodable values uniquely
+// identified by the key fields, according to the list parameters
+func (s *Server) writeList(w http.ResponseWriter, r *http.Request, items any, defaultSort string, keys ...string) {
+	opts, err := parseListOptions(r, defaultSort)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	page, err := paginate(items, keys, opts)
+	if errors.Is(err, errInvalidList) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		s.logger.Printf("Failed to list %s: %v", r.URL.Path, err)
+		http.Error(w, "Failed to list items", http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(page)
+}
+
+func paginate(items any, keys []string, opts *listOptions) (*ListPage, error) {
+	data, err := json.Marshal(items)
+	if err != nil {
+		return nil, err
+	}
+	var all []map[string]any
+	if err := decodeJSONNumbers(data, &all); err != nil {
+		return nil, err
+	}
+
+	field := strings.TrimPrefix(opts.sort, "-")
+	known := make(map[string]bool)
+	matching := all[:0]
+	for _, item := range all {
+		for name := range item {
+			known[name] = true
+		}
+		if matchesFilters(item, opts.filters) {
+			matching = append(matching, item)
+		}
+	}
+	// Fields may be omitted when empty, so only an unknown field in a
+	// non-empty list can be told apart from an empty one
+	if len(all) > 0 && !known[field] {
+		return nil, fmt.Errorf("%w: unknown sort field %q", errInvalidList, field)
+	}
+	for name := range opts.filters {
+		if len(all) > 0 && !known[name] {
+			return nil, fmt.Errorf("%w: unknown filter field %q", errInvalidList, name)
+		}
+	}
+
+	keyOf := func(item map[string]any) string {
+		parts := make([]string, len(keys))
+		for i, key := range keys {
+			if v, ok := item[key]; ok {
+				parts[i] = fmt.Sprint(v)
+			}
+		}
+		return strings.Join(parts, "\x00")
+	}
+	// before reports whether the item at (value, key) comes before item
+	before := func(value any, key string, item map[string]any) bool {
+		c := compareValues(value, item[field])
+		if c == 0 {
+			c = strings.Compare(key, keyOf(item))
+		}
+		if opts.desc {
+			return c > 0
+		}
+		return c < 0
+	}
+	sort.Slice(matching, func(i, j int) bool {
+		return before(matching[i][field], keyOf(matching[i]), matching[j])
+	})
+
+	start := 0
+	if opts.cursor != nil {
+		start = sort.Search(len(matching), func(i int) bool {
+			return before(opts.cursor.Value, opts.cursor.Key, matching[i])
+		})
+	}
+	end := min(start+opts.limit, len(matching))
+
+	page := &ListPage{Items: make([]map[string]any, 0, end-start), Total: len(matching)}
+	for _, item := range matching[start:end] {
+		page.Items = append(page.Items, project(item, opts.fields))
+	}
+	if end < len(matching) {
+		last := matching[end-1]
+		cursor, err := json.Marshal(listCursor{Sort: opts.sort, Value: last[field], Key: keyOf(last)})
+		if err != nil {
+			return nil, err
+		}
+		page.NextCursor = base64.RawURLEncoding.EncodeToString(cursor)
+	}
+	return page, nil
+}
+
+func matchesFilters(item map[string]any, filters map[string]string) bool {
+	for field, value := range filters {
+		v, ok := item[field]
+		if !ok {
+			// Omitted fields are empty
+			if value != "" && value != "false" && value != "0" {
+				return false
+			}
+			continue
+		}
+		if fmt.Sprint(v) != value {
+			return false
+		}
+	}
+	return true
+}
+
+func project(item map[string]any, fields []string) map[string]any {
+	if len(fields) == 0 {
+		return item
+	}
+	projected := make(map[string]any, len(fields))
+	for _, field := range fields {
+		if v, ok := item[field]; ok {
+			projected[field] = v
+		}
+	}
+	return projected
+}
+
+// compareValues orders decoded JSON values: missing values first, numbers
+// numerically, timestamps chronologically and other strings lexically
+func compareValues(a, b any) int {
+	switch {
+	case a == nil && b == nil:
+		return 0
+	case a == nil:
+		return -1
+	case b == nil:
+		return 1
+	}
+	switch av := a.(type) {
+	case json.Number:
+		if bv, ok := b.(json.Number); ok {
+			af, _ := av.Float64()
+			bf, _ := bv.Float64()
+			switch {
+			case af < bf:
+				return -1
+			case af > bf:
+				return 1
+			}
+			return 0
+		}
+	case string:
+		if bv, ok := b.(string); ok {
+			at, aerr := time.Parse(time.RFC3339Nano, av)
+			bt, berr := time.Parse(time.RFC3339Nano, bv)
+			if aerr == nil && berr == nil {
+				return at.Compare(bt)
+			}
+			return strings.Compare(av, bv)
+		}
+	case bool:
+		if bv, ok := b.(bool); ok {
+			switch {
+			case av == bv:
+				return 0
+			case !av:
+				return -1
+			}
+			return 1
+		}
+	}
+	return strings.Compare(fmt.Sprint(a), fmt.Sprint(b))
+}
+
+// decodeJSONNumbers decodes keeping numbers exact, so byte counts above 2^53
+// survive the round trip
+func decodeJSONNumbers(data []byte, v any) error {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	return dec.Decode(v)
+}
@@ -0,0 +1,103 @@
+package cachesrv
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/bitechdev/go-turbo-cachesrv/storage"
+)
+
+// With the date layout every upload day is a directory of its own, so
+// lifecycle tooling can archive or remove old days with one directory
+// operation instead of touching artifacts one by one. The hash-to-file index
+// notices artifacts removed behind its back on their next lookup, and the
+// next maintenance scan drops their metadata. DELETE /admin/partitions/{name}
+// does the same from the server, forgetting the metadata right away.
+
+// classPartition is a partition of a size class's storage
+type classPartition struct {
+	Class string `json:"class"`
+	storage.Partition
+}
+
+// partitionedStorage returns the filesystem storage of a class if its
+// layout has partitions
+func partitionedStorage(class *SizeClass) *storage.FileSystem {
+	fs, ok := unwrapStorage(class.Storage).(*storage.FileSystem)
+	if !ok || !fs.Partitioned() {
+		return nil
+	}
+	return fs
+}
+
+// Handler for /admin/partitions
+func (s *Server) listPartitions(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	partitions := make([]classPartition, 0)
+	for _, class := range s.classes {
+		if fs := partitionedStorage(class); fs != nil {
+			for _, p := range fs.Partitions() {
+				partitions = append(partitions, classPartition{Class: class.Name, Partition: p})
+			}
+		}
+	}
+	s.writeList(w, r, partitions, "name", "class", "name")
+}
+
+// Handler for /admin/partitions/{name}; DELETE drops the partition in every
+// class, or only in the class parameter
+func (s *Server) dropPartition(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	name := strings.TrimPrefix(r.URL.Path, "/admin/partitions/")
+	only := r.URL.Query().Get("class")
+	dryRun := dryRunRequested(r)
+	now := time.Now()
+
+	report := &PurgeReport{DryRun: dryRun, Artifacts: make([]PurgedArtifact, 0)}
+	for _, class := range s.classes {
+		fs := partitionedStorage(class)
+		if fs == nil || (only != "" && class.Name != only) {
+			continue
+		}
+		hashes, err := fs.PartitionHashes(name)
+		if errors.Is(err, storage.ErrInvalidPartition) {
+			http.Error(w, "Invalid partition", http.StatusBadRequest)
+			return
+		}
+		for _, hash := range hashes {
+			if m, ok := s.index.Get(hash); ok && m.Class == class.Name {
+				if m.retained(now) {
+					http.Error(w, "Partition holds retained artifacts", http.StatusConflict)
+					return
+				}
+				report.add(&m)
+			}
+		}
+		if dryRun || len(hashes) == 0 {
+			continue
+		}
+		if err := fs.DropPartition(name); err != nil {
+			s.logger.Printf("Failed to drop partition %s of class %s: %v", name, class.Name, err)
+			http.Error(w, "Failed to drop partition", http.StatusInternalServerError)
+			return
+		}
+		for _, hash := range hashes {
+			if m, ok := s.index.Get(hash); ok && m.Class == class.Name {
+				s.index.Delete(hash)
+			}
+		}
+	}
+	if !dryRun {
+		s.logger.Printf("Dropped partition %s: %d artifacts (%d bytes)", name, report.Count, report.Bytes)
+	}
+	json.NewEncoder(w).Encode(report)
+}
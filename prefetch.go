@@ -0,0 +1,97 @@
+package cachesrv
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+)
+
+type PrefetchRequest struct {
+	Hashes []string `json:"hashes"`
+}
+
+type PrefetchResponse struct {
+	Queued  int `json:"queued"`
+	Dropped int `json:"dropped,omitempty"`
+}
+
+// Prefetcher stages artifacts into the hot tier in the background ahead of
+// the GETs of an upcoming build
+type Prefetcher struct {
+	queue  chan string
+	stage  func(hash string) error
+	logger *log.Logger
+}
+
+func NewPrefetcher(stage func(hash string) error, workers, queueSize int, logger *log.Logger) *Prefetcher {
+	p := &Prefetcher{
+		queue:  make(chan string, queueSize),
+		stage:  stage,
+		logger: logger,
+	}
+	for i := 0; i < workers; i++ {
+		go p.work()
+	}
+	return p
+}
+
+// Pending returns the number of queued hashes and how many fit
+func (p *Prefetcher) Pending() (int, int) {
+	return len(p.queue), cap(p.queue)
+}
+
+// Enqueue queues hashes without blocking, returning how many fit
+func (p *Prefetcher) Enqueue(hashes []string) int {
+	queued := 0
+	for _, hash := range hashes {
+		select {
+		case p.queue <- hash:
+			queued++
+		default:
+			return queued
+		}
+	}
+	return queued
+}
+
+func (p *Prefetcher) work() {
+	for hash := range p.queue {
+		if err := p.stage(hash); err != nil && err != errArtifactNotFound {
+			p.logger.Printf("Prefetch of %s failed: %v", hash, err)
+		}
+	}
+}
+
+// stageArtifact pulls an artifact into the hot tier of its storage, if it has one
+func (s *Server) stageArtifact(hash string) error {
+	if tiered, ok := unwrapStorage(s.storageFor(hash)).(*TieredStorage); ok {
+		return tiered.Stage(hash)
+	}
+	return nil
+}
+
+// Handler for /v8/artifacts/prefetch
+func (s *Server) prefetchArtifacts(w http.ResponseWriter, r *http.Request) {
+	var req PrefetchRequest
+	if !s.decodeBody(w, r, &req) {
+		return
+	}
+	hashes := make([]string, 0, len(req.Hashes))
+	for _, hash := range req.Hashes {
+		if !validHash(hash) || s.blocklist.Refuse(hash) {
+			continue
+		}
+		if key, err := s.namespaced(hash, r); err == nil {
+			hashes = append(hashes, key)
+		}
+	}
+
+	queued := s.prefetch.Enqueue(hashes)
+	if queued < len(hashes) {
+		s.logger.Printf("Prefetch queue full, dropped %d of %d hashes", len(hashes)-queued, len(hashes))
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(PrefetchResponse{Queued: queued, Dropped: len(hashes) - queued})
+}
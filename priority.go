@@ -0,0 +1,103 @@
+package cachesrv
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// Tokens can carry a priority class, so that when uploads or downloads wait
+// for a concurrency slot the release builds go first and a flood of PR builds
+// can't starve them. TURBO_PRIORITY_CLASSES lists the classes from highest
+// to lowest; a waiting request is only admitted once no request of a higher
+// class is waiting.
+
+// PriorityClasses ranks the configured classes, 0 being the highest
+type PriorityClasses struct {
+	ranks map[string]int
+	names []string
+	// def is the rank of tokens without a class
+	def int
+}
+
+func newPriorityClassesFromEnv() (*PriorityClasses, error) {
+	names := parseTags(envString("TURBO_PRIORITY_CLASSES", ""))
+	if len(names) == 0 {
+		return nil, nil
+	}
+	p := &PriorityClasses{ranks: make(map[string]int), names: names, def: len(names) - 1}
+	for i, name := range names {
+		if _, ok := p.ranks[name]; ok {
+			return nil, fmt.Errorf("priority class %q listed twice", name)
+		}
+		p.ranks[name] = i
+	}
+	if def := envString("TURBO_DEFAULT_PRIORITY", ""); def != "" {
+		rank, ok := p.ranks[def]
+		if !ok {
+			return nil, fmt.Errorf("unknown TURBO_DEFAULT_PRIORITY %q (expected one of %s)", def, strings.Join(names, ", "))
+		}
+		p.def = rank
+	}
+	return p, nil
+}
+
+// Rank returns the rank of a token's class; without classes every request
+// ranks the same
+func (p *PriorityClasses) Rank(class string) int {
+	if p == nil {
+		return 0
+	}
+	if rank, ok := p.ranks[class]; ok {
+		return rank
+	}
+	return p.def
+}
+
+// Name returns the class of a rank
+func (p *PriorityClasses) Name(rank int) string {
+	if p == nil || rank < 0 || rank >= len(p.names) {
+		return ""
+	}
+	return p.names[rank]
+}
+
+// Has reports whether a class is configured
+func (p *PriorityClasses) Has(class string) bool {
+	if p == nil {
+		return false
+	}
+	_, ok := p.ranks[class]
+	return ok
+}
+
+// check rejects tokens naming a class that isn't configured
+func (p *PriorityClasses) check(ts *TokenStore) error {
+	ts.mu.RLock()
+	defer ts.mu.RUnlock()
+	for _, t := range ts.tokens {
+		if t.Priority == "" {
+			continue
+		}
+		if p == nil {
+			return fmt.Errorf("token %q has priority %q but TURBO_PRIORITY_CLASSES is not set", t.Name, t.Priority)
+		}
+		if _, ok := p.ranks[t.Priority]; !ok {
+			return fmt.Errorf("token %q has unknown priority %q (expected one of %s)", t.Name, t.Priority, strings.Join(p.names, ", "))
+		}
+	}
+	return nil
+}
+
+type priorityKey struct{}
+
+func withPriority(ctx context.Context, rank int) context.Context {
+	return context.WithValue(ctx, priorityKey{}, rank)
+}
+
+// priorityOf returns the rank a request was authenticated with, 0 for
+// background work
+func priorityOf(ctx context.Context) int {
+	rank, _ := ctx.Value(priorityKey{}).(int)
+	return rank
+}
@@ -0,0 +1,223 @@
+package cachesrv
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// /metrics exposes the cache's counters in the Prometheus text format, for
+// dashboards of cache effectiveness. Traffic counters are cumulative since
+// startup; artifact counts and sizes are read from the index at each scrape.
+
+// latencyBuckets are the request duration histogram bounds in seconds,
+// reaching further than usual because large artifacts take a while
+var latencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60}
+
+type requestKey struct {
+	tenant, endpoint, method string
+	code                     int
+}
+
+type latencyKey struct {
+	endpoint, method string
+}
+
+type latencyHistogram struct {
+	counts []int64 // per bucket, not cumulative
+	count  int64
+	sum    float64
+}
+
+// RequestMetrics counts API requests by tenant, endpoint, method and status,
+// and keeps a latency histogram per endpoint and method. Endpoints are the
+// registered routes, "/v8/artifacts/{hash}" for every artifact, so the number of
+// series stays bounded.
+type RequestMetrics struct {
+	mu       sync.Mutex
+	requests map[requestKey]int64
+	latency  map[latencyKey]*latencyHistogram
+}
+
+func NewRequestMetrics() *RequestMetrics {
+	return &RequestMetrics{
+		requests: make(map[requestKey]int64),
+		latency:  make(map[latencyKey]*latencyHistogram),
+	}
+}
+
+// Observe records a finished request
+func (m *RequestMetrics) Observe(tenant string, r *http.Request, code int, elapsed time.Duration) {
+	if m == nil {
+		return
+	}
+	endpoint := route(r)
+	if endpoint == "" {
+		endpoint = "other"
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.requests[requestKey{orDefault(tenant), endpoint, r.Method, code}]++
+	key := latencyKey{endpoint, r.Method}
+	h := m.latency[key]
+	if h == nil {
+		h = &latencyHistogram{counts: make([]int64, len(latencyBuckets))}
+		m.latency[key] = h
+	}
+	seconds := elapsed.Seconds()
+	if i := sort.SearchFloat64s(latencyBuckets, seconds); i < len(latencyBuckets) {
+		h.counts[i]++
+	}
+	h.count++
+	h.sum += seconds
+}
+
+// orDefault names the default tenant and size class in metric labels
+func orDefault(name string) string {
+	if name == "" {
+		return "default"
+	}
+	return name
+}
+
+// promWriter writes metric families in the text exposition format
+type promWriter struct {
+	w *bufio.Writer
+}
+
+func (p *promWriter) family(name, kind, help string) {
+	fmt.Fprintf(p.w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+// sample writes one sample; labels alternate names and values
+func (p *promWriter) sample(name string, value float64, labels ...string) {
+	p.w.WriteString(name)
+	if len(labels) > 0 {
+		p.w.WriteByte('{')
+		for i := 0; i+1 < len(labels); i += 2 {
+			if i > 0 {
+				p.w.WriteByte(',')
+			}
+			// %q escapes backslashes, quotes and newlines as the format wants
+			fmt.Fprintf(p.w, "%s=%q", labels[i], labels[i+1])
+		}
+		p.w.WriteByte('}')
+	}
+	p.w.WriteByte(' ')
+	p.w.WriteString(strconv.FormatFloat(value, 'g', -1, 64))
+	p.w.WriteByte('\n')
+}
+
+// Handler for /metrics
+func (s *Server) getPrometheusMetrics(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	p := &promWriter{w: bufio.NewWriter(w)}
+	defer p.w.Flush()
+
+	s.requests.write(p)
+	writeBackendMetrics(p)
+
+	servers := append([]*Server{s}, s.tenants...)
+	totals := make([]MetricsBucket, len(servers))
+	for i, t := range servers {
+		totals[i] = t.metrics.Totals()
+	}
+	for _, counter := range []struct {
+		name, help string
+		value      func(MetricsBucket) int64
+	}{
+		{"turbo_cache_hits_total", "Artifact downloads served from the cache.", func(b MetricsBucket) int64 { return b.Hits }},
+		{"turbo_cache_misses_total", "Artifact downloads that found nothing.", func(b MetricsBucket) int64 { return b.Misses }},
+		{"turbo_cache_uploads_total", "Artifacts stored.", func(b MetricsBucket) int64 { return b.Uploads }},
+		{"turbo_cache_aborted_uploads_total", "Uploads the client disconnected from.", func(b MetricsBucket) int64 { return b.AbortedUploads }},
+		{"turbo_cache_upload_bytes_total", "Bytes of artifacts stored.", func(b MetricsBucket) int64 { return b.UploadBytes }},
+		{"turbo_cache_download_bytes_total", "Bytes of artifacts served.", func(b MetricsBucket) int64 { return b.DownloadBytes }},
+	} {
+		p.family(counter.name, "counter", counter.help)
+		for i, t := range servers {
+			p.sample(counter.name, float64(counter.value(totals[i])), "tenant", orDefault(t.tenant))
+		}
+	}
+
+	p.family("turbo_cache_artifacts", "gauge", "Artifacts stored, by size class.")
+	for _, t := range servers {
+		for _, class := range t.classes {
+			p.sample("turbo_cache_artifacts", float64(t.index.ClassCount(class.Name)), "tenant", orDefault(t.tenant), "class", orDefault(class.Name))
+		}
+	}
+	p.family("turbo_cache_storage_bytes", "gauge", "Bytes of artifacts stored, by size class.")
+	for _, t := range servers {
+		for _, class := range t.classes {
+			p.sample("turbo_cache_storage_bytes", float64(t.index.ClassSize(class.Name)), "tenant", orDefault(t.tenant), "class", orDefault(class.Name))
+		}
+	}
+}
+
+func (m *RequestMetrics) write(p *promWriter) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	keys := make([]requestKey, 0, len(m.requests))
+	for k := range m.requests {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		a, b := keys[i], keys[j]
+		if a.tenant != b.tenant {
+			return a.tenant < b.tenant
+		}
+		if a.endpoint != b.endpoint {
+			return a.endpoint < b.endpoint
+		}
+		if a.method != b.method {
+			return a.method < b.method
+		}
+		return a.code < b.code
+	})
+	p.family("turbo_cache_requests_total", "counter", "API requests by endpoint, method and status.")
+	for _, k := range keys {
+		p.sample("turbo_cache_requests_total", float64(m.requests[k]),
+			"tenant", k.tenant, "endpoint", k.endpoint, "method", k.method, "code", strconv.Itoa(k.code))
+	}
+
+	latencies := make([]latencyKey, 0, len(m.latency))
+	for k := range m.latency {
+		latencies = append(latencies, k)
+	}
+	sort.Slice(latencies, func(i, j int) bool {
+		return latencies[i].endpoint+" "+latencies[i].method < latencies[j].endpoint+" "+latencies[j].method
+	})
+	const name = "turbo_cache_request_duration_seconds"
+	p.family(name, "histogram", "API request latency by endpoint and method.")
+	for _, k := range latencies {
+		h := m.latency[k]
+		var cumulative int64
+		for i, bound := range latencyBuckets {
+			cumulative += h.counts[i]
+			p.sample(name+"_bucket", float64(cumulative), "endpoint", k.endpoint, "method", k.method,
+				"le", strconv.FormatFloat(bound, 'g', -1, 64))
+		}
+		p.sample(name+"_bucket", float64(h.count), "endpoint", k.endpoint, "method", k.method, "le", "+Inf")
+		p.sample(name+"_sum", h.sum, "endpoint", k.endpoint, "method", k.method)
+		p.sample(name+"_count", float64(h.count), "endpoint", k.endpoint, "method", k.method)
+	}
+}
+
+// serveMetrics serves /metrics without authentication on its own address,
+// for scrapers on an internal network
+func (s *Server) serveMetrics(addr string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", s.getPrometheusMetrics)
+	s.logger.Printf("Serving metrics on %s", addr)
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		s.logger.Fatal(err)
+	}
+}
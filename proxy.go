@@ -0,0 +1,348 @@
+package cachesrv
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// With TURBO_PROXY_BACKENDS the server stores nothing: it is a proxy in
+// front of a set of cache servers, sending each artifact to the backend that
+// owns its hash prefix on a consistent hash ring. Clients keep talking to
+// one URL while the cache is spread over as many servers as it needs, and
+// adding or removing a backend only moves the artifacts of its share of the
+// ring. Backends check the tokens, the proxy passes them on.
+
+// ProxyRing maps hash prefixes to backends
+type ProxyRing struct {
+	backends []*url.URL
+	points   []ringPoint
+	// prefix is how many characters of a hash place it on the ring, all of
+	// them if zero
+	prefix int
+}
+
+type ringPoint struct {
+	pos     uint64
+	backend int
+}
+
+// newProxyRing places vnodes points per unit of weight for every backend.
+// The points only depend on the backend's URL, so the ring is the same for
+// every proxy given the same backends, in any order.
+func newProxyRing(backends []*url.URL, weights []int, vnodes, prefix int) *ProxyRing {
+	ring := &ProxyRing{backends: backends, prefix: prefix}
+	for i, backend := range backends {
+		for n := range vnodes * weights[i] {
+			ring.points = append(ring.points, ringPoint{pos: ringPosition(fmt.Sprintf("%s#%d", backend, n)), backend: i})
+		}
+	}
+	sort.Slice(ring.points, func(i, j int) bool { return ring.points[i].pos < ring.points[j].pos })
+	return ring
+}
+
+func ringPosition(key string) uint64 {
+	sum := sha256.Sum256([]byte(key))
+	return binary.BigEndian.Uint64(sum[:8])
+}
+
+// Owner returns the backend of a hash: the first point at or after the
+// position of its prefix
+func (r *ProxyRing) Owner(hash string) int {
+	if r.prefix > 0 && len(hash) > r.prefix {
+		hash = hash[:r.prefix]
+	}
+	pos := ringPosition(strings.ToLower(hash))
+	i := sort.Search(len(r.points), func(i int) bool { return r.points[i].pos >= pos })
+	if i == len(r.points) {
+		i = 0
+	}
+	return r.points[i].backend
+}
+
+// Proxy routes the requests of clients to the backends of a ring
+type Proxy struct {
+	ring           *ProxyRing
+	client         *http.Client
+	maxRequestBody int64
+	logger         *log.Logger
+}
+
+// proxyFromEnv returns nil when TURBO_PROXY_BACKENDS is not set
+func proxyFromEnv(logger *log.Logger) (*Proxy, error) {
+	raw := getenv("TURBO_PROXY_BACKENDS")
+	if raw == "" {
+		return nil, nil
+	}
+	var backends []*url.URL
+	var weights []int
+	for _, entry := range strings.Split(raw, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		weight := 1
+		if i := strings.LastIndex(entry, "="); i >= 0 {
+			w, err := strconv.Atoi(entry[i+1:])
+			if err != nil || w < 1 {
+				return nil, fmt.Errorf("invalid weight in TURBO_PROXY_BACKENDS entry %q", entry)
+			}
+			entry, weight = entry[:i], w
+		}
+		u, err := url.Parse(strings.TrimSuffix(entry, "/"))
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, fmt.Errorf("invalid backend %q in TURBO_PROXY_BACKENDS", entry)
+		}
+		for _, other := range backends {
+			if other.String() == u.String() {
+				return nil, fmt.Errorf("backend %s is listed twice in TURBO_PROXY_BACKENDS", u)
+			}
+		}
+		backends = append(backends, u)
+		weights = append(weights, weight)
+	}
+	if len(backends) == 0 {
+		return nil, fmt.Errorf("TURBO_PROXY_BACKENDS lists no backends")
+	}
+	vnodes, err := envInt("TURBO_PROXY_VNODES", 128)
+	if err != nil {
+		return nil, err
+	}
+	if vnodes < 1 {
+		return nil, fmt.Errorf("invalid TURBO_PROXY_VNODES %d", vnodes)
+	}
+	prefix, err := envInt("TURBO_PROXY_PREFIX_LENGTH", 8)
+	if err != nil {
+		return nil, err
+	}
+	if prefix < 0 {
+		return nil, fmt.Errorf("invalid TURBO_PROXY_PREFIX_LENGTH %d", prefix)
+	}
+	timeout, err := envDuration("TURBO_PROXY_TIMEOUT", time.Minute)
+	if err != nil {
+		return nil, err
+	}
+	maxRequestBody, err := envSize("TURBO_MAX_REQUEST_BODY", 4<<20)
+	if err != nil {
+		return nil, err
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	// Uploads take as long as the client sends; only the answer is timed
+	transport.ResponseHeaderTimeout = timeout
+	return &Proxy{
+		ring: newProxyRing(backends, weights, vnodes, prefix),
+		client: &http.Client{
+			Transport: transport,
+			// Redirects of a backend are the client's to follow
+			CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+		},
+		maxRequestBody: maxRequestBody,
+		logger:         logger,
+	}, nil
+}
+
+// Register adds the routes of the proxy to a mux
+func (p *Proxy) Register(mux *http.ServeMux) {
+	mux.HandleFunc("/healthz", p.getHealth)
+	mux.HandleFunc(artifactRoute, p.routeArtifact)
+	mux.HandleFunc("POST /v8/artifacts", p.queryArtifacts)
+	mux.HandleFunc("DELETE /v8/team/artifacts/{hash}", p.routeArtifact)
+	// These work on many artifacts at once, which the backends can't
+	// answer for each other
+	for _, pattern := range []string{"/v8/artifacts/batch", "/v8/artifacts/summary", "/v8/artifacts/prefetch"} {
+		mux.HandleFunc(pattern, p.notProxied)
+	}
+	// The rest, such as status and events, is the first backend's to answer
+	mux.HandleFunc("GET /v8/artifacts/status", p.forwardFirst)
+	mux.HandleFunc("POST /v8/artifacts/events", p.forwardFirst)
+	mux.HandleFunc("/v8/", p.forwardFirst)
+}
+
+// Handler for /healthz
+func (p *Proxy) getHealth(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Write([]byte("ok\n"))
+}
+
+// Handler for /v8/artifacts/{hash} and /v8/team/artifacts/{hash}
+func (p *Proxy) routeArtifact(w http.ResponseWriter, r *http.Request) {
+	hash := r.PathValue("hash")
+	if !validHash(hash) {
+		http.Error(w, "Invalid artifact hash", http.StatusBadRequest)
+		return
+	}
+	p.forward(w, r, p.ring.Owner(hash))
+}
+
+// Handler for the endpoints the proxy doesn't route
+func (p *Proxy) notProxied(w http.ResponseWriter, r *http.Request) {
+	http.Error(w, "Not available through the proxy", http.StatusNotImplemented)
+}
+
+func (p *Proxy) forwardFirst(w http.ResponseWriter, r *http.Request) {
+	p.forward(w, r, 0)
+}
+
+func (p *Proxy) forward(w http.ResponseWriter, r *http.Request, backend int) {
+	base := p.ring.backends[backend]
+	if err := forward(p.client, base, w, r, p.logger); err != nil {
+		p.logger.Printf("Failed to forward %s %s to backend %s: %v", r.Method, r.URL.Path, base.Host, err)
+		http.Error(w, "Backend unavailable", http.StatusBadGateway)
+	}
+}
+
+// proxyAnswer is what a backend said to its part of a query
+type proxyAnswer struct {
+	status    int
+	header    http.Header
+	body      []byte
+	artifacts map[string]json.RawMessage
+	err       error
+}
+
+// Handler for POST /v8/artifacts: every backend is asked about its hashes
+// and their answers are merged
+func (p *Proxy) queryArtifacts(w http.ResponseWriter, r *http.Request) {
+	var req ArtifactQueryRequest
+	err := json.NewDecoder(http.MaxBytesReader(w, r.Body, p.maxRequestBody)).Decode(&req)
+	if tooLarge(err) {
+		http.Error(w, "Request body too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	shares := make(map[int][]string)
+	for _, hash := range req.Hashes {
+		owner := p.ring.Owner(hash)
+		shares[owner] = append(shares[owner], hash)
+	}
+
+	answers := make(map[int]*proxyAnswer, len(shares))
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for backend, hashes := range shares {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			answer := p.query(r, backend, hashes)
+			mu.Lock()
+			answers[backend] = answer
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+
+	response := make(map[string]json.RawMessage, len(req.Hashes))
+	for backend, answer := range answers {
+		if answer.err != nil {
+			p.logger.Printf("Failed to query backend %s for %d artifacts: %v", p.ring.backends[backend].Host, len(shares[backend]), answer.err)
+			unavailable, _ := json.Marshal(ArtifactInfo{Error: &struct {
+				Message string `json:"message"`
+			}{Message: "Backend unavailable"}})
+			for _, hash := range shares[backend] {
+				response[hash] = unavailable
+			}
+			continue
+		}
+		// A refused token is refused by every backend, pass the first on
+		if answer.status != http.StatusOK {
+			for name, values := range answer.header {
+				w.Header()[name] = values
+			}
+			w.WriteHeader(answer.status)
+			w.Write(answer.body)
+			return
+		}
+		for hash, info := range answer.artifacts {
+			response[hash] = info
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// query asks a backend about some of the hashes of a query
+func (p *Proxy) query(r *http.Request, backend int, hashes []string) *proxyAnswer {
+	body, err := json.Marshal(ArtifactQueryRequest{Hashes: hashes})
+	if err != nil {
+		return &proxyAnswer{err: err}
+	}
+	target := *p.ring.backends[backend]
+	target.Path += r.URL.Path
+	target.RawQuery = r.URL.RawQuery
+	req, err := http.NewRequestWithContext(r.Context(), http.MethodPost, target.String(), bytes.NewReader(body))
+	if err != nil {
+		return &proxyAnswer{err: err}
+	}
+	req.Header = forwardedHeader(r)
+	req.Header.Del("Content-Length")
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return &proxyAnswer{err: err}
+	}
+	defer resp.Body.Close()
+	answer := &proxyAnswer{status: resp.StatusCode, header: resp.Header}
+	if answer.body, err = io.ReadAll(resp.Body); err != nil {
+		return &proxyAnswer{err: err}
+	}
+	if resp.StatusCode == http.StatusOK {
+		if err := json.Unmarshal(answer.body, &answer.artifacts); err != nil {
+			return &proxyAnswer{err: fmt.Errorf("failed to parse answer: %w", err)}
+		}
+	}
+	return answer
+}
+
+// serveProxy serves a proxy instead of a cache until the listener fails
+func serveProxy(proxy *Proxy, logger *log.Logger) {
+	backends := make([]string, len(proxy.ring.backends))
+	for i, backend := range proxy.ring.backends {
+		backends[i] = backend.Host
+	}
+	logger.Printf("Proxying to %d backends: %s", len(backends), strings.Join(backends, ", "))
+	tlsConfig, _, err := tlsConfigFromEnv()
+	if err != nil {
+		logger.Fatal(err)
+	}
+	readHeaderTimeout, err := envDuration("TURBO_READ_HEADER_TIMEOUT", 10*time.Second)
+	if err != nil {
+		logger.Fatal(err)
+	}
+	idleTimeout, err := envDuration("TURBO_IDLE_TIMEOUT", 2*time.Minute)
+	if err != nil {
+		logger.Fatal(err)
+	}
+	mux := http.NewServeMux()
+	proxy.Register(mux)
+
+	listen := envString("TURBO_LISTEN", ":8080")
+	reportUnusedSettings(logger)
+	httpServer := &http.Server{Addr: listen, Handler: mux, ReadHeaderTimeout: readHeaderTimeout, IdleTimeout: idleTimeout, ErrorLog: logger}
+	if tlsConfig == nil {
+		logger.Printf("Starting proxy on %s", listen)
+		fmt.Println("Starting proxy on", listen)
+		err = httpServer.ListenAndServe()
+	} else {
+		logger.Printf("Starting proxy on %s with TLS", listen)
+		fmt.Println("Starting proxy on", listen, "with TLS")
+		httpServer.TLSConfig = tlsConfig
+		err = httpServer.ListenAndServeTLS("", "")
+	}
+	if err != nil {
+		logger.Fatal(err)
+	}
+}
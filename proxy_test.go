@@ -0,0 +1,143 @@
+package cachesrv
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func testBackends(t *testing.T, raw ...string) []*url.URL {
+	t.Helper()
+	backends := make([]*url.URL, len(raw))
+	for i, r := range raw {
+		u, err := url.Parse(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		backends[i] = u
+	}
+	return backends
+}
+
+// ringOwners maps every test hash to the URL of the backend owning it
+func ringOwners(ring *ProxyRing, hashes []string) map[string]string {
+	owners := make(map[string]string, len(hashes))
+	for _, hash := range hashes {
+		owners[hash] = ring.backends[ring.Owner(hash)].String()
+	}
+	return owners
+}
+
+func testHashes(n int) []string {
+	hashes := make([]string, n)
+	for i := range hashes {
+		hashes[i] = fmt.Sprintf("%016x", uint64(i)*0x9e3779b97f4a7c15)
+	}
+	return hashes
+}
+
+func TestProxyRingOwnership(t *testing.T) {
+	hashes := testHashes(10000)
+	ring := newProxyRing(testBackends(t, "http://a:8080", "http://b:8080", "http://c:8080"), []int{1, 1, 1}, 128, 0)
+	owners := ringOwners(ring, hashes)
+
+	t.Run("same in any order", func(t *testing.T) {
+		shuffled := newProxyRing(testBackends(t, "http://c:8080", "http://a:8080", "http://b:8080"), []int{1, 1, 1}, 128, 0)
+		for hash, owner := range ringOwners(shuffled, hashes) {
+			if owner != owners[hash] {
+				t.Fatalf("%s owned by %s, and by %s with the backends reordered", hash, owners[hash], owner)
+			}
+		}
+	})
+
+	t.Run("balanced", func(t *testing.T) {
+		shares := make(map[string]int)
+		for _, owner := range owners {
+			shares[owner]++
+		}
+		for backend, n := range shares {
+			if n < 2500 || n > 4200 {
+				t.Errorf("%s owns %d of %d hashes", backend, n, len(hashes))
+			}
+		}
+	})
+
+	t.Run("weighted", func(t *testing.T) {
+		weighted := newProxyRing(testBackends(t, "http://a:8080", "http://b:8080"), []int{2, 1}, 128, 0)
+		shares := make(map[string]int)
+		for _, owner := range ringOwners(weighted, hashes) {
+			shares[owner]++
+		}
+		if ratio := float64(shares["http://a:8080"]) / float64(shares["http://b:8080"]); ratio < 1.5 || ratio > 2.7 {
+			t.Errorf("weight 2 owns %.2f times the share of weight 1, want about 2", ratio)
+		}
+	})
+
+	t.Run("adding a backend only moves hashes to it", func(t *testing.T) {
+		grown := newProxyRing(testBackends(t, "http://a:8080", "http://b:8080", "http://c:8080", "http://d:8080"), []int{1, 1, 1, 1}, 128, 0)
+		moved := 0
+		for hash, owner := range ringOwners(grown, hashes) {
+			if owner == owners[hash] {
+				continue
+			}
+			moved++
+			if owner != "http://d:8080" {
+				t.Fatalf("%s moved from %s to %s", hash, owners[hash], owner)
+			}
+		}
+		if moved < 1500 || moved > 3500 {
+			t.Errorf("%d of %d hashes moved to the new backend, want about a quarter", moved, len(hashes))
+		}
+	})
+
+	t.Run("removing a backend only moves its hashes", func(t *testing.T) {
+		shrunk := newProxyRing(testBackends(t, "http://a:8080", "http://c:8080"), []int{1, 1}, 128, 0)
+		for hash, owner := range ringOwners(shrunk, hashes) {
+			if owners[hash] != "http://b:8080" && owner != owners[hash] {
+				t.Fatalf("%s moved from %s to %s", hash, owners[hash], owner)
+			}
+		}
+	})
+
+	t.Run("prefix and case", func(t *testing.T) {
+		prefixed := newProxyRing(ring.backends, []int{1, 1, 1}, 128, 4)
+		for _, hash := range hashes[:100] {
+			want := prefixed.Owner(hash[:4])
+			if got := prefixed.Owner(hash + "ffff"); got != want {
+				t.Errorf("%sffff owned by %d, its prefix by %d", hash, got, want)
+			}
+			if got := ring.Owner(strings.ToUpper(hash)); got != ring.Owner(hash) {
+				t.Errorf("%s owned by %d upper-cased, %d otherwise", hash, got, ring.Owner(hash))
+			}
+		}
+	})
+}
+
+func TestProxyRoutesToOwner(t *testing.T) {
+	var raw []string
+	for _, name := range []string{"a", "b", "c"} {
+		backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprintf(w, "%s %s", name, r.URL.Path)
+		}))
+		defer backend.Close()
+		raw = append(raw, backend.URL)
+	}
+	ring := newProxyRing(testBackends(t, raw...), []int{1, 1, 1}, 128, 0)
+	p := &Proxy{ring: ring, client: http.DefaultClient, maxRequestBody: 1 << 20, logger: log.New(io.Discard, "", 0)}
+	mux := http.NewServeMux()
+	p.Register(mux)
+
+	for _, hash := range testHashes(20) {
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/v8/artifacts/"+hash, nil))
+		want := fmt.Sprintf("%s /v8/artifacts/%s", []string{"a", "b", "c"}[ring.Owner(hash)], hash)
+		if w.Code != http.StatusOK || w.Body.String() != want {
+			t.Errorf("GET %s = %d %q, want %q", hash, w.Code, w.Body, want)
+		}
+	}
+}
@@ -0,0 +1,178 @@
+package cachesrv
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// Every admin call that removes artifacts goes through purgeArtifacts and
+// accepts dry_run=true, which returns the same report without changing
+// anything.
+
+// PurgedArtifact is one artifact removed by an admin call
+type PurgedArtifact struct {
+	Hash   string `json:"hash"`
+	Class  string `json:"class,omitempty"`
+	Team   string `json:"team,omitempty"`
+	Size   int64  `json:"size"`
+	Digest string `json:"digest,omitempty"`
+}
+
+// PurgeReport lists the artifacts an admin call removed or, in a dry run,
+// would remove
+type PurgeReport struct {
+	DryRun    bool             `json:"dryRun"`
+	Count     int              `json:"count"`
+	Bytes     int64            `json:"bytes"`
+	Failed    int              `json:"failed,omitempty"`
+	Artifacts []PurgedArtifact `json:"artifacts"`
+
+	// Retained counts the compliance uploads that were kept
+	Retained int `json:"retained,omitempty"`
+}
+
+func (p *PurgeReport) add(m *ArtifactMeta) {
+	p.Count++
+	p.Bytes += m.Size
+	p.Artifacts = append(p.Artifacts, PurgedArtifact{Hash: m.Hash, Class: m.Class, Team: m.Team, Size: m.Size, Digest: m.Digest})
+}
+
+// merge adds the artifacts of another report
+func (p *PurgeReport) merge(other *PurgeReport) {
+	p.Count += other.Count
+	p.Bytes += other.Bytes
+	p.Failed += other.Failed
+	p.Retained += other.Retained
+	p.Artifacts = append(p.Artifacts, other.Artifacts...)
+}
+
+func dryRunRequested(r *http.Request) bool {
+	return r.URL.Query().Get("dry_run") == "true"
+}
+
+// purgeArtifacts forgets the candidates and deletes their files, or in a dry
+// run only reports them. Candidates uploaded again since they were selected
+// are left alone, so a dry run can list an artifact that is then kept, and
+// so are retained compliance uploads. A cancelled context stops it early with
+// a partial report.
+func purgeArtifacts(ctx context.Context, job *Job, index *MetadataIndex, classes []*SizeClass, candidates []ArtifactMeta, dryRun bool, logger *log.Logger) *PurgeReport {
+	report := &PurgeReport{DryRun: dryRun, Artifacts: make([]PurgedArtifact, 0, len(candidates))}
+	job.AddTotal(len(candidates))
+	now := index.clock.Now()
+	for i := range candidates {
+		if ctx.Err() != nil {
+			break
+		}
+		job.Advance(1)
+		m := &candidates[i]
+		if m.retained(now) {
+			report.Retained++
+			continue
+		}
+		if dryRun {
+			report.add(m)
+			continue
+		}
+		if !index.DeleteIfUnchanged(m) {
+			continue
+		}
+		report.add(m)
+		class := findClass(classes, m.Class)
+		if class == nil {
+			continue
+		}
+		if err := class.Storage.Delete(m.Hash); err != nil {
+			logger.Printf("Failed to delete artifact %s: %v", m.Hash, err)
+			report.Failed++
+		}
+	}
+	return report
+}
+
+// selectArtifacts returns the artifacts matching the metadata headers and
+// the team, class, olderThan and unusedFor parameters; selected is false
+// when the request had no criteria at all
+func (s *Server) selectArtifacts(r *http.Request) (matches []ArtifactMeta, selected bool, err error) {
+	q := r.URL.Query()
+	filter := make(map[string]string)
+	for _, name := range s.metadataHeaders {
+		if value := q.Get(name); value != "" {
+			filter[name] = value
+		}
+	}
+	selected = len(filter) > 0
+
+	now := s.index.clock.Now()
+	var olderThan, unusedFor time.Duration
+	for _, p := range []struct {
+		name string
+		d    *time.Duration
+	}{{"olderThan", &olderThan}, {"unusedFor", &unusedFor}} {
+		if v := q.Get(p.name); v != "" {
+			if *p.d, err = time.ParseDuration(v); err != nil {
+				return nil, false, err
+			}
+			selected = true
+		}
+	}
+	team, class := q.Get("team"), q.Get("class")
+	selected = selected || team != "" || class != ""
+
+	for _, m := range s.index.Find(filter) {
+		switch {
+		case team != "" && m.Team != team:
+		case class != "" && m.Class != class:
+		case olderThan > 0 && !m.CreatedAt.Before(now.Add(-olderThan)):
+		case unusedFor > 0 && !m.lastUsed().Before(now.Add(-unusedFor)):
+		default:
+			matches = append(matches, m)
+		}
+	}
+	sort.Slice(matches, func(i, j int) bool { return matches[i].Hash < matches[j].Hash })
+	return matches, selected, nil
+}
+
+// deleteArtifacts handles DELETE /admin/artifacts; wiping the whole cache
+// takes an explicit all=true. Federated servers leave tombstones for the
+// peers to delete their copies too, unless local=true.
+func (s *Server) deleteArtifacts(w http.ResponseWriter, r *http.Request) {
+	matches, selected, err := s.selectArtifacts(r)
+	if err != nil {
+		http.Error(w, "Invalid duration", http.StatusBadRequest)
+		return
+	}
+	if !selected && r.URL.Query().Get("all") != "true" {
+		http.Error(w, "Refusing to delete every artifact without all=true", http.StatusBadRequest)
+		return
+	}
+
+	dryRun := dryRunRequested(r)
+	local := r.URL.Query().Get("local") == "true"
+	if asyncRequested(r) {
+		s.startJob(w, "delete", func(ctx context.Context, job *Job) (any, error) {
+			report := purgeArtifacts(ctx, job, s.index, s.classes, matches, dryRun, s.logger)
+			job.Logf("%d artifacts (%d bytes) matched, %d failed", report.Count, report.Bytes, report.Failed)
+			if !local {
+				if err := s.federation.Bury(report); err != nil {
+					job.Logf("Failed to record tombstones: %v", err)
+				}
+			}
+			return report, nil
+		})
+		return
+	}
+	report := purgeArtifacts(r.Context(), nil, s.index, s.classes, matches, dryRun, s.logger)
+	if !dryRun {
+		s.logger.Printf("Deleted %d artifacts (%d bytes), %d failed", report.Count, report.Bytes, report.Failed)
+	}
+	if !local {
+		if err := s.federation.Bury(report); err != nil {
+			s.logger.Printf("Failed to record tombstones: %v", err)
+		}
+	}
+	json.NewEncoder(w).Encode(report)
+}
@@ -0,0 +1,73 @@
+package cachesrv
+
+import (
+	"net/http"
+)
+
+// QueueStatus is what /admin/queues reports about one internal queue.
+// Saturation is the share of its capacity in use: above 1 for a concurrency
+// limit means operations are waiting for a slot.
+type QueueStatus struct {
+	Name       string  `json:"name"`
+	Depth      int     `json:"depth"`
+	InFlight   int     `json:"inFlight,omitempty"`
+	Capacity   int     `json:"capacity,omitempty"`
+	Saturation float64 `json:"saturation"`
+	Shed       int64   `json:"shed,omitempty"`
+}
+
+func queueStatus(name string, depth, capacity int) QueueStatus {
+	q := QueueStatus{Name: name, Depth: depth, Capacity: capacity}
+	if capacity > 0 {
+		q.Saturation = float64(depth) / float64(capacity)
+	}
+	return q
+}
+
+// queues collects the depth of every queue in the server
+func (s *Server) queues() []QueueStatus {
+	queues := []QueueStatus{{Name: "pending-uploads", Depth: s.index.Uploading()}}
+	for _, l := range []*AdaptiveLimit{s.uploadLimit, s.downloadLimit, s.scanner.limit} {
+		if l == nil {
+			continue
+		}
+		status := l.Status()
+		q := QueueStatus{
+			Name:     status.Name,
+			Depth:    status.Waiting,
+			InFlight: status.InFlight,
+			Capacity: status.Limit,
+			Shed:     status.Shed,
+		}
+		if q.Capacity > 0 {
+			q.Saturation = float64(q.InFlight+q.Depth) / float64(q.Capacity)
+		}
+		queues = append(queues, q)
+	}
+	if s.prefetch != nil {
+		depth, capacity := s.prefetch.Pending()
+		queues = append(queues, queueStatus("prefetch", depth, capacity))
+	}
+	if s.archive != nil {
+		depth, capacity := s.archive.Pending()
+		queues = append(queues, queueStatus("archive", depth, capacity))
+	}
+	if s.callbacks != nil {
+		depth, capacity := s.callbacks.Pending()
+		queues = append(queues, queueStatus("callbacks", depth, capacity))
+	}
+	if s.jobs != nil {
+		depth, capacity := s.jobs.Pending()
+		queues = append(queues, queueStatus("jobs", depth, capacity))
+	}
+	return queues
+}
+
+// Handler for /admin/queues
+func (s *Server) listQueues(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	s.writeList(w, r, s.queues(), "name", "name")
+}
@@ -0,0 +1,164 @@
+package cachesrv
+
+import (
+	"errors"
+	"sync"
+)
+
+var (
+	errQuotaExceeded = errors.New("team quota exceeded")
+	errStorageFull   = errors.New("cache budget exceeded")
+)
+
+// QuotaManager enforces per-team storage quotas and the budget (bytes and
+// artifact count) of each size class. Uploads reserve their Content-Length before any bytes are written,
+// so concurrent uploads can't jointly exceed a limit between checking usage
+// and finishing the write.
+type QuotaManager struct {
+	mu            sync.Mutex
+	index         *MetadataIndex
+	classBudgets  map[string]ClassBudget
+	defaultLimit  int64
+	limits        map[string]int64
+	directory     *TeamDirectory
+	reserved      map[string]int64
+	classReserved map[string]int64
+	classPending  map[string]int64
+}
+
+// QuotaReservation is held for the duration of an upload
+type QuotaReservation struct {
+	q        *QuotaManager
+	team     string
+	class    string
+	size     int64
+	newFile  bool
+	released bool
+}
+
+func NewQuotaManager(index *MetadataIndex, classBudgets map[string]ClassBudget, defaultLimit int64, limits map[string]int64, directory *TeamDirectory) *QuotaManager {
+	return &QuotaManager{
+		index:         index,
+		classBudgets:  classBudgets,
+		defaultLimit:  defaultLimit,
+		limits:        limits,
+		directory:     directory,
+		reserved:      make(map[string]int64),
+		classReserved: make(map[string]int64),
+		classPending:  make(map[string]int64),
+	}
+}
+
+// Limit returns the quota for a team; zero means unlimited
+func (q *QuotaManager) Limit(team string) int64 {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.limit(team)
+}
+
+// limit returns the quota for a team: its own setting, else the team
+// directory's, else the default. Callers must hold the lock.
+func (q *QuotaManager) limit(team string) int64 {
+	if limit, ok := q.limits[team]; ok {
+		return limit
+	}
+	if limit, ok := q.directory.Quota(team); ok {
+		return limit
+	}
+	return q.defaultLimit
+}
+
+// OverBudget reports whether any size class has used up its budget, i.e.
+// has no room left for even one more byte or artifact
+func (q *QuotaManager) OverBudget() bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for class, budget := range q.classBudgets {
+		if budget.limited() && budget.exceeded(q.index.ClassSize(class)+1, q.index.ClassCount(class)+1) {
+			return true
+		}
+	}
+	return false
+}
+
+// ClassBudget returns the budget of a size class
+func (q *QuotaManager) ClassBudget(class string) ClassBudget {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.classBudgets[class]
+}
+
+// SetLimits replaces the class budgets and team quotas, for a reload.
+// Reservations already made stay valid.
+func (q *QuotaManager) SetLimits(classBudgets map[string]ClassBudget, defaultLimit int64, limits map[string]int64) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.classBudgets, q.defaultLimit, q.limits = classBudgets, defaultLimit, limits
+}
+
+// Reserve claims size bytes of the team's quota and of the class' budget, or
+// fails with errQuotaExceeded or errStorageFull. An existing artifact being
+// overwritten is credited back since it will be replaced.
+func (q *QuotaManager) Reserve(team, hash, class string, size int64) (*QuotaReservation, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	existing, exists := q.index.Get(hash)
+
+	newFile := !exists || existing.Class != class
+	if budget := q.classBudgets[class]; budget.limited() {
+		used := q.index.ClassSize(class) + q.classReserved[class]
+		files := q.index.ClassCount(class) + q.classPending[class]
+		if !newFile {
+			used -= existing.Size
+		} else {
+			files++
+		}
+		if budget.exceeded(used+size, files) {
+			return nil, errStorageFull
+		}
+	}
+
+	if limit := q.limit(team); limit > 0 {
+		used := q.index.TeamUsage(team) + q.reserved[team]
+		if exists && existing.Team == team {
+			used -= existing.Size
+		}
+		if used+size > limit {
+			return nil, errQuotaExceeded
+		}
+	}
+
+	q.reserved[team] += size
+	q.classReserved[class] += size
+	if newFile {
+		q.classPending[class]++
+	}
+	return &QuotaReservation{q: q, team: team, class: class, size: size, newFile: newFile}, nil
+}
+
+// Release returns the reservation once the upload has been recorded in the
+// index or abandoned; it is safe to call more than once
+func (r *QuotaReservation) Release() {
+	r.q.mu.Lock()
+	defer r.q.mu.Unlock()
+	if r.released {
+		return
+	}
+	r.released = true
+	r.q.reserved[r.team] -= r.size
+	r.q.classReserved[r.class] -= r.size
+	if r.newFile {
+		r.q.classPending[r.class]--
+	}
+	if r.q.reserved[r.team] == 0 {
+		delete(r.q.reserved, r.team)
+	}
+}
+
+// Usage reports stored and currently reserved bytes for a team
+func (q *QuotaManager) Usage(team string) (used, reserved int64) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.index.TeamUsage(team), q.reserved[team]
+}
@@ -0,0 +1,99 @@
+package cachesrv
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/bitechdev/go-turbo-cachesrv/storage"
+)
+
+func newTestQuotaManager(t *testing.T, budget ClassBudget, limits map[string]int64) (*QuotaManager, *storage.FileSystem, *MetadataIndex) {
+	t.Helper()
+	dir := t.TempDir()
+	fs, err := storage.NewFileSystem(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	idx := newJournaledIndex(t, dir, fs)
+	t.Cleanup(func() { idx.journal.Close() })
+	return NewQuotaManager(idx, map[string]ClassBudget{defaultClass: budget}, 0, limits, nil), fs, idx
+}
+
+func TestQuotaReserveConcurrent(t *testing.T) {
+	tests := []struct {
+		name   string
+		budget ClassBudget
+		limits map[string]int64
+		err    error
+		want   int
+	}{
+		{"team quota", ClassBudget{}, map[string]int64{"web": 250}, errQuotaExceeded, 25},
+		{"class size", ClassBudget{MaxSize: 155}, nil, errStorageFull, 15},
+		{"class files", ClassBudget{MaxFiles: 7}, nil, errStorageFull, 7},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q, _, _ := newTestQuotaManager(t, tt.budget, tt.limits)
+			var (
+				wg           sync.WaitGroup
+				mu           sync.Mutex
+				reservations []*QuotaReservation
+			)
+			for i := 0; i < 100; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					r, err := q.Reserve("web", fmt.Sprintf("%04x", i), defaultClass, 10)
+					if err != nil {
+						if !errors.Is(err, tt.err) {
+							t.Errorf("Reserve error = %v, want %v", err, tt.err)
+						}
+						return
+					}
+					mu.Lock()
+					reservations = append(reservations, r)
+					mu.Unlock()
+				}()
+			}
+			wg.Wait()
+			if len(reservations) != tt.want {
+				t.Errorf("%d concurrent reservations succeeded, want %d", len(reservations), tt.want)
+			}
+			if _, reserved := q.Usage("web"); reserved != int64(10*tt.want) {
+				t.Errorf("reserved = %d, want %d", reserved, 10*tt.want)
+			}
+
+			// Releasing, twice for good measure, frees the room again
+			for _, r := range reservations {
+				r.Release()
+				r.Release()
+			}
+			if _, reserved := q.Usage("web"); reserved != 0 {
+				t.Errorf("reserved after release = %d, want 0", reserved)
+			}
+			if _, err := q.Reserve("web", "ffff", defaultClass, 10); err != nil {
+				t.Errorf("Reserve after release: %v", err)
+			}
+		})
+	}
+}
+
+func TestQuotaReserveOverwrite(t *testing.T) {
+	q, fs, idx := newTestQuotaManager(t, ClassBudget{MaxSize: 100, MaxFiles: 1}, map[string]int64{"web": 100})
+	storeArtifact(t, fs, idx, ArtifactMeta{Hash: "aaaa", Size: 80, Team: "web"})
+
+	// Replacing an artifact only needs room for the difference
+	r, err := q.Reserve("web", "aaaa", defaultClass, 90)
+	if err != nil {
+		t.Fatalf("Reserve of an overwrite: %v", err)
+	}
+	defer r.Release()
+	if _, err := q.Reserve("web", "bbbb", defaultClass, 5); !errors.Is(err, errStorageFull) {
+		t.Errorf("Reserve of a new file error = %v, want %v", err, errStorageFull)
+	}
+	if _, err := q.Reserve("api", "aaaa", defaultClass, 200); !errors.Is(err, errStorageFull) {
+		t.Errorf("Reserve over the class size error = %v, want %v", err, errStorageFull)
+	}
+}
@@ -0,0 +1,148 @@
+package cachesrv
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"strings"
+)
+
+// Role is the access an admin credential grants; each role includes the
+// ones before it
+type Role int
+
+const (
+	roleNone Role = iota
+	// roleViewer reads stats, lists and reports
+	roleViewer
+	// roleOperator also runs maintenance: scans, backups, restores and kill switches
+	roleOperator
+	// roleAdmin also changes configuration: tokens and tenants
+	roleAdmin
+)
+
+var roleNames = []string{"none", "viewer", "operator", "admin"}
+
+func (r Role) String() string {
+	if r < roleNone || int(r) >= len(roleNames) {
+		return fmt.Sprintf("role(%d)", int(r))
+	}
+	return roleNames[r]
+}
+
+func parseRole(name string) (Role, error) {
+	for i, n := range roleNames {
+		if n == name {
+			return Role(i), nil
+		}
+	}
+	return roleNone, fmt.Errorf("unknown role %q (expected viewer, operator or admin)", name)
+}
+
+// AdminRoles maps admin tokens, and the users and groups of LDAP or
+// dashboard logins, onto roles
+type AdminRoles struct {
+	tokens      map[string]Role
+	users       map[string]Role
+	groups      map[string]Role
+	defaultRole Role
+	// scopeRole is granted to artifact tokens of the admin scope
+	scopeRole Role
+}
+
+// Enabled reports whether any admin token is configured
+func (ar *AdminRoles) Enabled() bool {
+	return len(ar.tokens) > 0
+}
+
+// TokenRole returns the role of a bearer token, or roleNone
+func (ar *AdminRoles) TokenRole(token string) Role {
+	role := roleNone
+	// Compare against every token so the timing doesn't reveal which matched
+	for t, r := range ar.tokens {
+		if subtle.ConstantTimeCompare([]byte(token), []byte(t)) == 1 {
+			role = r
+		}
+	}
+	return role
+}
+
+// IdentityRole returns the role of a user: their own mapping if there is
+// one, otherwise the highest role of their groups, otherwise the default
+func (ar *AdminRoles) IdentityRole(user string, groups []string) Role {
+	if role, ok := ar.users[user]; ok {
+		return role
+	}
+	role, mapped := roleNone, false
+	for _, g := range groups {
+		if r, ok := ar.groups[g]; ok {
+			role, mapped = max(role, r), true
+		}
+	}
+	if mapped {
+		return role
+	}
+	return ar.defaultRole
+}
+
+// parseRoleMap parses "name:role,..." lists
+func parseRoleMap(name string) (map[string]Role, error) {
+	roles := make(map[string]Role)
+	v := getenv(name)
+	if v == "" {
+		return roles, nil
+	}
+	for _, pair := range strings.Split(v, ",") {
+		key, value, ok := strings.Cut(strings.TrimSpace(pair), ":")
+		if !ok || key == "" {
+			return nil, fmt.Errorf("invalid %s entry %q (expected name:role)", name, pair)
+		}
+		role, err := parseRole(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s: %w", name, err)
+		}
+		roles[key] = role
+	}
+	return roles, nil
+}
+
+// newAdminRolesFromEnv grants adminToken the admin role and reads the other
+// role assignments. Logins without a mapping default to viewer; making them
+// admins takes TURBO_ADMIN_DEFAULT_ROLE=admin. Artifact tokens of the admin
+// scope get no role unless TURBO_ADMIN_SCOPE_ROLE grants one.
+func newAdminRolesFromEnv(adminToken, authToken string) (*AdminRoles, error) {
+	ar := &AdminRoles{tokens: make(map[string]Role)}
+	for _, source := range []struct {
+		env  string
+		role Role
+	}{
+		{"TURBO_ADMIN_VIEWER_TOKENS", roleViewer},
+		{"TURBO_ADMIN_OPERATOR_TOKENS", roleOperator},
+	} {
+		for _, token := range strings.Split(getenv(source.env), ",") {
+			if token = strings.TrimSpace(token); token != "" {
+				ar.tokens[token] = source.role
+			}
+		}
+	}
+	if adminToken != "" {
+		ar.tokens[adminToken] = roleAdmin
+	}
+	if _, ok := ar.tokens[authToken]; ok && authToken != "" {
+		return nil, fmt.Errorf("admin tokens must differ from TURBO_AUTH_TOKEN")
+	}
+
+	var err error
+	if ar.users, err = parseRoleMap("TURBO_ADMIN_USER_ROLES"); err != nil {
+		return nil, err
+	}
+	if ar.groups, err = parseRoleMap("TURBO_ADMIN_GROUP_ROLES"); err != nil {
+		return nil, err
+	}
+	if ar.defaultRole, err = parseRole(envString("TURBO_ADMIN_DEFAULT_ROLE", "viewer")); err != nil {
+		return nil, fmt.Errorf("invalid TURBO_ADMIN_DEFAULT_ROLE: %w", err)
+	}
+	if ar.scopeRole, err = parseRole(envString("TURBO_ADMIN_SCOPE_ROLE", "none")); err != nil {
+		return nil, fmt.Errorf("invalid TURBO_ADMIN_SCOPE_ROLE: %w", err)
+	}
+	return ar, nil
+}
@@ -0,0 +1,163 @@
+package cachesrv
+
+import (
+	"context"
+	"io"
+	"log"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestIdentityRole(t *testing.T) {
+	roles := &AdminRoles{
+		users:       map[string]Role{"alice": roleAdmin, "mallory": roleNone},
+		groups:      map[string]Role{"sre": roleOperator, "engineering": roleViewer, "contractors": roleNone},
+		defaultRole: roleViewer,
+	}
+	tests := []struct {
+		name   string
+		user   string
+		groups []string
+		want   Role
+	}{
+		{"user mapping", "alice", nil, roleAdmin},
+		{"user mapping wins over groups", "mallory", []string{"sre"}, roleNone},
+		{"group mapping", "bob", []string{"engineering"}, roleViewer},
+		{"highest group", "bob", []string{"engineering", "sre"}, roleOperator},
+		{"unmapped groups are ignored", "bob", []string{"sales", "sre"}, roleOperator},
+		{"group mapped to none", "bob", []string{"contractors"}, roleNone},
+		{"default without groups", "carol", nil, roleViewer},
+		{"default with unmapped groups", "carol", []string{"sales"}, roleViewer},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := roles.IdentityRole(tt.user, tt.groups); got != tt.want {
+				t.Errorf("IdentityRole(%q, %q) = %s, want %s", tt.user, tt.groups, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAdminRolesDefault(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    Role
+		wantErr bool
+	}{
+		{"", roleViewer, false},
+		{"none", roleNone, false},
+		{"admin", roleAdmin, false},
+		{"root", roleNone, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			t.Setenv("TURBO_ADMIN_DEFAULT_ROLE", tt.value)
+			roles, err := newAdminRolesFromEnv("admin-token", "auth-token")
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("newAdminRolesFromEnv succeeded, want an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("newAdminRolesFromEnv: %v", err)
+			}
+			if roles.defaultRole != tt.want {
+				t.Errorf("default role = %s, want %s", roles.defaultRole, tt.want)
+			}
+		})
+	}
+}
+
+// stubPasswords accepts any password and returns the same groups
+type stubPasswords struct {
+	groups []string
+	err    error
+}
+
+func (p stubPasswords) AuthenticatePassword(ctx context.Context, username, password string) ([]string, error) {
+	return p.groups, p.err
+}
+
+func TestAdminAuthLDAP(t *testing.T) {
+	roles := &AdminRoles{
+		users:       map[string]Role{},
+		groups:      map[string]Role{"sre": roleOperator, "contractors": roleNone},
+		defaultRole: roleViewer,
+	}
+	tests := []struct {
+		name      string
+		passwords stubPasswords
+		method    string
+		want      int
+	}{
+		{"default role reads", stubPasswords{}, http.MethodGet, http.StatusOK},
+		{"default role can't write", stubPasswords{}, http.MethodPost, http.StatusForbidden},
+		{"group role writes", stubPasswords{groups: []string{"sre"}}, http.MethodPost, http.StatusOK},
+		{"no role", stubPasswords{groups: []string{"contractors"}}, http.MethodGet, http.StatusForbidden},
+		{"outside the login group", stubPasswords{err: errNotAuthorized}, http.MethodGet, http.StatusForbidden},
+		{"wrong password", stubPasswords{err: errInvalidCredentials}, http.MethodGet, http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &Server{
+				roles:   roles,
+				ldap:    tt.passwords,
+				logger:  log.New(io.Discard, "", 0),
+				slogger: slog.New(slog.NewTextHandler(io.Discard, nil)),
+			}
+			handler := s.handleAdminAuth(roleOperator, func(w http.ResponseWriter, r *http.Request) {})
+			r := httptest.NewRequest(tt.method, "/admin/scan", nil)
+			r.SetBasicAuth("bob", "secret")
+			w := httptest.NewRecorder()
+			handler(w, r)
+			if w.Code != tt.want {
+				t.Errorf("status = %d, want %d", w.Code, tt.want)
+			}
+		})
+	}
+}
+
+func TestAdminAuthScopeTokens(t *testing.T) {
+	ts, _ := newTestTokenStore(t, "")
+	_, adminValue, err := ts.Create("ops", scopeAdmin, "", nil, 0)
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	_, writeValue, err := ts.Create("ci", scopeReadWrite, "", nil, 0)
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	tests := []struct {
+		name      string
+		scopeRole Role
+		value     string
+		want      int
+	}{
+		{"admin scope without a scope role", roleNone, adminValue, http.StatusUnauthorized},
+		{"admin scope with a scope role", roleOperator, adminValue, http.StatusOK},
+		{"scope role isn't enough for writes", roleViewer, adminValue, http.StatusForbidden},
+		{"read-write scope", roleAdmin, writeValue, http.StatusUnauthorized},
+		{"admin token", roleNone, "admin-token", http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &Server{
+				roles:   &AdminRoles{tokens: map[string]Role{"admin-token": roleAdmin}, scopeRole: tt.scopeRole},
+				tokens:  ts,
+				logger:  log.New(io.Discard, "", 0),
+				slogger: slog.New(slog.NewTextHandler(io.Discard, nil)),
+			}
+			handler := s.handleAdminAuth(roleOperator, func(w http.ResponseWriter, r *http.Request) {})
+			r := httptest.NewRequest(http.MethodPost, "/admin/scan", nil)
+			r.Header.Set("Authorization", "Bearer "+tt.value)
+			w := httptest.NewRecorder()
+			handler(w, r)
+			if w.Code != tt.want {
+				t.Errorf("status = %d, want %d", w.Code, tt.want)
+			}
+		})
+	}
+}
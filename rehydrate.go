@@ -0,0 +1,85 @@
+package cachesrv
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Downloads of artifacts that have to come back from the cold tier can be
+// answered with 202 while they are staged, rather than holding the
+// connection open for the whole copy. The client polls the artifact's URL
+// until it gets the artifact.
+
+// Rehydration modes of TURBO_REHYDRATE_ASYNC
+const (
+	rehydrateWait   = ""       // hold the connection, as before
+	rehydratePrefer = "prefer" // 202 for clients sending Prefer: respond-async
+	rehydrateAlways = "always" // 202 for every client
+)
+
+// RehydrationResponse is the body of a 202 answer to a download
+type RehydrationResponse struct {
+	Hash       string `json:"hash"`
+	Status     string `json:"status"`
+	RetryAfter int    `json:"retryAfter"`
+}
+
+func parseRehydrateMode(mode string) (string, error) {
+	switch mode {
+	case rehydrateWait, rehydratePrefer, rehydrateAlways:
+		return mode, nil
+	}
+	return "", fmt.Errorf("invalid TURBO_REHYDRATE_ASYNC %q (expected prefer or always)", mode)
+}
+
+// prefersAsync reports whether the request carries Prefer: respond-async
+func prefersAsync(r *http.Request) bool {
+	for _, value := range r.Header.Values("Prefer") {
+		for _, preference := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(preference), "respond-async") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// rehydrating answers a download with 202 if its artifact is known but not
+// on the hot tier yet, starting to stage it. It reports whether it
+// answered; failed stagings fall through to a normal download.
+func (s *Server) rehydrating(w http.ResponseWriter, r *http.Request, hash string) bool {
+	if s.rehydrateMode == rehydrateWait || (s.rehydrateMode == rehydratePrefer && !prefersAsync(r)) {
+		return false
+	}
+	tiered, ok := unwrapStorage(s.storageFor(hash)).(*TieredStorage)
+	if !ok {
+		return false
+	}
+	// Only artifacts the cache has are worth waiting for
+	if _, ok := s.index.Get(hash); !ok {
+		return false
+	}
+	ready, err := tiered.Rehydrate(hash)
+	if err != nil {
+		s.logger.Printf("Rehydration of %s failed, serving it from cold storage: %v", hash, err)
+		return false
+	}
+	if ready {
+		return false
+	}
+
+	retryAfter := int(s.rehydrateRetry.Round(time.Second) / time.Second)
+	if retryAfter < 1 {
+		retryAfter = 1
+	}
+	w.Header().Set("Location", r.URL.RequestURI())
+	w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(RehydrationResponse{Hash: hash, Status: "rehydrating", RetryAfter: retryAfter})
+	return true
+}
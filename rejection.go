@@ -0,0 +1,190 @@
+package cachesrv
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+// Refused uploads answer with a machine readable code and a message for the
+// developer, in the error format of the Vercel API that turbo prints. Upload
+// policies, such as the TURBO_UPLOAD_POLICY_URL hook, refuse uploads the
+// same way.
+
+// UploadRejection is an upload refused by a check or a policy
+type UploadRejection struct {
+	// Status is the HTTP status of the answer, 403 if unset
+	Status  int    `json:"-"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+func (r *UploadRejection) Error() string {
+	return fmt.Sprintf("%s (%s)", r.Message, r.Code)
+}
+
+func rejectUpload(status int, code, format string, args ...any) *UploadRejection {
+	return &UploadRejection{Status: status, Code: code, Message: fmt.Sprintf(format, args...)}
+}
+
+// refuseUpload logs a rejected upload and answers it
+func (s *Server) refuseUpload(w http.ResponseWriter, hash string, rejection *UploadRejection) {
+	s.logger.Printf("Upload rejected for hash %s: %v", hash, rejection)
+	status := rejection.Status
+	if status == 0 {
+		status = http.StatusForbidden
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(struct {
+		Error *UploadRejection `json:"error"`
+	}{rejection})
+}
+
+// rejectionOf reads the code and message back from the body of a refused
+// upload, for batch results
+func rejectionOf(body []byte) (*UploadRejection, bool) {
+	var answer struct {
+		Error *UploadRejection `json:"error"`
+	}
+	if json.Unmarshal(body, &answer) != nil || answer.Error == nil || answer.Error.Code == "" {
+		return nil, false
+	}
+	return answer.Error, true
+}
+
+// UploadCheck is what a policy sees of an upload, before its body is read
+type UploadCheck struct {
+	Hash   string   `json:"hash"`
+	Team   string   `json:"team"`
+	Tenant string   `json:"tenant,omitempty"`
+	Size   int64    `json:"size"`
+	Tags   []string `json:"tags,omitempty"`
+}
+
+// UploadPolicy decides whether an upload is accepted. Returning an
+// *UploadRejection refuses it with that code and message; any other error
+// is a failure of the policy itself.
+type UploadPolicy interface {
+	CheckUpload(ctx context.Context, upload UploadCheck) error
+}
+
+// checkUpload runs the upload policies in order, answering the request if
+// one refuses it
+func (s *Server) checkUpload(w http.ResponseWriter, r *http.Request, upload UploadCheck) bool {
+	for _, policy := range s.uploadPolicies {
+		err := policy.CheckUpload(r.Context(), upload)
+		var rejection *UploadRejection
+		switch {
+		case err == nil:
+			continue
+		case errors.As(err, &rejection):
+		default:
+			s.logger.Printf("Failed to check upload of %s: %v", upload.Hash, err)
+			rejection = rejectUpload(http.StatusServiceUnavailable, "policy_unavailable", "the upload policy could not be checked, try again later")
+		}
+		s.refuseUpload(w, upload.Hash, rejection)
+		return false
+	}
+	return true
+}
+
+// WebhookPolicy asks an HTTP service about every upload: a POST of the
+// UploadCheck answered by 2xx with {"allow": true}, or {"allow": false}
+// with the code, message and optionally the 4xx status of the rejection.
+type WebhookPolicy struct {
+	url      string
+	token    string
+	failOpen bool
+	client   *http.Client
+	logger   *log.Logger
+}
+
+// newWebhookPolicyFromEnv returns nil when TURBO_UPLOAD_POLICY_URL is not set
+func newWebhookPolicyFromEnv(logger *log.Logger) (*WebhookPolicy, error) {
+	url := getenv("TURBO_UPLOAD_POLICY_URL")
+	if url == "" {
+		return nil, nil
+	}
+	timeout, err := envDuration("TURBO_UPLOAD_POLICY_TIMEOUT", 5*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	p := &WebhookPolicy{
+		url:    url,
+		token:  getenv("TURBO_UPLOAD_POLICY_TOKEN"),
+		client: &http.Client{Timeout: timeout},
+		logger: logger,
+	}
+	switch failure := envString("TURBO_UPLOAD_POLICY_FAILURE", "allow"); failure {
+	case "allow":
+		p.failOpen = true
+	case "reject":
+	default:
+		return nil, fmt.Errorf("invalid TURBO_UPLOAD_POLICY_FAILURE %q (expected allow or reject)", failure)
+	}
+	return p, nil
+}
+
+func (p *WebhookPolicy) CheckUpload(ctx context.Context, upload UploadCheck) error {
+	err := p.ask(ctx, upload)
+	var rejection *UploadRejection
+	if err != nil && !errors.As(err, &rejection) && p.failOpen {
+		p.logger.Printf("Failed to check upload of %s, accepting it: %v", upload.Hash, err)
+		return nil
+	}
+	return err
+}
+
+func (p *WebhookPolicy) ask(ctx context.Context, upload UploadCheck) error {
+	body, err := json.Marshal(upload)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if p.token != "" {
+		req.Header.Set("Authorization", "Bearer "+p.token)
+	}
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to call upload policy: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("upload policy answered %s", resp.Status)
+	}
+	var decision struct {
+		Allow   bool   `json:"allow"`
+		Status  int    `json:"status"`
+		Code    string `json:"code"`
+		Message string `json:"message"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&decision); err != nil {
+		return fmt.Errorf("failed to parse upload policy answer: %w", err)
+	}
+	if decision.Allow {
+		return nil
+	}
+	rejection := &UploadRejection{Status: decision.Status, Code: decision.Code, Message: decision.Message}
+	// Other statuses would tell turbo to retry or that the server broke
+	if rejection.Status < 400 || rejection.Status > 499 {
+		rejection.Status = http.StatusForbidden
+	}
+	if rejection.Code == "" {
+		rejection.Code = "upload_rejected"
+	}
+	if rejection.Message == "" {
+		rejection.Message = "the upload was rejected by policy"
+	}
+	return rejection
+}
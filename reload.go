@@ -0,0 +1,221 @@
+package cachesrv
+
+import (
+	"errors"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// SIGHUP, or a change to one of the files when TURBO_CONFIG_WATCH_INTERVAL
+// is set, reloads the config file, the tokens, tenants and teams files,
+// and the TLS certificate.
+// New tokens, tenant rate limits, budgets, quotas and retention apply from
+// the next request on; requests in flight finish under the old settings.
+// Other settings need a restart.
+
+// reloadableSettings are the settings of the config file a reload applies
+var reloadableSettings = map[string]bool{
+	"TURBO_AUTH_TOKEN":             true,
+	"TURBO_CACHE_MAX_SIZE":         true,
+	"TURBO_CACHE_MAX_FILES":        true,
+	"TURBO_SMALL_CACHE_MAX_SIZE":   true,
+	"TURBO_SMALL_CACHE_MAX_FILES":  true,
+	"TURBO_INLINE_CACHE_MAX_SIZE":  true,
+	"TURBO_INLINE_CACHE_MAX_FILES": true,
+	"TURBO_TEAM_QUOTA":             true,
+	"TURBO_TEAM_QUOTAS":            true,
+	"TURBO_EVICTION_TARGET":        true,
+	"TURBO_CACHE_TTL":              true,
+}
+
+// Reloader applies changed settings to a running server
+type Reloader struct {
+	server      *Server
+	tenantsFile string
+	logFile     *LogFile
+	certs       *CertificateFile
+
+	mu sync.Mutex // one reload at a time
+}
+
+func NewReloader(server *Server, tenantsFile string, logFile *LogFile) *Reloader {
+	return &Reloader{server: server, tenantsFile: tenantsFile, logFile: logFile}
+}
+
+// gcSettings are the budgets, quotas and retention of the default tenant
+type gcSettings struct {
+	budgets      map[string]ClassBudget
+	defaultQuota int64
+	teamQuotas   map[string]int64
+	target       float64
+	ttl          time.Duration
+}
+
+func gcSettingsFromEnv() (gcSettings, error) {
+	var gc gcSettings
+	var err error
+	gc.budgets = make(map[string]ClassBudget)
+	for _, c := range []struct {
+		class, prefix string
+		maxSize       int64
+	}{
+		{defaultClass, "TURBO_CACHE_", 0},
+		{smallClass, "TURBO_SMALL_CACHE_", 0},
+		{inlineClass, "TURBO_INLINE_CACHE_", defaultInlineBudget},
+	} {
+		if gc.budgets[c.class], err = classBudgetFromEnv(c.prefix, c.maxSize); err != nil {
+			return gc, err
+		}
+	}
+	if gc.defaultQuota, err = envSize("TURBO_TEAM_QUOTA", 0); err != nil {
+		return gc, err
+	}
+	if gc.teamQuotas, err = parseSizeMap(getenv("TURBO_TEAM_QUOTAS")); err != nil {
+		return gc, err
+	}
+	if gc.target, err = envFloat("TURBO_EVICTION_TARGET", 0.9); err != nil {
+		return gc, err
+	}
+	if gc.ttl, err = envDuration("TURBO_CACHE_TTL", 0); err != nil {
+		return gc, err
+	}
+	return gc, nil
+}
+
+// Reload reads the settings again and applies them. Nothing is applied
+// if one of the files or settings is invalid.
+func (rl *Reloader) Reload() error {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	s := rl.server
+
+	changed, undo, err := reloadConfigFile()
+	if err != nil {
+		return err
+	}
+	gc, err := gcSettingsFromEnv()
+	if err != nil {
+		undo()
+		return err
+	}
+	authToken := getenv("TURBO_AUTH_TOKEN")
+	if authToken == "" {
+		undo()
+		return errors.New("TURBO_AUTH_TOKEN is required")
+	}
+	var tenants map[string]TenantConfig
+	if rl.tenantsFile != "" {
+		var names []string
+		if tenants, names, err = readTenantsFile(rl.tenantsFile, s); err != nil {
+			undo()
+			return err
+		}
+		added := false
+		for _, name := range names {
+			added = added || s.tenantByName(name) == nil
+		}
+		if added || len(names) != len(s.tenants) {
+			s.logger.Printf("Tenants added to or removed from %s take effect after a restart", rl.tenantsFile)
+		}
+	}
+	var teams map[string]TeamConfig
+	if path := s.teams.file(); path != "" {
+		if teams, err = readTeamsFile(path); err != nil {
+			undo()
+			return err
+		}
+	}
+	if err := s.tokens.Reload(); err != nil {
+		undo()
+		return err
+	}
+	s.tokens.ReplaceStatic(map[string]string{"default": authToken})
+
+	budgets := make(map[string]ClassBudget)
+	for _, c := range s.classes {
+		budgets[c.Name] = gc.budgets[c.Name]
+		if c.Evictor != nil {
+			c.Evictor.SetBudget(gc.budgets[c.Name], gc.target)
+		}
+	}
+	s.quotas.SetLimits(budgets, gc.defaultQuota, gc.teamQuotas)
+	s.expirer.SetMaxAge(gc.ttl)
+	if s.teams != nil {
+		s.teams.Reset(teams)
+	}
+	for _, tenant := range s.tenants {
+		if cfg, ok := tenants[tenant.tenant]; ok {
+			tenant.applyTenant(cfg)
+		}
+	}
+
+	if rl.certs != nil {
+		if err := rl.certs.Reload(); err != nil {
+			s.logger.Printf("Failed to reload TLS certificate, serving the current one: %v", err)
+		}
+	}
+
+	for _, name := range changed {
+		if !reloadableSettings[name] {
+			s.logger.Printf("Setting %s changed in the config file and takes effect after a restart", name)
+		}
+	}
+	s.logger.Printf("Reloaded configuration")
+	return nil
+}
+
+// Run reloads on SIGHUP, reopening the log file first, and when one of the
+// files changes if interval is positive
+func (rl *Reloader) Run(interval time.Duration, stop <-chan struct{}) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	var tick <-chan time.Time
+	if interval > 0 {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	modified := rl.modTimes()
+	for {
+		select {
+		case <-hup:
+			// logrotate's postrotate sends SIGHUP to move on to a new file
+			if rl.logFile != nil {
+				if err := rl.logFile.Reopen(); err != nil {
+					rl.server.logger.Printf("Failed to reopen log file: %v", err)
+				} else {
+					rl.server.logger.Printf("Reopened log file")
+				}
+			}
+		case <-tick:
+			if rl.modTimes() == modified {
+				continue
+			}
+		case <-stop:
+			return
+		}
+		if err := rl.Reload(); err != nil {
+			rl.server.logger.Printf("Failed to reload configuration, keeping the current one: %v", err)
+		}
+		modified = rl.modTimes()
+	}
+}
+
+// modTimes sums up when the reloaded files last changed
+func (rl *Reloader) modTimes() [4]time.Time {
+	var times [4]time.Time
+	for i, path := range []string{settingSources.file, rl.server.tokens.path, rl.tenantsFile, rl.server.teams.file()} {
+		if path == "" {
+			continue
+		}
+		if info, err := os.Stat(path); err == nil {
+			times[i] = info.ModTime()
+		}
+	}
+	return times
+}
@@ -0,0 +1,163 @@
+package cachesrv
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// With TURBO_PRIMARY_URL the server is a read replica: it serves downloads
+// from its own storage, typically the primary's bucket or a synced copy of
+// its directory, and forwards everything that writes to the primary. Large
+// CI fleets can then add replicas for read throughput without any of them
+// writing to storage or disagreeing about what was uploaded.
+
+var errReadOnlyReplica = errors.New("storage is read-only on a replica")
+
+// ReadOnlyStorage refuses writes to the storage of a replica. It has no
+// Unwrap, so nothing reaches around it to the files.
+type ReadOnlyStorage struct {
+	inner Storage
+}
+
+func (s *ReadOnlyStorage) Store(hash string, data io.Reader) error {
+	return errReadOnlyReplica
+}
+
+func (s *ReadOnlyStorage) Get(hash string) (io.ReadCloser, int64, error) {
+	return s.inner.Get(hash)
+}
+
+func (s *ReadOnlyStorage) Exists(hash string) (bool, error) {
+	return s.inner.Exists(hash)
+}
+
+func (s *ReadOnlyStorage) Delete(hash string) error {
+	return errReadOnlyReplica
+}
+
+func (s *ReadOnlyStorage) List() ([]ArtifactStat, error) {
+	return s.inner.List()
+}
+
+// Primary is the server a replica forwards writes to
+type Primary struct {
+	url    *url.URL
+	client *http.Client
+	// forwardMisses also sends downloads this replica can't serve to the
+	// primary
+	forwardMisses bool
+	logger        *log.Logger
+}
+
+// hopHeaders are dropped when forwarding, they only apply to one connection
+var hopHeaders = []string{
+	"Connection", "Keep-Alive", "Proxy-Authenticate", "Proxy-Authorization",
+	"Te", "Trailer", "Transfer-Encoding", "Upgrade", "Expect",
+}
+
+// primaryFromEnv returns nil when TURBO_PRIMARY_URL is not set
+func primaryFromEnv(logger *log.Logger) (*Primary, error) {
+	raw := getenv("TURBO_PRIMARY_URL")
+	if raw == "" {
+		return nil, nil
+	}
+	u, err := url.Parse(strings.TrimSuffix(raw, "/"))
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("invalid TURBO_PRIMARY_URL %q", raw)
+	}
+	timeout, err := envDuration("TURBO_PRIMARY_TIMEOUT", time.Minute)
+	if err != nil {
+		return nil, err
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	// Uploads take as long as the client sends; only the answer is timed
+	transport.ResponseHeaderTimeout = timeout
+	return &Primary{
+		url: u,
+		client: &http.Client{
+			Transport: transport,
+			// Redirects of the primary are the client's to follow
+			CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+		},
+		forwardMisses: getenv("TURBO_REPLICA_FORWARD_MISSES") == "true",
+		logger:        logger,
+	}, nil
+}
+
+// Forward sends a request on to the primary, credentials included, and
+// answers it with the primary's response
+func (p *Primary) Forward(w http.ResponseWriter, r *http.Request) {
+	if err := forward(p.client, p.url, w, r, p.logger); err != nil {
+		p.logger.Printf("Failed to forward %s %s to the primary: %v", r.Method, r.URL.Path, err)
+		http.Error(w, "Primary unavailable", http.StatusBadGateway)
+	}
+}
+
+// forward sends a request on to the server at base and answers it with
+// that server's response. When the server can't be reached it returns the
+// error without answering.
+func forward(client *http.Client, base *url.URL, w http.ResponseWriter, r *http.Request, logger *log.Logger) error {
+	target := *base
+	target.Path += r.URL.Path
+	target.RawQuery = r.URL.RawQuery
+	req, err := http.NewRequestWithContext(r.Context(), r.Method, target.String(), r.Body)
+	if err != nil {
+		return err
+	}
+	if r.Method == http.MethodGet || r.Method == http.MethodHead {
+		req.Body = nil
+	}
+	req.ContentLength = r.ContentLength
+	req.Header = forwardedHeader(r)
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	for name, values := range resp.Header {
+		w.Header()[name] = values
+	}
+	for _, name := range hopHeaders {
+		w.Header().Del(name)
+	}
+	for name := range resp.Trailer {
+		w.Header().Add("Trailer", name)
+	}
+	w.WriteHeader(resp.StatusCode)
+	if _, err := io.Copy(w, resp.Body); err != nil {
+		logger.Printf("Error streaming the answer of %s to %s %s: %v", base.Host, r.Method, r.URL.Path, err)
+		return nil
+	}
+	for name, values := range resp.Trailer {
+		w.Header()[name] = values
+	}
+	return nil
+}
+
+// forwardedHeader returns the headers of a request to send on, without
+// those of the client's connection and with the client in X-Forwarded-For
+func forwardedHeader(r *http.Request) http.Header {
+	header := r.Header.Clone()
+	for _, name := range hopHeaders {
+		header.Del(name)
+	}
+	// Trailers, such as the digest of a download, are passed on
+	if acceptsTrailers(r) {
+		header.Set("Te", "trailers")
+	}
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		if prior := r.Header.Get("X-Forwarded-For"); prior != "" {
+			host = prior + ", " + host
+		}
+		header.Set("X-Forwarded-For", host)
+	}
+	return header
+}
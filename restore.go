@@ -0,0 +1,259 @@
+package cachesrv
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// errArtifactCorrupt marks an imported artifact that doesn't match its backup
+var errArtifactCorrupt = errors.New("artifact does not match its backup digest")
+
+// RestoreFailure is an artifact a restore refused to import
+type RestoreFailure struct {
+	Hash   string `json:"hash"`
+	Reason string `json:"reason"`
+}
+
+// RestoreReport is the progress of a restore
+type RestoreReport struct {
+	ID            string           `json:"id"`
+	Backup        string           `json:"backup"`
+	CreatedAt     time.Time        `json:"createdAt"`
+	Expected      int              `json:"expected"`
+	Restored      int              `json:"restored"`
+	RestoredBytes int64            `json:"restoredBytes"`
+	Pending       int              `json:"pending"`
+	Corrupt       []RestoreFailure `json:"corrupt,omitempty"`
+}
+
+// restoreSession imports the artifacts of one backup manifest. Every upload is
+// spooled and checked against the size and SHA-256 the manifest recorded
+// before it reaches storage, so damaged copies are reported and skipped
+// rather than served as cache hits.
+type restoreSession struct {
+	mu       sync.Mutex
+	report   RestoreReport
+	entries  map[string]BackupEntry
+	restored map[string]bool
+	corrupt  map[string]string
+}
+
+// RestoreSessions holds the restores in progress; they don't survive a restart
+type RestoreSessions struct {
+	dir string
+
+	mu       sync.Mutex
+	sessions map[string]*restoreSession
+}
+
+func NewRestoreSessions(dir string) (*RestoreSessions, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create restore directory: %w", err)
+	}
+	return &RestoreSessions{dir: dir, sessions: make(map[string]*restoreSession)}, nil
+}
+
+// Start begins restoring the artifacts listed in a manifest
+func (rs *RestoreSessions) Start(m *BackupManifest) (RestoreReport, error) {
+	id, err := randomHex(8)
+	if err != nil {
+		return RestoreReport{}, err
+	}
+	session := &restoreSession{
+		report:   RestoreReport{ID: id, Backup: m.ID, CreatedAt: time.Now().UTC()},
+		entries:  make(map[string]BackupEntry, len(m.Entries)),
+		restored: make(map[string]bool),
+		corrupt:  make(map[string]string),
+	}
+	for _, e := range m.Entries {
+		if validHash(e.Hash) {
+			session.entries[e.Hash] = e
+		}
+	}
+	session.report.Expected = len(session.entries)
+
+	rs.mu.Lock()
+	rs.sessions[id] = session
+	rs.mu.Unlock()
+	return session.snapshot(), nil
+}
+
+func (rs *RestoreSessions) get(id string) *restoreSession {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	return rs.sessions[id]
+}
+
+func (rs *RestoreSessions) end(id string) bool {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	_, ok := rs.sessions[id]
+	delete(rs.sessions, id)
+	return ok
+}
+
+// verify spools an artifact and checks it against the manifest; the returned
+// file is rewound and the caller closes and removes it
+func (rs *RestoreSessions) verify(body io.Reader, e BackupEntry) (*os.File, error) {
+	file, err := os.CreateTemp(rs.dir, ".restore-*")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create restore file: %w", err)
+	}
+	ok := false
+	defer func() {
+		if !ok {
+			file.Close()
+			os.Remove(file.Name())
+		}
+	}()
+
+	algorithm, _, err := parseDigest(e.digest())
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errArtifactCorrupt, err)
+	}
+	h, _ := newDigest(algorithm)
+	n, err := io.Copy(io.MultiWriter(file, h), body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to spool restore: %w", err)
+	}
+	if n != e.Size {
+		return nil, fmt.Errorf("%w: received %d bytes, expected %d", errArtifactCorrupt, n, e.Size)
+	}
+	if digest := formatDigest(algorithm, h); digest != e.digest() {
+		return nil, fmt.Errorf("%w: %s, expected %s", errArtifactCorrupt, digest, e.digest())
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return nil, fmt.Errorf("failed to rewind restore file: %w", err)
+	}
+	ok = true
+	return file, nil
+}
+
+func (session *restoreSession) done(hash string, size int64, err error) {
+	session.mu.Lock()
+	defer session.mu.Unlock()
+	if err != nil {
+		session.corrupt[hash] = err.Error()
+		return
+	}
+	delete(session.corrupt, hash)
+	if !session.restored[hash] {
+		session.restored[hash] = true
+		session.report.Restored++
+		session.report.RestoredBytes += size
+	}
+}
+
+func (session *restoreSession) snapshot() RestoreReport {
+	session.mu.Lock()
+	defer session.mu.Unlock()
+	report := session.report
+	report.Pending = report.Expected - report.Restored
+	report.Corrupt = nil
+	for hash, reason := range session.corrupt {
+		report.Corrupt = append(report.Corrupt, RestoreFailure{Hash: hash, Reason: reason})
+	}
+	sort.Slice(report.Corrupt, func(i, j int) bool { return report.Corrupt[i].Hash < report.Corrupt[j].Hash })
+	return report
+}
+
+// Handler for /admin/restores
+func (s *Server) startRestore(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var m BackupManifest
+	if err := json.NewDecoder(r.Body).Decode(&m); err != nil || m.ID == "" {
+		http.Error(w, "Invalid backup manifest", http.StatusBadRequest)
+		return
+	}
+	report, err := s.restores.Start(&m)
+	if err != nil {
+		s.logger.Printf("Failed to start restore: %v", err)
+		http.Error(w, "Failed to start restore", http.StatusInternalServerError)
+		return
+	}
+	s.logger.Printf("Restore %s of backup %s started with %d artifacts", report.ID, report.Backup, report.Expected)
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(report)
+}
+
+// Handler for /admin/restores/{id} and /admin/restores/{id}/artifacts/{hash}
+func (s *Server) handleRestore(w http.ResponseWriter, r *http.Request) {
+	id, rest, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/admin/restores/"), "/")
+	session := s.restores.get(id)
+	if session == nil {
+		http.Error(w, "Restore not found", http.StatusNotFound)
+		return
+	}
+	switch {
+	case rest == "" && r.Method == http.MethodGet:
+		json.NewEncoder(w).Encode(session.snapshot())
+	case rest == "" && r.Method == http.MethodDelete:
+		report := session.snapshot()
+		s.restores.end(id)
+		s.logger.Printf("Restore %s ended: %d of %d artifacts restored, %d corrupt",
+			id, report.Restored, report.Expected, len(report.Corrupt))
+		json.NewEncoder(w).Encode(report)
+	case strings.HasPrefix(rest, "artifacts/") && r.Method == http.MethodPut:
+		s.restoreArtifact(w, r, session, strings.TrimPrefix(rest, "artifacts/"))
+	case rest == "" || strings.HasPrefix(rest, "artifacts/"):
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (s *Server) restoreArtifact(w http.ResponseWriter, r *http.Request, session *restoreSession, hash string) {
+	e, ok := session.entries[hash]
+	if !ok {
+		http.Error(w, "Artifact not in backup", http.StatusNotFound)
+		return
+	}
+
+	file, err := s.restores.verify(r.Body, e)
+	if errors.Is(err, errArtifactCorrupt) {
+		s.logger.Printf("Restore %s skipped %s: %v", session.report.ID, hash, err)
+		session.done(hash, 0, err)
+		http.Error(w, "Artifact does not match backup checksum", http.StatusUnprocessableEntity)
+		return
+	}
+	if err != nil {
+		s.logger.Printf("Restore of %s failed: %v", hash, err)
+		http.Error(w, "Failed to restore artifact", http.StatusInternalServerError)
+		return
+	}
+	defer os.Remove(file.Name())
+	defer file.Close()
+
+	s.index.StartUpload(hash)
+	defer s.index.FinishUpload(hash)
+	if current, ok := s.index.Get(hash); ok && current.retained(s.index.clock.Now()) {
+		http.Error(w, "Artifact is retained", http.StatusConflict)
+		return
+	}
+	class := s.classFor(e.Size)
+	describeArtifact(class.Storage, hash, ArtifactDetails{Team: e.Team, Tags: e.Tags, RetainUntil: e.RetainUntil})
+	if err := class.Storage.Store(hash, file); err != nil {
+		s.logger.Printf("Restore of %s failed: %v", hash, err)
+		http.Error(w, "Failed to restore artifact", http.StatusInternalServerError)
+		return
+	}
+	meta := e.ArtifactMeta
+	meta.Class = class.Name
+	s.index.Put(&meta)
+	if class.Evictor != nil {
+		class.Evictor.Notify()
+	}
+	session.done(hash, e.Size, nil)
+	w.WriteHeader(http.StatusNoContent)
+}
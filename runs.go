@@ -0,0 +1,401 @@
+package cachesrv
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const maxRunSummarySize = 32 << 20
+
+var errRunNotFound = errors.New("run not found")
+
+// runSummary is the part of `turbo run --summarize` output the server indexes
+type runSummary struct {
+	ID           string `json:"id"`
+	TurboVersion string `json:"turboVersion"`
+	User         string `json:"user"`
+	Execution    struct {
+		Command   string `json:"command"`
+		Success   int    `json:"success"`
+		Failed    int    `json:"failed"`
+		Cached    int    `json:"cached"`
+		Attempted int    `json:"attempted"`
+		StartTime int64  `json:"startTime"`
+		EndTime   int64  `json:"endTime"`
+		ExitCode  int    `json:"exitCode"`
+	} `json:"execution"`
+	SCM struct {
+		SHA    string `json:"sha"`
+		Branch string `json:"branch"`
+	} `json:"scm"`
+	Tasks []struct {
+		TaskID  string `json:"taskId"`
+		Task    string `json:"task"`
+		Package string `json:"package"`
+		Hash    string `json:"hash"`
+		Cache   struct {
+			Status    string `json:"status"`
+			Source    string `json:"source"`
+			TimeSaved int64  `json:"timeSaved"`
+		} `json:"cache"`
+		Execution *struct {
+			StartTime int64 `json:"startTime"`
+			EndTime   int64 `json:"endTime"`
+			ExitCode  *int  `json:"exitCode"`
+		} `json:"execution"`
+	} `json:"tasks"`
+}
+
+// RunInfo summarizes an ingested run for listing and filtering
+type RunInfo struct {
+	ID           string    `json:"id"`
+	SessionID    string    `json:"sessionId,omitempty"`
+	Team         string    `json:"team,omitempty"`
+	Command      string    `json:"command"`
+	Branch       string    `json:"branch,omitempty"`
+	SHA          string    `json:"sha,omitempty"`
+	User         string    `json:"user,omitempty"`
+	TurboVersion string    `json:"turboVersion,omitempty"`
+	StartTime    time.Time `json:"startTime"`
+	EndTime      time.Time `json:"endTime"`
+	DurationMs   int64     `json:"durationMs"`
+	ExitCode     int       `json:"exitCode"`
+	Attempted    int       `json:"attempted"`
+	Cached       int       `json:"cached"`
+	Failed       int       `json:"failed"`
+	HitRate      float64   `json:"hitRate"`
+	TimeSavedMs  int64     `json:"timeSavedMs"`
+	UploadedAt   time.Time `json:"uploadedAt"`
+}
+
+// TimelineEntry is one task of a run, laid out for a Gantt-style view
+type TimelineEntry struct {
+	TaskID      string `json:"taskId"`
+	Package     string `json:"package"`
+	Task        string `json:"task"`
+	Hash        string `json:"hash"`
+	CacheStatus string `json:"cacheStatus"`
+	CacheSource string `json:"cacheSource,omitempty"`
+	StartMs     int64  `json:"startMs"` // relative to the run start
+	DurationMs  int64  `json:"durationMs"`
+	ExitCode    *int   `json:"exitCode,omitempty"`
+}
+
+// storedRun is what is written to disk: the index entry plus the raw summary
+type storedRun struct {
+	Info    RunInfo         `json:"info"`
+	Summary json.RawMessage `json:"summary"`
+}
+
+// RunStore keeps ingested run summaries as one JSON file per run with an
+// in-memory index for queries
+type RunStore struct {
+	dir    string
+	logger *log.Logger
+
+	mu   sync.RWMutex
+	runs map[string]*RunInfo
+	// tasks maps task hashes to the task that produced them
+	tasks map[string]TaskRef
+}
+
+// TaskRef identifies the task behind an artifact hash
+type TaskRef struct {
+	TaskID  string `json:"taskId"`
+	Package string `json:"package"`
+	Task    string `json:"task"`
+}
+
+func NewRunStore(dir string, logger *log.Logger) (*RunStore, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create runs directory: %w", err)
+	}
+	rs := &RunStore{
+		dir:    dir,
+		logger: logger,
+		runs:   make(map[string]*RunInfo),
+		tasks:  make(map[string]TaskRef),
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read runs directory: %w", err)
+	}
+	for _, entry := range entries {
+		if !strings.HasSuffix(entry.Name(), ".json") {
+			continue
+		}
+		run, err := rs.load(strings.TrimSuffix(entry.Name(), ".json"))
+		if err != nil {
+			logger.Printf("Skipping run summary %s: %v", entry.Name(), err)
+			continue
+		}
+		info := run.Info
+		rs.runs[info.ID] = &info
+		var summary runSummary
+		if err := json.Unmarshal(run.Summary, &summary); err == nil {
+			rs.indexTasks(&summary)
+		}
+	}
+	return rs, nil
+}
+
+// Add parses and stores a run summary, replacing an earlier upload of the same run
+func (rs *RunStore) Add(raw []byte, sessionID, team string) (*RunInfo, error) {
+	var summary runSummary
+	if err := json.Unmarshal(raw, &summary); err != nil {
+		return nil, fmt.Errorf("invalid run summary: %w", err)
+	}
+	if !validHash(summary.ID) {
+		return nil, fmt.Errorf("invalid run summary: missing or invalid id")
+	}
+
+	info := &RunInfo{
+		ID:           summary.ID,
+		SessionID:    sessionID,
+		Team:         team,
+		Command:      summary.Execution.Command,
+		Branch:       summary.SCM.Branch,
+		SHA:          summary.SCM.SHA,
+		User:         summary.User,
+		TurboVersion: summary.TurboVersion,
+		StartTime:    time.UnixMilli(summary.Execution.StartTime),
+		EndTime:      time.UnixMilli(summary.Execution.EndTime),
+		DurationMs:   summary.Execution.EndTime - summary.Execution.StartTime,
+		ExitCode:     summary.Execution.ExitCode,
+		Attempted:    summary.Execution.Attempted,
+		Cached:       summary.Execution.Cached,
+		Failed:       summary.Execution.Failed,
+		UploadedAt:   time.Now(),
+	}
+	if info.Attempted > 0 {
+		info.HitRate = float64(info.Cached) / float64(info.Attempted)
+	}
+	for _, t := range summary.Tasks {
+		info.TimeSavedMs += t.Cache.TimeSaved
+	}
+
+	data, err := json.Marshal(storedRun{Info: *info, Summary: raw})
+	if err != nil {
+		return nil, err
+	}
+	if err := writeFileAtomic(rs.path(info.ID), data, 0644); err != nil {
+		return nil, err
+	}
+
+	rs.mu.Lock()
+	rs.runs[info.ID] = info
+	rs.indexTasks(&summary)
+	rs.mu.Unlock()
+	return info, nil
+}
+
+// indexTasks records which task produced each hash; callers must hold the lock
+func (rs *RunStore) indexTasks(summary *runSummary) {
+	for _, t := range summary.Tasks {
+		if t.Hash != "" {
+			rs.tasks[t.Hash] = TaskRef{TaskID: t.TaskID, Package: t.Package, Task: t.Task}
+		}
+	}
+}
+
+// TaskOf returns the task that produced a hash, as seen in run summaries
+func (rs *RunStore) TaskOf(hash string) (TaskRef, bool) {
+	rs.mu.RLock()
+	defer rs.mu.RUnlock()
+	ref, ok := rs.tasks[hash]
+	return ref, ok
+}
+
+// RunFilter selects runs in List; empty fields match everything
+type RunFilter struct {
+	Team      string
+	Branch    string
+	SessionID string
+	Since     time.Time
+	Limit     int
+}
+
+// List returns matching runs, newest first
+func (rs *RunStore) List(f RunFilter) []RunInfo {
+	rs.mu.RLock()
+	runs := make([]RunInfo, 0, len(rs.runs))
+	for _, info := range rs.runs {
+		if (f.Team != "" && info.Team != f.Team) ||
+			(f.Branch != "" && info.Branch != f.Branch) ||
+			(f.SessionID != "" && info.SessionID != f.SessionID) ||
+			info.StartTime.Before(f.Since) {
+			continue
+		}
+		runs = append(runs, *info)
+	}
+	rs.mu.RUnlock()
+
+	sort.Slice(runs, func(i, j int) bool { return runs[i].StartTime.After(runs[j].StartTime) })
+	if f.Limit > 0 && len(runs) > f.Limit {
+		runs = runs[:f.Limit]
+	}
+	return runs
+}
+
+// Raw returns the summary as uploaded
+func (rs *RunStore) Raw(id string) (json.RawMessage, error) {
+	run, err := rs.load(id)
+	if err != nil {
+		return nil, err
+	}
+	return run.Summary, nil
+}
+
+// Timeline returns the tasks of a run ordered by start time
+func (rs *RunStore) Timeline(id string) ([]TimelineEntry, error) {
+	run, err := rs.load(id)
+	if err != nil {
+		return nil, err
+	}
+	var summary runSummary
+	if err := json.Unmarshal(run.Summary, &summary); err != nil {
+		return nil, fmt.Errorf("invalid stored run summary: %w", err)
+	}
+
+	start := summary.Execution.StartTime
+	entries := make([]TimelineEntry, 0, len(summary.Tasks))
+	for _, t := range summary.Tasks {
+		e := TimelineEntry{
+			TaskID:      t.TaskID,
+			Package:     t.Package,
+			Task:        t.Task,
+			Hash:        t.Hash,
+			CacheStatus: t.Cache.Status,
+			CacheSource: t.Cache.Source,
+		}
+		if t.Execution != nil {
+			e.StartMs = t.Execution.StartTime - start
+			e.DurationMs = t.Execution.EndTime - t.Execution.StartTime
+			e.ExitCode = t.Execution.ExitCode
+		}
+		entries = append(entries, e)
+	}
+	sort.SliceStable(entries, func(i, j int) bool { return entries[i].StartMs < entries[j].StartMs })
+	return entries, nil
+}
+
+func (rs *RunStore) load(id string) (*storedRun, error) {
+	if !validHash(id) {
+		return nil, errRunNotFound
+	}
+	data, err := os.ReadFile(rs.path(id))
+	if os.IsNotExist(err) {
+		return nil, errRunNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read run summary: %w", err)
+	}
+	var run storedRun
+	if err := json.Unmarshal(data, &run); err != nil {
+		return nil, fmt.Errorf("failed to decode run summary: %w", err)
+	}
+	return &run, nil
+}
+
+func (rs *RunStore) path(id string) string {
+	return filepath.Join(rs.dir, id+".json")
+}
+
+// Handler for POST /v8/runs
+func (s *Server) ingestRun(w http.ResponseWriter, r *http.Request) {
+	raw, err := io.ReadAll(io.LimitReader(r.Body, maxRunSummarySize+1))
+	if err != nil {
+		http.Error(w, "Failed to read request body", http.StatusBadRequest)
+		return
+	}
+	if len(raw) > maxRunSummarySize {
+		http.Error(w, "Run summary too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	// Turbo doesn't put the session id into the summary, so clients pass it along
+	sessionID := r.URL.Query().Get("sessionId")
+	if sessionID == "" {
+		sessionID = r.Header.Get("X-Turbo-Session-Id")
+	}
+	info, err := s.runs.Add(raw, sessionID, teamOf(r))
+	if err != nil {
+		s.logger.Printf("Run summary rejected: %v", err)
+		http.Error(w, "Invalid run summary", http.StatusBadRequest)
+		return
+	}
+	s.logger.Printf("Run summary %s ingested (%d/%d cached)", info.ID, info.Cached, info.Attempted)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(info)
+}
+
+func (s *Server) listRuns(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	filter := RunFilter{
+		Team:      teamOf(r),
+		Branch:    q.Get("branch"),
+		SessionID: q.Get("sessionId"),
+		Limit:     100,
+	}
+	if since := q.Get("since"); since != "" {
+		d, err := parseDuration(since)
+		if err != nil {
+			http.Error(w, "Invalid since", http.StatusBadRequest)
+			return
+		}
+		filter.Since = time.Now().Add(-d)
+	}
+	if limit := q.Get("limit"); limit != "" {
+		n, err := strconv.Atoi(limit)
+		if err != nil || n < 1 {
+			http.Error(w, "Invalid limit", http.StatusBadRequest)
+			return
+		}
+		filter.Limit = n
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.runs.List(filter))
+}
+
+// Handler for /v8/runs/{id} and /v8/runs/{id}/timeline
+func (s *Server) getRun(w http.ResponseWriter, r *http.Request) {
+	id, view := r.PathValue("id"), r.PathValue("view")
+	var result any
+	var err error
+	switch view {
+	case "":
+		result, err = s.runs.Raw(id)
+	case "timeline":
+		result, err = s.runs.Timeline(id)
+	default:
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+	if errors.Is(err, errRunNotFound) {
+		http.Error(w, "Run not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		s.logger.Printf("Failed to load run %s: %v", id, err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
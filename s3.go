@@ -0,0 +1,451 @@
+package cachesrv
+
+import (
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// emptySHA256 is the payload hash of requests without a body
+const emptySHA256 = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+// S3Storage stores artifacts in an Amazon S3 bucket or an S3-compatible
+// service, signing requests with AWS Signature Version 4
+type S3Storage struct {
+	client       *http.Client
+	endpoint     *url.URL // e.g. https://s3.eu-west-1.amazonaws.com
+	region       string
+	bucket       string
+	accessKey    string
+	secretKey    string
+	sessionToken string
+	prefix       string
+	// pathStyle addresses the bucket in the path rather than the host name,
+	// as MinIO and most other S3-compatible services expect
+	pathStyle bool
+	spoolDir  string
+	classes   *S3StorageClasses
+	// lockMode is the Object Lock mode of retained artifacts, GOVERNANCE or
+	// COMPLIANCE; empty stores them unlocked
+	lockMode string
+
+	mu sync.Mutex
+	// pending holds the artifact info passed to Describe until Store
+	pending map[string]ArtifactDetails
+}
+
+func NewS3Storage(endpoint, region, bucket, accessKey, secretKey, prefix, spoolDir string) (*S3Storage, error) {
+	if endpoint == "" {
+		endpoint = "https://s3." + region + ".amazonaws.com"
+	}
+	if !strings.Contains(endpoint, "://") {
+		endpoint = "https://" + endpoint
+	}
+	u, err := url.Parse(strings.TrimSuffix(endpoint, "/"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid endpoint: %w", err)
+	}
+	s := &S3Storage{
+		client:    &http.Client{},
+		endpoint:  u,
+		region:    region,
+		bucket:    bucket,
+		accessKey: accessKey,
+		secretKey: secretKey,
+		prefix:    prefix,
+		spoolDir:  spoolDir,
+		pending:   make(map[string]ArtifactDetails),
+	}
+	return s, nil
+}
+
+// check fails at startup rather than on the first upload if the bucket or
+// keys are wrong
+func (s *S3Storage) check() error {
+	resp, err := s.do(http.MethodHead, "", nil, nil, emptySHA256, nil)
+	if err != nil {
+		return fmt.Errorf("failed to access bucket: %w", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed to access bucket %s: %s", s.bucket, resp.Status)
+	}
+	return nil
+}
+
+// checkObjectLock fails at startup if the bucket can't lock objects, which
+// S3 only allows for buckets created with Object Lock enabled
+func (s *S3Storage) checkObjectLock() error {
+	resp, err := s.do(http.MethodGet, "", url.Values{"object-lock": {""}}, nil, emptySHA256, nil)
+	if err != nil {
+		return fmt.Errorf("failed to read bucket object lock configuration: %w", err)
+	}
+	defer resp.Body.Close()
+	var config struct {
+		Enabled string `xml:"ObjectLockEnabled"`
+	}
+	if resp.StatusCode == http.StatusOK {
+		if err := xml.NewDecoder(resp.Body).Decode(&config); err != nil {
+			return fmt.Errorf("failed to decode bucket object lock configuration: %w", err)
+		}
+	} else if resp.StatusCode != http.StatusNotFound {
+		return fmt.Errorf("failed to read bucket object lock configuration: %s", s3Error(resp))
+	}
+	if config.Enabled != "Enabled" {
+		return fmt.Errorf("bucket %s does not have Object Lock enabled", s.bucket)
+	}
+	return nil
+}
+
+// Describe records the tags of an artifact about to be stored, which pick
+// its storage class and are copied to object tags for lifecycle rules
+func (s *S3Storage) Describe(hash string, info ArtifactDetails) {
+	s.mu.Lock()
+	s.pending[hash] = info
+	s.mu.Unlock()
+}
+
+// Store spools the upload first, since S3 needs the size and, for a signed
+// payload, the SHA-256 before the body is sent
+func (s *S3Storage) Store(hash string, data io.Reader) error {
+	s.mu.Lock()
+	info := s.pending[hash]
+	delete(s.pending, hash)
+	s.mu.Unlock()
+
+	spool, err := os.CreateTemp(s.spoolDir, ".s3-upload-*")
+	if err != nil {
+		return fmt.Errorf("failed to create spool file: %w", err)
+	}
+	defer os.Remove(spool.Name())
+	defer spool.Close()
+
+	digest, sum := sha256.New(), md5.New()
+	size, err := io.Copy(io.MultiWriter(spool, digest, sum), data)
+	if err != nil {
+		return fmt.Errorf("failed to spool upload: %w", err)
+	}
+	if _, err := spool.Seek(0, io.SeekStart); err != nil {
+		return fmt.Errorf("failed to rewind spool file: %w", err)
+	}
+
+	header := http.Header{"Content-Type": {"application/octet-stream"}}
+	if class := s.classes.For(info.Tags); class != "" {
+		header.Set("X-Amz-Storage-Class", class)
+	}
+	if tagging := s3Tagging(info.Tags); tagging != "" {
+		header.Set("X-Amz-Tagging", tagging)
+	}
+	if s.lockMode != "" && !info.RetainUntil.IsZero() {
+		header.Set("X-Amz-Object-Lock-Mode", s.lockMode)
+		header.Set("X-Amz-Object-Lock-Retain-Until-Date", info.RetainUntil.UTC().Format(time.RFC3339))
+		// Object Lock uploads must carry a Content-MD5
+		header.Set("Content-Md5", base64.StdEncoding.EncodeToString(sum.Sum(nil)))
+	}
+	resp, err := s.do(http.MethodPut, s.prefix+hash, nil, &sizedReader{spool, size}, hex.EncodeToString(digest.Sum(nil)), header)
+	if err != nil {
+		return fmt.Errorf("failed to upload object: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed to upload object: %s", s3Error(resp))
+	}
+	return nil
+}
+
+// Clone copies an object to a new hash with CopyObject, so the bytes stay
+// in the bucket. The details described for dst pick its storage class, tags
+// and lock as in Store; they are kept for Store if the copy fails.
+func (s *S3Storage) Clone(src, dst string) error {
+	s.mu.Lock()
+	info := s.pending[dst]
+	s.mu.Unlock()
+
+	header := http.Header{"X-Amz-Copy-Source": {"/" + s.bucket + "/" + s.prefix + src}}
+	if class := s.classes.For(info.Tags); class != "" {
+		header.Set("X-Amz-Storage-Class", class)
+	}
+	if tagging := s3Tagging(info.Tags); tagging != "" {
+		header.Set("X-Amz-Tagging-Directive", "REPLACE")
+		header.Set("X-Amz-Tagging", tagging)
+	}
+	if s.lockMode != "" && !info.RetainUntil.IsZero() {
+		header.Set("X-Amz-Object-Lock-Mode", s.lockMode)
+		header.Set("X-Amz-Object-Lock-Retain-Until-Date", info.RetainUntil.UTC().Format(time.RFC3339))
+	}
+	resp, err := s.do(http.MethodPut, s.prefix+dst, nil, nil, emptySHA256, header)
+	if err != nil {
+		return fmt.Errorf("failed to copy object: %w", err)
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return errArtifactNotFound
+	default:
+		return fmt.Errorf("failed to copy object: %s", s3Error(resp))
+	}
+
+	s.mu.Lock()
+	delete(s.pending, dst)
+	s.mu.Unlock()
+	return nil
+}
+
+func (s *S3Storage) Get(hash string) (io.ReadCloser, int64, error) {
+	resp, err := s.do(http.MethodGet, s.prefix+hash, nil, nil, emptySHA256, nil)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to download object: %w", err)
+	}
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return resp.Body, resp.ContentLength, nil
+	case http.StatusNotFound:
+		resp.Body.Close()
+		return nil, 0, errArtifactNotFound
+	default:
+		defer resp.Body.Close()
+		return nil, 0, fmt.Errorf("failed to download object: %s", s3Error(resp))
+	}
+}
+
+func (s *S3Storage) Exists(hash string) (bool, error) {
+	resp, err := s.do(http.MethodHead, s.prefix+hash, nil, nil, emptySHA256, nil)
+	if err != nil {
+		return false, fmt.Errorf("failed to check object: %w", err)
+	}
+	resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return true, nil
+	case http.StatusNotFound:
+		return false, nil
+	default:
+		return false, fmt.Errorf("failed to check object: %s", resp.Status)
+	}
+}
+
+func (s *S3Storage) Delete(hash string) error {
+	resp, err := s.do(http.MethodDelete, s.prefix+hash, nil, nil, emptySHA256, nil)
+	if err != nil {
+		return fmt.Errorf("failed to delete object: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusNotFound {
+		return fmt.Errorf("failed to delete object: %s", s3Error(resp))
+	}
+	return nil
+}
+
+// List pages through the bucket with ListObjectsV2
+func (s *S3Storage) List() ([]ArtifactStat, error) {
+	var artifacts []ArtifactStat
+	token := ""
+	for {
+		query := url.Values{"list-type": {"2"}, "prefix": {s.prefix}, "max-keys": {"1000"}}
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+		resp, err := s.do(http.MethodGet, "", query, nil, emptySHA256, nil)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list bucket: %w", err)
+		}
+		if resp.StatusCode != http.StatusOK {
+			defer resp.Body.Close()
+			return nil, fmt.Errorf("failed to list bucket: %s", s3Error(resp))
+		}
+		var page struct {
+			IsTruncated           bool   `xml:"IsTruncated"`
+			NextContinuationToken string `xml:"NextContinuationToken"`
+			Contents              []struct {
+				Key          string    `xml:"Key"`
+				Size         int64     `xml:"Size"`
+				LastModified time.Time `xml:"LastModified"`
+			} `xml:"Contents"`
+		}
+		err = xml.NewDecoder(resp.Body).Decode(&page)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode bucket listing: %w", err)
+		}
+
+		for _, c := range page.Contents {
+			hash := strings.TrimPrefix(c.Key, s.prefix)
+			if hash == "" || strings.Contains(hash, "/") || strings.HasPrefix(hash, ".") {
+				continue
+			}
+			artifacts = append(artifacts, ArtifactStat{Hash: hash, Size: c.Size, ModTime: c.LastModified})
+		}
+		if !page.IsTruncated {
+			return artifacts, nil
+		}
+		token = page.NextContinuationToken
+	}
+}
+
+// sizedReader gives a request body a known length without buffering it
+type sizedReader struct {
+	io.Reader
+	size int64
+}
+
+// do sends a request signed with SigV4. payloadHash is the hex SHA-256 of
+// the body.
+func (s *S3Storage) do(method, key string, query url.Values, body io.Reader, payloadHash string, header http.Header) (*http.Response, error) {
+	u := *s.endpoint
+	switch {
+	case s.pathStyle && key == "":
+		u.Path += "/" + s.bucket
+	case s.pathStyle:
+		u.Path += "/" + s.bucket + "/" + key
+	default:
+		u.Host = s.bucket + "." + u.Host
+		u.Path += "/" + key
+	}
+	u.RawQuery = s3Query(query)
+
+	req, err := http.NewRequest(method, u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	if sized, ok := body.(*sizedReader); ok {
+		req.ContentLength = sized.size
+		if sized.size == 0 {
+			req.Body = http.NoBody
+		}
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	s.sign(req, u.EscapedPath(), payloadHash, time.Now().UTC())
+	return s.client.Do(req)
+}
+
+// sign adds the SigV4 Authorization header. Every x-amz-* header, the host
+// and the content headers are signed.
+func (s *S3Storage) sign(req *http.Request, path, payloadHash string, now time.Time) {
+	amzDate := now.Format("20060102T150405Z")
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	if s.sessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", s.sessionToken)
+	}
+
+	headers := map[string]string{"host": req.URL.Host}
+	for k := range req.Header {
+		lk := strings.ToLower(k)
+		if strings.HasPrefix(lk, "x-amz-") || lk == "content-type" || lk == "content-md5" {
+			headers[lk] = strings.TrimSpace(req.Header.Get(k))
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	if path == "" {
+		path = "/"
+	}
+	canonical := strings.Join([]string{
+		req.Method,
+		path,
+		req.URL.RawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := now.Format("20060102") + "/" + s.region + "/s3/aws4_request"
+	digest := sha256.Sum256([]byte(canonical))
+	toSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(digest[:])
+
+	key := []byte("AWS4" + s.secretKey)
+	for _, part := range []string{now.Format("20060102"), s.region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, toSign))
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.accessKey, scope, signedHeaders, signature))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// s3Query encodes a query string the way SigV4 canonicalizes it: sorted by
+// key, with spaces as %20
+func s3Query(query url.Values) string {
+	return strings.ReplaceAll(query.Encode(), "+", "%20")
+}
+
+// s3Error formats an error response with the code S3 returns in its body
+func s3Error(resp *http.Response) string {
+	var body struct {
+		Code    string `xml:"Code"`
+		Message string `xml:"Message"`
+	}
+	if err := xml.NewDecoder(io.LimitReader(resp.Body, 4096)).Decode(&body); err != nil || body.Code == "" {
+		return resp.Status
+	}
+	return fmt.Sprintf("%s: %s: %s", resp.Status, body.Code, body.Message)
+}
+
+func newS3StorageFromEnv(prefix, cacheDir string) (*S3Storage, error) {
+	values, err := requireEnv(prefix+"S3_BUCKET", prefix+"S3_ACCESS_KEY_ID", prefix+"S3_SECRET_ACCESS_KEY")
+	if err != nil {
+		return nil, err
+	}
+	spoolDir := envString(prefix+"S3_SPOOL_DIR", filepath.Join(cacheDir, ".spool"))
+	if err := os.MkdirAll(spoolDir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create spool directory: %w", err)
+	}
+	s, err := NewS3Storage(getenv(prefix+"S3_ENDPOINT"), envString(prefix+"S3_REGION", "us-east-1"),
+		values[0], values[1], values[2], envString(prefix+"S3_PREFIX", ""), spoolDir)
+	if err != nil {
+		return nil, err
+	}
+	s.sessionToken = getenv(prefix + "S3_SESSION_TOKEN")
+	s.pathStyle = getenv(prefix+"S3_PATH_STYLE") == "true"
+	if s.classes, err = newS3StorageClassesFromEnv(prefix); err != nil {
+		return nil, err
+	}
+	switch mode := strings.ToUpper(getenv(prefix + "S3_OBJECT_LOCK_MODE")); mode {
+	case "", "GOVERNANCE", "COMPLIANCE":
+		s.lockMode = mode
+	default:
+		return nil, fmt.Errorf("invalid %sS3_OBJECT_LOCK_MODE %q (expected GOVERNANCE or COMPLIANCE)", prefix, mode)
+	}
+	if err := s.check(); err != nil {
+		return nil, err
+	}
+	if s.lockMode != "" {
+		if err := s.checkObjectLock(); err != nil {
+			return nil, err
+		}
+	}
+	if err := s.applyLifecycleFromEnv(prefix); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
@@ -0,0 +1,301 @@
+package cachesrv
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Storage classes artifacts can be stored in or moved to. They all serve
+// reads right away; GLACIER and DEEP_ARCHIVE need a restore first, which a
+// cache can't wait for.
+var s3StorageClassNames = []string{"STANDARD", "STANDARD_IA", "ONEZONE_IA", "INTELLIGENT_TIERING", "GLACIER_IR"}
+
+// s3ExpireAction marks a lifecycle rule that deletes artifacts instead of
+// moving them
+const s3ExpireAction = "expire"
+
+// s3TagPrefix prefixes the object tags artifact tags are copied to
+const s3TagPrefix = "turbo:"
+
+// s3RulePrefix marks the lifecycle rules the server manages; rules with
+// other IDs are left alone
+const s3RulePrefix = "turbo-cache"
+
+func parseS3StorageClass(name string) (string, error) {
+	name = strings.ToUpper(strings.TrimSpace(name))
+	for _, c := range s3StorageClassNames {
+		if c == name {
+			return c, nil
+		}
+	}
+	return "", fmt.Errorf("unsupported storage class %q (expected one of %s)", name, strings.Join(s3StorageClassNames, ", "))
+}
+
+// S3StorageClasses picks the storage class of new artifacts from their tags
+type S3StorageClasses struct {
+	defaultClass string
+	byTag        []s3TagClass
+}
+
+type s3TagClass struct {
+	tag   string
+	class string
+}
+
+// For returns the class of the first configured tag an artifact carries,
+// else the default; empty leaves the choice to the bucket
+func (c *S3StorageClasses) For(tags []string) string {
+	if c == nil {
+		return ""
+	}
+	for _, tc := range c.byTag {
+		for _, tag := range tags {
+			if tag == tc.tag {
+				return tc.class
+			}
+		}
+	}
+	return c.defaultClass
+}
+
+// newS3StorageClassesFromEnv reads S3_STORAGE_CLASS and
+// S3_TAG_STORAGE_CLASSES ("release:GLACIER_IR,nightly:STANDARD_IA")
+func newS3StorageClassesFromEnv(prefix string) (*S3StorageClasses, error) {
+	c := &S3StorageClasses{}
+	if name := getenv(prefix + "S3_STORAGE_CLASS"); name != "" {
+		class, err := parseS3StorageClass(name)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %sS3_STORAGE_CLASS: %w", prefix, err)
+		}
+		c.defaultClass = class
+	}
+	for _, entry := range parseTags(getenv(prefix + "S3_TAG_STORAGE_CLASSES")) {
+		tag, name, ok := strings.Cut(entry, ":")
+		if !ok || tag == "" {
+			return nil, fmt.Errorf("invalid %sS3_TAG_STORAGE_CLASSES entry %q (expected tag:CLASS)", prefix, entry)
+		}
+		class, err := parseS3StorageClass(name)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %sS3_TAG_STORAGE_CLASSES: %w", prefix, err)
+		}
+		c.byTag = append(c.byTag, s3TagClass{tag: tag, class: class})
+	}
+	return c, nil
+}
+
+// s3Tagging turns artifact tags into the X-Amz-Tagging header. S3 takes at
+// most 10 tags per object and restricts their characters, so the rest are
+// dropped.
+func s3Tagging(tags []string) string {
+	values := url.Values{}
+	for _, tag := range tags {
+		if len(values) == 10 {
+			break
+		}
+		if validS3Tag(tag) {
+			values.Set(s3TagPrefix+tag, "true")
+		}
+	}
+	return s3Query(values)
+}
+
+func validS3Tag(tag string) bool {
+	if len(s3TagPrefix+tag) > 128 {
+		return false
+	}
+	for _, c := range tag {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || strings.ContainsRune(" +-=._:/@", c)) {
+			return false
+		}
+	}
+	return true
+}
+
+// s3LifecycleStep moves or expires artifacts of an age
+type s3LifecycleStep struct {
+	days int
+	// action is a storage class or s3ExpireAction
+	action string
+}
+
+// s3LifecycleRule is the steps for artifacts with a tag, or all artifacts
+// when tag is empty
+type s3LifecycleRule struct {
+	tag   string
+	steps []s3LifecycleStep
+}
+
+// parseS3Lifecycle parses "30d:STANDARD_IA,90d:GLACIER_IR,release=7d:GLACIER_IR,180d:expire"
+// into one rule per tag, steps ordered by age
+func parseS3Lifecycle(spec string) ([]s3LifecycleRule, error) {
+	byTag := make(map[string]*s3LifecycleRule)
+	var order []string
+	for _, entry := range parseTags(spec) {
+		tag, step, hasTag := strings.Cut(entry, "=")
+		if !hasTag {
+			tag, step = "", entry
+		}
+		age, action, ok := strings.Cut(step, ":")
+		days, err := strconv.Atoi(strings.TrimSuffix(age, "d"))
+		if !ok || !strings.HasSuffix(age, "d") || err != nil || days < 1 || (hasTag && !validS3Tag(tag)) {
+			return nil, fmt.Errorf("invalid lifecycle entry %q (expected [tag=]<days>d:<CLASS|expire>)", entry)
+		}
+		if action != s3ExpireAction {
+			if action, err = parseS3StorageClass(action); err != nil {
+				return nil, err
+			}
+		}
+		rule, ok := byTag[tag]
+		if !ok {
+			rule = &s3LifecycleRule{tag: tag}
+			byTag[tag] = rule
+			order = append(order, tag)
+		}
+		rule.steps = append(rule.steps, s3LifecycleStep{days: days, action: action})
+	}
+
+	rules := make([]s3LifecycleRule, 0, len(order))
+	for _, tag := range order {
+		rule := byTag[tag]
+		sort.Slice(rule.steps, func(i, j int) bool { return rule.steps[i].days < rule.steps[j].days })
+		rules = append(rules, *rule)
+	}
+	return rules, nil
+}
+
+// s3LifecycleXML renders the managed rules in the bucket's key prefix
+func s3LifecycleXML(rules []s3LifecycleRule, prefix string) string {
+	var b strings.Builder
+	for _, rule := range rules {
+		id := s3RulePrefix
+		if rule.tag != "" {
+			id += "-tag-" + rule.tag
+		}
+		b.WriteString("<Rule><ID>" + xmlEscape(id) + "</ID><Filter>")
+		tag := "<Tag><Key>" + xmlEscape(s3TagPrefix+rule.tag) + "</Key><Value>true</Value></Tag>"
+		switch {
+		case rule.tag != "" && prefix != "":
+			b.WriteString("<And><Prefix>" + xmlEscape(prefix) + "</Prefix>" + tag + "</And>")
+		case rule.tag != "":
+			b.WriteString(tag)
+		default:
+			b.WriteString("<Prefix>" + xmlEscape(prefix) + "</Prefix>")
+		}
+		b.WriteString("</Filter><Status>Enabled</Status>")
+		for _, step := range rule.steps {
+			if step.action == s3ExpireAction {
+				fmt.Fprintf(&b, "<Expiration><Days>%d</Days></Expiration>", step.days)
+			} else {
+				fmt.Fprintf(&b, "<Transition><Days>%d</Days><StorageClass>%s</StorageClass></Transition>", step.days, step.action)
+			}
+		}
+		b.WriteString("</Rule>")
+	}
+	return b.String()
+}
+
+func xmlEscape(s string) string {
+	var b bytes.Buffer
+	xml.EscapeText(&b, []byte(s))
+	return b.String()
+}
+
+// applyLifecycleFromEnv replaces the managed lifecycle rules of the bucket
+// with S3_LIFECYCLE. Unset leaves the bucket alone; "none" removes the
+// managed rules. Rules added by hand are kept either way.
+func (s *S3Storage) applyLifecycleFromEnv(prefix string) error {
+	spec, set := lookupEnv(prefix + "S3_LIFECYCLE")
+	if !set {
+		return nil
+	}
+	var rules []s3LifecycleRule
+	if spec != "none" {
+		var err error
+		if rules, err = parseS3Lifecycle(spec); err != nil {
+			return fmt.Errorf("invalid %sS3_LIFECYCLE: %w", prefix, err)
+		}
+	}
+	return s.applyLifecycle(rules)
+}
+
+func (s *S3Storage) applyLifecycle(rules []s3LifecycleRule) error {
+	query := url.Values{"lifecycle": {""}}
+	resp, err := s.do(http.MethodGet, "", query, nil, emptySHA256, nil)
+	if err != nil {
+		return fmt.Errorf("failed to read bucket lifecycle: %w", err)
+	}
+	var current struct {
+		Rules []struct {
+			ID    string `xml:"ID"`
+			Inner string `xml:",innerxml"`
+		} `xml:"Rule"`
+	}
+	switch resp.StatusCode {
+	case http.StatusOK:
+		err = xml.NewDecoder(resp.Body).Decode(&current)
+		resp.Body.Close()
+		if err != nil {
+			return fmt.Errorf("failed to decode bucket lifecycle: %w", err)
+		}
+	case http.StatusNotFound:
+		// NoSuchLifecycleConfiguration
+		resp.Body.Close()
+	default:
+		defer resp.Body.Close()
+		return fmt.Errorf("failed to read bucket lifecycle: %s", s3Error(resp))
+	}
+
+	var body strings.Builder
+	kept := 0
+	for _, rule := range current.Rules {
+		if !strings.HasPrefix(rule.ID, s3RulePrefix) {
+			body.WriteString("<Rule>" + rule.Inner + "</Rule>")
+			kept++
+		}
+	}
+	body.WriteString(s3LifecycleXML(rules, s.prefix))
+
+	if kept+len(rules) == 0 {
+		if len(current.Rules) == 0 {
+			return nil
+		}
+		// S3 refuses an empty configuration, so delete it instead
+		resp, err := s.do(http.MethodDelete, "", query, nil, emptySHA256, nil)
+		if err != nil {
+			return fmt.Errorf("failed to delete bucket lifecycle: %w", err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusNoContent {
+			return fmt.Errorf("failed to delete bucket lifecycle: %s", s3Error(resp))
+		}
+		return nil
+	}
+
+	data := []byte(`<?xml version="1.0" encoding="UTF-8"?><LifecycleConfiguration xmlns="http://s3.amazonaws.com/doc/2006-03-01/">` +
+		body.String() + "</LifecycleConfiguration>")
+	sum := md5.Sum(data)
+	payload := sha256.Sum256(data)
+	header := http.Header{
+		"Content-Type": {"application/xml"},
+		"Content-Md5":  {base64.StdEncoding.EncodeToString(sum[:])},
+	}
+	resp, err = s.do(http.MethodPut, "", query, bytes.NewReader(data), hex.EncodeToString(payload[:]), header)
+	if err != nil {
+		return fmt.Errorf("failed to set bucket lifecycle: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed to set bucket lifecycle: %s", s3Error(resp))
+	}
+	return nil
+}
@@ -0,0 +1,436 @@
+package cachesrv
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Settings are environment variables at heart: every option is read with
+// getenv wherever it is needed. A config file and command line flags are
+// layered over them by setting the variables before anything reads them,
+// flags over the environment over the file.
+//
+// The config file is TOML with string, number, boolean and string array
+// values. Keys name settings without the TURBO_ prefix, and section names
+// are prefixed to the keys of their section:
+//
+//	cache_dir = "/var/cache/turbo"   # TURBO_CACHE_DIR
+//	[s3]
+//	bucket = "turbo-cache"           # TURBO_S3_BUCKET
+//	[otel]
+//	service_name = "turbo-cache"     # OTEL_SERVICE_NAME
+
+const serverUsage = `Usage: go-turbo-cachesrv [flags]
+
+Serves the Turborepo remote cache API. Every option is an environment
+variable (see the README); a config file and the flags below override them,
+flags taking precedence over the environment and the environment over the
+config file.
+
+Flags:
+`
+
+// settingFlags are the common settings that have a flag of their own
+var settingFlags = []struct {
+	name, setting, usage string
+}{
+	{"listen", "TURBO_LISTEN", "address to serve on (default :8080)"},
+	{"storage-dir", "TURBO_CACHE_DIR", "cache directory (default ./turbo-cache)"},
+	{"token-file", "TURBO_TOKENS_FILE", "JSON file of additional tokens (default .meta/tokens.json in the cache dir)"},
+	{"log-file", "TURBO_LOG_FILE", "log to this file instead of stdout"},
+	{"log-format", "TURBO_LOG_FORMAT", "text or json (default text)"},
+	{"log-level", "TURBO_LOG_LEVEL", "debug, info, warn or error (default info)"},
+	{"metrics-addr", "TURBO_METRICS_ADDR", "also serve /metrics without authentication on this address"},
+	{"tls-cert", "TURBO_TLS_CERT", "serve HTTPS with this PEM certificate chain"},
+	{"tls-key", "TURBO_TLS_KEY", "PEM private key of the TLS certificate"},
+}
+
+// settingSources remembers where the settings not from the environment came
+// from and which settings were read, to report the ones nothing read
+var settingSources = struct {
+	sync.Mutex
+	file string
+	from map[string]string
+	read map[string]bool
+}{from: make(map[string]string), read: make(map[string]bool)}
+
+// getenv reads a setting
+func getenv(key string) string {
+	v, _ := lookupEnv(key)
+	return v
+}
+
+// lookupEnv reads a setting, reporting whether it is set
+func lookupEnv(key string) (string, bool) {
+	settingSources.Lock()
+	settingSources.read[key] = true
+	settingSources.Unlock()
+	return os.LookupEnv(key)
+}
+
+// configure layers the config file and flags over the environment. It
+// reports whether the server should only print its configuration.
+func configure(args []string) (bool, error) {
+	flagged := make(map[string]string)
+	var order []string
+	set := func(name, value string) {
+		if _, ok := flagged[name]; !ok {
+			order = append(order, name)
+		}
+		flagged[name] = value
+	}
+
+	fs := flag.NewFlagSet("go-turbo-cachesrv", flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprint(fs.Output(), serverUsage)
+		fs.PrintDefaults()
+	}
+	configPath := fs.String("config", getenv("TURBO_CONFIG_FILE"), "TOML config file (TURBO_CONFIG_FILE)")
+	printConfig := fs.Bool("print-config", false, "print the settings in effect and where they come from, and exit")
+	for _, f := range settingFlags {
+		setting := f.setting
+		fs.Func(f.name, f.usage+" ("+setting+")", func(v string) error {
+			set(setting, v)
+			return nil
+		})
+	}
+	fs.Func("set", "set any setting, as NAME=value or section.key=value; repeatable", func(v string) error {
+		key, value, ok := strings.Cut(v, "=")
+		if !ok {
+			return fmt.Errorf("expected NAME=value, got %q", v)
+		}
+		name, err := settingName("", strings.TrimSpace(key))
+		if err != nil {
+			return err
+		}
+		set(name, value)
+		return nil
+	})
+	if err := fs.Parse(args); err != nil {
+		return false, err
+	}
+	if fs.NArg() > 0 {
+		return false, fmt.Errorf("unexpected argument %q", fs.Arg(0))
+	}
+
+	if *configPath != "" {
+		entries, err := readConfigFile(*configPath)
+		if err != nil {
+			return false, err
+		}
+		settingSources.file = *configPath
+		for _, e := range entries {
+			if _, ok := os.LookupEnv(e.name); ok {
+				continue
+			}
+			os.Setenv(e.name, e.value)
+			settingSources.from[e.name] = fmt.Sprintf("%s:%d", *configPath, e.line)
+		}
+	}
+	for _, name := range order {
+		os.Setenv(name, flagged[name])
+		settingSources.from[name] = "flag"
+	}
+	return *printConfig, nil
+}
+
+// reloadConfigFile reads the config file again and updates the settings
+// that come from it, leaving those from the environment and flags alone. It
+// returns the names of the settings that changed and a function undoing the
+// changes.
+func reloadConfigFile() ([]string, func(), error) {
+	settingSources.Lock()
+	defer settingSources.Unlock()
+	path := settingSources.file
+	if path == "" {
+		return nil, func() {}, nil
+	}
+	entries, err := readConfigFile(path)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	fromFile := func(name string) bool {
+		from, ok := settingSources.from[name]
+		if ok {
+			return from != "flag"
+		}
+		_, set := os.LookupEnv(name)
+		return !set
+	}
+	previous := make(map[string]string)
+	sources := make(map[string]string)
+	for name, from := range settingSources.from {
+		sources[name] = from
+	}
+	var changed []string
+	update := func(name string, value *string) {
+		old, set := os.LookupEnv(name)
+		if set {
+			previous[name] = old
+		}
+		if value == nil {
+			os.Unsetenv(name)
+			delete(settingSources.from, name)
+		} else {
+			os.Setenv(name, *value)
+		}
+		if value == nil || !set || old != *value {
+			changed = append(changed, name)
+		}
+	}
+
+	seen := make(map[string]bool)
+	for _, e := range entries {
+		seen[e.name] = true
+		if !fromFile(e.name) {
+			continue
+		}
+		update(e.name, &e.value)
+		settingSources.from[e.name] = fmt.Sprintf("%s:%d", path, e.line)
+	}
+	for name, from := range sources {
+		if from != "flag" && !seen[name] {
+			update(name, nil)
+		}
+	}
+	sort.Strings(changed)
+
+	undo := func() {
+		settingSources.Lock()
+		defer settingSources.Unlock()
+		for _, name := range changed {
+			if old, ok := previous[name]; ok {
+				os.Setenv(name, old)
+			} else {
+				os.Unsetenv(name)
+			}
+		}
+		settingSources.from = sources
+	}
+	return changed, undo, nil
+}
+
+// readConfigFile reads the settings of the config file at path
+func readConfigFile(path string) ([]configEntry, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open config file: %w", err)
+	}
+	defer file.Close()
+	entries, err := parseConfigFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return entries, nil
+}
+
+type configEntry struct {
+	name, value string
+	line        int
+}
+
+// parseConfigFile reads the settings of a config file, in order
+func parseConfigFile(r io.Reader) ([]configEntry, error) {
+	var entries []configEntry
+	seen := make(map[string]int)
+	section := ""
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		if line[0] == '[' {
+			end := strings.IndexByte(line, ']')
+			if end < 0 || strings.HasPrefix(line, "[[") || !isComment(line[end+1:]) {
+				return nil, fmt.Errorf("line %d: invalid section header", n)
+			}
+			section = strings.TrimSpace(line[1:end])
+			if _, err := settingName(section, "x"); err != nil {
+				return nil, fmt.Errorf("line %d: %w", n, err)
+			}
+			continue
+		}
+
+		key, raw, ok := strings.Cut(line, "=")
+		if !ok {
+			return nil, fmt.Errorf("line %d: expected key = value", n)
+		}
+		name, err := settingName(section, strings.TrimSpace(key))
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", n, err)
+		}
+		value, err := parseConfigValue(strings.TrimSpace(raw))
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %s: %w", n, strings.TrimSpace(key), err)
+		}
+		if first, ok := seen[name]; ok {
+			return nil, fmt.Errorf("line %d: %s is already set on line %d", n, name, first)
+		}
+		seen[name] = n
+		entries = append(entries, configEntry{name: name, value: value, line: n})
+	}
+	return entries, scanner.Err()
+}
+
+// settingName turns a key of a config file section into the name of its
+// environment variable
+func settingName(section, key string) (string, error) {
+	if key == "" {
+		return "", errors.New("empty key")
+	}
+	parts := strings.FieldsFunc(section, func(r rune) bool { return r == '.' })
+	parts = append(parts, strings.Split(key, ".")...)
+	for _, p := range parts {
+		for _, r := range p {
+			if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '_' || r == '-') {
+				return "", fmt.Errorf("invalid key %q", strings.Join(parts, "."))
+			}
+		}
+	}
+	name := strings.ToUpper(strings.ReplaceAll(strings.Join(parts, "_"), "-", "_"))
+	switch {
+	case strings.HasPrefix(name, "TURBO_"), strings.HasPrefix(name, "OTEL_"):
+		return name, nil
+	case strings.HasPrefix(name, "OTEL"):
+		return "", fmt.Errorf("invalid key %q", key)
+	}
+	return "TURBO_" + name, nil
+}
+
+// parseConfigValue reads a TOML value: a quoted string, a number, a boolean
+// or an array of those, which becomes a comma separated list
+func parseConfigValue(raw string) (string, error) {
+	if strings.HasPrefix(raw, "[") {
+		end := strings.LastIndexByte(raw, ']')
+		if end < 0 || !isComment(raw[end+1:]) {
+			return "", errors.New("unterminated array")
+		}
+		var items []string
+		rest := strings.TrimSpace(raw[1:end])
+		for rest != "" {
+			item, tail, err := parseScalar(rest)
+			if err != nil {
+				return "", err
+			}
+			items = append(items, item)
+			tail = strings.TrimSpace(tail)
+			if tail != "" && tail[0] != ',' {
+				return "", errors.New("expected , between array items")
+			}
+			rest = strings.TrimSpace(strings.TrimPrefix(tail, ","))
+		}
+		return strings.Join(items, ","), nil
+	}
+	value, rest, err := parseScalar(raw)
+	if err != nil {
+		return "", err
+	}
+	if !isComment(rest) {
+		return "", fmt.Errorf("unexpected %q after value", strings.TrimSpace(rest))
+	}
+	return value, nil
+}
+
+// parseScalar reads one value off the front of s
+func parseScalar(s string) (string, string, error) {
+	switch {
+	case s == "":
+		return "", "", errors.New("missing value")
+	case s[0] == '"':
+		for i := 1; i < len(s); i++ {
+			if s[i] == '\\' {
+				i++
+				continue
+			}
+			if s[i] == '"' {
+				v, err := strconv.Unquote(s[:i+1])
+				return v, s[i+1:], err
+			}
+		}
+		return "", "", errors.New("unterminated string")
+	case s[0] == '\'':
+		end := strings.IndexByte(s[1:], '\'')
+		if end < 0 {
+			return "", "", errors.New("unterminated string")
+		}
+		return s[1 : end+1], s[end+2:], nil
+	}
+	end := strings.IndexAny(s, " \t,#]")
+	if end < 0 {
+		end = len(s)
+	}
+	token := s[:end]
+	if token == "true" || token == "false" {
+		return token, s[end:], nil
+	}
+	if _, err := strconv.ParseFloat(strings.ReplaceAll(token, "_", ""), 64); err == nil {
+		return strings.ReplaceAll(token, "_", ""), s[end:], nil
+	}
+	return "", "", fmt.Errorf("%q is not a value; quote strings such as sizes and durations", token)
+}
+
+func isComment(s string) bool {
+	s = strings.TrimSpace(s)
+	return s == "" || s[0] == '#'
+}
+
+// secretSetting reports whether a setting holds a credential
+func secretSetting(name string) bool {
+	for _, word := range []string{"TOKEN", "SECRET", "PASSWORD", "_KEY", "HEADERS"} {
+		if strings.Contains(name, word) && !strings.HasSuffix(name, "_KEY_ID") && !strings.HasSuffix(name, "_FILE") {
+			return true
+		}
+	}
+	return false
+}
+
+// writeConfig prints the settings in effect as a config file, with where
+// each comes from. Options left at their defaults are not listed.
+func writeConfig(w io.Writer) {
+	var names []string
+	for _, kv := range os.Environ() {
+		name, _, _ := strings.Cut(kv, "=")
+		if (strings.HasPrefix(name, "TURBO_") || strings.HasPrefix(name, "OTEL_")) && name != "TURBO_CONFIG_FILE" {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		value := os.Getenv(name)
+		if secretSetting(name) && value != "" {
+			value = "********"
+		}
+		from := settingSources.from[name]
+		if from == "" {
+			from = "env"
+		}
+		fmt.Fprintf(w, "%s = %s  # %s\n", name, strconv.Quote(value), from)
+	}
+}
+
+// reportUnusedSettings logs the settings of the config file and flags that
+// nothing read, mistyped or meant for a backend not in use
+func reportUnusedSettings(logger interface{ Printf(string, ...any) }) {
+	settingSources.Lock()
+	defer settingSources.Unlock()
+	var unused []string
+	for name := range settingSources.from {
+		if !settingSources.read[name] {
+			unused = append(unused, name)
+		}
+	}
+	sort.Strings(unused)
+	for _, name := range unused {
+		logger.Printf("Ignoring setting %s from %s: it is unknown or unused with this configuration", name, settingSources.from[name])
+	}
+}
@@ -0,0 +1,146 @@
+package cachesrv
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"hash"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	signatureHeader = "X-Turbo-Signature"
+	timestampHeader = "X-Turbo-Timestamp"
+	nonceHeader     = "X-Turbo-Nonce"
+	// bodyDigestHeader carries the hex SHA-256 of a signed request's body
+	bodyDigestHeader = "X-Content-SHA256"
+)
+
+var (
+	errSignatureMissing = errors.New("missing request signature")
+	errSignatureInvalid = errors.New("invalid request signature")
+	errTimestampSkew    = errors.New("request timestamp outside allowed window")
+	errNonceReused      = errors.New("request nonce already used")
+	errBodyDigest       = errors.New("request body doesn't match its signed digest")
+)
+
+// RequestVerifier checks HMAC request signatures and rejects replays by
+// enforcing a timestamp window and remembering nonces seen inside it
+type RequestVerifier struct {
+	key    []byte
+	window time.Duration
+
+	mu        sync.Mutex
+	nonces    map[string]time.Time
+	lastSweep time.Time
+}
+
+func NewRequestVerifier(key []byte, window time.Duration) *RequestVerifier {
+	return &RequestVerifier{
+		key:       key,
+		window:    window,
+		nonces:    make(map[string]time.Time),
+		lastSweep: time.Now(),
+	}
+}
+
+// Verify validates the signature headers. The signature is the hex HMAC-SHA256 of
+//
+//	METHOD \n PATH?QUERY \n TIMESTAMP \n NONCE \n CONTENT-LENGTH \n X-ARTIFACT-TAG \n X-CONTENT-SHA256
+//
+// where TIMESTAMP is in unix seconds. Requests with a body must send its
+// SHA-256; the body is checked against it as it is read, and reading its end
+// fails if it doesn't match, so a swapped body is never stored.
+func (v *RequestVerifier) Verify(r *http.Request) error {
+	sig := r.Header.Get(signatureHeader)
+	ts := r.Header.Get(timestampHeader)
+	nonce := r.Header.Get(nonceHeader)
+	bodyDigest := r.Header.Get(bodyDigestHeader)
+	if sig == "" || ts == "" || nonce == "" || (r.ContentLength != 0 && bodyDigest == "") {
+		return errSignatureMissing
+	}
+
+	expected := v.Sign(r.Method, r.URL.RequestURI(), ts, nonce,
+		r.Header.Get("Content-Length"), r.Header.Get("x-artifact-tag"), bodyDigest)
+	if !hmac.Equal([]byte(sig), []byte(expected)) {
+		return errSignatureInvalid
+	}
+
+	unix, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil {
+		return errSignatureInvalid
+	}
+	now := time.Now()
+	signedAt := time.Unix(unix, 0)
+	if signedAt.Before(now.Add(-v.window)) || signedAt.After(now.Add(v.window)) {
+		return errTimestampSkew
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	if now.Sub(v.lastSweep) > v.window {
+		for n, expires := range v.nonces {
+			if now.After(expires) {
+				delete(v.nonces, n)
+			}
+		}
+		v.lastSweep = now
+	}
+
+	if _, seen := v.nonces[nonce]; seen {
+		return errNonceReused
+	}
+	// A nonce only needs remembering until its timestamp leaves the window
+	v.nonces[nonce] = signedAt.Add(v.window)
+	if r.ContentLength != 0 {
+		r.Body = &bodyDigestReader{ReadCloser: r.Body, hash: sha256.New(), want: bodyDigest, remaining: r.ContentLength}
+	}
+	return nil
+}
+
+// Sign computes the signature for the given request components
+func (v *RequestVerifier) Sign(method, requestURI, timestamp, nonce, contentLength, tag, bodyDigest string) string {
+	mac := hmac.New(sha256.New, v.key)
+	for i, part := range []string{method, requestURI, timestamp, nonce, contentLength, tag, bodyDigest} {
+		if i > 0 {
+			mac.Write([]byte("\n"))
+		}
+		mac.Write([]byte(part))
+	}
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// bodyDigestReader fails the read that reaches the end of a body, at EOF or
+// once Content-Length bytes are in, and every read after it, unless the body
+// matches its digest
+type bodyDigestReader struct {
+	io.ReadCloser
+	hash hash.Hash
+	want string
+	// remaining is what is left of the Content-Length, or negative if unknown
+	remaining int64
+	err       error
+}
+
+func (br *bodyDigestReader) Read(p []byte) (int, error) {
+	if br.err != nil {
+		return 0, br.err
+	}
+	n, err := br.ReadCloser.Read(p)
+	br.hash.Write(p[:n])
+	br.remaining -= int64(n)
+	if err == io.EOF || br.remaining == 0 {
+		if !strings.EqualFold(hex.EncodeToString(br.hash.Sum(nil)), br.want) {
+			br.err = errBodyDigest
+			return n, br.err
+		}
+	}
+	return n, err
+}
@@ -0,0 +1,151 @@
+package cachesrv
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// signedRequest builds a request signed with key at the given time; a nil
+// body makes a bodiless GET
+func signedRequest(v *RequestVerifier, at time.Time, nonce string, body *string) *http.Request {
+	method, target := http.MethodGet, "/v8/artifacts/abcd?teamId=web"
+	var r *http.Request
+	if body == nil {
+		r = httptest.NewRequest(method, target, nil)
+	} else {
+		method = http.MethodPut
+		r = httptest.NewRequest(method, target, strings.NewReader(*body))
+		r.Header.Set("Content-Length", strconv.Itoa(len(*body)))
+		sum := sha256.Sum256([]byte(*body))
+		r.Header.Set(bodyDigestHeader, hex.EncodeToString(sum[:]))
+	}
+	ts := strconv.FormatInt(at.Unix(), 10)
+	r.Header.Set(timestampHeader, ts)
+	r.Header.Set(nonceHeader, nonce)
+	r.Header.Set(signatureHeader, v.Sign(method, target, ts, nonce,
+		r.Header.Get("Content-Length"), "", r.Header.Get(bodyDigestHeader)))
+	return r
+}
+
+func TestRequestVerifierWindow(t *testing.T) {
+	v := NewRequestVerifier([]byte("key"), 5*time.Minute)
+	now := time.Now()
+	tests := []struct {
+		name string
+		at   time.Time
+		want error
+	}{
+		{"now", now, nil},
+		{"inside the window", now.Add(-4 * time.Minute), nil},
+		{"clock ahead inside the window", now.Add(4 * time.Minute), nil},
+		{"too old", now.Add(-6 * time.Minute), errTimestampSkew},
+		{"too far ahead", now.Add(6 * time.Minute), errTimestampSkew},
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := signedRequest(v, tt.at, "nonce-"+strconv.Itoa(i), nil)
+			if err := v.Verify(r); !errors.Is(err, tt.want) {
+				t.Errorf("Verify = %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestRequestVerifierNonces(t *testing.T) {
+	v := NewRequestVerifier([]byte("key"), time.Minute)
+	now := time.Now()
+	if err := v.Verify(signedRequest(v, now, "once", nil)); err != nil {
+		t.Fatalf("first request: %v", err)
+	}
+	if err := v.Verify(signedRequest(v, now, "once", nil)); !errors.Is(err, errNonceReused) {
+		t.Errorf("replay = %v, want %v", err, errNonceReused)
+	}
+	// A rejected request doesn't use up its nonce
+	if err := v.Verify(signedRequest(v, now.Add(-time.Hour), "late", nil)); !errors.Is(err, errTimestampSkew) {
+		t.Fatalf("stale request = %v, want %v", err, errTimestampSkew)
+	}
+	if err := v.Verify(signedRequest(v, now, "late", nil)); err != nil {
+		t.Errorf("fresh request with the nonce of a rejected one: %v", err)
+	}
+
+	// Nonces are forgotten once their timestamp has left the window
+	v.nonces["once"] = now.Add(-time.Second)
+	v.lastSweep = now.Add(-2 * time.Minute)
+	if err := v.Verify(signedRequest(v, now, "sweep", nil)); err != nil {
+		t.Fatalf("request: %v", err)
+	}
+	if _, ok := v.nonces["once"]; ok {
+		t.Error("expired nonce still remembered after a sweep")
+	}
+}
+
+func TestRequestVerifierSignature(t *testing.T) {
+	v := NewRequestVerifier([]byte("key"), time.Minute)
+	now := time.Now()
+	tests := []struct {
+		name   string
+		tamper func(r *http.Request)
+		want   error
+	}{
+		{"untouched", func(r *http.Request) {}, nil},
+		{"other key", func(r *http.Request) {
+			other := NewRequestVerifier([]byte("other"), time.Minute)
+			r.Header.Set(signatureHeader, other.Sign(r.Method, r.URL.RequestURI(), r.Header.Get(timestampHeader),
+				r.Header.Get(nonceHeader), r.Header.Get("Content-Length"), "", r.Header.Get(bodyDigestHeader)))
+		}, errSignatureInvalid},
+		{"other team", func(r *http.Request) { r.URL.RawQuery = "teamId=api" }, errSignatureInvalid},
+		{"added tag", func(r *http.Request) { r.Header.Set("x-artifact-tag", "tag") }, errSignatureInvalid},
+		{"other body digest", func(r *http.Request) { r.Header.Set(bodyDigestHeader, strings.Repeat("0", 64)) }, errSignatureInvalid},
+		{"no body digest", func(r *http.Request) { r.Header.Del(bodyDigestHeader) }, errSignatureMissing},
+		{"no nonce", func(r *http.Request) { r.Header.Del(nonceHeader) }, errSignatureMissing},
+	}
+	body := "artifact"
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := signedRequest(v, now, "nonce-"+strconv.Itoa(i), &body)
+			tt.tamper(r)
+			if err := v.Verify(r); !errors.Is(err, tt.want) {
+				t.Errorf("Verify = %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestRequestVerifierBody(t *testing.T) {
+	v := NewRequestVerifier([]byte("key"), time.Minute)
+	signed := "artifact"
+	tests := []struct {
+		name string
+		body string
+		want error
+	}{
+		{"signed body", signed, nil},
+		{"swapped body of the same length", "ARTIFACT", errBodyDigest},
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := signedRequest(v, time.Now(), "nonce-"+strconv.Itoa(i), &signed)
+			// On the way the body is replaced, headers and signature kept
+			r.Body = io.NopCloser(strings.NewReader(tt.body))
+			if err := v.Verify(r); err != nil {
+				t.Fatalf("Verify: %v", err)
+			}
+			if _, err := io.Copy(io.Discard, r.Body); !errors.Is(err, tt.want) {
+				t.Errorf("reading the body = %v, want %v", err, tt.want)
+			}
+			// Readers that stop at Content-Length and drop the error of their
+			// last read fail on the next one
+			if _, err := r.Body.Read(make([]byte, 1)); tt.want != nil && !errors.Is(err, tt.want) {
+				t.Errorf("reading past the body = %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
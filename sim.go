@@ -0,0 +1,545 @@
+package cachesrv
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"flag"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"log"
+	"math"
+	mathrand "math/rand/v2"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// "go-turbo-cachesrv simulate" runs the server's upload and download
+// handlers, eviction, expiry and team quotas in one process, against an
+// in-memory storage and a clock it advances itself. A scheduler seeded with
+// -seed picks what happens next: a new request, resuming one in flight, an
+// eviction or expiry pass, or time passing. Requests pause before and after
+// every storage read and write, so a seed explores interleavings that are rare
+// on a real server, and running it again replays exactly the same steps.
+// After every step the simulator checks that
+//
+//   - no team is over its quota and the cache is within its budget
+//   - every indexed artifact is in storage with the indexed size and digest,
+//     unless an upload of it is in flight
+//   - a download returns the bytes that were uploaded
+//
+// Hashes are content addressed, as turbo's are: every upload of a hash sends
+// the same bytes. Storage operations fail at random with -faults; artifacts a
+// failed delete leaves in storage without an index entry are counted, not
+// failed, since the index picks them up again on the next start.
+
+const simUsage = `Usage: go-turbo-cachesrv simulate [flags]
+
+Runs a deterministic simulation of uploads, downloads, eviction and expiry
+against an in-memory storage, checking the cache's invariants after every
+step. A failing seed is replayed with -seed <seed> -trace.
+
+`
+
+// simConfig are the command line flags of the simulator
+type simConfig struct {
+	seed        uint64
+	seeds       int
+	steps       int
+	concurrency int
+	artifacts   int
+	teams       int
+	maxSize     int64
+	quota       int64
+	budget      int64
+	ttl         time.Duration
+	policy      string
+	faults      float64
+	trace       bool
+}
+
+func parseSimFlags(args []string) (*simConfig, error) {
+	cfg := &simConfig{maxSize: 64 << 10, quota: 512 << 10, budget: 1 << 20}
+	fs := flag.NewFlagSet("simulate", flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprint(fs.Output(), simUsage)
+		fs.PrintDefaults()
+	}
+	fs.Uint64Var(&cfg.seed, "seed", 1, "seed of the first run")
+	fs.IntVar(&cfg.seeds, "seeds", 1, "number of runs, with consecutive seeds")
+	fs.IntVar(&cfg.steps, "steps", 10000, "steps per run")
+	fs.IntVar(&cfg.concurrency, "concurrency", 8, "requests in flight at most")
+	fs.IntVar(&cfg.artifacts, "artifacts", 128, "distinct hashes")
+	fs.IntVar(&cfg.teams, "teams", 4, "teams uploading")
+	fs.Func("max-size", "largest artifact (default 64KB)", func(v string) (err error) {
+		cfg.maxSize, err = parseSize(v)
+		return err
+	})
+	fs.Func("quota", "quota of every team, 0 for none (default 512KB)", func(v string) (err error) {
+		cfg.quota, err = parseSize(v)
+		return err
+	})
+	fs.Func("budget", "size budget of the cache, 0 for none (default 1MB)", func(v string) (err error) {
+		cfg.budget, err = parseSize(v)
+		return err
+	})
+	fs.DurationVar(&cfg.ttl, "ttl", 72*time.Hour, "expire artifacts unused for this long, 0 to never")
+	fs.StringVar(&cfg.policy, "policy", "lru", "eviction policy")
+	fs.Float64Var(&cfg.faults, "faults", 0.01, "probability of a storage operation failing")
+	fs.BoolVar(&cfg.trace, "trace", false, "print every step")
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+
+	if cfg.seeds < 1 || cfg.steps < 1 || cfg.concurrency < 1 || cfg.artifacts < 1 || cfg.teams < 1 {
+		return nil, fmt.Errorf("seeds, steps, concurrency, artifacts and teams must be positive")
+	}
+	if cfg.maxSize < 1 || cfg.faults < 0 || cfg.faults > 1 {
+		return nil, fmt.Errorf("max-size must be positive and faults between 0 and 1")
+	}
+	if _, err := evictionPolicyByName(cfg.policy, 24*time.Hour); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// runSimulation is the simulate subcommand; it returns the exit status
+func runSimulation(args []string) int {
+	cfg, err := parseSimFlags(args)
+	if err == flag.ErrHelp {
+		return 0
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+
+	for seed := cfg.seed; seed < cfg.seed+uint64(cfg.seeds); seed++ {
+		sim, err := newSimulation(cfg, seed)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 2
+		}
+		ok := sim.run()
+		sim.close()
+		if !ok {
+			fmt.Printf("Seed %d FAILED at step %d: %s\n", seed, sim.step, sim.failure)
+			fmt.Printf("Replay with: go-turbo-cachesrv simulate -seed %d -steps %d -trace\n", seed, sim.step)
+			return 1
+		}
+		fmt.Printf("Seed %d passed: %s\n", seed, sim.summary())
+	}
+	return 0
+}
+
+// simClock is the simulation's time; only the scheduler advances it
+type simClock struct {
+	now time.Time
+}
+
+func (c *simClock) Now() time.Time { return c.now }
+
+// simActor is a request running in its own goroutine, which only runs while
+// the scheduler waits for it to pause or finish
+type simActor struct {
+	name   string
+	hash   string
+	upload bool
+	wake   chan struct{}
+	// parked receives false when the actor pauses and true when it is done
+	parked chan bool
+}
+
+type simulation struct {
+	cfg     *simConfig
+	seed    uint64
+	rng     *mathrand.Rand
+	clock   *simClock
+	start   time.Time
+	dir     string
+	storage *simStorage
+	server  *Server
+	expirer *Expirer
+	sizes   []int64
+
+	actors  []*simActor
+	current *simActor
+	step    int
+	failure string
+	counts  map[string]int
+}
+
+func newSimulation(cfg *simConfig, seed uint64) (*simulation, error) {
+	dir, err := os.MkdirTemp("", "cachesrv-sim-")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create simulation directory: %w", err)
+	}
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	sim := &simulation{
+		cfg:    cfg,
+		seed:   seed,
+		rng:    mathrand.New(mathrand.NewPCG(seed, 0)),
+		clock:  &simClock{now: start},
+		start:  start,
+		dir:    dir,
+		counts: make(map[string]int),
+	}
+	sim.storage = &simStorage{sim: sim, objects: make(map[string]simObject), ops: make(map[string]int)}
+
+	logger := log.New(io.Discard, "", 0)
+	index, err := NewMetadataIndex(filepath.Join(dir, "metadata.json"), map[string]Storage{defaultClass: sim.storage}, logger)
+	if err != nil {
+		os.RemoveAll(dir)
+		return nil, err
+	}
+	index.clock = sim.clock
+
+	budget := ClassBudget{MaxSize: cfg.budget}
+	class := &SizeClass{Name: defaultClass, Storage: sim.storage, Budget: budget}
+	if budget.limited() {
+		policy, _ := evictionPolicyByName(cfg.policy, 24*time.Hour)
+		class.Evictor = NewEvictor(defaultClass, index, sim.storage, policy, budget, 0.9, logger)
+	}
+	classes := []*SizeClass{class}
+	sim.server = &Server{
+		classes:   classes,
+		index:     index,
+		quotas:    NewQuotaManager(index, map[string]ClassBudget{defaultClass: budget}, cfg.quota, nil, nil),
+		logger:    logger,
+		transfers: NewTransfers(math.MaxInt64, logger),
+		metrics:   NewCacheMetrics(1),
+	}
+	if cfg.ttl > 0 {
+		sim.expirer = NewExpirer(index, classes, cfg.ttl, logger)
+	}
+
+	// Sizes are log-uniform from 512 bytes, so small artifacts dominate
+	lo, hi := math.Log(512), math.Log(float64(max(cfg.maxSize, 512)))
+	for i := 0; i < cfg.artifacts; i++ {
+		sim.sizes = append(sim.sizes, int64(math.Exp(lo+sim.rng.Float64()*(hi-lo))))
+	}
+	return sim, nil
+}
+
+func (sim *simulation) close() {
+	// Requests still in flight after a failure stay parked; their goroutines
+	// are left behind, which is fine for a process about to exit
+	os.RemoveAll(sim.dir)
+}
+
+func simHash(i int) string {
+	return fmt.Sprintf("sim%05d", i)
+}
+
+// simContent is the artifact of a hash, the same for every upload
+func (sim *simulation) simContent(i int) []byte {
+	seed := sha256.Sum256([]byte(simHash(i)))
+	data := make([]byte, sim.sizes[i])
+	mathrand.NewChaCha8(seed).Read(data)
+	return data
+}
+
+func (sim *simulation) tracef(format string, args ...any) {
+	if sim.cfg.trace {
+		fmt.Printf("%6d %10v  %s\n", sim.step, sim.clock.now.Sub(sim.start), fmt.Sprintf(format, args...))
+	}
+}
+
+func (sim *simulation) fail(format string, args ...any) {
+	if sim.failure == "" {
+		sim.failure = fmt.Sprintf(format, args...)
+		sim.tracef("FAILED: %s", sim.failure)
+	}
+}
+
+// run performs the steps, then lets the requests in flight finish, and
+// reports whether every check passed
+func (sim *simulation) run() bool {
+	for sim.step = 1; sim.step <= sim.cfg.steps; sim.step++ {
+		sim.next()
+		sim.check()
+		if sim.failure != "" {
+			return false
+		}
+	}
+	for sim.step--; len(sim.actors) > 0; {
+		sim.step++
+		sim.resume(sim.actors[0])
+		sim.check()
+		if sim.failure != "" {
+			return false
+		}
+	}
+	for hash := range sim.storage.objects {
+		if _, ok := sim.server.index.Get(hash); !ok {
+			sim.counts["orphaned"]++
+		}
+	}
+	return true
+}
+
+// next performs one step chosen by the seed
+func (sim *simulation) next() {
+	if len(sim.actors) > 0 && (len(sim.actors) >= sim.cfg.concurrency || sim.rng.IntN(2) == 0) {
+		sim.resume(sim.actors[sim.rng.IntN(len(sim.actors))])
+		return
+	}
+	switch n := sim.rng.IntN(100); {
+	case n < 45:
+		sim.startUpload(sim.rng.IntN(sim.cfg.artifacts), sim.rng.IntN(sim.cfg.teams))
+	case n < 85:
+		sim.startDownload(sim.rng.IntN(sim.cfg.artifacts))
+	case n < 93:
+		d := time.Duration(sim.rng.Int64N(6*60*60)) * time.Second
+		sim.clock.now = sim.clock.now.Add(d)
+		sim.tracef("%v pass", d)
+	case n < 97:
+		if evictor := sim.server.classes[0].Evictor; evictor != nil {
+			count, freed := evictor.Evict(0, 0)
+			sim.counts["evicted"] += count
+			sim.tracef("eviction pass: %d artifacts, %d bytes", count, freed)
+		}
+	default:
+		if sim.expirer != nil {
+			count, freed := sim.expirer.Expire()
+			sim.counts["expired"] += count
+			sim.tracef("expiry pass: %d artifacts, %d bytes", count, freed)
+		}
+	}
+}
+
+func (sim *simulation) startUpload(i, team int) {
+	hash, data := simHash(i), sim.simContent(i)
+	sim.spawn(fmt.Sprintf("upload of %s by team-%d", hash, team), hash, true, func() string {
+		req := httptest.NewRequest(http.MethodPut, "/v8/artifacts/"+hash+"?teamId=team-"+strconv.Itoa(team), bytes.NewReader(data))
+		req.Header.Set("Content-Length", strconv.Itoa(len(data)))
+		req.SetPathValue("hash", hash)
+		w := httptest.NewRecorder()
+		sim.server.handleArtifact(w, req)
+		return strconv.Itoa(w.Code)
+	})
+}
+
+func (sim *simulation) startDownload(i int) {
+	hash := simHash(i)
+	sim.spawn("download of "+hash, hash, false, func() string {
+		req := httptest.NewRequest(http.MethodGet, "/v8/artifacts/"+hash, nil)
+		req.SetPathValue("hash", hash)
+		w := httptest.NewRecorder()
+		sim.server.handleArtifact(w, req)
+		if w.Code == http.StatusOK && !bytes.Equal(w.Body.Bytes(), sim.simContent(i)) {
+			sim.fail("download of %s returned %d bytes that are not the %d uploaded", hash, w.Body.Len(), sim.sizes[i])
+		}
+		return strconv.Itoa(w.Code)
+	})
+}
+
+// spawn starts an actor, which waits to be resumed; fn returns the outcome
+// counted and traced when it is done
+func (sim *simulation) spawn(name, hash string, upload bool, fn func() string) {
+	a := &simActor{name: name, hash: hash, upload: upload, wake: make(chan struct{}), parked: make(chan bool)}
+	sim.actors = append(sim.actors, a)
+	sim.tracef("%s starts", name)
+	go func() {
+		<-a.wake
+		outcome := "panic"
+		defer func() {
+			if p := recover(); p != nil {
+				sim.fail("%s panicked: %v", a.name, p)
+			}
+			op, _, _ := strings.Cut(a.name, " ")
+			sim.counts[op+" "+outcome]++
+			sim.tracef("%s done: %s", a.name, outcome)
+			a.parked <- true
+		}()
+		outcome = fn()
+	}()
+}
+
+// resume runs an actor until it pauses or finishes
+func (sim *simulation) resume(a *simActor) {
+	sim.tracef("%s resumes", a.name)
+	sim.current = a
+	a.wake <- struct{}{}
+	done := <-a.parked
+	sim.current = nil
+	if done {
+		for i, other := range sim.actors {
+			if other == a {
+				sim.actors = append(sim.actors[:i], sim.actors[i+1:]...)
+				break
+			}
+		}
+	}
+}
+
+// pause hands control back to the scheduler from an actor; called outside
+// of an actor, e.g. by an eviction pass, it does nothing
+func (sim *simulation) pause() {
+	a := sim.current
+	if a == nil {
+		return
+	}
+	a.parked <- false
+	<-a.wake
+}
+
+// check verifies the invariants between steps, while no actor runs
+func (sim *simulation) check() {
+	index := sim.server.index
+	if sim.cfg.quota > 0 {
+		for team := 0; team < sim.cfg.teams; team++ {
+			if used := index.TeamUsage("team-" + strconv.Itoa(team)); used > sim.cfg.quota {
+				sim.fail("team-%d uses %d bytes, over its quota of %d", team, used, sim.cfg.quota)
+			}
+		}
+	}
+	if size := index.ClassSize(defaultClass); sim.cfg.budget > 0 && size > sim.cfg.budget {
+		sim.fail("the cache holds %d bytes, over its budget of %d", size, sim.cfg.budget)
+	}
+
+	uploading := make(map[string]bool)
+	for _, a := range sim.actors {
+		if a.upload {
+			uploading[a.hash] = true
+		}
+	}
+	entries := index.All()
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Hash < entries[j].Hash })
+	for _, m := range entries {
+		if uploading[m.Hash] {
+			continue
+		}
+		object, ok := sim.storage.objects[m.Hash]
+		if !ok {
+			sim.fail("%s is indexed but not in storage", m.Hash)
+			continue
+		}
+		if int64(len(object.data)) != m.Size || object.digest != m.Digest {
+			sim.fail("%s is indexed with %d bytes and digest %s, storage has %d bytes with digest %s",
+				m.Hash, m.Size, m.Digest, len(object.data), object.digest)
+		}
+	}
+}
+
+func (sim *simulation) summary() string {
+	keys := make([]string, 0, len(sim.counts))
+	for key := range sim.counts {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	parts := make([]string, 0, len(keys))
+	for _, key := range keys {
+		parts = append(parts, fmt.Sprintf("%s %d", key, sim.counts[key]))
+	}
+	return fmt.Sprintf("%d steps, %s", sim.step, strings.Join(parts, ", "))
+}
+
+// simStorage keeps artifacts in memory. Store pauses the calling request
+// before reading the body, before writing it and after, and Get before
+// reading, so other steps happen in between; Exists and Delete are atomic.
+type simStorage struct {
+	sim     *simulation
+	mu      sync.Mutex
+	objects map[string]simObject
+	// ops counts the operations on each hash, so whether one fails depends
+	// on the seed and not on the order a pass iterates the index in
+	ops map[string]int
+}
+
+// simObject is a stored artifact with its digest as the server computes it
+type simObject struct {
+	data   []byte
+	digest string
+}
+
+func (st *simStorage) fault(op, hash string) error {
+	if st.sim.cfg.faults == 0 {
+		return nil
+	}
+	st.mu.Lock()
+	key := op + " " + hash
+	n := st.ops[key]
+	st.ops[key]++
+	st.mu.Unlock()
+
+	h := fnv.New64a()
+	fmt.Fprintf(h, "%d/%s/%d", st.sim.seed, key, n)
+	if float64(h.Sum64()%1000000)/1000000 >= st.sim.cfg.faults {
+		return nil
+	}
+	st.sim.counts["failed "+op]++
+	st.sim.tracef("%s of %s fails", op, hash)
+	return fmt.Errorf("simulated %s failure of %s", op, hash)
+}
+
+func (st *simStorage) Store(hash string, data io.Reader) error {
+	st.sim.pause()
+	body, err := io.ReadAll(data)
+	if err != nil {
+		return err
+	}
+	st.sim.pause()
+	if err := st.fault("store", hash); err != nil {
+		return err
+	}
+	algorithm, digest := st.sim.server.contentHash()
+	digest.Write(body)
+	st.mu.Lock()
+	st.objects[hash] = simObject{data: body, digest: formatDigest(algorithm, digest)}
+	st.mu.Unlock()
+	st.sim.pause()
+	return nil
+}
+
+func (st *simStorage) Get(hash string) (io.ReadCloser, int64, error) {
+	st.sim.pause()
+	if err := st.fault("get", hash); err != nil {
+		return nil, 0, err
+	}
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	object, ok := st.objects[hash]
+	if !ok {
+		return nil, 0, errArtifactNotFound
+	}
+	return io.NopCloser(bytes.NewReader(object.data)), int64(len(object.data)), nil
+}
+
+func (st *simStorage) Exists(hash string) (bool, error) {
+	if err := st.fault("exists", hash); err != nil {
+		return false, err
+	}
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	_, ok := st.objects[hash]
+	return ok, nil
+}
+
+func (st *simStorage) Delete(hash string) error {
+	if err := st.fault("delete", hash); err != nil {
+		return err
+	}
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	delete(st.objects, hash)
+	return nil
+}
+
+func (st *simStorage) List() ([]ArtifactStat, error) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	stats := make([]ArtifactStat, 0, len(st.objects))
+	for hash, object := range st.objects {
+		stats = append(stats, ArtifactStat{Hash: hash, Size: int64(len(object.data)), ModTime: st.sim.clock.now})
+	}
+	sort.Slice(stats, func(i, j int) bool { return stats[i].Hash < stats[j].Hash })
+	return stats, nil
+}
@@ -0,0 +1,105 @@
+package cachesrv
+
+const (
+	defaultClass = ""
+	smallClass   = "small"
+	inlineClass  = "inline"
+)
+
+// ClassBudget limits the bytes and the number of artifacts (and so inodes)
+// of a size class; zero values mean unlimited
+type ClassBudget struct {
+	MaxSize  int64
+	MaxFiles int64
+}
+
+// classBudgetFromEnv reads the <prefix>MAX_SIZE and <prefix>MAX_FILES
+// budget of a class
+func classBudgetFromEnv(prefix string, maxSize int64) (ClassBudget, error) {
+	var budget ClassBudget
+	var err error
+	if budget.MaxSize, err = envSize(prefix+"MAX_SIZE", maxSize); err != nil {
+		return budget, err
+	}
+	files, err := envInt(prefix+"MAX_FILES", 0)
+	if err != nil {
+		return budget, err
+	}
+	budget.MaxFiles = int64(files)
+	return budget, nil
+}
+
+// exceeded reports whether the given usage is over the budget
+func (b ClassBudget) exceeded(size, files int64) bool {
+	return (b.MaxSize > 0 && size > b.MaxSize) || (b.MaxFiles > 0 && files > b.MaxFiles)
+}
+
+func (b ClassBudget) limited() bool {
+	return b.MaxSize > 0 || b.MaxFiles > 0
+}
+
+// scaled returns the budget reduced to a fraction, e.g. an eviction target
+func (b ClassBudget) scaled(f float64) ClassBudget {
+	return ClassBudget{
+		MaxSize:  int64(float64(b.MaxSize) * f),
+		MaxFiles: int64(float64(b.MaxFiles) * f),
+	}
+}
+
+// SizeClass is a storage area for artifacts up to a certain size with its own
+// budget and eviction, so that millions of tiny artifacts and a few huge ones
+// don't compete for the same inodes and bytes
+type SizeClass struct {
+	Name string
+	// MaxArtifactSize is the largest artifact stored in this class, 0 for no limit
+	MaxArtifactSize int64
+	Storage         Storage
+	Budget          ClassBudget
+	Evictor         *Evictor
+}
+
+// classFor picks the first class an artifact of the given size fits into.
+// Inline artifacts that no evictor makes room for go to the next class.
+func (s *Server) classFor(size int64) *SizeClass {
+	for _, c := range s.classes {
+		if c.Name == inlineClass && c.Evictor == nil &&
+			s.quotas.ClassBudget(c.Name).exceeded(s.index.ClassSize(c.Name)+size, s.index.ClassCount(c.Name)+1) {
+			continue
+		}
+		if c.MaxArtifactSize == 0 || size <= c.MaxArtifactSize {
+			return c
+		}
+	}
+	return s.classes[len(s.classes)-1]
+}
+
+// classByName returns the named class, falling back to the last (unbounded) one
+func (s *Server) classByName(name string) *SizeClass {
+	return findClass(s.classes, name)
+}
+
+func findClass(classes []*SizeClass, name string) *SizeClass {
+	for _, c := range classes {
+		if c.Name == name {
+			return c
+		}
+	}
+	return classes[len(classes)-1]
+}
+
+// storageFor returns the storage an artifact lives in according to the index,
+// or the default storage if the artifact isn't indexed
+func (s *Server) storageFor(hash string) Storage {
+	if m, ok := s.index.Get(hash); ok {
+		return s.classByName(m.Class).Storage
+	}
+	return s.classByName(defaultClass).Storage
+}
+
+// classLabel names a class in log messages
+func classLabel(class string) string {
+	if class == defaultClass {
+		return "default storage"
+	}
+	return class + " storage"
+}
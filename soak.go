@@ -0,0 +1,501 @@
+package cachesrv
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	mathrand "math/rand/v2"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// "go-turbo-cachesrv soak" runs a mixed workload against a server and checks
+// every response against what it uploaded. Operations on one artifact are
+// serialized, so the expected contents are known:
+//
+//   - a download must return the last upload, byte for byte, or 404 if the
+//     server may have evicted it (-durable makes that a failure too)
+//   - a download after a delete must be 404
+//   - HEAD must agree with the last upload's size
+//
+// An upload or delete that failed with a server error or timeout may or may
+// not have happened, so until a download settles it either outcome passes.
+//
+// Artifacts are spread over teams, and a delete purges a whole team through
+// the admin API. Run the server with a TURBO_CACHE_MAX_SIZE below the working
+// set (-artifacts times the average size) to exercise eviction as well.
+
+const soakUsage = `Usage: go-turbo-cachesrv soak [flags]
+
+Runs uploads, downloads, existence checks and deletes against a server,
+verifying every response, and exits non-zero if any check failed.
+
+`
+
+// soakConfig are the command line flags of the soak tool
+type soakConfig struct {
+	url        string
+	token      string
+	adminToken string
+	duration   time.Duration
+	workers    int
+	artifacts  int
+	teams      int
+	minSize    int64
+	maxSize    int64
+	mix        map[string]int
+	interval   time.Duration
+	durable    bool
+}
+
+// soakOps are the operations of the workload, in the order they are reported
+var soakOps = []string{"upload", "download", "exists", "delete"}
+
+func parseSoakFlags(args []string) (*soakConfig, error) {
+	cfg := &soakConfig{minSize: 1 << 10, maxSize: 4 << 20}
+	fs := flag.NewFlagSet("soak", flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprint(fs.Output(), soakUsage)
+		fs.PrintDefaults()
+	}
+	fs.StringVar(&cfg.url, "url", "http://localhost:8080", "server URL")
+	fs.StringVar(&cfg.token, "token", getenv("TURBO_TOKEN"), "cache token (default $TURBO_TOKEN)")
+	fs.StringVar(&cfg.adminToken, "admin-token", getenv("TURBO_ADMIN_TOKEN"), "admin token for deletes; none disables them (default $TURBO_ADMIN_TOKEN)")
+	fs.DurationVar(&cfg.duration, "duration", time.Hour, "how long to run")
+	fs.IntVar(&cfg.workers, "workers", 16, "concurrent requests")
+	fs.IntVar(&cfg.artifacts, "artifacts", 1000, "artifacts in the working set")
+	fs.IntVar(&cfg.teams, "teams", 8, "teams the artifacts are spread over")
+	fs.Func("min-size", "smallest artifact (default 1KB)", func(v string) (err error) {
+		cfg.minSize, err = parseSize(v)
+		return err
+	})
+	fs.Func("max-size", "largest artifact (default 4MB)", func(v string) (err error) {
+		cfg.maxSize, err = parseSize(v)
+		return err
+	})
+	mix := fs.String("mix", "upload=3,download=10,exists=2,delete=1", "relative weight of each operation")
+	fs.DurationVar(&cfg.interval, "interval", 30*time.Second, "how often to print progress")
+	fs.BoolVar(&cfg.durable, "durable", false, "fail on artifacts missing without a delete, for servers that don't evict")
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+
+	if cfg.token == "" {
+		return nil, fmt.Errorf("a token is required (-token or TURBO_TOKEN)")
+	}
+	if cfg.workers < 1 || cfg.artifacts < 1 || cfg.teams < 1 || cfg.teams > cfg.artifacts {
+		return nil, fmt.Errorf("workers and artifacts must be positive, teams between 1 and artifacts")
+	}
+	if cfg.minSize < 1 || cfg.maxSize < cfg.minSize {
+		return nil, fmt.Errorf("sizes must be positive and min-size at most max-size")
+	}
+	cfg.mix = make(map[string]int)
+	total := 0
+	for _, entry := range parseTags(*mix) {
+		op, weight, _ := strings.Cut(entry, "=")
+		var n int
+		if _, err := fmt.Sscan(weight, &n); err != nil || n < 0 || !contains(soakOps, op) {
+			return nil, fmt.Errorf("invalid -mix entry %q (expected op=weight with op one of %s)", entry, strings.Join(soakOps, ", "))
+		}
+		cfg.mix[op] = n
+		total += n
+	}
+	if cfg.adminToken == "" {
+		total -= cfg.mix["delete"]
+		delete(cfg.mix, "delete")
+	}
+	if total == 0 {
+		return nil, fmt.Errorf("-mix has no operations to run")
+	}
+	return cfg, nil
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// soakArtifact is what the server may serve for a hash. Its lock serializes
+// the operations on it.
+type soakArtifact struct {
+	mu   sync.Mutex
+	hash string
+	team int
+	// generation counts the uploads; the contents are derived from the hash
+	// and generation
+	generation uint64
+	// valid are the contents a download may return: the last upload, or
+	// after an upload or delete whose outcome is unknown, any of the
+	// candidates. Empty means nothing may be served.
+	valid []soakContents
+	// certain is set when exactly the last upload must be there, unless the
+	// server evicted it
+	certain bool
+}
+
+// soakContents identifies the contents of a generation
+type soakContents struct {
+	generation uint64
+	size       int64
+	sum        [32]byte
+}
+
+func (a *soakArtifact) match(sum [32]byte) (soakContents, bool) {
+	for _, c := range a.valid {
+		if c.sum == sum {
+			return c, true
+		}
+	}
+	return soakContents{}, false
+}
+
+// soakStats counts the operations of one kind
+type soakStats struct {
+	ops     atomic.Int64
+	errors  atomic.Int64
+	bytes   atomic.Int64
+	latency atomic.Int64 // nanoseconds, summed
+}
+
+type soakRun struct {
+	cfg       *soakConfig
+	client    *http.Client
+	logger    *log.Logger
+	artifacts []*soakArtifact
+	// teams locks the artifacts of a team, exclusively for a delete
+	teams    []sync.RWMutex
+	teamName []string
+	stats    map[string]*soakStats
+	failures atomic.Int64
+	missing  atomic.Int64
+}
+
+// runSoak is the soak subcommand; it returns the exit status
+func runSoak(args []string) int {
+	cfg, err := parseSoakFlags(args)
+	if err == flag.ErrHelp {
+		return 0
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+
+	var id [4]byte
+	rand.Read(id[:])
+	runID := hex.EncodeToString(id[:])
+	run := &soakRun{
+		cfg:    cfg,
+		client: &http.Client{Timeout: 5 * time.Minute},
+		logger: log.New(os.Stdout, "", log.LstdFlags),
+		teams:  make([]sync.RWMutex, cfg.teams),
+		stats:  make(map[string]*soakStats),
+	}
+	for i := 0; i < cfg.teams; i++ {
+		run.teamName = append(run.teamName, fmt.Sprintf("soak-%s-%d", runID, i))
+	}
+	for i := 0; i < cfg.artifacts; i++ {
+		run.artifacts = append(run.artifacts, &soakArtifact{hash: fmt.Sprintf("soak%s%08d", runID, i), team: i % cfg.teams})
+	}
+	for _, op := range soakOps {
+		run.stats[op] = &soakStats{}
+	}
+
+	run.logger.Printf("Soak run %s against %s: %d workers, %d artifacts of %d-%d bytes in %d teams, for %v",
+		runID, cfg.url, cfg.workers, cfg.artifacts, cfg.minSize, cfg.maxSize, cfg.teams, cfg.duration)
+
+	stop := make(chan struct{})
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		select {
+		case <-signals:
+			run.logger.Printf("Interrupted, finishing in-flight requests")
+		case <-time.After(cfg.duration):
+		}
+		close(stop)
+	}()
+
+	var wg sync.WaitGroup
+	for i := 0; i < cfg.workers; i++ {
+		wg.Add(1)
+		go func(seed uint64) {
+			defer wg.Done()
+			run.work(mathrand.New(mathrand.NewPCG(seed, uint64(time.Now().UnixNano()))), stop)
+		}(uint64(i))
+	}
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	start := time.Now()
+	ticker := time.NewTicker(cfg.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			run.report(time.Since(start))
+			continue
+		case <-done:
+		}
+		break
+	}
+	run.report(time.Since(start))
+	if n := run.failures.Load(); n > 0 {
+		run.logger.Printf("FAILED: %d integrity checks failed", n)
+		return 1
+	}
+	run.logger.Printf("PASSED: no integrity failures, %d artifacts were missing without a delete", run.missing.Load())
+	return 0
+}
+
+// work runs random operations until stop is closed
+func (run *soakRun) work(rng *mathrand.Rand, stop <-chan struct{}) {
+	total := 0
+	for _, w := range run.cfg.mix {
+		total += w
+	}
+	for {
+		select {
+		case <-stop:
+			return
+		default:
+		}
+		pick := rng.IntN(total)
+		var op string
+		for _, candidate := range soakOps {
+			if pick < run.cfg.mix[candidate] {
+				op = candidate
+				break
+			}
+			pick -= run.cfg.mix[candidate]
+		}
+
+		start := time.Now()
+		var n int64
+		var err error
+		if op == "delete" {
+			n, err = run.deleteTeam(rng.IntN(run.cfg.teams))
+		} else {
+			a := run.artifacts[rng.IntN(len(run.artifacts))]
+			run.teams[a.team].RLock()
+			a.mu.Lock()
+			switch op {
+			case "upload":
+				n, err = run.upload(a, run.size(rng))
+			case "download":
+				n, err = run.download(a)
+			case "exists":
+				err = run.exists(a)
+			}
+			a.mu.Unlock()
+			run.teams[a.team].RUnlock()
+		}
+		stats := run.stats[op]
+		stats.ops.Add(1)
+		stats.bytes.Add(n)
+		stats.latency.Add(int64(time.Since(start)))
+		if err != nil {
+			stats.errors.Add(1)
+			run.logger.Printf("%s failed: %v", op, err)
+		}
+	}
+}
+
+// size picks an artifact size, log-uniform so small artifacts dominate as
+// they do in real caches
+func (run *soakRun) size(rng *mathrand.Rand) int64 {
+	lo, hi := math.Log(float64(run.cfg.minSize)), math.Log(float64(run.cfg.maxSize))
+	return int64(math.Exp(lo + rng.Float64()*(hi-lo)))
+}
+
+// soakContent generates the contents of a generation of an artifact
+func soakContent(hash string, generation uint64, size int64) io.Reader {
+	seed := sha256.Sum256([]byte(fmt.Sprintf("%s/%d", hash, generation)))
+	return io.LimitReader(mathrand.NewChaCha8(seed), size)
+}
+
+func (run *soakRun) fail(format string, args ...any) {
+	run.failures.Add(1)
+	run.logger.Printf("INTEGRITY: "+format, args...)
+}
+
+func (run *soakRun) request(method string, a *soakArtifact, body io.Reader, size int64) (*http.Response, error) {
+	u := run.cfg.url + "/v8/artifacts/" + a.hash + "?teamId=" + url.QueryEscape(run.teamName[a.team])
+	req, err := http.NewRequest(method, u, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+run.cfg.token)
+	req.Header.Set("User-Agent", "go-turbo-cachesrv-soak")
+	if body != nil {
+		req.ContentLength = size
+		req.Header.Set("Content-Type", "application/octet-stream")
+	}
+	return run.client.Do(req)
+}
+
+func (run *soakRun) upload(a *soakArtifact, size int64) (int64, error) {
+	generation := a.generation + 1
+	contents := soakContents{generation: generation, size: size}
+	digest := sha256.New()
+	io.Copy(digest, soakContent(a.hash, generation, size))
+	copy(contents.sum[:], digest.Sum(nil))
+	a.generation = generation
+
+	resp, err := run.request(http.MethodPut, a, soakContent(a.hash, generation, size), size)
+	if err != nil {
+		// The server may or may not have stored it
+		a.valid, a.certain = append(a.valid, contents), false
+		return 0, err
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	switch {
+	case resp.StatusCode == http.StatusOK || resp.StatusCode == http.StatusAccepted:
+		a.valid, a.certain = []soakContents{contents}, true
+		return size, nil
+	case resp.StatusCode >= 500 && resp.StatusCode != http.StatusInsufficientStorage || resp.StatusCode == http.StatusRequestTimeout:
+		a.valid, a.certain = append(a.valid, contents), false
+		return 0, fmt.Errorf("upload of %s: %s", a.hash, resp.Status)
+	default:
+		// Rejected before anything was stored, e.g. over quota or budget
+		return 0, fmt.Errorf("upload of %s: %s", a.hash, resp.Status)
+	}
+}
+
+// missed counts a 404 for an artifact that should be there
+func (run *soakRun) missed(a *soakArtifact) {
+	if !a.certain {
+		return
+	}
+	run.missing.Add(1)
+	if run.cfg.durable {
+		run.fail("%s generation %d is missing", a.hash, a.generation)
+	}
+}
+
+func (run *soakRun) download(a *soakArtifact) (int64, error) {
+	resp, err := run.request(http.MethodGet, a, nil, 0)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusNotFound:
+		run.missed(a)
+		return 0, nil
+	case http.StatusOK:
+	default:
+		return 0, fmt.Errorf("download of %s: %s", a.hash, resp.Status)
+	}
+
+	digest := sha256.New()
+	n, err := io.Copy(digest, resp.Body)
+	if err != nil {
+		return n, fmt.Errorf("download of %s: %w", a.hash, err)
+	}
+	var sum [32]byte
+	copy(sum[:], digest.Sum(nil))
+	contents, ok := a.match(sum)
+	switch {
+	case len(a.valid) == 0:
+		run.fail("%s is served (%d bytes) but was deleted or never uploaded", a.hash, n)
+	case resp.ContentLength >= 0 && resp.ContentLength != n:
+		run.fail("%s: Content-Length %d but %d bytes received", a.hash, resp.ContentLength, n)
+	case !ok:
+		run.fail("%s: %d bytes received match no upload, expected generation %d", a.hash, n, a.generation)
+	default:
+		// An upload or delete with an unknown outcome has been settled
+		a.valid, a.certain = []soakContents{contents}, true
+	}
+	return n, nil
+}
+
+func (run *soakRun) exists(a *soakArtifact) error {
+	resp, err := run.request(http.MethodHead, a, nil, 0)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusNotFound:
+		run.missed(a)
+	case http.StatusOK:
+		if len(a.valid) == 0 {
+			run.fail("%s exists but was deleted or never uploaded", a.hash)
+		} else if a.certain && resp.ContentLength >= 0 && resp.ContentLength != a.valid[0].size {
+			run.fail("%s: HEAD reports %d bytes, generation %d has %d", a.hash, resp.ContentLength, a.generation, a.valid[0].size)
+		}
+	default:
+		return fmt.Errorf("exists of %s: %s", a.hash, resp.Status)
+	}
+	return nil
+}
+
+// deleteTeam purges every artifact of a team through the admin API
+func (run *soakRun) deleteTeam(team int) (int64, error) {
+	run.teams[team].Lock()
+	defer run.teams[team].Unlock()
+
+	req, err := http.NewRequest(http.MethodDelete, run.cfg.url+"/admin/artifacts?team="+url.QueryEscape(run.teamName[team]), nil)
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Authorization", "Bearer "+run.cfg.adminToken)
+	resp, err := run.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	var report PurgeReport
+	err = decodeJSONResponse(resp, &report)
+	for _, a := range run.artifacts {
+		if a.team != team {
+			continue
+		}
+		// If the delete failed it may still have removed some artifacts
+		if err == nil {
+			a.valid = nil
+		}
+		a.certain = false
+	}
+	if err != nil {
+		return 0, fmt.Errorf("delete of team %s: %w", run.teamName[team], err)
+	}
+	return report.Bytes, nil
+}
+
+func (run *soakRun) report(elapsed time.Duration) {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "After %v:", elapsed.Round(time.Second))
+	for _, op := range soakOps {
+		s := run.stats[op]
+		n := s.ops.Load()
+		if n == 0 {
+			continue
+		}
+		fmt.Fprintf(&b, " %s %d (%d errors, %.1f MB, %v avg)", op, n, s.errors.Load(),
+			float64(s.bytes.Load())/(1<<20), (time.Duration(s.latency.Load()) / time.Duration(n)).Round(time.Microsecond))
+	}
+	fmt.Fprintf(&b, ", %d missing, %d integrity failures", run.missing.Load(), run.failures.Load())
+	run.logger.Print(b.String())
+}
@@ -0,0 +1,149 @@
+package cachesrv
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/bitechdev/go-turbo-cachesrv/storage"
+)
+
+var errUploadInvalid = errors.New("artifact failed validation")
+
+var (
+	gzipMagic = []byte{0x1f, 0x8b}
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+)
+
+// UploadSpool buffers uploads in a temp area and validates them before they
+// are promoted into storage, so a truncated or corrupt upload never replaces
+// a good artifact. Streaming straight to storage is faster; spooling is safer.
+type UploadSpool struct {
+	dir string
+}
+
+func NewUploadSpool(dir string) (*UploadSpool, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create spool directory: %w", err)
+	}
+	return &UploadSpool{dir: dir}, nil
+}
+
+// Spool copies an upload to a temp file and validates its size, the
+// checksums sent in Content-MD5 or X-Checksum-Sha256 and the archive
+// structure. The returned file is rewound; the caller closes and removes it.
+func (sp *UploadSpool) Spool(body io.Reader, r *http.Request, size int64) (*os.File, error) {
+	file, err := os.CreateTemp(sp.dir, ".upload-*")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create spool file: %w", err)
+	}
+	ok := false
+	defer func() {
+		if !ok {
+			file.Close()
+			os.Remove(file.Name())
+		}
+	}()
+
+	md5sum, sha := md5.New(), sha256.New()
+	n, err := io.Copy(io.MultiWriter(file, md5sum, sha), body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to spool upload: %w", err)
+	}
+	if n != size {
+		return nil, fmt.Errorf("%w: received %d bytes, expected %d", errUploadInvalid, n, size)
+	}
+	if err := checkDigest(r.Header.Get("Content-MD5"), md5sum, base64.StdEncoding.EncodeToString); err != nil {
+		return nil, err
+	}
+	if err := checkDigest(strings.ToLower(r.Header.Get("X-Checksum-Sha256")), sha, hex.EncodeToString); err != nil {
+		return nil, err
+	}
+
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return nil, fmt.Errorf("failed to rewind spool file: %w", err)
+	}
+	if err := checkArchive(file); err != nil {
+		return nil, err
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return nil, fmt.Errorf("failed to rewind spool file: %w", err)
+	}
+
+	ok = true
+	return file, nil
+}
+
+// Discard closes and removes a spool file
+func (sp *UploadSpool) Discard(file *os.File) {
+	file.Close()
+	os.Remove(file.Name())
+}
+
+func checkDigest(expected string, h hash.Hash, encode func([]byte) string) error {
+	if expected == "" {
+		return nil
+	}
+	if actual := encode(h.Sum(nil)); actual != expected {
+		return fmt.Errorf("%w: checksum mismatch", errUploadInvalid)
+	}
+	return nil
+}
+
+// checkArchive reads a gzipped tarball (turbo's artifact format) through to
+// the gzip checksum. Zstd artifacts are only recognized, not decompressed.
+func checkArchive(r io.Reader) error {
+	magic := make([]byte, 4)
+	n, _ := io.ReadFull(r, magic)
+	magic = magic[:n]
+	r = io.MultiReader(bytes.NewReader(magic), r)
+
+	switch {
+	case bytes.HasPrefix(magic, zstdMagic):
+		return nil
+	case !bytes.HasPrefix(magic, gzipMagic):
+		return fmt.Errorf("%w: not a gzip or zstd archive", errUploadInvalid)
+	}
+
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return fmt.Errorf("%w: %v", errUploadInvalid, err)
+	}
+	tr := tar.NewReader(gz)
+	for {
+		_, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("%w: broken tar archive: %v", errUploadInvalid, err)
+		}
+	}
+	// Reading the rest verifies the gzip trailer
+	if _, err := io.Copy(io.Discard, gz); err != nil {
+		return fmt.Errorf("%w: broken gzip stream: %v", errUploadInvalid, err)
+	}
+	return nil
+}
+
+// promote moves a validated spool file into storage, renaming or copying it
+// into place when the storage is a local directory
+func promote(target Storage, hash string, file *os.File) error {
+	if fs, ok := unwrapStorage(target).(*storage.FileSystem); ok {
+		if err := fs.Promote(hash, file.Name()); err == nil {
+			return nil
+		}
+	}
+	return target.Store(hash, file)
+}
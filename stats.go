@@ -0,0 +1,82 @@
+package cachesrv
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// taskTagPrefix marks an upload tag naming the task, e.g. "task:web#build",
+// for clients that don't upload run summaries
+const taskTagPrefix = "task:"
+
+const unknownTask = "(unknown)"
+
+// TaskStats is the cache behaviour of one task across all its hashes
+type TaskStats struct {
+	TaskID         string  `json:"taskId"`
+	Package        string  `json:"package,omitempty"`
+	Task           string  `json:"task,omitempty"`
+	Hits           int64   `json:"hits"`
+	Misses         int64   `json:"misses"`
+	HitRate        float64 `json:"hitRate"`
+	DistinctHashes int     `json:"distinctHashes"`
+	TimeSavedMs    float64 `json:"timeSavedMs"`
+}
+
+// taskOf resolves the task behind a hash from run summaries, then from the
+// tags of the artifact stored under key
+func (s *Server) taskOf(hash, key string) TaskRef {
+	if ref, ok := s.runs.TaskOf(hash); ok {
+		return ref
+	}
+	if m, ok := s.index.Get(key); ok {
+		for _, tag := range m.Tags {
+			if id, ok := strings.CutPrefix(tag, taskTagPrefix); ok {
+				pkg, task, _ := strings.Cut(id, "#")
+				return TaskRef{TaskID: id, Package: pkg, Task: task}
+			}
+		}
+	}
+	return TaskRef{TaskID: unknownTask}
+}
+
+// Handler for /v8/stats/tasks
+func (s *Server) getTaskStats(w http.ResponseWriter, r *http.Request) {
+	byTask := make(map[string]*TaskStats)
+	for hash, c := range s.events.Snapshot(teamOf(r)) {
+		key, err := s.namespaced(hash, r)
+		if err != nil {
+			key = hash
+		}
+		ref := s.taskOf(hash, key)
+		stats, ok := byTask[ref.TaskID]
+		if !ok {
+			stats = &TaskStats{TaskID: ref.TaskID, Package: ref.Package, Task: ref.Task}
+			byTask[ref.TaskID] = stats
+		}
+		stats.Hits += c.Hits
+		stats.Misses += c.Misses
+		stats.TimeSavedMs += c.TimeSavedMs
+		stats.DistinctHashes++
+	}
+
+	result := make([]TaskStats, 0, len(byTask))
+	for _, stats := range byTask {
+		if total := stats.Hits + stats.Misses; total > 0 {
+			stats.HitRate = float64(stats.Hits) / float64(total)
+		}
+		result = append(result, *stats)
+	}
+	// Worst first: tasks that almost never hit usually have unstable inputs
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].HitRate != result[j].HitRate {
+			return result[i].HitRate < result[j].HitRate
+		}
+		return result[i].Hits+result[i].Misses > result[j].Hits+result[j].Misses
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
@@ -0,0 +1,319 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+)
+
+// FileSystem implements artifact storage using the local filesystem
+type FileSystem struct {
+	basePath string
+	// tmpfile writes through O_TMPFILE where the filesystem supports it
+	tmpfile atomic.Bool
+	// mmapMinSize is the size from which reads are served from a memory
+	// mapping, 0 to always read through the file
+	mmapMinSize int64
+	layout      Layout
+
+	mu sync.RWMutex
+	// locations maps hashes to their files for layouts that aren't Fixed
+	locations map[string]string
+	// pending holds what Describe recorded until the artifact is stored, in
+	// order, as uploads of the same hash can overlap
+	pending map[string][]ArtifactDetails
+}
+
+var (
+	errTmpfileUnsupported = errors.New("O_TMPFILE not supported")
+	errReflinkUnsupported = errors.New("reflinks not supported")
+)
+
+func NewFileSystem(basePath string) (*FileSystem, error) {
+	// Create base directory if it doesn't exist
+	if err := os.MkdirAll(basePath, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create storage directory: %w", err)
+	}
+	return &FileSystem{basePath: basePath, layout: flatLayout{}}, nil
+}
+
+// BasePath returns the storage directory
+func (fs *FileSystem) BasePath() string {
+	return fs.basePath
+}
+
+// UseTmpfile enables O_TMPFILE writes, falling back to plain files on
+// platforms and filesystems without them
+func (fs *FileSystem) UseTmpfile(enabled bool) {
+	fs.tmpfile.Store(enabled)
+}
+
+// UseMmap serves artifacts of at least minSize bytes from memory mappings,
+// saving read syscalls and a copy per chunk; 0 disables it
+func (fs *FileSystem) UseMmap(minSize int64) {
+	fs.mmapMinSize = minSize
+}
+
+func (fs *FileSystem) Store(hash string, data io.Reader) error {
+	file, info, err := fs.place(hash)
+	if err != nil {
+		return err
+	}
+	if err := fs.store(file, data); err != nil {
+		return err
+	}
+	fs.placed(hash, file)
+	return fs.seal(file, info)
+}
+
+func (fs *FileSystem) store(name string, data io.Reader) error {
+	if fs.tmpfile.Load() {
+		err := storeTmpfile(fs.basePath, name, data)
+		if !errors.Is(err, errTmpfileUnsupported) {
+			return err
+		}
+		fs.tmpfile.Store(false)
+	}
+
+	// Write to a temp file and rename it into place once complete, so a
+	// crash mid-upload never leaves a truncated artifact and readers see
+	// either the previous contents or the new ones. Renaming over the old
+	// name also leaves hard links such as backup pins with the previous
+	// contents. Concurrent uploads of a hash each write their own file and
+	// the last rename wins.
+	out, err := os.CreateTemp(fs.basePath, "."+filepath.Base(name)+"-*")
+	if err != nil {
+		return fmt.Errorf("failed to create file: %w", err)
+	}
+	defer os.Remove(out.Name())
+
+	// CreateTemp makes the file private; artifacts are readable like any
+	// file os.Create would have made
+	if err := out.Chmod(0644); err != nil {
+		out.Close()
+		return fmt.Errorf("failed to create file: %w", err)
+	}
+	if _, err := io.Copy(out, data); err != nil {
+		out.Close()
+		return fmt.Errorf("failed to write file: %w", err)
+	}
+	// Without a sync the rename can reach the disk before the data does
+	if err := out.Sync(); err != nil {
+		out.Close()
+		return fmt.Errorf("failed to sync file: %w", err)
+	}
+	if err := out.Close(); err != nil {
+		return fmt.Errorf("failed to write file: %w", err)
+	}
+	if err := os.Rename(out.Name(), filepath.Join(fs.basePath, name)); err != nil {
+		return fmt.Errorf("failed to rename file: %w", err)
+	}
+	return nil
+}
+
+func (fs *FileSystem) Get(hash string) (io.ReadCloser, int64, error) {
+	path, ok := fs.path(hash)
+	if !ok {
+		return nil, 0, ErrArtifactNotFound
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			// Removed behind our back, say with its partition
+			fs.forget(hash)
+			return nil, 0, ErrArtifactNotFound
+		}
+		return nil, 0, fmt.Errorf("failed to open file: %w", err)
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, 0, fmt.Errorf("failed to get file info: %w", err)
+	}
+
+	if fs.mmapMinSize > 0 && info.Size() >= fs.mmapMinSize {
+		// The mapping stays valid after the file is closed
+		if mapped, err := mmapFile(file, info.Size()); err == nil {
+			file.Close()
+			return mapped, info.Size(), nil
+		}
+	}
+	return file, info.Size(), nil
+}
+
+func (fs *FileSystem) Exists(hash string) (bool, error) {
+	path, ok := fs.path(hash)
+	if !ok {
+		return false, nil
+	}
+	_, err := os.Stat(path)
+	if err == nil {
+		return true, nil
+	}
+	if os.IsNotExist(err) {
+		fs.forget(hash)
+		return false, nil
+	}
+	return false, err
+}
+
+func (fs *FileSystem) Delete(hash string) error {
+	path, ok := fs.path(hash)
+	if !ok {
+		return nil
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to delete file: %w", err)
+	}
+	fs.forget(hash)
+	return nil
+}
+
+// Clone copies an artifact to a new hash, sharing the data blocks through a
+// reflink where the filesystem supports it
+func (fs *FileSystem) Clone(src, dst string) error {
+	path, ok := fs.path(src)
+	if !ok {
+		return ErrArtifactNotFound
+	}
+	in, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return ErrArtifactNotFound
+		}
+		return fmt.Errorf("failed to open file: %w", err)
+	}
+	defer in.Close()
+
+	out, err := os.CreateTemp(fs.basePath, "."+dst+"-*")
+	if err != nil {
+		return fmt.Errorf("failed to create file: %w", err)
+	}
+	defer os.Remove(out.Name())
+
+	if err := reflink(out, in); err != nil {
+		if _, err := io.Copy(out, in); err != nil {
+			out.Close()
+			return fmt.Errorf("failed to copy file: %w", err)
+		}
+	}
+	if err := out.Sync(); err != nil {
+		out.Close()
+		return fmt.Errorf("failed to sync file: %w", err)
+	}
+	if err := out.Close(); err != nil {
+		return fmt.Errorf("failed to copy file: %w", err)
+	}
+	file, _, err := fs.place(dst)
+	if err != nil {
+		return err
+	}
+	if err := os.Rename(out.Name(), filepath.Join(fs.basePath, file)); err != nil {
+		return fmt.Errorf("failed to rename file: %w", err)
+	}
+	fs.placed(dst, file)
+	return nil
+}
+
+// Promote moves a complete file into place as an artifact. A file on another
+// filesystem, such as a spool on a faster volume, is copied next to the
+// artifact first and then renamed, so readers never see a partial file.
+func (fs *FileSystem) Promote(hash, path string) error {
+	file, info, err := fs.place(hash)
+	if err != nil {
+		return err
+	}
+	err = os.Rename(path, filepath.Join(fs.basePath, file))
+	if errors.Is(err, syscall.EXDEV) {
+		err = fs.copyIn(hash, file, path)
+	} else if err != nil {
+		err = fmt.Errorf("failed to rename file: %w", err)
+	}
+	if err != nil {
+		return err
+	}
+	fs.placed(hash, file)
+	return fs.seal(file, info)
+}
+
+// seal makes the file of a retained artifact read-only, so other tools
+// writing to the directory can't change it by accident; the server keeps it
+// from being replaced or removed
+func (fs *FileSystem) seal(file string, info ArtifactDetails) error {
+	if info.RetainUntil.IsZero() {
+		return nil
+	}
+	if err := os.Chmod(filepath.Join(fs.basePath, file), 0444); err != nil {
+		return fmt.Errorf("failed to make file read-only: %w", err)
+	}
+	return nil
+}
+
+func (fs *FileSystem) copyIn(hash, file, path string) error {
+	in, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("failed to open file: %w", err)
+	}
+	defer in.Close()
+
+	out, err := os.CreateTemp(fs.basePath, "."+hash+"-*")
+	if err != nil {
+		return fmt.Errorf("failed to create file: %w", err)
+	}
+	defer os.Remove(out.Name())
+
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return fmt.Errorf("failed to copy file: %w", err)
+	}
+	// The spool file is removed once promoted, so the copy must be durable
+	if err := out.Sync(); err != nil {
+		out.Close()
+		return fmt.Errorf("failed to sync file: %w", err)
+	}
+	if err := out.Close(); err != nil {
+		return fmt.Errorf("failed to copy file: %w", err)
+	}
+	if err := os.Rename(out.Name(), filepath.Join(fs.basePath, file)); err != nil {
+		return fmt.Errorf("failed to rename file: %w", err)
+	}
+	return nil
+}
+
+// List returns every stored artifact, skipping hidden files used for server state
+func (fs *FileSystem) List() ([]ArtifactStat, error) {
+	if _, flat := fs.layout.(flatLayout); !flat {
+		return fs.listTree()
+	}
+	entries, err := os.ReadDir(fs.basePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read storage directory: %w", err)
+	}
+
+	artifacts := make([]ArtifactStat, 0, len(entries))
+	for _, entry := range entries {
+		if entry.IsDir() || strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return nil, fmt.Errorf("failed to get file info: %w", err)
+		}
+		artifacts = append(artifacts, ArtifactStat{
+			Hash:    entry.Name(),
+			Size:    info.Size(),
+			ModTime: info.ModTime(),
+		})
+	}
+	return artifacts, nil
+}
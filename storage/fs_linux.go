@@ -0,0 +1,61 @@
+//go:build linux
+
+package storage
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"golang.org/x/sys/unix"
+)
+
+// storeTmpfile writes an artifact into an anonymous O_TMPFILE inode and only
+// links it into the directory once complete, so readers never see a partial
+// file and a crash leaves nothing behind to clean up
+func storeTmpfile(dir, name string, data io.Reader) error {
+	file, err := os.OpenFile(dir, unix.O_TMPFILE|os.O_WRONLY, 0644)
+	if err != nil {
+		if errors.Is(err, unix.EOPNOTSUPP) || errors.Is(err, unix.EISDIR) || errors.Is(err, unix.EINVAL) {
+			return errTmpfileUnsupported
+		}
+		return fmt.Errorf("failed to create file: %w", err)
+	}
+	defer file.Close()
+
+	if _, err := io.Copy(file, data); err != nil {
+		return fmt.Errorf("failed to write file: %w", err)
+	}
+	if err := file.Sync(); err != nil {
+		return fmt.Errorf("failed to sync file: %w", err)
+	}
+
+	// linkat can't replace an existing name, so link under a temp name and rename over
+	var random [8]byte
+	if _, err := rand.Read(random[:]); err != nil {
+		return fmt.Errorf("failed to generate temp name: %w", err)
+	}
+	suffix := hex.EncodeToString(random[:])
+	tmp := filepath.Join(dir, "."+filepath.Base(name)+"-"+suffix)
+	procPath := fmt.Sprintf("/proc/self/fd/%d", file.Fd())
+	if err := unix.Linkat(unix.AT_FDCWD, procPath, unix.AT_FDCWD, tmp, unix.AT_SYMLINK_FOLLOW); err != nil {
+		return fmt.Errorf("failed to link file: %w", err)
+	}
+	if err := os.Rename(tmp, filepath.Join(dir, name)); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("failed to rename file: %w", err)
+	}
+	return nil
+}
+
+// reflink makes dst share src's extents (XFS, btrfs), copying nothing
+func reflink(dst, src *os.File) error {
+	if err := unix.IoctlFileClone(int(dst.Fd()), int(src.Fd())); err != nil {
+		return errReflinkUnsupported
+	}
+	return nil
+}
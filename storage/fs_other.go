@@ -0,0 +1,16 @@
+//go:build !linux
+
+package storage
+
+import (
+	"io"
+	"os"
+)
+
+func storeTmpfile(dir, name string, data io.Reader) error {
+	return errTmpfileUnsupported
+}
+
+func reflink(dst, src *os.File) error {
+	return errReflinkUnsupported
+}
@@ -0,0 +1,319 @@
+package storage
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Layout decides where in a storage directory an artifact file lives, so
+// operators can match the tree to their backup and replication tooling
+type Layout interface {
+	Name() string
+	// Path returns the path of a new artifact relative to the storage
+	// directory
+	Path(hash, team string, now time.Time) string
+	// Fixed reports whether the path depends on the hash alone. Artifacts of
+	// other layouts are found through a location index built at startup.
+	Fixed() bool
+}
+
+// flatLayout keeps every artifact at the top of the directory
+type flatLayout struct{}
+
+func (flatLayout) Name() string                            { return "flat" }
+func (flatLayout) Path(hash, _ string, _ time.Time) string { return hash }
+func (flatLayout) Fixed() bool                             { return true }
+
+// shardedLayout spreads artifacts over 256 directories named after the first
+// two characters of the hash, keeping directories small
+type shardedLayout struct{}
+
+func (shardedLayout) Name() string { return "sharded" }
+func (shardedLayout) Path(hash, _ string, _ time.Time) string {
+	if len(hash) < 2 {
+		return hash
+	}
+	return filepath.Join(hash[:2], hash)
+}
+func (shardedLayout) Fixed() bool { return true }
+
+// nestedLayout shards over two levels, ab/cd/abcd..., for caches of millions
+// of artifacts where 256 directories would still each hold thousands
+type nestedLayout struct{}
+
+func (nestedLayout) Name() string { return "nested" }
+func (nestedLayout) Path(hash, _ string, _ time.Time) string {
+	if len(hash) < 4 {
+		return hash
+	}
+	return filepath.Join(hash[:2], hash[2:4], hash)
+}
+func (nestedLayout) Fixed() bool { return true }
+
+// dateLayout groups artifacts by upload day as YYYY/MM/DD
+type dateLayout struct{}
+
+func (dateLayout) Name() string { return "date" }
+func (dateLayout) Path(hash, _ string, now time.Time) string {
+	return filepath.Join(now.UTC().Format("2006/01/02"), hash)
+}
+func (dateLayout) Fixed() bool { return false }
+
+// teamLayout groups artifacts by the team that uploaded them. Artifacts
+// stored without a known team go under "_".
+type teamLayout struct{}
+
+func (teamLayout) Name() string { return "team" }
+func (teamLayout) Path(hash, team string, _ time.Time) string {
+	return filepath.Join(teamDir(team), hash)
+}
+func (teamLayout) Fixed() bool { return false }
+
+// teamDir turns a team into a safe directory name
+func teamDir(team string) string {
+	if team == "" {
+		return "_"
+	}
+	dir := []byte(team)
+	for i, c := range dir {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_' || c == '.') {
+			dir[i] = '_'
+		}
+	}
+	if dir[0] == '.' {
+		dir[0] = '_'
+	}
+	return string(dir)
+}
+
+func ParseLayout(name string) (Layout, error) {
+	for _, layout := range []Layout{flatLayout{}, shardedLayout{}, nestedLayout{}, dateLayout{}, teamLayout{}} {
+		if layout.Name() == name {
+			return layout, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown layout %q (expected flat, sharded, nested, date or team)", name)
+}
+
+// layoutFile records the layout of a storage directory, so a change of
+// layout moves the existing artifacts
+const layoutFile = ".layout"
+
+// SetLayout switches the directory to a layout, first moving artifacts
+// stored under a previous one. Moved artifacts keep their modification
+// time, which the date layout files them by; the team layout can't know
+// their team and puts them under "_". The new layout is only recorded once
+// every file has moved, so a move interrupted by a crash or restart picks
+// up where it stopped.
+func (fs *FileSystem) SetLayout(layout Layout) error {
+	previous := "flat"
+	if data, err := os.ReadFile(filepath.Join(fs.basePath, layoutFile)); err == nil {
+		previous = strings.TrimSpace(string(data))
+	} else if !os.IsNotExist(err) {
+		return fmt.Errorf("failed to read storage layout: %w", err)
+	}
+
+	var files map[string]string
+	if previous != layout.Name() || !layout.Fixed() {
+		var err error
+		if files, err = fs.walk(); err != nil {
+			return err
+		}
+	}
+	if previous != layout.Name() {
+		for hash, file := range files {
+			info, err := os.Stat(filepath.Join(fs.basePath, file))
+			if err != nil {
+				continue
+			}
+			target := layout.Path(hash, "", info.ModTime())
+			if target == file {
+				continue
+			}
+			if err := fs.move(file, target); err != nil {
+				return err
+			}
+			files[hash] = target
+		}
+		fs.removeEmptyDirs()
+		if err := os.WriteFile(filepath.Join(fs.basePath, layoutFile), []byte(layout.Name()+"\n"), 0644); err != nil {
+			return fmt.Errorf("failed to record storage layout: %w", err)
+		}
+	}
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fs.layout = layout
+	fs.locations = nil
+	if !layout.Fixed() {
+		fs.locations = files
+	}
+	return nil
+}
+
+// Describe records the team of an artifact about to be stored and whether it
+// is retained
+func (fs *FileSystem) Describe(hash string, info ArtifactDetails) {
+	if fs.layout.Fixed() && info.RetainUntil.IsZero() {
+		return
+	}
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if fs.pending == nil {
+		fs.pending = make(map[string][]ArtifactDetails)
+	}
+	fs.pending[hash] = append(fs.pending[hash], info)
+}
+
+// path returns where an existing artifact is, and false if it isn't stored
+func (fs *FileSystem) path(hash string) (string, bool) {
+	if fs.layout.Fixed() {
+		return filepath.Join(fs.basePath, fs.layout.Path(hash, "", time.Time{})), true
+	}
+	fs.mu.RLock()
+	defer fs.mu.RUnlock()
+	file, ok := fs.locations[hash]
+	if !ok {
+		return "", false
+	}
+	return filepath.Join(fs.basePath, file), true
+}
+
+// place picks the relative path for a new copy of an artifact, using the
+// team recorded by Describe, and creates its directory. It also returns the
+// rest of what Describe recorded.
+func (fs *FileSystem) place(hash string) (string, ArtifactDetails, error) {
+	fs.mu.Lock()
+	var info ArtifactDetails
+	if queued := fs.pending[hash]; len(queued) > 0 {
+		info = queued[0]
+		if len(queued) == 1 {
+			delete(fs.pending, hash)
+		} else {
+			fs.pending[hash] = queued[1:]
+		}
+	}
+	fs.mu.Unlock()
+
+	file := fs.layout.Path(hash, info.Team, time.Now())
+	if dir := filepath.Dir(file); dir != "." {
+		if err := os.MkdirAll(filepath.Join(fs.basePath, dir), 0755); err != nil {
+			return "", info, fmt.Errorf("failed to create directory: %w", err)
+		}
+	}
+	return file, info, nil
+}
+
+// placed records that an artifact now lives at file, removing a previous copy
+// stored elsewhere
+func (fs *FileSystem) placed(hash, file string) {
+	if fs.layout.Fixed() {
+		return
+	}
+	fs.mu.Lock()
+	previous, ok := fs.locations[hash]
+	fs.locations[hash] = file
+	fs.mu.Unlock()
+	if ok && previous != file {
+		os.Remove(filepath.Join(fs.basePath, previous))
+	}
+}
+
+// forget drops an artifact from the location index
+func (fs *FileSystem) forget(hash string) {
+	if fs.layout.Fixed() {
+		return
+	}
+	fs.mu.Lock()
+	delete(fs.locations, hash)
+	fs.mu.Unlock()
+}
+
+// walk finds every artifact file in the directory tree, skipping hidden
+// files and directories used for server state
+func (fs *FileSystem) walk() (map[string]string, error) {
+	files := make(map[string]string)
+	err := filepath.WalkDir(fs.basePath, func(path string, entry os.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if path == fs.basePath {
+			return nil
+		}
+		if strings.HasPrefix(entry.Name(), ".") {
+			if entry.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if entry.IsDir() {
+			return nil
+		}
+		rel, err := filepath.Rel(fs.basePath, path)
+		if err != nil {
+			return err
+		}
+		files[entry.Name()] = rel
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read storage directory: %w", err)
+	}
+	return files, nil
+}
+
+// listTree lists the artifacts of layouts that use subdirectories
+func (fs *FileSystem) listTree() ([]ArtifactStat, error) {
+	files, err := fs.walk()
+	if err != nil {
+		return nil, err
+	}
+	artifacts := make([]ArtifactStat, 0, len(files))
+	for hash, file := range files {
+		info, err := os.Stat(filepath.Join(fs.basePath, file))
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return nil, fmt.Errorf("failed to get file info: %w", err)
+		}
+		artifacts = append(artifacts, ArtifactStat{Hash: hash, Size: info.Size(), ModTime: info.ModTime()})
+	}
+	return artifacts, nil
+}
+
+// move renames an artifact file to another relative path
+func (fs *FileSystem) move(from, to string) error {
+	if err := os.MkdirAll(filepath.Join(fs.basePath, filepath.Dir(to)), 0755); err != nil {
+		return fmt.Errorf("failed to create directory: %w", err)
+	}
+	if err := os.Rename(filepath.Join(fs.basePath, from), filepath.Join(fs.basePath, to)); err != nil {
+		return fmt.Errorf("failed to move artifact: %w", err)
+	}
+	return nil
+}
+
+// removeEmptyDirs removes the directories a layout change left empty
+func (fs *FileSystem) removeEmptyDirs() {
+	var dirs []string
+	filepath.WalkDir(fs.basePath, func(path string, entry os.DirEntry, err error) error {
+		if err != nil || path == fs.basePath || !entry.IsDir() {
+			return nil
+		}
+		if strings.HasPrefix(entry.Name(), ".") {
+			return filepath.SkipDir
+		}
+		dirs = append(dirs, path)
+		return nil
+	})
+	// Deepest first, so parents are empty by the time they come up
+	for i := len(dirs) - 1; i >= 0; i-- {
+		os.Remove(dirs[i])
+	}
+}
@@ -0,0 +1,176 @@
+package storage
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// readArtifact returns the contents of an artifact, or "" if it isn't stored
+func readArtifact(t *testing.T, fs *FileSystem, hash string) string {
+	t.Helper()
+	r, _, err := fs.Get(hash)
+	if err != nil {
+		return ""
+	}
+	defer r.Close()
+	data, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatalf("reading %s: %v", hash, err)
+	}
+	return string(data)
+}
+
+func TestSetLayoutMigrates(t *testing.T) {
+	dir := t.TempDir()
+	fs, err := NewFileSystem(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	day := time.Date(2025, 3, 7, 12, 0, 0, 0, time.UTC)
+	artifacts := map[string]string{"abcd1234": "one", "abef5678": "two", "ff001122": "three"}
+	for hash, content := range artifacts {
+		if err := fs.Store(hash, strings.NewReader(content)); err != nil {
+			t.Fatalf("Store %s: %v", hash, err)
+		}
+		if err := os.Chtimes(filepath.Join(dir, hash), day, day); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Server state next to the artifacts stays where it is
+	if err := os.MkdirAll(filepath.Join(dir, ".meta"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, ".meta", "index.json"), []byte("{}"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		layout string
+		file   string
+	}{
+		{"sharded", "ab/abcd1234"},
+		{"nested", "ab/cd/abcd1234"},
+		{"date", "2025/03/07/abcd1234"},
+		{"team", "_/abcd1234"},
+		{"flat", "abcd1234"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.layout, func(t *testing.T) {
+			layout, err := ParseLayout(tt.layout)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// Each change starts from a fresh server on the previous layout
+			fs, err := NewFileSystem(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := fs.SetLayout(layout); err != nil {
+				t.Fatalf("SetLayout: %v", err)
+			}
+			if _, err := os.Stat(filepath.Join(dir, tt.file)); err != nil {
+				t.Errorf("artifact not moved to %s: %v", tt.file, err)
+			}
+			for hash, content := range artifacts {
+				if got := readArtifact(t, fs, hash); got != content {
+					t.Errorf("Get %s = %q, want %q", hash, got, content)
+				}
+			}
+			files, err := fs.walk()
+			if err != nil || len(files) != len(artifacts) {
+				t.Errorf("tree holds %v, %v, want only the %d artifacts", files, err, len(artifacts))
+			}
+			if data, _ := os.ReadFile(filepath.Join(dir, layoutFile)); strings.TrimSpace(string(data)) != tt.layout {
+				t.Errorf("recorded layout %q, want %q", data, tt.layout)
+			}
+			if _, err := os.Stat(filepath.Join(dir, ".meta", "index.json")); err != nil {
+				t.Errorf("server state: %v", err)
+			}
+		})
+	}
+
+	// The last move back to flat left no directories behind
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range entries {
+		if entry.IsDir() && entry.Name() != ".meta" {
+			t.Errorf("directory %s left after moving back to flat", entry.Name())
+		}
+	}
+}
+
+func TestSetLayoutResumesInterruptedMove(t *testing.T) {
+	dir := t.TempDir()
+	fs, err := NewFileSystem(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, hash := range []string{"abcd1234", "abef5678"} {
+		if err := fs.Store(hash, strings.NewReader(hash)); err != nil {
+			t.Fatalf("Store %s: %v", hash, err)
+		}
+	}
+	// A crash after moving one artifact, before the layout was recorded
+	if err := fs.move("abcd1234", "ab/cd/abcd1234"); err != nil {
+		t.Fatal(err)
+	}
+
+	fs, err = NewFileSystem(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.SetLayout(nestedLayout{}); err != nil {
+		t.Fatalf("SetLayout: %v", err)
+	}
+	for _, file := range []string{"ab/cd/abcd1234", "ab/ef/abef5678"} {
+		if _, err := os.Stat(filepath.Join(dir, file)); err != nil {
+			t.Errorf("%s: %v", file, err)
+		}
+	}
+	for _, hash := range []string{"abcd1234", "abef5678"} {
+		if got := readArtifact(t, fs, hash); got != hash {
+			t.Errorf("Get %s = %q, want %q", hash, got, hash)
+		}
+	}
+}
+
+func TestTeamLayoutPlacesUploads(t *testing.T) {
+	dir := t.TempDir()
+	fs, err := NewFileSystem(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.SetLayout(teamLayout{}); err != nil {
+		t.Fatalf("SetLayout: %v", err)
+	}
+	fs.Describe("abcd1234", ArtifactDetails{Team: "web/../api"})
+	if err := fs.Store("abcd1234", strings.NewReader("web")); err != nil {
+		t.Fatalf("Store: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "web_.._api", "abcd1234")); err != nil {
+		t.Errorf("upload not under its team: %v", err)
+	}
+	// A re-upload by another team moves the artifact
+	fs.Describe("abcd1234", ArtifactDetails{Team: "api"})
+	if err := fs.Store("abcd1234", strings.NewReader("api")); err != nil {
+		t.Fatalf("Store: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "web_.._api", "abcd1234")); !os.IsNotExist(err) {
+		t.Errorf("previous copy still stored: %v", err)
+	}
+	if got := readArtifact(t, fs, "abcd1234"); got != "api" {
+		t.Errorf("Get = %q, want %q", got, "api")
+	}
+	if err := fs.Delete("abcd1234"); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if ok, _ := fs.Exists("abcd1234"); ok {
+		t.Error("artifact still exists after Delete")
+	}
+}
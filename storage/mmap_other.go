@@ -0,0 +1,17 @@
+//go:build !unix
+
+package storage
+
+import (
+	"errors"
+	"io"
+	"os"
+)
+
+func mmapFile(file *os.File, size int64) (io.ReadCloser, error) {
+	return nil, errors.New("mmap not supported")
+}
+
+func Mapped(r io.Reader) bool {
+	return false
+}
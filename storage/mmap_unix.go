@@ -0,0 +1,84 @@
+//go:build unix
+
+package storage
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"runtime"
+	"runtime/debug"
+
+	"golang.org/x/sys/unix"
+)
+
+// mmapFile maps a whole file read-only for serving
+func mmapFile(file *os.File, size int64) (io.ReadCloser, error) {
+	data, err := unix.Mmap(int(file.Fd()), 0, int(size), unix.PROT_READ, unix.MAP_SHARED)
+	if err != nil {
+		return nil, fmt.Errorf("failed to map file: %w", err)
+	}
+	unix.Madvise(data, unix.MADV_SEQUENTIAL)
+	return &mmapReader{data: data}, nil
+}
+
+// Mapped reports whether r serves a memory-mapped file, which is best
+// written out with its WriteTo rather than read
+func Mapped(r io.Reader) bool {
+	_, ok := r.(*mmapReader)
+	return ok
+}
+
+// mmapReader serves a mapping straight to the writer without an intermediate
+// buffer. If the file is truncated underneath the mapping, the resulting
+// fault is turned into a read error instead of crashing the server.
+type mmapReader struct {
+	data []byte
+	off  int
+}
+
+func (m *mmapReader) Read(p []byte) (n int, err error) {
+	if m.off >= len(m.data) {
+		return 0, io.EOF
+	}
+	defer debug.SetPanicOnFault(debug.SetPanicOnFault(true))
+	defer recoverFault(&err)
+	n = copy(p, m.data[m.off:])
+	m.off += n
+	return n, nil
+}
+
+func (m *mmapReader) WriteTo(w io.Writer) (n int64, err error) {
+	defer debug.SetPanicOnFault(debug.SetPanicOnFault(true))
+	defer recoverFault(&err)
+	for m.off < len(m.data) {
+		end := min(m.off+4<<20, len(m.data))
+		written, err := w.Write(m.data[m.off:end])
+		m.off += written
+		n += int64(written)
+		if err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+func (m *mmapReader) Close() error {
+	if m.data == nil {
+		return nil
+	}
+	err := unix.Munmap(m.data)
+	m.data = nil
+	return err
+}
+
+func recoverFault(err *error) {
+	r := recover()
+	if r == nil {
+		return
+	}
+	if _, ok := r.(runtime.Error); !ok {
+		panic(r)
+	}
+	*err = fmt.Errorf("mapped file changed while reading: %v", r)
+}
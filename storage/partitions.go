@@ -0,0 +1,90 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+var ErrInvalidPartition = errors.New("invalid partition")
+
+// Partition is one directory of a date or team layout
+type Partition struct {
+	Name  string `json:"name"`
+	Count int    `json:"count"`
+	Bytes int64  `json:"bytes"`
+}
+
+// Partitions returns the directories artifacts are filed under, empty for
+// the flat and sharded layouts
+func (fs *FileSystem) Partitions() []Partition {
+	fs.mu.RLock()
+	files := make(map[string]string, len(fs.locations))
+	for hash, file := range fs.locations {
+		files[hash] = file
+	}
+	fs.mu.RUnlock()
+
+	byName := make(map[string]*Partition)
+	for _, file := range files {
+		name := filepath.ToSlash(filepath.Dir(file))
+		p, ok := byName[name]
+		if !ok {
+			p = &Partition{Name: name}
+			byName[name] = p
+		}
+		info, err := os.Stat(filepath.Join(fs.basePath, file))
+		if err != nil {
+			continue
+		}
+		p.Count++
+		p.Bytes += info.Size()
+	}
+	partitions := make([]Partition, 0, len(byName))
+	for _, p := range byName {
+		partitions = append(partitions, *p)
+	}
+	return partitions
+}
+
+// PartitionHashes returns the artifacts filed under a partition or any
+// partition below it, such as every day of "2026/01"
+func (fs *FileSystem) PartitionHashes(name string) ([]string, error) {
+	name = filepath.Clean(filepath.FromSlash(name))
+	if fs.layout.Fixed() || filepath.IsAbs(name) || strings.HasPrefix(name, ".") {
+		return nil, ErrInvalidPartition
+	}
+	fs.mu.RLock()
+	defer fs.mu.RUnlock()
+	var hashes []string
+	for hash, file := range fs.locations {
+		if strings.HasPrefix(file, name+string(filepath.Separator)) {
+			hashes = append(hashes, hash)
+		}
+	}
+	return hashes, nil
+}
+
+// DropPartition removes a partition directory with everything in it
+func (fs *FileSystem) DropPartition(name string) error {
+	hashes, err := fs.PartitionHashes(name)
+	if err != nil {
+		return err
+	}
+	if err := os.RemoveAll(filepath.Join(fs.basePath, filepath.Clean(filepath.FromSlash(name)))); err != nil {
+		return fmt.Errorf("failed to remove partition: %w", err)
+	}
+	fs.mu.Lock()
+	for _, hash := range hashes {
+		delete(fs.locations, hash)
+	}
+	fs.mu.Unlock()
+	return nil
+}
+
+// Partitioned reports whether the layout files artifacts into partitions
+func (fs *FileSystem) Partitioned() bool {
+	return !fs.layout.Fixed()
+}
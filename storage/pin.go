@@ -0,0 +1,51 @@
+package storage
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// Pin hard links an artifact under .backups/<id>, so replacing or deleting it
+// leaves the pinned contents intact
+func (fs *FileSystem) Pin(hash, id string) error {
+	dir := filepath.Join(fs.basePath, ".backups", id)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("failed to create backup directory: %w", err)
+	}
+	path, ok := fs.path(hash)
+	if !ok {
+		return ErrArtifactNotFound
+	}
+	err := os.Link(path, filepath.Join(dir, hash))
+	if os.IsNotExist(err) {
+		return ErrArtifactNotFound
+	}
+	if err != nil && !os.IsExist(err) {
+		return fmt.Errorf("failed to pin artifact: %w", err)
+	}
+	return nil
+}
+
+// GetPinned opens the pinned copy of an artifact
+func (fs *FileSystem) GetPinned(hash, id string) (io.ReadCloser, int64, error) {
+	file, err := os.Open(filepath.Join(fs.basePath, ".backups", id, hash))
+	if os.IsNotExist(err) {
+		return nil, 0, ErrArtifactNotFound
+	}
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to open file: %w", err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, 0, fmt.Errorf("failed to get file info: %w", err)
+	}
+	return file, info.Size(), nil
+}
+
+// Unpin removes the pinned copies of a backup
+func (fs *FileSystem) Unpin(id string) error {
+	return os.RemoveAll(filepath.Join(fs.basePath, ".backups", id))
+}
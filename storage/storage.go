@@ -0,0 +1,87 @@
+// Package storage defines where artifact bytes live: the Storage interface
+// every backend implements, a registry for backends kept outside the server,
+// and the local filesystem backend.
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Storage is where artifact bytes live; implementations must be safe for
+// concurrent use
+type Storage interface {
+	Store(hash string, data io.Reader) error
+	// Get returns the artifact and its size, or ErrArtifactNotFound
+	Get(hash string) (io.ReadCloser, int64, error)
+	Exists(hash string) (bool, error)
+	// Delete removes an artifact; deleting a missing artifact is not an error
+	Delete(hash string) error
+	List() ([]ArtifactStat, error)
+}
+
+var ErrArtifactNotFound = errors.New("artifact not found")
+
+// ArtifactStat describes a stored artifact file
+type ArtifactStat struct {
+	Hash    string
+	Size    int64
+	ModTime time.Time
+}
+
+// ArtifactDetails are what some backends use to place or classify an
+// artifact. Backends that want them implement
+// Describe(hash string, details ArtifactDetails), which the server calls
+// right before Store.
+type ArtifactDetails struct {
+	Team string
+	Tags []string
+	// RetainUntil is set for compliance uploads; backends that can keep
+	// the artifact from being changed or removed until then should
+	RetainUntil time.Time
+}
+
+// Opener creates a backend configured by the environment variables starting
+// with prefix, e.g. TURBO_ for the primary storage; dir is the directory the
+// filesystem backend would use
+type Opener func(prefix, dir string) (Storage, error)
+
+var (
+	registryMu sync.RWMutex
+	registry   = make(map[string]Opener)
+)
+
+// Register makes a backend available as TURBO_STORAGE_BACKEND=name. It is
+// meant to be called from an init function of the package implementing it.
+func Register(name string, open Opener) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	if _, ok := registry[name]; ok {
+		panic(fmt.Sprintf("storage backend %q registered twice", name))
+	}
+	registry[name] = open
+}
+
+// Lookup returns the opener of a registered backend
+func Lookup(name string) (Opener, bool) {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+	open, ok := registry[name]
+	return open, ok
+}
+
+// Registered returns the names of the registered backends
+func Registered() []string {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+	names := make([]string, 0, len(registry))
+	for name := range registry {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
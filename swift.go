@@ -0,0 +1,342 @@
+package cachesrv
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SwiftStorage stores artifacts as objects in an OpenStack Swift container.
+// Ceph RadosGW is supported through its Swift API, which unlike its S3 shim
+// needs no request signing and supports keystone users directly.
+type SwiftStorage struct {
+	client    *http.Client
+	container string
+	auth      swiftAuthenticator
+
+	mu         sync.Mutex
+	storageURL string
+	token      string
+	expires    time.Time
+}
+
+// swiftAuthenticator obtains a token and the storage URL to use it with
+type swiftAuthenticator interface {
+	authenticate(client *http.Client) (storageURL, token string, expires time.Time, err error)
+}
+
+func NewSwiftStorage(auth swiftAuthenticator, container string) (*SwiftStorage, error) {
+	s := &SwiftStorage{
+		client:    &http.Client{},
+		container: container,
+		auth:      auth,
+	}
+
+	// Creating an existing container is a no-op
+	resp, err := s.do(http.MethodPut, "", nil, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create container: %w", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated && resp.StatusCode != http.StatusAccepted &&
+		resp.StatusCode != http.StatusNoContent {
+		return nil, fmt.Errorf("failed to create container: %s", resp.Status)
+	}
+	return s, nil
+}
+
+func (s *SwiftStorage) Store(hash string, data io.Reader) error {
+	resp, err := s.do(http.MethodPut, hash, data, http.Header{"Content-Type": {"application/octet-stream"}})
+	if err != nil {
+		return fmt.Errorf("failed to upload object: %w", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		return fmt.Errorf("failed to upload object: %s", resp.Status)
+	}
+	return nil
+}
+
+func (s *SwiftStorage) Get(hash string) (io.ReadCloser, int64, error) {
+	resp, err := s.do(http.MethodGet, hash, nil, nil)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to download object: %w", err)
+	}
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return resp.Body, resp.ContentLength, nil
+	case http.StatusNotFound:
+		resp.Body.Close()
+		return nil, 0, errArtifactNotFound
+	default:
+		resp.Body.Close()
+		return nil, 0, fmt.Errorf("failed to download object: %s", resp.Status)
+	}
+}
+
+func (s *SwiftStorage) Exists(hash string) (bool, error) {
+	resp, err := s.do(http.MethodHead, hash, nil, nil)
+	if err != nil {
+		return false, fmt.Errorf("failed to check object: %w", err)
+	}
+	resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return true, nil
+	case http.StatusNotFound:
+		return false, nil
+	default:
+		return false, fmt.Errorf("failed to check object: %s", resp.Status)
+	}
+}
+
+func (s *SwiftStorage) Delete(hash string) error {
+	resp, err := s.do(http.MethodDelete, hash, nil, nil)
+	if err != nil {
+		return fmt.Errorf("failed to delete object: %w", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusNotFound {
+		return fmt.Errorf("failed to delete object: %s", resp.Status)
+	}
+	return nil
+}
+
+// List pages through the container listing
+func (s *SwiftStorage) List() ([]ArtifactStat, error) {
+	var artifacts []ArtifactStat
+	marker := ""
+	for {
+		query := url.Values{"format": {"json"}, "limit": {"10000"}, "marker": {marker}}
+		resp, err := s.do(http.MethodGet, "?"+query.Encode(), nil, nil)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list container: %w", err)
+		}
+		var page []struct {
+			Name         string `json:"name"`
+			Bytes        int64  `json:"bytes"`
+			LastModified string `json:"last_modified"`
+		}
+		err = decodeJSONResponse(resp, &page)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list container: %w", err)
+		}
+		if len(page) == 0 {
+			return artifacts, nil
+		}
+		for _, o := range page {
+			marker = o.Name
+			if strings.HasPrefix(o.Name, ".") {
+				continue
+			}
+			// Swift reports UTC timestamps without a zone
+			modTime, _ := time.Parse("2006-01-02T15:04:05.999999", o.LastModified)
+			artifacts = append(artifacts, ArtifactStat{Hash: o.Name, Size: o.Bytes, ModTime: modTime})
+		}
+	}
+}
+
+// do sends a request for an object (or the container if object is empty),
+// authenticating first if the token is missing or about to expire
+func (s *SwiftStorage) do(method, object string, body io.Reader, header http.Header) (*http.Response, error) {
+	for attempt := 0; ; attempt++ {
+		storageURL, token, err := s.credentials(attempt > 0)
+		if err != nil {
+			return nil, err
+		}
+		target := storageURL + "/" + url.PathEscape(s.container)
+		if strings.HasPrefix(object, "?") {
+			target += object
+		} else if object != "" {
+			target += "/" + url.PathEscape(object)
+		}
+
+		req, err := http.NewRequest(method, target, body)
+		if err != nil {
+			return nil, err
+		}
+		for k, v := range header {
+			req.Header[k] = v
+		}
+		req.Header.Set("X-Auth-Token", token)
+
+		resp, err := s.client.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		// Tokens can be revoked early; retry once unless the body is already spent
+		if resp.StatusCode == http.StatusUnauthorized && attempt == 0 && body == nil {
+			resp.Body.Close()
+			continue
+		}
+		return resp, nil
+	}
+}
+
+func (s *SwiftStorage) credentials(renew bool) (string, string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if renew || s.token == "" || (!s.expires.IsZero() && time.Until(s.expires) < 5*time.Minute) {
+		storageURL, token, expires, err := s.auth.authenticate(s.client)
+		if err != nil {
+			return "", "", fmt.Errorf("swift authentication failed: %w", err)
+		}
+		s.storageURL, s.token, s.expires = strings.TrimSuffix(storageURL, "/"), token, expires
+	}
+	return s.storageURL, s.token, nil
+}
+
+// swiftV1Auth is the legacy TempAuth scheme, also served by RadosGW on /auth/1.0
+type swiftV1Auth struct {
+	url, user, key string
+}
+
+func (a swiftV1Auth) authenticate(client *http.Client) (string, string, time.Time, error) {
+	req, err := http.NewRequest(http.MethodGet, a.url, nil)
+	if err != nil {
+		return "", "", time.Time{}, err
+	}
+	req.Header.Set("X-Auth-User", a.user)
+	req.Header.Set("X-Auth-Key", a.key)
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", "", time.Time{}, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return "", "", time.Time{}, fmt.Errorf("unexpected response %s", resp.Status)
+	}
+
+	var expires time.Time
+	if secs, err := time.ParseDuration(resp.Header.Get("X-Auth-Token-Expires") + "s"); err == nil {
+		expires = time.Now().Add(secs)
+	}
+	return resp.Header.Get("X-Storage-Url"), resp.Header.Get("X-Auth-Token"), expires, nil
+}
+
+// keystoneAuth authenticates with a Keystone v3 password and finds the
+// object-store endpoint in the service catalog
+type keystoneAuth struct {
+	url           string
+	user          string
+	password      string
+	userDomain    string
+	project       string
+	projectDomain string
+	region        string
+	endpoint      string // public, internal or admin
+}
+
+func (a keystoneAuth) authenticate(client *http.Client) (string, string, time.Time, error) {
+	var body struct {
+		Auth struct {
+			Identity struct {
+				Methods  []string `json:"methods"`
+				Password struct {
+					User struct {
+						Name     string            `json:"name"`
+						Domain   map[string]string `json:"domain"`
+						Password string            `json:"password"`
+					} `json:"user"`
+				} `json:"password"`
+			} `json:"identity"`
+			Scope struct {
+				Project struct {
+					Name   string            `json:"name"`
+					Domain map[string]string `json:"domain"`
+				} `json:"project"`
+			} `json:"scope"`
+		} `json:"auth"`
+	}
+	body.Auth.Identity.Methods = []string{"password"}
+	body.Auth.Identity.Password.User.Name = a.user
+	body.Auth.Identity.Password.User.Domain = map[string]string{"name": a.userDomain}
+	body.Auth.Identity.Password.User.Password = a.password
+	body.Auth.Scope.Project.Name = a.project
+	body.Auth.Scope.Project.Domain = map[string]string{"name": a.projectDomain}
+
+	payload, err := json.Marshal(body)
+	if err != nil {
+		return "", "", time.Time{}, err
+	}
+	resp, err := client.Post(strings.TrimSuffix(a.url, "/")+"/auth/tokens", "application/json", bytes.NewReader(payload))
+	if err != nil {
+		return "", "", time.Time{}, err
+	}
+
+	var result struct {
+		Token struct {
+			ExpiresAt time.Time `json:"expires_at"`
+			Catalog   []struct {
+				Type      string `json:"type"`
+				Endpoints []struct {
+					Interface string `json:"interface"`
+					Region    string `json:"region"`
+					URL       string `json:"url"`
+				} `json:"endpoints"`
+			} `json:"catalog"`
+		} `json:"token"`
+	}
+	token := resp.Header.Get("X-Subject-Token")
+	if err := decodeJSONResponse(resp, &result); err != nil {
+		return "", "", time.Time{}, err
+	}
+
+	for _, service := range result.Token.Catalog {
+		if service.Type != "object-store" {
+			continue
+		}
+		for _, e := range service.Endpoints {
+			if e.Interface == a.endpoint && (a.region == "" || e.Region == a.region) {
+				return e.URL, token, result.Token.ExpiresAt, nil
+			}
+		}
+	}
+	return "", "", time.Time{}, fmt.Errorf("no %s object-store endpoint in region %q", a.endpoint, a.region)
+}
+
+func newSwiftStorageFromEnv(prefix, backend string) (*SwiftStorage, error) {
+	values, err := requireEnv(prefix+"SWIFT_AUTH_URL", prefix+"SWIFT_USER", prefix+"SWIFT_KEY")
+	if err != nil {
+		return nil, err
+	}
+	authURL, user, key := values[0], values[1], values[2]
+
+	// RadosGW deployments usually use its built-in v1 auth
+	defaultVersion := "3"
+	if backend == "radosgw" {
+		defaultVersion = "1"
+	}
+
+	var auth swiftAuthenticator
+	switch version := envString(prefix+"SWIFT_AUTH_VERSION", defaultVersion); version {
+	case "1":
+		auth = swiftV1Auth{url: authURL, user: user, key: key}
+	case "3":
+		project := getenv(prefix + "SWIFT_PROJECT")
+		if project == "" {
+			return nil, fmt.Errorf("%sSWIFT_PROJECT is required for keystone auth", prefix)
+		}
+		auth = keystoneAuth{
+			url:           authURL,
+			user:          user,
+			password:      key,
+			userDomain:    envString(prefix+"SWIFT_USER_DOMAIN", "Default"),
+			project:       project,
+			projectDomain: envString(prefix+"SWIFT_PROJECT_DOMAIN", "Default"),
+			region:        getenv(prefix + "SWIFT_REGION"),
+			endpoint:      envString(prefix+"SWIFT_ENDPOINT_TYPE", "public"),
+		}
+	default:
+		return nil, fmt.Errorf("unsupported TURBO_SWIFT_AUTH_VERSION %q (expected 1 or 3)", version)
+	}
+
+	return NewSwiftStorage(auth, envString(prefix+"SWIFT_CONTAINER", "turbo-cache"))
+}
@@ -0,0 +1,127 @@
+package cachesrv
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// The /v8/team endpoints let a team see and clean up its own artifacts with
+// an ordinary token, without the admin API. They only ever cover a team the
+// token is limited to, named by the request's teamId (or slug), within the
+// token's tenant; tokens that may be used for any team own none.
+
+// TeamUsageResponse is the body of GET /v8/team/usage
+type TeamUsageResponse struct {
+	Team      string `json:"team"`
+	Artifacts int    `json:"artifacts"`
+	Used      int64  `json:"used"`
+	Reserved  int64  `json:"reserved"`
+	// Limit is the team's quota; 0 means unlimited
+	Limit int64 `json:"limit"`
+	Hits  int64 `json:"hits"`
+}
+
+// teamArtifacts returns the indexed artifacts of a team
+func (s *Server) teamArtifacts(team string) []ArtifactMeta {
+	var artifacts []ArtifactMeta
+	for _, m := range s.index.Find(nil) {
+		if m.Team == team {
+			artifacts = append(artifacts, m)
+		}
+	}
+	return artifacts
+}
+
+// requireTeam returns the team of the request if its token is limited to it,
+// or answers 400 without a team and 403 for teams the token doesn't own
+func requireTeam(w http.ResponseWriter, r *http.Request) (string, bool) {
+	team := teamOf(r)
+	if team == "" {
+		http.Error(w, "Missing teamId", http.StatusBadRequest)
+		return "", false
+	}
+	if token := tokenOf(r); token == nil || !token.ownsTeam(team) {
+		http.Error(w, "Token not limited to this team", http.StatusForbidden)
+		return "", false
+	}
+	return team, true
+}
+
+// Handler for GET /v8/team/artifacts?teamId=
+func (s *Server) listTeamArtifacts(w http.ResponseWriter, r *http.Request) {
+	team, ok := requireTeam(w, r)
+	if !ok {
+		return
+	}
+	artifacts := s.teamArtifacts(team)
+	if artifacts == nil {
+		artifacts = []ArtifactMeta{}
+	}
+	s.writeList(w, r, artifacts, "-createdAt", "hash")
+}
+
+// Handler for GET /v8/team/usage?teamId=
+func (s *Server) getTeamUsage(w http.ResponseWriter, r *http.Request) {
+	team, ok := requireTeam(w, r)
+	if !ok {
+		return
+	}
+	artifacts := s.teamArtifacts(team)
+	used, reserved := s.quotas.Usage(team)
+	usage := TeamUsageResponse{
+		Team:      team,
+		Artifacts: len(artifacts),
+		Used:      used,
+		Reserved:  reserved,
+		Limit:     s.quotas.Limit(team),
+	}
+	for _, m := range artifacts {
+		usage.Hits += m.Hits
+	}
+	json.NewEncoder(w).Encode(usage)
+}
+
+// Handler for DELETE /v8/team/artifacts/{hash}?teamId=. Artifacts of other
+// teams answer 404 like missing ones, so their hashes can't be probed.
+func (s *Server) deleteTeamArtifact(w http.ResponseWriter, r *http.Request) {
+	if !s.teamCleanup {
+		http.Error(w, "Team cleanup is disabled", http.StatusForbidden)
+		return
+	}
+	team, ok := requireTeam(w, r)
+	if !ok {
+		return
+	}
+	hash := r.PathValue("hash")
+	if !validHash(hash) {
+		http.Error(w, "Invalid artifact hash", http.StatusBadRequest)
+		return
+	}
+	// The listed keys carry the team already, turbo's hashes don't
+	if s.teamNamespaces {
+		var err error
+		if hash, err = namespaceKey(hash, team); err != nil {
+			http.Error(w, "Invalid team", http.StatusBadRequest)
+			return
+		}
+	}
+	m, found := s.index.Get(hash)
+	if !found || m.Team != team {
+		http.Error(w, "Artifact not found", http.StatusNotFound)
+		return
+	}
+
+	dryRun := dryRunRequested(r)
+	report := purgeArtifacts(r.Context(), nil, s.index, s.classes, []ArtifactMeta{m}, dryRun, s.logger)
+	if report.Retained > 0 {
+		http.Error(w, "Artifact is under compliance retention", http.StatusConflict)
+		return
+	}
+	if !dryRun && report.Count > 0 {
+		s.logger.Printf("Team %s deleted artifact %s (%d bytes)", team, hash, m.Size)
+		if err := s.federation.Bury(report); err != nil {
+			s.logger.Printf("Failed to record tombstones: %v", err)
+		}
+	}
+	json.NewEncoder(w).Encode(report)
+}
@@ -0,0 +1,46 @@
+package cachesrv
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRequireTeam(t *testing.T) {
+	tests := []struct {
+		name     string
+		token    *Token
+		query    string
+		resolved string
+		want     string
+		status   int
+	}{
+		{"owned team", &Token{Teams: []string{"web"}}, "?teamId=web", "", "web", http.StatusOK},
+		{"owned slug", &Token{Teams: []string{"web"}}, "?slug=web", "", "web", http.StatusOK},
+		{"resolved team", &Token{Teams: []string{"team_4f2a"}}, "?teamId=web", "team_4f2a", "team_4f2a", http.StatusOK},
+		{"unrestricted token", &Token{}, "?teamId=web", "", "", http.StatusForbidden},
+		{"other team", &Token{Teams: []string{"web"}}, "?teamId=api", "", "", http.StatusForbidden},
+		{"no token", nil, "?teamId=web", "", "", http.StatusForbidden},
+		{"no team", &Token{Teams: []string{"web"}}, "", "", "", http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/v8/team/usage"+tt.query, nil)
+			ctx := r.Context()
+			if tt.token != nil {
+				ctx = withToken(ctx, tt.token)
+			}
+			if tt.resolved != "" {
+				ctx = withTeam(ctx, tt.resolved)
+			}
+			w := httptest.NewRecorder()
+			team, ok := requireTeam(w, r.WithContext(ctx))
+			if ok != (tt.status == http.StatusOK) || team != tt.want {
+				t.Errorf("requireTeam = %q, %v, want %q", team, ok, tt.want)
+			}
+			if w.Code != tt.status {
+				t.Errorf("status = %d, want %d", w.Code, tt.status)
+			}
+		})
+	}
+}
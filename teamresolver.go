@@ -0,0 +1,388 @@
+package cachesrv
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-ldap/ldap/v3"
+)
+
+// With TURBO_TEAM_RESOLVER the teamId or slug of every request is looked up
+// in a team directory: a JSON file, an HTTP service or LDAP. The directory
+// says which team an id names, which tenant it belongs to and its quota, so
+// new teams are onboarded there rather than in the server's settings.
+// Teams the directory doesn't know are refused.
+
+var errTeamUnknown = errors.New("unknown team")
+
+// TeamConfig is what the directory knows about a team
+type TeamConfig struct {
+	// Name is what artifacts are filed under, the same for every id and
+	// slug of the team
+	Name string `json:"name"`
+	// IDs are the teamIds and slugs naming the team, in the static file
+	IDs []string `json:"ids,omitempty"`
+	// Tenant is the tenant whose tokens may use the team, empty for the
+	// default one
+	Tenant string `json:"tenant,omitempty"`
+	Quota  string `json:"quota,omitempty"`
+}
+
+// TeamResolver looks up a teamId or slug, failing with errTeamUnknown if
+// it names no team
+type TeamResolver interface {
+	ResolveTeam(ctx context.Context, id string) (TeamConfig, error)
+}
+
+// teamResolvers open the resolver selected by TURBO_TEAM_RESOLVER
+var teamResolvers = map[string]func() (TeamResolver, error){
+	"static": newStaticTeamResolverFromEnv,
+	"http":   newHTTPTeamResolverFromEnv,
+	"ldap":   newLDAPTeamResolverFromEnv,
+}
+
+// resolvedTeam is a cached answer of the resolver
+type resolvedTeam struct {
+	team TeamConfig
+	err  error
+	at   time.Time
+}
+
+// TeamDirectory caches the answers of a resolver for
+// TURBO_TEAM_RESOLVER_CACHE_TTL. When the resolver fails, the last answer
+// for the team is used however old it is.
+type TeamDirectory struct {
+	resolver TeamResolver
+	ttl      time.Duration
+	logger   *log.Logger
+
+	mu     sync.Mutex
+	byID   map[string]*resolvedTeam
+	quotas map[string]int64 // team name -> quota of the teams resolved so far
+}
+
+// newTeamDirectoryFromEnv returns nil when TURBO_TEAM_RESOLVER is not set
+func newTeamDirectoryFromEnv(logger *log.Logger) (*TeamDirectory, error) {
+	kind := getenv("TURBO_TEAM_RESOLVER")
+	if kind == "" {
+		return nil, nil
+	}
+	open, ok := teamResolvers[kind]
+	if !ok {
+		names := make([]string, 0, len(teamResolvers))
+		for name := range teamResolvers {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return nil, fmt.Errorf("invalid TURBO_TEAM_RESOLVER %q (expected one of %s)", kind, strings.Join(names, ", "))
+	}
+	ttl, err := envDuration("TURBO_TEAM_RESOLVER_CACHE_TTL", 5*time.Minute)
+	if err != nil {
+		return nil, err
+	}
+	resolver, err := open()
+	if err != nil {
+		return nil, err
+	}
+	return &TeamDirectory{
+		resolver: resolver,
+		ttl:      ttl,
+		logger:   logger,
+		byID:     make(map[string]*resolvedTeam),
+		quotas:   make(map[string]int64),
+	}, nil
+}
+
+// Resolve returns the team an id names
+func (d *TeamDirectory) Resolve(ctx context.Context, id string) (TeamConfig, error) {
+	d.mu.Lock()
+	cached, ok := d.byID[id]
+	d.mu.Unlock()
+	if ok && time.Since(cached.at) < d.ttl {
+		return cached.team, cached.err
+	}
+
+	team, err := d.resolver.ResolveTeam(ctx, id)
+	var quota int64
+	if err == nil {
+		if team.Name == "" {
+			team.Name = id
+		}
+		if team.Quota != "" {
+			if quota, err = parseSize(team.Quota); err != nil {
+				err = fmt.Errorf("invalid quota of team %s: %w", team.Name, err)
+			}
+		}
+	}
+	if err != nil && !errors.Is(err, errTeamUnknown) {
+		if ok && cached.err == nil {
+			d.logger.Printf("Failed to resolve team %q, using the answer from %s: %v", id, cached.at.Format(time.RFC3339), err)
+			return cached.team, nil
+		}
+		return team, err
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.byID[id] = &resolvedTeam{team: team, err: err, at: time.Now()}
+	if err == nil {
+		if team.Quota != "" {
+			d.quotas[team.Name] = quota
+		} else {
+			delete(d.quotas, team.Name)
+		}
+	}
+	return team, err
+}
+
+// Quota returns the quota of a resolved team, if the directory sets one
+func (d *TeamDirectory) Quota(team string) (int64, bool) {
+	if d == nil {
+		return 0, false
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	quota, ok := d.quotas[team]
+	return quota, ok
+}
+
+// file returns the teams file of a static directory
+func (d *TeamDirectory) file() string {
+	if d == nil {
+		return ""
+	}
+	if r, ok := d.resolver.(*StaticTeamResolver); ok {
+		return r.path
+	}
+	return ""
+}
+
+// Reset forgets every cached answer, for a reload. A static directory
+// takes the teams read again from its file.
+func (d *TeamDirectory) Reset(teams map[string]TeamConfig) {
+	if r, ok := d.resolver.(*StaticTeamResolver); ok && teams != nil {
+		r.mu.Lock()
+		r.teams = teams
+		r.mu.Unlock()
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.byID = make(map[string]*resolvedTeam)
+}
+
+type teamKey struct{}
+
+func withTeam(ctx context.Context, team string) context.Context {
+	return context.WithValue(ctx, teamKey{}, team)
+}
+
+// resolveTeam files the request under the team its teamId or slug names,
+// answering 403 for unknown teams and teams of other tenants
+func (s *Server) resolveTeam(w http.ResponseWriter, r *http.Request) (*http.Request, bool) {
+	id := teamOf(r)
+	if s.teams == nil || id == "" {
+		return r, true
+	}
+	team, err := s.teams.Resolve(r.Context(), id)
+	switch {
+	case errors.Is(err, errTeamUnknown) || err == nil && team.Tenant != s.tenant:
+		s.logger.Printf("Refused request for unknown team %q", id)
+		http.Error(w, "Unknown team", http.StatusForbidden)
+		return r, false
+	case err != nil:
+		s.logger.Printf("Failed to resolve team %q: %v", id, err)
+		http.Error(w, "Team directory unavailable", http.StatusServiceUnavailable)
+		return r, false
+	}
+	return r.WithContext(withTeam(r.Context(), team.Name)), true
+}
+
+// StaticTeamResolver reads the teams from TURBO_TEAMS_FILE, a JSON list of
+// TeamConfig, again on reload
+type StaticTeamResolver struct {
+	path string
+
+	mu    sync.RWMutex
+	teams map[string]TeamConfig // id -> team
+}
+
+func newStaticTeamResolverFromEnv() (TeamResolver, error) {
+	path := getenv("TURBO_TEAMS_FILE")
+	if path == "" {
+		return nil, errors.New("TURBO_TEAMS_FILE is required for TURBO_TEAM_RESOLVER=static")
+	}
+	teams, err := readTeamsFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return &StaticTeamResolver{path: path, teams: teams}, nil
+}
+
+// readTeamsFile reads and checks the teams file, returning the teams by id
+func readTeamsFile(path string) (map[string]TeamConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read teams file: %w", err)
+	}
+	var list []TeamConfig
+	if err := json.Unmarshal(data, &list); err != nil {
+		return nil, fmt.Errorf("failed to parse teams file: %w", err)
+	}
+	teams := make(map[string]TeamConfig)
+	for _, team := range list {
+		if team.Name == "" {
+			return nil, errors.New("failed to parse teams file: a team has no name")
+		}
+		if team.Quota != "" {
+			if _, err := parseSize(team.Quota); err != nil {
+				return nil, fmt.Errorf("invalid quota of team %s: %w", team.Name, err)
+			}
+		}
+		for _, id := range append([]string{team.Name}, team.IDs...) {
+			if other, ok := teams[id]; ok && other.Name != team.Name {
+				return nil, fmt.Errorf("teams %s and %s share the id %s", other.Name, team.Name, id)
+			}
+			teams[id] = team
+		}
+	}
+	return teams, nil
+}
+
+func (r *StaticTeamResolver) ResolveTeam(ctx context.Context, id string) (TeamConfig, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	team, ok := r.teams[id]
+	if !ok {
+		return TeamConfig{}, errTeamUnknown
+	}
+	return team, nil
+}
+
+// HTTPTeamResolver asks a directory service: a GET of
+// TURBO_TEAM_RESOLVER_URL with the id in place of {team} answers a
+// TeamConfig, or 404 for unknown teams
+type HTTPTeamResolver struct {
+	url    string
+	token  string
+	client *http.Client
+}
+
+func newHTTPTeamResolverFromEnv() (TeamResolver, error) {
+	r := &HTTPTeamResolver{
+		url:    getenv("TURBO_TEAM_RESOLVER_URL"),
+		token:  getenv("TURBO_TEAM_RESOLVER_TOKEN"),
+		client: &http.Client{Timeout: 10 * time.Second},
+	}
+	if !strings.Contains(r.url, "{team}") {
+		return nil, errors.New("TURBO_TEAM_RESOLVER_URL must contain {team} for TURBO_TEAM_RESOLVER=http")
+	}
+	return r, nil
+}
+
+func (r *HTTPTeamResolver) ResolveTeam(ctx context.Context, id string) (TeamConfig, error) {
+	var team TeamConfig
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.ReplaceAll(r.url, "{team}", url.PathEscape(id)), nil)
+	if err != nil {
+		return team, err
+	}
+	req.Header.Set("Accept", "application/json")
+	if r.token != "" {
+		req.Header.Set("Authorization", "Bearer "+r.token)
+	}
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return team, fmt.Errorf("failed to query team directory: %w", err)
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return team, errTeamUnknown
+	default:
+		return team, fmt.Errorf("team directory answered %s", resp.Status)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&team); err != nil {
+		return team, fmt.Errorf("failed to parse team directory response: %w", err)
+	}
+	return team, nil
+}
+
+// LDAPTeamResolver searches the TURBO_LDAP_URL directory for an entry
+// matching TURBO_TEAM_LDAP_FILTER, reading the team's name, tenant and
+// quota from its attributes
+type LDAPTeamResolver struct {
+	ldapServer
+	baseDN     string
+	filter     string
+	nameAttr   string
+	tenantAttr string
+	quotaAttr  string
+}
+
+func newLDAPTeamResolverFromEnv() (TeamResolver, error) {
+	r := &LDAPTeamResolver{
+		ldapServer: ldapServerFromEnv(),
+		baseDN:     envString("TURBO_TEAM_LDAP_BASE_DN", getenv("TURBO_LDAP_BASE_DN")),
+		filter:     envString("TURBO_TEAM_LDAP_FILTER", "(&(objectClass=group)(cn=%s))"),
+		nameAttr:   envString("TURBO_TEAM_LDAP_NAME_ATTR", "cn"),
+		tenantAttr: getenv("TURBO_TEAM_LDAP_TENANT_ATTR"),
+		quotaAttr:  getenv("TURBO_TEAM_LDAP_QUOTA_ATTR"),
+	}
+	if r.url == "" || r.baseDN == "" {
+		return nil, errors.New("TURBO_LDAP_URL and TURBO_TEAM_LDAP_BASE_DN are required for TURBO_TEAM_RESOLVER=ldap")
+	}
+	if !strings.Contains(r.filter, "%s") {
+		return nil, errors.New("TURBO_TEAM_LDAP_FILTER must contain %s for the team id")
+	}
+	return r, nil
+}
+
+func (r *LDAPTeamResolver) ResolveTeam(ctx context.Context, id string) (TeamConfig, error) {
+	var team TeamConfig
+	conn, err := r.dial()
+	if err != nil {
+		return team, err
+	}
+	defer conn.Close()
+
+	attrs := []string{r.nameAttr}
+	for _, attr := range []string{r.tenantAttr, r.quotaAttr} {
+		if attr != "" {
+			attrs = append(attrs, attr)
+		}
+	}
+	// A second match makes the id ambiguous
+	result, err := conn.Search(ldap.NewSearchRequest(
+		r.baseDN, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 2, int(r.timeout.Seconds()), false,
+		fmt.Sprintf(r.filter, ldap.EscapeFilter(id)), attrs, nil,
+	))
+	if err != nil {
+		return team, fmt.Errorf("failed to search LDAP: %w", err)
+	}
+	switch len(result.Entries) {
+	case 0:
+		return team, errTeamUnknown
+	case 1:
+	default:
+		return team, fmt.Errorf("team id %q matches several LDAP entries", id)
+	}
+	entry := result.Entries[0]
+	team.Name = entry.GetAttributeValue(r.nameAttr)
+	if r.tenantAttr != "" {
+		team.Tenant = entry.GetAttributeValue(r.tenantAttr)
+	}
+	if r.quotaAttr != "" {
+		team.Quota = entry.GetAttributeValue(r.quotaAttr)
+	}
+	return team, nil
+}
@@ -0,0 +1,391 @@
+package cachesrv
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TenantConfig describes one organization served by this instance. Each
+// tenant gets its own storage, metadata index, tokens and limits, so its
+// artifacts are invisible to every other tenant.
+type TenantConfig struct {
+	Tokens []string `json:"tokens"`
+	// Backend is fs, swift, radosgw, oss or b2; remote backends read their
+	// settings from TURBO_TENANT_<NAME>_* variables, e.g. TURBO_TENANT_ACME_B2_PREFIX
+	Backend string `json:"backend,omitempty"`
+	// Dir holds the artifacts of the fs backend
+	Dir       string  `json:"dir,omitempty"`
+	Quota     string  `json:"quota,omitempty"`
+	MaxFiles  int64   `json:"maxFiles,omitempty"`
+	TeamQuota string  `json:"teamQuota,omitempty"`
+	Retention string  `json:"retention,omitempty"`
+	RateLimit float64 `json:"rateLimit,omitempty"`
+	Burst     int     `json:"burst,omitempty"`
+}
+
+// TenantInfo is the admin view of a tenant
+type TenantInfo struct {
+	Name      string `json:"name"`
+	Artifacts int64  `json:"artifacts"`
+	Size      int64  `json:"size"`
+	Quota     int64  `json:"quota"`
+	Tokens    int    `json:"tokens"`
+}
+
+// loadTenants reads the tenants file and builds a server for each tenant.
+// Tenants share the base server's logger, request signing and callbacks.
+func loadTenants(path, cacheDir string, base *Server) ([]*Server, error) {
+	configs, names, err := readTenantsFile(path, base)
+	if err != nil {
+		return nil, err
+	}
+	var tenants []*Server
+	for _, name := range names {
+		tenant, err := newTenantServer(name, configs[name], cacheDir, base)
+		if err != nil {
+			return nil, fmt.Errorf("failed to configure tenant %s: %w", name, err)
+		}
+		tenants = append(tenants, tenant)
+	}
+	// Spooling, archiving and federation are only set up for the default tenant
+	for _, ignored := range []struct {
+		setting string
+		used    bool
+	}{
+		{"TURBO_UPLOAD_MODE", base.spool != nil},
+		{"TURBO_ARCHIVE_TAGS", base.archive != nil},
+		{"TURBO_REPLICAS", base.federation != nil},
+	} {
+		if ignored.used && len(tenants) > 0 {
+			base.logger.Printf("Ignoring setting %s for tenants: only the default tenant uses it", ignored.setting)
+		}
+	}
+	return tenants, nil
+}
+
+// readTenantsFile reads and checks the tenants file, returning the tenants
+// and their names in order
+func readTenantsFile(path string, base *Server) (map[string]TenantConfig, []string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read tenants file: %w", err)
+	}
+	var configs map[string]TenantConfig
+	if err := json.Unmarshal(data, &configs); err != nil {
+		return nil, nil, fmt.Errorf("failed to parse tenants file: %w", err)
+	}
+
+	names := make([]string, 0, len(configs))
+	for name := range configs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	// A token must identify exactly one tenant
+	owners := make(map[string]string)
+	for _, name := range names {
+		cfg := configs[name]
+		if !validHash(name) {
+			return nil, nil, fmt.Errorf("invalid tenant name %q", name)
+		}
+		if len(cfg.Tokens) == 0 {
+			return nil, nil, fmt.Errorf("tenant %s has no tokens", name)
+		}
+		for _, token := range cfg.Tokens {
+			if _, err := base.tokens.Lookup(token); err != errTokenUnknown {
+				return nil, nil, fmt.Errorf("tenant %s reuses a token of the default tenant", name)
+			}
+			if owner, ok := owners[token]; ok {
+				return nil, nil, fmt.Errorf("tenants %s and %s share a token", owner, name)
+			}
+			owners[token] = name
+		}
+		if _, err := cfg.limits(); err != nil {
+			return nil, nil, fmt.Errorf("failed to configure tenant %s: %w", name, err)
+		}
+	}
+	return configs, names, nil
+}
+
+// tenantLimits are the settings of a tenant that a reload can change
+type tenantLimits struct {
+	budget    ClassBudget
+	teamQuota int64
+	retention time.Duration
+	rate      float64
+	burst     int
+}
+
+func (cfg TenantConfig) limits() (tenantLimits, error) {
+	limits := tenantLimits{budget: ClassBudget{MaxFiles: cfg.MaxFiles}, rate: cfg.RateLimit, burst: cfg.Burst}
+	var err error
+	if cfg.Quota != "" {
+		if limits.budget.MaxSize, err = parseSize(cfg.Quota); err != nil {
+			return limits, fmt.Errorf("invalid quota: %w", err)
+		}
+	}
+	if cfg.TeamQuota != "" {
+		if limits.teamQuota, err = parseSize(cfg.TeamQuota); err != nil {
+			return limits, fmt.Errorf("invalid teamQuota: %w", err)
+		}
+	}
+	if cfg.Retention != "" {
+		if limits.retention, err = parseDuration(cfg.Retention); err != nil {
+			return limits, fmt.Errorf("invalid retention: %w", err)
+		}
+	}
+	if limits.burst <= 0 {
+		limits.burst = int(cfg.RateLimit) + 1
+	}
+	return limits, nil
+}
+
+// tenantTokens names the tokens of a tenant
+func tenantTokens(name string, cfg TenantConfig) map[string]string {
+	tokens := make(map[string]string, len(cfg.Tokens))
+	for i, token := range cfg.Tokens {
+		tokens[fmt.Sprintf("%s-%d", name, i+1)] = token
+	}
+	return tokens
+}
+
+// applyTenant updates a running tenant to its reloaded config
+func (s *Server) applyTenant(cfg TenantConfig) {
+	limits, _ := cfg.limits()
+	s.tokens.ReplaceStatic(tenantTokens(s.tenant, cfg))
+	s.quotas.SetLimits(map[string]ClassBudget{defaultClass: limits.budget}, limits.teamQuota, nil)
+	if s.classes[0].Evictor != nil {
+		s.classes[0].Evictor.SetBudget(limits.budget, 0.9)
+	}
+	s.expirer.SetMaxAge(limits.retention)
+	s.limiter.SetRate(limits.rate, limits.burst)
+}
+
+func newTenantServer(name string, cfg TenantConfig, cacheDir string, base *Server) (*Server, error) {
+	logger := log.New(base.logger.Writer(), "["+name+"] ", base.logger.Flags())
+	stateDir := filepath.Join(cacheDir, ".tenants", name)
+
+	backend := cfg.Backend
+	if backend == "" {
+		backend = "fs"
+	}
+	dir := cfg.Dir
+	if dir == "" {
+		dir = stateDir
+	}
+	storage, err := newBackend(tenantEnvPrefix(name), backend, dir)
+	if err != nil {
+		return nil, err
+	}
+	if storage, err = storageMonitors.Monitor(name+"/"+backend, storage); err != nil {
+		return nil, err
+	}
+	if storage, err = withStorageTimeout(storage); err != nil {
+		return nil, err
+	}
+
+	limits, err := cfg.limits()
+	if err != nil {
+		return nil, err
+	}
+	budget := limits.budget
+	if base.primary != nil {
+		storage = &ReadOnlyStorage{inner: storage}
+	}
+	classes := []*SizeClass{{Name: defaultClass, Storage: storage, Budget: budget}}
+
+	if base.primary == nil {
+		stateEnv := &migrationEnv{stateDir: stateDir, classes: classes, logger: logger}
+		if err := runMigrations(stateEnv); err != nil {
+			return nil, err
+		}
+		if err := removeStaleTempFiles(stateEnv); err != nil {
+			return nil, err
+		}
+	}
+	index, err := NewMetadataIndex(filepath.Join(stateDir, ".meta", "index.json"), map[string]Storage{defaultClass: storage}, logger)
+	if err != nil {
+		return nil, err
+	}
+	if err := journalFromEnv(index); err != nil {
+		return nil, err
+	}
+	go index.Run(10*time.Second, nil)
+
+	tokens, err := NewTokenStore("", base.tokens.expiryWarning, logger)
+	if err != nil {
+		return nil, err
+	}
+	tokens.ReplaceStatic(tenantTokens(name, cfg))
+
+	s := &Server{
+		classes:         classes,
+		index:           index,
+		quotas:          NewQuotaManager(index, map[string]ClassBudget{defaultClass: budget}, limits.teamQuota, nil, base.teams),
+		logger:          logger,
+		slogger:         base.slogger,
+		tokens:          tokens,
+		rotationOverlap: base.rotationOverlap,
+		signatures:      base.signatures,
+		maxEventBatch:   base.maxEventBatch,
+		maxBatch:        base.maxBatch,
+		rehydrateMode:   base.rehydrateMode,
+		rehydrateRetry:  base.rehydrateRetry,
+		teamCleanup:     base.teamCleanup,
+		teams:           base.teams,
+		uploadPolicies:  base.uploadPolicies,
+		primary:         base.primary,
+		teamNamespaces:  base.teamNamespaces,
+		maxArtifactSize: base.maxArtifactSize,
+		maxRequestBody:  base.maxRequestBody,
+		endpointLimits:  base.endpointLimits,
+		uploadLimit:     base.uploadLimit,
+		downloadLimit:   base.downloadLimit,
+		callbacks:       base.callbacks,
+		switches:        base.switches,
+		blocklist:       base.blocklist,
+		flags:           base.flags,
+		metadataHeaders: base.metadataHeaders,
+		digest:          base.digest,
+		transfers:       base.transfers,
+		compliance:      base.compliance,
+		events:          NewEventStats(),
+		clients:         base.clients,
+		metrics:         NewCacheMetrics(0),
+		requests:        base.requests,
+		tracer:          base.tracer,
+		tenant:          name,
+	}
+	s.runs, err = NewRunStore(filepath.Join(stateDir, ".runs"), logger)
+	if err != nil {
+		return nil, err
+	}
+	s.prefetch = NewPrefetcher(s.stageArtifact, 1, 1000, logger)
+
+	// Tenants with a budget evict the least recently used artifacts to stay
+	// in it; on a replica the primary does
+	if budget.limited() && base.primary == nil {
+		classes[0].Evictor = NewEvictor(defaultClass, index, storage, LRUPolicy{}, budget, 0.9, logger)
+		go classes[0].Evictor.Run(time.Minute, nil)
+	}
+	// The expirer and limiter run even when unset so a reload can set them
+	s.expirer = NewExpirer(index, classes, limits.retention, logger)
+	if base.primary == nil {
+		go s.expirer.Run(time.Hour, nil)
+	}
+	s.limiter = NewRequestLimiter(limits.rate, limits.burst)
+	return s, nil
+}
+
+// tenantEnvPrefix returns the variable prefix of a tenant's backend settings
+func tenantEnvPrefix(name string) string {
+	return "TURBO_TENANT_" + strings.ToUpper(strings.ReplaceAll(name, "-", "_")) + "_"
+}
+
+// resolveTenant finds the server owning a bearer token: the default tenant
+// first, then the configured tenants
+func (s *Server) resolveTenant(value string) (*Server, *Token, error) {
+	return s.findToken(func(tokens *TokenStore) (*Token, error) { return tokens.Lookup(value) })
+}
+
+// resolveTokenName finds the server owning the token a client certificate
+// names, in the same order
+func (s *Server) resolveTokenName(name string) (*Server, *Token, error) {
+	return s.findToken(func(tokens *TokenStore) (*Token, error) { return tokens.LookupName(name) })
+}
+
+func (s *Server) findToken(lookup func(*TokenStore) (*Token, error)) (*Server, *Token, error) {
+	token, err := lookup(s.tokens)
+	if err != errTokenUnknown {
+		return s, token, err
+	}
+	for _, tenant := range s.tenants {
+		token, err := lookup(tenant.tokens)
+		if err != errTokenUnknown {
+			return tenant, token, err
+		}
+	}
+	return s, nil, errTokenUnknown
+}
+
+// tenantByName returns the configured tenant with the given name, or nil
+func (s *Server) tenantByName(name string) *Server {
+	for _, t := range s.tenants {
+		if t.tenant == name {
+			return t
+		}
+	}
+	return nil
+}
+
+// Handler for /admin/tenants
+func (s *Server) listTenants(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	infos := make([]TenantInfo, 0, len(s.tenants))
+	for _, t := range s.tenants {
+		infos = append(infos, TenantInfo{
+			Name:      t.tenant,
+			Artifacts: t.index.ClassCount(defaultClass),
+			Size:      t.index.TotalSize(),
+			Quota:     t.quotas.ClassBudget(defaultClass).MaxSize,
+			Tokens:    len(t.tokens.List()),
+		})
+	}
+	s.writeList(w, r, infos, "name", "name")
+}
+
+// RequestLimiter is a token bucket limiting a tenant's request rate
+type RequestLimiter struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// NewRequestLimiter allows rate requests a second in bursts of up to burst
+// requests; a rate of 0 doesn't limit
+func NewRequestLimiter(rate float64, burst int) *RequestLimiter {
+	return &RequestLimiter{rate: rate, burst: float64(burst), tokens: float64(burst), last: time.Now()}
+}
+
+// SetRate changes the rate and burst, for a reload
+func (l *RequestLimiter) SetRate(rate float64, burst int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.rate, l.burst = rate, float64(burst)
+	if l.tokens > l.burst {
+		l.tokens = l.burst
+	}
+}
+
+// Allow takes a token from the bucket if one is available
+func (l *RequestLimiter) Allow() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.rate <= 0 {
+		return true
+	}
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.burst {
+		l.tokens = l.burst
+	}
+	l.last = now
+	if l.tokens < 1 {
+		return false
+	}
+	l.tokens--
+	return true
+}
@@ -0,0 +1,234 @@
+package cachesrv
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"time"
+)
+
+// TieredStorage keeps recently used artifacts on a local hot tier in front of
+// remote cold storage. The cold tier is authoritative: uploads are written
+// through to it, and hot copies can be dropped at any time.
+type TieredStorage struct {
+	hot     Storage
+	cold    Storage
+	maxSize int64
+
+	mu       sync.Mutex
+	entries  map[string]*hotEntry
+	hotBytes int64
+	staging  map[string]chan struct{}
+	// failed holds the error of a background Rehydrate until it is
+	// reported
+	failed map[string]error
+}
+
+type hotEntry struct {
+	size     int64
+	lastUsed time.Time
+}
+
+func NewTieredStorage(hot, cold Storage, maxSize int64) (*TieredStorage, error) {
+	t := &TieredStorage{
+		hot:     hot,
+		cold:    cold,
+		maxSize: maxSize,
+		entries: make(map[string]*hotEntry),
+		staging: make(map[string]chan struct{}),
+		failed:  make(map[string]error),
+	}
+	stored, err := hot.List()
+	if err != nil {
+		return nil, err
+	}
+	for _, a := range stored {
+		t.entries[a.Hash] = &hotEntry{size: a.Size, lastUsed: a.ModTime}
+		t.hotBytes += a.Size
+	}
+	t.trim()
+	return t, nil
+}
+
+// Describe passes artifact info on to both tiers
+func (t *TieredStorage) Describe(hash string, info ArtifactDetails) {
+	describeArtifact(t.hot, hash, info)
+	describeArtifact(t.cold, hash, info)
+}
+
+// Store writes to the hot tier and then through to the cold tier
+func (t *TieredStorage) Store(hash string, data io.Reader) error {
+	t.forget(hash)
+	if err := t.hot.Store(hash, data); err != nil {
+		return err
+	}
+
+	reader, size, err := t.hot.Get(hash)
+	if err != nil {
+		return err
+	}
+	err = t.cold.Store(hash, reader)
+	reader.Close()
+	if err != nil {
+		t.hot.Delete(hash)
+		return err
+	}
+	t.added(hash, size)
+	return nil
+}
+
+// Get serves from the hot tier, staging the artifact from cold storage on a
+// miss. If the hot tier can't take it, the cold copy is streamed directly.
+func (t *TieredStorage) Get(hash string) (io.ReadCloser, int64, error) {
+	if t.isHot(hash) {
+		if reader, size, err := t.hot.Get(hash); err == nil {
+			return reader, size, nil
+		}
+	}
+	if err := t.Stage(hash); err == nil {
+		if reader, size, err := t.hot.Get(hash); err == nil {
+			return reader, size, nil
+		}
+	}
+	return t.cold.Get(hash)
+}
+
+func (t *TieredStorage) Exists(hash string) (bool, error) {
+	if t.isHot(hash) {
+		return true, nil
+	}
+	return t.cold.Exists(hash)
+}
+
+func (t *TieredStorage) Delete(hash string) error {
+	t.forget(hash)
+	return t.cold.Delete(hash)
+}
+
+func (t *TieredStorage) List() ([]ArtifactStat, error) {
+	return t.cold.List()
+}
+
+// Stage copies an artifact from cold storage to the hot tier unless it is
+// already there; concurrent calls for the same artifact share one copy
+func (t *TieredStorage) Stage(hash string) error {
+	t.mu.Lock()
+	if _, ok := t.entries[hash]; ok {
+		t.mu.Unlock()
+		return nil
+	}
+	if wait, ok := t.staging[hash]; ok {
+		t.mu.Unlock()
+		<-wait
+		return nil
+	}
+	done := make(chan struct{})
+	t.staging[hash] = done
+	t.mu.Unlock()
+
+	defer func() {
+		t.mu.Lock()
+		delete(t.staging, hash)
+		t.mu.Unlock()
+		close(done)
+	}()
+
+	reader, size, err := t.cold.Get(hash)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+	if err := t.hot.Store(hash, reader); err != nil {
+		return fmt.Errorf("failed to stage artifact: %w", err)
+	}
+	t.added(hash, size)
+	return nil
+}
+
+// Rehydrate reports whether an artifact is on the hot tier, starting to
+// stage it in the background otherwise. A failed background copy is
+// returned by the next call, which doesn't start another.
+func (t *TieredStorage) Rehydrate(hash string) (bool, error) {
+	if t.isHot(hash) {
+		return true, nil
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if err, ok := t.failed[hash]; ok {
+		delete(t.failed, hash)
+		return false, err
+	}
+	if _, ok := t.staging[hash]; !ok {
+		go func() {
+			if err := t.Stage(hash); err != nil {
+				t.mu.Lock()
+				t.failed[hash] = err
+				t.mu.Unlock()
+			}
+		}()
+	}
+	return false, nil
+}
+
+// isHot reports whether a complete hot copy exists, marking it used
+func (t *TieredStorage) isHot(hash string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	e, ok := t.entries[hash]
+	if ok {
+		e.lastUsed = time.Now()
+	}
+	return ok
+}
+
+func (t *TieredStorage) added(hash string, size int64) {
+	t.mu.Lock()
+	if e, ok := t.entries[hash]; ok {
+		t.hotBytes -= e.size
+	}
+	t.entries[hash] = &hotEntry{size: size, lastUsed: time.Now()}
+	t.hotBytes += size
+	t.mu.Unlock()
+	t.trim()
+}
+
+func (t *TieredStorage) forget(hash string) {
+	t.mu.Lock()
+	if e, ok := t.entries[hash]; ok {
+		t.hotBytes -= e.size
+		delete(t.entries, hash)
+	}
+	t.mu.Unlock()
+	t.hot.Delete(hash)
+}
+
+// trim drops the least recently used hot copies while over the hot budget
+func (t *TieredStorage) trim() {
+	t.mu.Lock()
+	if t.maxSize <= 0 || t.hotBytes <= t.maxSize {
+		t.mu.Unlock()
+		return
+	}
+	hashes := make([]string, 0, len(t.entries))
+	for hash := range t.entries {
+		hashes = append(hashes, hash)
+	}
+	sort.Slice(hashes, func(i, j int) bool {
+		return t.entries[hashes[i]].lastUsed.Before(t.entries[hashes[j]].lastUsed)
+	})
+	var drop []string
+	for _, hash := range hashes {
+		if t.hotBytes <= t.maxSize {
+			break
+		}
+		t.hotBytes -= t.entries[hash].size
+		delete(t.entries, hash)
+		drop = append(drop, hash)
+	}
+	t.mu.Unlock()
+
+	for _, hash := range drop {
+		t.hot.Delete(hash)
+	}
+}
@@ -0,0 +1,228 @@
+package cachesrv
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+var errStorageTimeout = errors.New("storage operation timed out")
+
+// TimeoutStorage bounds how long a storage operation may block, so a hung
+// NFS mount or backend fails requests instead of piling up goroutines.
+// Streams are bounded by inactivity rather than total time: a download fails
+// once a read makes no progress for the timeout, an upload once storage stops
+// consuming data. A timed out call keeps running in the background until the
+// underlying syscall returns; its result is discarded.
+type TimeoutStorage struct {
+	inner   Storage
+	timeout time.Duration
+}
+
+func NewTimeoutStorage(inner Storage, timeout time.Duration) *TimeoutStorage {
+	return &TimeoutStorage{inner: inner, timeout: timeout}
+}
+
+// Unwrap returns the wrapped storage
+func (t *TimeoutStorage) Unwrap() Storage {
+	return t.inner
+}
+
+// do runs op, giving up after the timeout
+func (t *TimeoutStorage) do(name, hash string, op func() error) error {
+	done := make(chan error, 1)
+	go func() { done <- op() }()
+	timer := time.NewTimer(t.timeout)
+	defer timer.Stop()
+	select {
+	case err := <-done:
+		return err
+	case <-timer.C:
+		return fmt.Errorf("%w: %s %s after %v", errStorageTimeout, name, hash, t.timeout)
+	}
+}
+
+// Store aborts once storage has not asked for more data within the timeout
+func (t *TimeoutStorage) Store(hash string, data io.Reader) error {
+	pr := &progressReader{r: data, last: time.Now()}
+	done := make(chan error, 1)
+	go func() { done <- t.inner.Store(hash, pr) }()
+
+	ticker := time.NewTicker(t.timeout / 4)
+	defer ticker.Stop()
+	for {
+		select {
+		case err := <-done:
+			return err
+		case <-ticker.C:
+			// Failing further reads makes the backend clean up its partial write
+			if pr.abortIfStalled(t.timeout) {
+				return fmt.Errorf("%w: store %s stalled for %v", errStorageTimeout, hash, t.timeout)
+			}
+		}
+	}
+}
+
+func (t *TimeoutStorage) Get(hash string) (io.ReadCloser, int64, error) {
+	type opened struct {
+		reader io.ReadCloser
+		size   int64
+		err    error
+	}
+	done := make(chan opened, 1)
+	go func() {
+		reader, size, err := t.inner.Get(hash)
+		done <- opened{reader, size, err}
+	}()
+	timer := time.NewTimer(t.timeout)
+	defer timer.Stop()
+	select {
+	case o := <-done:
+		if o.err != nil {
+			return nil, 0, o.err
+		}
+		return &timeoutReader{rc: o.reader, timeout: t.timeout}, o.size, nil
+	case <-timer.C:
+		// Close the reader if the open ever completes
+		go func() {
+			if o := <-done; o.err == nil {
+				o.reader.Close()
+			}
+		}()
+		return nil, 0, fmt.Errorf("%w: get %s after %v", errStorageTimeout, hash, t.timeout)
+	}
+}
+
+func (t *TimeoutStorage) Exists(hash string) (bool, error) {
+	var exists bool
+	err := t.do("exists", hash, func() error {
+		var err error
+		exists, err = t.inner.Exists(hash)
+		return err
+	})
+	if errors.Is(err, errStorageTimeout) {
+		return false, err
+	}
+	return exists, err
+}
+
+func (t *TimeoutStorage) Delete(hash string) error {
+	return t.do("delete", hash, func() error { return t.inner.Delete(hash) })
+}
+
+// List is not bounded: listing a large bucket legitimately takes long, and it
+// only runs at startup and during maintenance scans
+func (t *TimeoutStorage) List() ([]ArtifactStat, error) {
+	return t.inner.List()
+}
+
+// progressReader tracks when storage last pulled data from an upload. Time
+// spent waiting on the client inside Read doesn't count as a stall.
+type progressReader struct {
+	r io.Reader
+
+	mu      sync.Mutex
+	reading bool
+	last    time.Time
+	aborted bool
+}
+
+func (p *progressReader) Read(b []byte) (int, error) {
+	p.mu.Lock()
+	if p.aborted {
+		p.mu.Unlock()
+		return 0, errStorageTimeout
+	}
+	p.reading = true
+	p.mu.Unlock()
+
+	n, err := p.r.Read(b)
+
+	p.mu.Lock()
+	p.reading = false
+	p.last = time.Now()
+	p.mu.Unlock()
+	return n, err
+}
+
+// abortIfStalled fails all further reads if storage has not read for d
+func (p *progressReader) abortIfStalled(d time.Duration) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.reading || time.Since(p.last) < d {
+		return false
+	}
+	p.aborted = true
+	return true
+}
+
+// timeoutReader fails a read that makes no progress within the timeout. Reads
+// go through a private buffer so a read that returns late can't write into
+// the caller's buffer after it was given up on.
+type timeoutReader struct {
+	rc      io.ReadCloser
+	timeout time.Duration
+	buf     []byte
+	err     error
+}
+
+type readResult struct {
+	n   int
+	err error
+}
+
+func (t *timeoutReader) Read(p []byte) (int, error) {
+	if t.err != nil {
+		return 0, t.err
+	}
+	if len(t.buf) < len(p) {
+		t.buf = make([]byte, len(p))
+	}
+	buf := t.buf[:len(p)]
+	done := make(chan readResult, 1)
+	go func() {
+		n, err := t.rc.Read(buf)
+		done <- readResult{n, err}
+	}()
+	timer := time.NewTimer(t.timeout)
+	defer timer.Stop()
+	select {
+	case res := <-done:
+		copy(p, buf[:res.n])
+		return res.n, res.err
+	case <-timer.C:
+		t.err = fmt.Errorf("%w: read stalled for %v", errStorageTimeout, t.timeout)
+		return 0, t.err
+	}
+}
+
+func (t *timeoutReader) Close() error {
+	if t.err != nil {
+		// A hung read may block Close as well
+		go t.rc.Close()
+		return nil
+	}
+	return t.rc.Close()
+}
+
+// unwrapStorage strips wrappers such as TimeoutStorage to reach the backend
+func unwrapStorage(storage Storage) Storage {
+	for {
+		w, ok := storage.(interface{ Unwrap() Storage })
+		if !ok {
+			return storage
+		}
+		storage = w.Unwrap()
+	}
+}
+
+// withStorageTimeout applies TURBO_STORAGE_TIMEOUT to a storage backend
+func withStorageTimeout(storage Storage) (Storage, error) {
+	timeout, err := envDuration("TURBO_STORAGE_TIMEOUT", 0)
+	if err != nil || timeout <= 0 {
+		return storage, err
+	}
+	return NewTimeoutStorage(storage, timeout), nil
+}
@@ -0,0 +1,184 @@
+package cachesrv
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// With TURBO_TLS_CERT and TURBO_TLS_KEY the server speaks HTTPS itself, so
+// bearer tokens never cross the network in cleartext without a reverse
+// proxy in front. With TURBO_TLS_CLIENT_CA clients also authenticate with a
+// certificate, so CI doesn't need a token that may end up in its logs.
+
+// CertificateFile is a certificate and key read from PEM files, read again
+// on reload so a renewed certificate is served without a restart
+type CertificateFile struct {
+	certPath, keyPath string
+
+	mu   sync.RWMutex
+	cert *tls.Certificate
+}
+
+func LoadCertificateFile(certPath, keyPath string) (*CertificateFile, error) {
+	cf := &CertificateFile{certPath: certPath, keyPath: keyPath}
+	if err := cf.Reload(); err != nil {
+		return nil, err
+	}
+	return cf, nil
+}
+
+// Reload reads the files again; on error the previous certificate stays
+func (cf *CertificateFile) Reload() error {
+	cert, err := tls.LoadX509KeyPair(cf.certPath, cf.keyPath)
+	if err != nil {
+		return fmt.Errorf("failed to load TLS certificate: %w", err)
+	}
+	cf.mu.Lock()
+	defer cf.mu.Unlock()
+	cf.cert = &cert
+	return nil
+}
+
+// GetCertificate serves the current certificate to every handshake
+func (cf *CertificateFile) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cf.mu.RLock()
+	defer cf.mu.RUnlock()
+	return cf.cert, nil
+}
+
+// tlsConfigFromEnv returns the TLS settings of the listener, or nil if
+// TLS is off
+func tlsConfigFromEnv() (*tls.Config, *CertificateFile, error) {
+	certPath, keyPath := getenv("TURBO_TLS_CERT"), getenv("TURBO_TLS_KEY")
+	if certPath == "" && keyPath == "" {
+		return nil, nil, nil
+	}
+	if certPath == "" || keyPath == "" {
+		return nil, nil, errors.New("TURBO_TLS_CERT and TURBO_TLS_KEY must be set together")
+	}
+	certs, err := LoadCertificateFile(certPath, keyPath)
+	if err != nil {
+		return nil, nil, err
+	}
+	config, err := newTLSConfig(certs.GetCertificate)
+	if err != nil {
+		return nil, nil, err
+	}
+	return config, certs, nil
+}
+
+// newTLSConfig returns the TLS settings shared by certificate files and
+// ACME, with TURBO_TLS_MIN_VERSION
+func newTLSConfig(getCertificate func(*tls.ClientHelloInfo) (*tls.Certificate, error)) (*tls.Config, error) {
+	config := &tls.Config{
+		GetCertificate:   getCertificate,
+		CurvePreferences: []tls.CurveID{tls.X25519, tls.CurveP256},
+		// TLS 1.3 picks its own suites; these are the forward secret AEAD
+		// suites of TLS 1.2
+		CipherSuites: []uint16{
+			tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+			tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+			tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+			tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+			tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256,
+			tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256,
+		},
+	}
+	switch version := envString("TURBO_TLS_MIN_VERSION", "1.2"); version {
+	case "1.2":
+		config.MinVersion = tls.VersionTLS12
+	case "1.3":
+		config.MinVersion = tls.VersionTLS13
+	default:
+		return nil, fmt.Errorf("invalid TURBO_TLS_MIN_VERSION %q (expected 1.2 or 1.3)", version)
+	}
+	_, clientCAs, err := clientAuthFromEnv()
+	if err != nil {
+		return nil, err
+	}
+	if clientCAs != nil {
+		// The handshake checks certificates, but only the turbo API requires
+		// one, so health checks and the admin API work without
+		config.ClientCAs = clientCAs
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	return config, nil
+}
+
+// Client certificate modes of TURBO_TLS_CLIENT_AUTH
+const (
+	clientCertEither = "either" // a certificate or a token
+	clientCertOnly   = "cert"   // a certificate; tokens are refused
+	clientCertBoth   = "both"   // a certificate and the token named like it
+)
+
+// clientAuthFromEnv returns the client certificate mode and the CAs whose
+// client certificates are accepted, or "" without TURBO_TLS_CLIENT_CA
+func clientAuthFromEnv() (string, *x509.CertPool, error) {
+	path := getenv("TURBO_TLS_CLIENT_CA")
+	if path == "" {
+		return "", nil, nil
+	}
+	mode := envString("TURBO_TLS_CLIENT_AUTH", clientCertBoth)
+	switch mode {
+	case clientCertEither, clientCertOnly, clientCertBoth:
+	default:
+		return "", nil, fmt.Errorf("invalid TURBO_TLS_CLIENT_AUTH %q (expected either, cert or both)", mode)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to read TURBO_TLS_CLIENT_CA: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return "", nil, fmt.Errorf("no PEM certificates in TURBO_TLS_CLIENT_CA %s", path)
+	}
+	return mode, pool, nil
+}
+
+// clientCertificate returns the verified client certificate of a request,
+// or nil
+func clientCertificate(r *http.Request) *x509.Certificate {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+		return nil
+	}
+	return r.TLS.VerifiedChains[0][0]
+}
+
+// redirectToHTTPS answers plain HTTP requests with a permanent redirect to
+// the same URL on the HTTPS listener
+func redirectToHTTPS(listen string) http.Handler {
+	_, port, _ := net.SplitHostPort(listen)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		if strings.Contains(host, ":") {
+			host = "[" + host + "]"
+		}
+		if port != "" && port != "443" {
+			host += ":" + port
+		}
+		// 308 keeps the method and body of uploads
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusPermanentRedirect)
+	})
+}
+
+// serveRedirects serves the HTTP to HTTPS redirect, or another handler
+// wrapping it, on addr
+func (s *Server) serveRedirects(addr string, handler http.Handler) {
+	s.logger.Printf("Redirecting HTTP on %s to HTTPS", addr)
+	server := &http.Server{Addr: addr, Handler: handler, ReadHeaderTimeout: 10 * time.Second}
+	if err := server.ListenAndServe(); err != nil {
+		s.logger.Fatal(err)
+	}
+}
@@ -0,0 +1,594 @@
+package cachesrv
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+var (
+	errTokenUnknown  = errors.New("unknown token")
+	errTokenExpired  = errors.New("token expired")
+	errTokenNotFound = errors.New("token not found")
+	errTokenStatic   = errors.New("token is configured from the environment and cannot be rotated or revoked")
+	errTokenExists   = errors.New("token name already in use")
+)
+
+// Token scopes: read tokens may only download, admin tokens are also
+// accepted by the admin API. Tokens without a scope can read and write.
+const (
+	scopeRead      = "read"
+	scopeReadWrite = "read-write"
+	scopeAdmin     = "admin"
+)
+
+// Token is a bearer credential accepted by the artifact endpoints. Only the
+// hash of its value is kept; a value written into the tokens file by hand is
+// replaced by its hash when the file is read.
+type Token struct {
+	ID         string     `json:"id"`
+	Name       string     `json:"name"`
+	Value      string     `json:"token,omitempty"`
+	Hash       string     `json:"hash,omitempty"`
+	CreatedAt  time.Time  `json:"createdAt"`
+	ExpiresAt  *time.Time `json:"expiresAt,omitempty"`
+	ReplacedBy string     `json:"replacedBy,omitempty"`
+	// Priority is the class of TURBO_PRIORITY_CLASSES its requests wait in
+	Priority string `json:"priority,omitempty"`
+	Scope    string `json:"scope,omitempty"`
+	// Teams limits the token to these teams, see TURBO_TEAM_NAMESPACES
+	Teams []string `json:"teams,omitempty"`
+
+	// static tokens come from the environment and are never persisted
+	static bool
+}
+
+// hashToken returns the hex SHA-256 of a token value. Token values are long
+// random strings, so a plain hash is enough to keep them from being guessed.
+func hashToken(value string) string {
+	sum := sha256.Sum256([]byte(value))
+	return hex.EncodeToString(sum[:])
+}
+
+func (t *Token) expired(now time.Time) bool {
+	return t.ExpiresAt != nil && !now.Before(*t.ExpiresAt)
+}
+
+func (t *Token) expiresWithin(now time.Time, d time.Duration) bool {
+	return t.ExpiresAt != nil && t.ExpiresAt.Sub(now) <= d
+}
+
+func (t *Token) canWrite() bool {
+	return t.Scope != scopeRead
+}
+
+// isCacheWrite reports whether a request changes the cache, which read
+// tokens may not do. Queries, prefetches and events only read.
+func isCacheWrite(r *http.Request) bool {
+	switch r.Method {
+	case http.MethodPut, http.MethodDelete:
+		return true
+	case http.MethodPost:
+		return route(r) == "/v8/artifacts/batch" || route(r) == "/v8/runs"
+	}
+	return false
+}
+
+// TokenInfo is the admin view of a token; the secret value is never included
+type TokenInfo struct {
+	ID               string     `json:"id"`
+	Name             string     `json:"name"`
+	CreatedAt        time.Time  `json:"createdAt"`
+	ExpiresAt        *time.Time `json:"expiresAt,omitempty"`
+	ReplacedBy       string     `json:"replacedBy,omitempty"`
+	Priority         string     `json:"priority,omitempty"`
+	Scope            string     `json:"scope"`
+	Teams            []string   `json:"teams,omitempty"`
+	Static           bool       `json:"static,omitempty"`
+	Expired          bool       `json:"expired"`
+	ExpiresSoon      bool       `json:"expiresSoon"`
+	SoonToExpireUses int64      `json:"soonToExpireUses"`
+	Usage            TokenUsage `json:"usage"`
+}
+
+// TokenUsage aggregates the traffic seen for a single token since startup
+type TokenUsage struct {
+	Requests   int64      `json:"requests"`
+	BytesIn    int64      `json:"bytesIn"`
+	BytesOut   int64      `json:"bytesOut"`
+	Hits       int64      `json:"hits"`
+	Misses     int64      `json:"misses"`
+	HitRate    float64    `json:"hitRate"`
+	LastUsedAt *time.Time `json:"lastUsedAt,omitempty"`
+}
+
+// TokenStore holds the accepted tokens, persisted as JSON when a path is configured
+type TokenStore struct {
+	mu            sync.RWMutex
+	path          string
+	tokens        []*Token
+	expiryWarning time.Duration
+	logger        *log.Logger
+
+	// soonToExpireUses counts requests made with tokens inside the warning window
+	soonToExpireUses map[string]int64
+	lastWarned       map[string]time.Time
+	usage            map[string]*TokenUsage
+}
+
+func NewTokenStore(path string, expiryWarning time.Duration, logger *log.Logger) (*TokenStore, error) {
+	ts := &TokenStore{
+		path:             path,
+		expiryWarning:    expiryWarning,
+		logger:           logger,
+		soonToExpireUses: make(map[string]int64),
+		lastWarned:       make(map[string]time.Time),
+		usage:            make(map[string]*TokenUsage),
+	}
+	tokens, dirty, err := readTokensFile(path)
+	if err != nil {
+		return nil, err
+	}
+	ts.tokens = tokens
+	if dirty {
+		if err := ts.save(); err != nil {
+			return nil, err
+		}
+	}
+	return ts, nil
+}
+
+// readTokensFile reads the persisted tokens, hashing plain values and filling
+// in missing IDs and creation times; it reports whether it changed any
+func readTokensFile(path string) ([]*Token, bool, error) {
+	if path == "" {
+		return nil, false, nil
+	}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to read tokens file: %w", err)
+	}
+	var tokens []*Token
+	if err := json.Unmarshal(data, &tokens); err != nil {
+		return nil, false, fmt.Errorf("failed to parse tokens file: %w", err)
+	}
+
+	dirty := false
+	for _, t := range tokens {
+		if t.Value == "" && t.Hash == "" {
+			return nil, false, fmt.Errorf("token %q in tokens file has no value", t.Name)
+		}
+		if t.Value != "" {
+			t.Hash, t.Value = hashToken(t.Value), ""
+			dirty = true
+		}
+		switch t.Scope {
+		case "", scopeRead, scopeReadWrite, scopeAdmin:
+		default:
+			return nil, false, fmt.Errorf("token %q in tokens file has invalid scope %q (expected read, read-write or admin)", t.Name, t.Scope)
+		}
+		if t.ID == "" {
+			if t.ID, err = randomHex(8); err != nil {
+				return nil, false, err
+			}
+			dirty = true
+		}
+		if t.CreatedAt.IsZero() {
+			t.CreatedAt = time.Now()
+			dirty = true
+		}
+	}
+	return tokens, dirty, nil
+}
+
+// Reload reads the tokens file again, replacing the persisted tokens; the
+// static ones are kept. The lock is held from the read to the replace, so a
+// token created or rotated meanwhile is either in the file or not yet made.
+func (ts *TokenStore) Reload() error {
+	if ts.path == "" {
+		return nil
+	}
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	tokens, dirty, err := readTokensFile(ts.path)
+	if err != nil {
+		return err
+	}
+	kept := make([]*Token, 0, len(tokens))
+	for _, t := range ts.tokens {
+		if t.static {
+			kept = append(kept, t)
+		}
+	}
+	ts.tokens = append(kept, tokens...)
+	if dirty {
+		return ts.save()
+	}
+	return nil
+}
+
+// AddStatic registers a non-persisted token such as TURBO_AUTH_TOKEN
+func (ts *TokenStore) AddStatic(name, value string) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	ts.tokens = append(ts.tokens, &Token{
+		ID:        name,
+		Name:      name,
+		Hash:      hashToken(value),
+		CreatedAt: time.Now(),
+		static:    true,
+	})
+}
+
+// ReplaceStatic swaps the static tokens for the given name to value map,
+// keeping the creation time of those whose value didn't change
+func (ts *TokenStore) ReplaceStatic(values map[string]string) {
+	now := time.Now()
+
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	previous := make(map[string]*Token)
+	tokens := make([]*Token, 0, len(ts.tokens))
+	for _, t := range ts.tokens {
+		if t.static {
+			previous[t.Name] = t
+		} else {
+			tokens = append(tokens, t)
+		}
+	}
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	static := make([]*Token, 0, len(names))
+	for _, name := range names {
+		hash := hashToken(values[name])
+		if t, ok := previous[name]; ok && t.Hash == hash {
+			static = append(static, t)
+			continue
+		}
+		static = append(static, &Token{ID: name, Name: name, Hash: hash, CreatedAt: now, static: true})
+	}
+	ts.tokens = append(static, tokens...)
+}
+
+// Lookup resolves a bearer value to its token, rejecting expired ones
+func (ts *TokenStore) Lookup(value string) (*Token, error) {
+	now := time.Now()
+
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	hash := []byte(hashToken(value))
+	for _, t := range ts.tokens {
+		if subtle.ConstantTimeCompare([]byte(t.Hash), hash) == 1 {
+			return t, ts.checkExpiry(t, now)
+		}
+	}
+	return nil, errTokenUnknown
+}
+
+// LookupName resolves the name of a client certificate to the current
+// token of that name, rejecting it if expired
+func (ts *TokenStore) LookupName(name string) (*Token, error) {
+	now := time.Now()
+
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	for _, t := range ts.tokens {
+		if t.Name == name && t.ReplacedBy == "" {
+			return t, ts.checkExpiry(t, now)
+		}
+	}
+	return nil, errTokenUnknown
+}
+
+// checkExpiry fails for expired tokens and counts uses of soon to expire
+// ones; callers must hold the lock
+func (ts *TokenStore) checkExpiry(t *Token, now time.Time) error {
+	if t.expired(now) {
+		return errTokenExpired
+	}
+	if t.expiresWithin(now, ts.expiryWarning) {
+		ts.soonToExpireUses[t.ID]++
+		if now.Sub(ts.lastWarned[t.ID]) > time.Hour {
+			ts.lastWarned[t.ID] = now
+			ts.logger.Printf("Token %s (%s) expires at %s and is still in use",
+				t.Name, t.ID, t.ExpiresAt.Format(time.RFC3339))
+		}
+	}
+	return nil
+}
+
+// Rotate mints a replacement for the token with the given ID or name and lets
+// the old one keep working for the overlap window. The replacement's value is
+// returned only here.
+func (ts *TokenStore) Rotate(ref string, overlap, lifetime time.Duration) (*Token, string, error) {
+	now := time.Now()
+
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	old := ts.find(ref)
+	if old == nil {
+		return nil, "", errTokenNotFound
+	}
+	if old.static {
+		return nil, "", errTokenStatic
+	}
+
+	value, err := randomHex(32)
+	if err != nil {
+		return nil, "", err
+	}
+	id, err := randomHex(8)
+	if err != nil {
+		return nil, "", err
+	}
+
+	replacement := &Token{
+		ID:        id,
+		Name:      old.Name,
+		Hash:      hashToken(value),
+		CreatedAt: now,
+		Priority:  old.Priority,
+		Scope:     old.Scope,
+		Teams:     old.Teams,
+	}
+	if lifetime > 0 {
+		expires := now.Add(lifetime)
+		replacement.ExpiresAt = &expires
+	}
+
+	expiresAt, replacedBy := old.ExpiresAt, old.ReplacedBy
+	deprecated := now.Add(overlap)
+	if old.ExpiresAt == nil || old.ExpiresAt.After(deprecated) {
+		old.ExpiresAt = &deprecated
+	}
+	old.ReplacedBy = replacement.ID
+
+	ts.tokens = append(ts.tokens, replacement)
+	if err := ts.save(); err != nil {
+		ts.tokens = ts.tokens[:len(ts.tokens)-1]
+		old.ExpiresAt, old.ReplacedBy = expiresAt, replacedBy
+		return nil, "", err
+	}
+	return replacement, value, nil
+}
+
+// Create mints a token, persisting it with the others, and returns its value,
+// which isn't kept. Names stay unique among the current tokens, as client
+// certificates and rotation refer to them.
+func (ts *TokenStore) Create(name, scope, priority string, teams []string, lifetime time.Duration) (*Token, string, error) {
+	now := time.Now()
+
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	for _, t := range ts.tokens {
+		if t.Name == name && t.ReplacedBy == "" && !t.expired(now) {
+			return nil, "", errTokenExists
+		}
+	}
+	value, err := randomHex(32)
+	if err != nil {
+		return nil, "", err
+	}
+	id, err := randomHex(8)
+	if err != nil {
+		return nil, "", err
+	}
+	token := &Token{
+		ID:        id,
+		Name:      name,
+		Hash:      hashToken(value),
+		CreatedAt: now,
+		Priority:  priority,
+		Scope:     scope,
+		Teams:     teams,
+	}
+	if lifetime > 0 {
+		expires := now.Add(lifetime)
+		token.ExpiresAt = &expires
+	}
+
+	ts.tokens = append(ts.tokens, token)
+	if err := ts.save(); err != nil {
+		ts.tokens = ts.tokens[:len(ts.tokens)-1]
+		return nil, "", err
+	}
+	return token, value, nil
+}
+
+// Revoke removes the token with the given ID at once, or given a name every
+// token of that name, including those still being rotated out
+func (ts *TokenStore) Revoke(ref string) ([]*Token, error) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	// By name, tokens being rotated out go too, even without a current one
+	match := func(t *Token) bool { return t.Name == ref }
+	if found := ts.find(ref); found != nil && found.ID == ref {
+		match = func(t *Token) bool { return t == found }
+	}
+	var kept, revoked []*Token
+	for _, t := range ts.tokens {
+		switch {
+		case !match(t):
+			kept = append(kept, t)
+		case t.static:
+			return nil, errTokenStatic
+		default:
+			revoked = append(revoked, t)
+		}
+	}
+	if len(revoked) == 0 {
+		return nil, errTokenNotFound
+	}
+
+	previous := ts.tokens
+	ts.tokens = kept
+	if err := ts.save(); err != nil {
+		ts.tokens = previous
+		return nil, err
+	}
+	for _, t := range revoked {
+		delete(ts.usage, t.ID)
+		delete(ts.soonToExpireUses, t.ID)
+		delete(ts.lastWarned, t.ID)
+	}
+	return revoked, nil
+}
+
+// List returns the admin view of all tokens
+func (ts *TokenStore) List() []TokenInfo {
+	now := time.Now()
+
+	ts.mu.RLock()
+	defer ts.mu.RUnlock()
+
+	infos := make([]TokenInfo, 0, len(ts.tokens))
+	for _, t := range ts.tokens {
+		infos = append(infos, ts.info(t, now))
+	}
+	return infos
+}
+
+// Info returns the admin view of the token with the given ID or name
+func (ts *TokenStore) Info(ref string) (TokenInfo, error) {
+	ts.mu.RLock()
+	defer ts.mu.RUnlock()
+
+	t := ts.find(ref)
+	if t == nil {
+		return TokenInfo{}, errTokenNotFound
+	}
+	return ts.info(t, time.Now()), nil
+}
+
+// info builds the admin view of a token; callers must hold the lock
+func (ts *TokenStore) info(t *Token, now time.Time) TokenInfo {
+	scope := t.Scope
+	if scope == "" {
+		scope = scopeReadWrite
+	}
+	return TokenInfo{
+		ID:               t.ID,
+		Name:             t.Name,
+		CreatedAt:        t.CreatedAt,
+		ExpiresAt:        t.ExpiresAt,
+		ReplacedBy:       t.ReplacedBy,
+		Priority:         t.Priority,
+		Scope:            scope,
+		Teams:            t.Teams,
+		Static:           t.static,
+		Expired:          t.expired(now),
+		ExpiresSoon:      !t.expired(now) && t.expiresWithin(now, ts.expiryWarning),
+		SoonToExpireUses: ts.soonToExpireUses[t.ID],
+		Usage:            ts.usageOf(t.ID),
+	}
+}
+
+// RecordUsage accounts a completed request against its token. GET and HEAD
+// requests for a single artifact count as a hit or miss depending on status.
+func (ts *TokenStore) RecordUsage(t *Token, r *http.Request, status int, bytesIn, bytesOut int64) {
+	now := time.Now()
+
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	u, ok := ts.usage[t.ID]
+	if !ok {
+		u = &TokenUsage{}
+		ts.usage[t.ID] = u
+	}
+	u.Requests++
+	u.BytesIn += bytesIn
+	u.BytesOut += bytesOut
+	u.LastUsedAt = &now
+
+	if isArtifactRead(r) {
+		switch status {
+		case http.StatusOK:
+			u.Hits++
+		case http.StatusNotFound:
+			u.Misses++
+		}
+	}
+}
+
+// usageOf returns a copy of the usage counters; callers must hold the lock
+func (ts *TokenStore) usageOf(id string) TokenUsage {
+	u, ok := ts.usage[id]
+	if !ok {
+		return TokenUsage{}
+	}
+	usage := *u
+	if lookups := u.Hits + u.Misses; lookups > 0 {
+		usage.HitRate = float64(u.Hits) / float64(lookups)
+	}
+	return usage
+}
+
+func isArtifactRead(r *http.Request) bool {
+	return route(r) == artifactRoute && (r.Method == http.MethodGet || r.Method == http.MethodHead)
+}
+
+// find prefers an exact ID match, then the current (not yet replaced) token with that name
+func (ts *TokenStore) find(ref string) *Token {
+	for _, t := range ts.tokens {
+		if t.ID == ref {
+			return t
+		}
+	}
+	for _, t := range ts.tokens {
+		if t.Name == ref && t.ReplacedBy == "" {
+			return t
+		}
+	}
+	return nil
+}
+
+// save writes the persisted tokens atomically; callers must hold the lock
+func (ts *TokenStore) save() error {
+	if ts.path == "" {
+		return nil
+	}
+
+	persisted := make([]*Token, 0, len(ts.tokens))
+	for _, t := range ts.tokens {
+		if !t.static {
+			persisted = append(persisted, t)
+		}
+	}
+	data, err := json.MarshalIndent(persisted, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode tokens: %w", err)
+	}
+
+	return writeFileAtomic(ts.path, data, 0600)
+}
+
+func randomHex(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("failed to generate random value: %w", err)
+	}
+	return hex.EncodeToString(b), nil
+}
@@ -0,0 +1,231 @@
+package cachesrv
+
+import (
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestTokenStore(t *testing.T, contents string) (*TokenStore, string) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "tokens.json")
+	if contents != "" {
+		if err := os.WriteFile(path, []byte(contents), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ts, err := NewTokenStore(path, 24*time.Hour, log.New(io.Discard, "", 0))
+	if err != nil {
+		t.Fatalf("NewTokenStore: %v", err)
+	}
+	return ts, path
+}
+
+func TestTokenStoreLookup(t *testing.T) {
+	past := time.Now().Add(-time.Hour).Format(time.RFC3339)
+	future := time.Now().Add(time.Hour).Format(time.RFC3339)
+	ts, path := newTestTokenStore(t, `[
+		{"name": "ci", "token": "ci-secret"},
+		{"name": "old", "token": "old-secret", "expiresAt": "`+past+`"},
+		{"name": "soon", "token": "soon-secret", "expiresAt": "`+future+`"},
+		{"name": "hashed", "hash": "`+hashToken("hashed-secret")+`"}
+	]`)
+	ts.AddStatic("default", "static-secret")
+
+	tests := []struct {
+		value string
+		want  string
+		err   error
+	}{
+		{"ci-secret", "ci", nil},
+		{"soon-secret", "soon", nil},
+		{"hashed-secret", "hashed", nil},
+		{"static-secret", "default", nil},
+		{"old-secret", "old", errTokenExpired},
+		{"unknown", "", errTokenUnknown},
+		{hashToken("ci-secret"), "", errTokenUnknown},
+		{"", "", errTokenUnknown},
+	}
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			token, err := ts.Lookup(tt.value)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("Lookup error = %v, want %v", err, tt.err)
+			}
+			if name := ""; token != nil {
+				name = token.Name
+				if name != tt.want {
+					t.Errorf("Lookup = %s, want %s", name, tt.want)
+				}
+			} else if tt.want != "" {
+				t.Errorf("Lookup = nil, want %s", tt.want)
+			}
+		})
+	}
+
+	if info, _ := ts.Info("soon"); !info.ExpiresSoon || info.SoonToExpireUses != 1 {
+		t.Errorf("soon info = %+v, want one use while expiring soon", info)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, secret := range []string{"ci-secret", "old-secret", "soon-secret", "static-secret", `"token"`} {
+		if strings.Contains(string(data), secret) {
+			t.Errorf("tokens file contains %s:\n%s", secret, data)
+		}
+	}
+}
+
+func TestTokenStoreLifecycle(t *testing.T) {
+	ts, path := newTestTokenStore(t, "")
+
+	created, value, err := ts.Create("ci", scopeRead, "", []string{"web"}, time.Hour)
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	if created.Value != "" || created.Hash != hashToken(value) {
+		t.Errorf("created token keeps value %q and hash %q", created.Value, created.Hash)
+	}
+	if _, _, err := ts.Create("ci", "", "", nil, 0); !errors.Is(err, errTokenExists) {
+		t.Errorf("Create of a taken name error = %v, want %v", err, errTokenExists)
+	}
+
+	replacement, newValue, err := ts.Rotate("ci", time.Minute, 0)
+	if err != nil {
+		t.Fatalf("Rotate: %v", err)
+	}
+	if replacement.Scope != scopeRead || len(replacement.Teams) != 1 {
+		t.Errorf("replacement = %+v, want the scope and teams of the old token", replacement)
+	}
+
+	// A restart only knows what the file kept
+	reopened, err := NewTokenStore(path, 0, log.New(io.Discard, "", 0))
+	if err != nil {
+		t.Fatalf("NewTokenStore: %v", err)
+	}
+	tests := []struct {
+		name  string
+		value string
+		want  string
+	}{
+		{"old value in overlap", value, created.ID},
+		{"new value", newValue, replacement.ID},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, store := range []*TokenStore{ts, reopened} {
+				token, err := store.Lookup(tt.value)
+				if err != nil || token.ID != tt.want {
+					t.Errorf("Lookup = %v, %v, want %s", token, err, tt.want)
+				}
+			}
+		})
+	}
+	if info, _ := ts.Info(created.ID); info.ExpiresAt == nil || info.ExpiresAt.After(time.Now().Add(time.Minute)) {
+		t.Errorf("rotated token expires at %v, want within the overlap", info.ExpiresAt)
+	}
+
+	revoked, err := ts.Revoke(replacement.ID)
+	if err != nil || len(revoked) != 1 {
+		t.Fatalf("Revoke by id = %v, %v, want the replacement", revoked, err)
+	}
+	if _, err := ts.Lookup(newValue); !errors.Is(err, errTokenUnknown) {
+		t.Errorf("Lookup of a revoked token error = %v, want %v", err, errTokenUnknown)
+	}
+	if _, err := ts.Lookup(value); err != nil {
+		t.Errorf("Lookup of the other token of the name: %v", err)
+	}
+	if revoked, err := ts.Revoke("ci"); err != nil || len(revoked) != 1 {
+		t.Errorf("Revoke by name = %v, %v, want the remaining token", revoked, err)
+	}
+	if _, err := ts.Revoke("ci"); !errors.Is(err, errTokenNotFound) {
+		t.Errorf("second Revoke error = %v, want %v", err, errTokenNotFound)
+	}
+}
+
+func TestTokenStoreStatic(t *testing.T) {
+	ts, _ := newTestTokenStore(t, "")
+	ts.AddStatic("default", "static-secret")
+	if _, _, err := ts.Rotate("default", time.Minute, 0); !errors.Is(err, errTokenStatic) {
+		t.Errorf("Rotate error = %v, want %v", err, errTokenStatic)
+	}
+	if _, err := ts.Revoke("default"); !errors.Is(err, errTokenStatic) {
+		t.Errorf("Revoke error = %v, want %v", err, errTokenStatic)
+	}
+}
+
+func TestTokenStoreSaveFailure(t *testing.T) {
+	ts, path := newTestTokenStore(t, "")
+	existing, value, err := ts.Create("ci", "", "", nil, 0)
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	// Saving fails once the directory is gone
+	if err := os.RemoveAll(filepath.Dir(path)); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, err := ts.Create("other", "", "", nil, 0); err == nil {
+		t.Error("Create succeeded without a tokens directory")
+	}
+	if _, _, err := ts.Rotate("ci", time.Minute, 0); err == nil {
+		t.Error("Rotate succeeded without a tokens directory")
+	}
+	if _, err := ts.Revoke("ci"); err == nil {
+		t.Error("Revoke succeeded without a tokens directory")
+	}
+
+	if infos := ts.List(); len(infos) != 1 {
+		t.Fatalf("List = %+v, want only the existing token", infos)
+	}
+	info, _ := ts.Info("ci")
+	if info.ID != existing.ID || info.ExpiresAt != nil || info.ReplacedBy != "" {
+		t.Errorf("existing token = %+v, want it unchanged", info)
+	}
+	if token, err := ts.Lookup(value); err != nil || token.ID != existing.ID {
+		t.Errorf("Lookup = %v, %v, want the existing token", token, err)
+	}
+}
+
+func TestTokenHandlersBodyLimit(t *testing.T) {
+	ts, _ := newTestTokenStore(t, "")
+	if _, _, err := ts.Create("ci", "", "", nil, 0); err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	s := &Server{tokens: ts, maxRequestBody: 64, logger: log.New(io.Discard, "", 0)}
+	padding := strings.Repeat(" ", 64)
+	tests := []struct {
+		name    string
+		handler http.HandlerFunc
+		body    string
+		want    int
+	}{
+		{"create", s.createToken, `{"name":"web"}`, http.StatusCreated},
+		{"create without name", s.createToken, `{}`, http.StatusBadRequest},
+		{"create oversized", s.createToken, `{"name":"big"` + padding + `}`, http.StatusRequestEntityTooLarge},
+		{"rotate", s.rotateToken, `{"token":"ci"}`, http.StatusOK},
+		{"rotate without token", s.rotateToken, `{}`, http.StatusBadRequest},
+		{"rotate malformed", s.rotateToken, `{"token":`, http.StatusBadRequest},
+		{"rotate oversized", s.rotateToken, `{"token":"web"` + padding + `}`, http.StatusRequestEntityTooLarge},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			tt.handler(w, httptest.NewRequest(http.MethodPost, "/admin/tokens", strings.NewReader(tt.body)))
+			if w.Code != tt.want {
+				t.Errorf("status = %d, want %d: %s", w.Code, tt.want, w.Body)
+			}
+		})
+	}
+	if _, err := ts.Info("big"); !errors.Is(err, errTokenNotFound) {
+		t.Errorf("oversized create made a token: %v", err)
+	}
+}
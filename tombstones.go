@@ -0,0 +1,220 @@
+package cachesrv
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+const tombstonesPath = "/v8/federation/tombstones"
+
+// Tombstone records that an artifact was deleted on purpose, say a poisoned
+// artifact removed during an incident. Peers pull the tombstones with the
+// inventory and delete their own copies with the same contents or uploaded
+// before the delete, and while it lives no replica fetches or redirects to
+// the artifact, so it can't come back through replication. A rebuild
+// uploaded afterwards is kept. Peers pass on the tombstones they received,
+// so they reach every replica even without a full mesh.
+type Tombstone struct {
+	Hash      string    `json:"hash"`
+	Digest    string    `json:"digest,omitempty"`
+	DeletedAt time.Time `json:"deletedAt"`
+	ExpiresAt time.Time `json:"expiresAt"`
+	// Origin is the replica the artifact was deleted on, empty for this one
+	Origin string `json:"origin,omitempty"`
+}
+
+// Tombstones holds the live tombstones, persisted so a restart during an
+// incident doesn't forget them
+type Tombstones struct {
+	mu     sync.RWMutex
+	path   string
+	ttl    time.Duration
+	stones map[string]Tombstone
+}
+
+func NewTombstones(path string, ttl time.Duration) (*Tombstones, error) {
+	t := &Tombstones{path: path, ttl: ttl, stones: make(map[string]Tombstone)}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return t, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read tombstones: %w", err)
+	}
+	var saved []Tombstone
+	if err := json.Unmarshal(data, &saved); err != nil {
+		return nil, fmt.Errorf("failed to parse tombstones: %w", err)
+	}
+	now := time.Now()
+	for _, stone := range saved {
+		if now.Before(stone.ExpiresAt) {
+			t.stones[stone.Hash] = stone
+		}
+	}
+	return t, nil
+}
+
+// Bury records tombstones for artifacts deleted on this server
+func (t *Tombstones) Bury(artifacts []PurgedArtifact, now time.Time) error {
+	if t == nil || len(artifacts) == 0 {
+		return nil
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, a := range artifacts {
+		t.stones[a.Hash] = Tombstone{Hash: a.Hash, Digest: a.Digest, DeletedAt: now, ExpiresAt: now.Add(t.ttl)}
+	}
+	return t.save(now)
+}
+
+// Merge adds the tombstones received from a peer and returns those that are
+// new here or record a later delete. They keep their original expiry, so
+// passing them on doesn't keep them alive forever.
+func (t *Tombstones) Merge(received []Tombstone, peer string, now time.Time) ([]Tombstone, error) {
+	if t == nil {
+		return nil, nil
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var fresh []Tombstone
+	for _, stone := range received {
+		if !validHash(stone.Hash) || !now.Before(stone.ExpiresAt) {
+			continue
+		}
+		if known, ok := t.stones[stone.Hash]; ok && !stone.DeletedAt.After(known.DeletedAt) {
+			continue
+		}
+		if stone.Origin == "" {
+			stone.Origin = peer
+		}
+		t.stones[stone.Hash] = stone
+		fresh = append(fresh, stone)
+	}
+	if len(fresh) == 0 {
+		return nil, nil
+	}
+	return fresh, t.save(now)
+}
+
+// Buried reports whether an artifact has a live tombstone
+func (t *Tombstones) Buried(hash string, now time.Time) bool {
+	if t == nil {
+		return false
+	}
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	stone, ok := t.stones[hash]
+	return ok && now.Before(stone.ExpiresAt)
+}
+
+// List returns the live tombstones, most recent first
+func (t *Tombstones) List(now time.Time) []Tombstone {
+	list := make([]Tombstone, 0)
+	if t == nil {
+		return list
+	}
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	for _, stone := range t.stones {
+		if now.Before(stone.ExpiresAt) {
+			list = append(list, stone)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].DeletedAt.After(list[j].DeletedAt) })
+	return list
+}
+
+// save drops expired tombstones and writes the rest atomically; callers must
+// hold the lock
+func (t *Tombstones) save(now time.Time) error {
+	list := make([]Tombstone, 0, len(t.stones))
+	for hash, stone := range t.stones {
+		if !now.Before(stone.ExpiresAt) {
+			delete(t.stones, hash)
+			continue
+		}
+		list = append(list, stone)
+	}
+	data, err := json.MarshalIndent(list, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode tombstones: %w", err)
+	}
+	return writeFileAtomic(t.path, data, 0644)
+}
+
+// Bury records tombstones for artifacts an admin deleted, for peers to pull
+func (f *Federation) Bury(report *PurgeReport) error {
+	if f == nil || report.DryRun {
+		return nil
+	}
+	return f.tombstones.Bury(report.Artifacts, time.Now())
+}
+
+func (f *Federation) fetchTombstones(replica Replica) ([]Tombstone, error) {
+	resp, err := f.client.Get(f.presignPath(replica, http.MethodGet, tombstonesPath, url.Values{}))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected response %s", resp.Status)
+	}
+	var stones []Tombstone
+	if err := json.NewDecoder(resp.Body).Decode(&stones); err != nil {
+		return nil, fmt.Errorf("failed to parse tombstones: %w", err)
+	}
+	return stones, nil
+}
+
+// applyTombstone deletes the local copy of an artifact deleted on a peer,
+// unless it is retained or was uploaded after the delete with other
+// contents. Copies fetched from a peer since carry the deleted contents and
+// go as well.
+func (s *Server) applyTombstone(stone Tombstone) {
+	m, ok := s.index.Get(stone.Hash)
+	if !ok {
+		return
+	}
+	deleted := stone.Digest != "" && m.Digest == stone.Digest
+	if !deleted && m.CreatedAt.After(stone.DeletedAt) {
+		return
+	}
+	report := purgeArtifacts(context.Background(), nil, s.index, s.classes, []ArtifactMeta{m}, false, s.logger)
+	if report.Count > 0 {
+		s.logger.Printf("Deleted artifact %s after it was deleted on %s", stone.Hash, stone.Origin)
+	}
+}
+
+// Handler for /v8/federation/tombstones
+func (s *Server) getTombstones(w http.ResponseWriter, r *http.Request) {
+	if s.federation == nil {
+		http.NotFound(w, r)
+		return
+	}
+	if !s.federation.VerifyPresigned(r) {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.federation.tombstones.List(time.Now()))
+}
+
+// Handler for /admin/tombstones
+func (s *Server) listTombstones(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var tombstones *Tombstones
+	if s.federation != nil {
+		tombstones = s.federation.tombstones
+	}
+	s.writeList(w, r, tombstones.List(time.Now()), "-deletedAt", "hash")
+}
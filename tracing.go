@@ -0,0 +1,348 @@
+package cachesrv
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Spans are exported over OTLP/HTTP as JSON, which Tempo, Jaeger and the
+// OpenTelemetry Collector all accept, to the endpoint of the standard
+// OTEL_EXPORTER_OTLP_* variables. Requests continue the trace of an incoming
+// W3C traceparent header, and calls to peers carry it on.
+
+// Span kinds, as OTLP numbers them
+const (
+	spanInternal = 1
+	spanServer   = 2
+	spanClient   = 3
+)
+
+const (
+	traceBatchSize  = 512
+	traceQueueSize  = 4096
+	traceFlushEvery = 5 * time.Second
+)
+
+// Tracer samples and exports spans; a nil tracer traces nothing
+type Tracer struct {
+	endpoint string
+	headers  http.Header
+	service  string
+	// ratio of new traces sampled; traces started upstream follow the
+	// caller's decision
+	ratio   float64
+	client  *http.Client
+	logger  *log.Logger
+	queue   chan *Span
+	dropped atomic.Int64
+}
+
+type spanAttr struct {
+	key   string
+	value any
+}
+
+// Span is one timed operation of a trace
+type Span struct {
+	tracer   *Tracer
+	traceID  [16]byte
+	spanID   [8]byte
+	parentID [8]byte
+	sampled  bool
+	name     string
+	kind     int
+	start    time.Time
+	end      time.Time
+	attrs    []spanAttr
+	err      error
+}
+
+func newTracerFromEnv(logger *log.Logger) (*Tracer, error) {
+	endpoint := getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT")
+	if endpoint == "" {
+		base := getenv("OTEL_EXPORTER_OTLP_ENDPOINT")
+		if base == "" {
+			return nil, nil
+		}
+		endpoint = strings.TrimSuffix(base, "/") + "/v1/traces"
+	}
+	ratio, err := envFloat("OTEL_TRACES_SAMPLER_ARG", 1)
+	if err != nil {
+		return nil, err
+	}
+	if ratio < 0 || ratio > 1 {
+		return nil, fmt.Errorf("invalid OTEL_TRACES_SAMPLER_ARG %v (expected 0 to 1)", ratio)
+	}
+	headers := http.Header{"Content-Type": {"application/json"}}
+	for _, pair := range parseTags(getenv("OTEL_EXPORTER_OTLP_HEADERS")) {
+		key, value, ok := strings.Cut(pair, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid OTEL_EXPORTER_OTLP_HEADERS entry %q (expected key=value)", pair)
+		}
+		headers.Set(strings.TrimSpace(key), strings.TrimSpace(value))
+	}
+	return &Tracer{
+		endpoint: endpoint,
+		headers:  headers,
+		service:  envString("OTEL_SERVICE_NAME", "go-turbo-cachesrv"),
+		ratio:    ratio,
+		client:   &http.Client{Timeout: 10 * time.Second},
+		logger:   logger,
+		queue:    make(chan *Span, traceQueueSize),
+	}, nil
+}
+
+type spanKey struct{}
+
+// Start begins a span as a child of the span in ctx, or of its remote
+// parent, and returns the context carrying it. Spans must be ended.
+func (t *Tracer) Start(ctx context.Context, name string, kind int) (context.Context, *Span) {
+	if t == nil {
+		return ctx, nil
+	}
+	span := &Span{tracer: t, name: name, kind: kind, start: time.Now()}
+	rand.Read(span.spanID[:])
+	if parent, ok := ctx.Value(spanKey{}).(*Span); ok {
+		span.traceID, span.parentID, span.sampled = parent.traceID, parent.spanID, parent.sampled
+	} else {
+		rand.Read(span.traceID[:])
+		// The low bits of a random trace ID are uniform, so every service
+		// sampling by ratio keeps the same traces
+		span.sampled = float64(binary.BigEndian.Uint64(span.traceID[8:])>>11)/(1<<53) < t.ratio
+	}
+	return context.WithValue(ctx, spanKey{}, span), span
+}
+
+// Extract continues the trace of an incoming traceparent header
+func (t *Tracer) Extract(r *http.Request) context.Context {
+	ctx := r.Context()
+	if t == nil {
+		return ctx
+	}
+	// version-traceid-parentid-flags
+	parts := strings.Split(r.Header.Get("Traceparent"), "-")
+	if len(parts) != 4 || len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return ctx
+	}
+	remote := &Span{tracer: t}
+	flags, err := hex.DecodeString(parts[3])
+	if err != nil {
+		return ctx
+	}
+	if _, err := hex.Decode(remote.traceID[:], []byte(parts[1])); err != nil {
+		return ctx
+	}
+	if _, err := hex.Decode(remote.spanID[:], []byte(parts[2])); err != nil {
+		return ctx
+	}
+	if remote.traceID == [16]byte{} || remote.spanID == [8]byte{} {
+		return ctx
+	}
+	remote.sampled = flags[0]&1 == 1
+	return context.WithValue(ctx, spanKey{}, remote)
+}
+
+// Inject adds the traceparent of the span in ctx to an outgoing request
+func (t *Tracer) Inject(ctx context.Context, header http.Header) {
+	if t == nil {
+		return
+	}
+	span, ok := ctx.Value(spanKey{}).(*Span)
+	if !ok {
+		return
+	}
+	flags := "00"
+	if span.sampled {
+		flags = "01"
+	}
+	header.Set("Traceparent", "00-"+hex.EncodeToString(span.traceID[:])+"-"+hex.EncodeToString(span.spanID[:])+"-"+flags)
+}
+
+// SetAttr records an attribute of the span; values are strings, integers,
+// floats or booleans
+func (sp *Span) SetAttr(key string, value any) {
+	if sp == nil {
+		return
+	}
+	sp.attrs = append(sp.attrs, spanAttr{key, value})
+}
+
+// End finishes the span, marking it failed when err is set
+func (sp *Span) End(err error) {
+	if sp == nil || !sp.sampled {
+		return
+	}
+	sp.end, sp.err = time.Now(), err
+	select {
+	case sp.tracer.queue <- sp:
+	default:
+		// The collector is slower than the traffic; losing spans beats
+		// holding up requests
+		sp.tracer.dropped.Add(1)
+	}
+}
+
+// TraceID returns the hex ID of the span's trace, empty when not tracing
+func (sp *Span) TraceID() string {
+	if sp == nil {
+		return ""
+	}
+	return hex.EncodeToString(sp.traceID[:])
+}
+
+// statusError marks the span of a request answered with a server error as
+// failed, as OpenTelemetry does for HTTP servers
+func statusError(code int) error {
+	if code < 500 {
+		return nil
+	}
+	return errors.New(http.StatusText(code))
+}
+
+// Run exports queued spans in batches until stop is closed
+func (t *Tracer) Run(stop <-chan struct{}) {
+	ticker := time.NewTicker(traceFlushEvery)
+	defer ticker.Stop()
+	batch := make([]*Span, 0, traceBatchSize)
+	var lastErr time.Time
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		if err := t.export(batch); err != nil && time.Since(lastErr) >= time.Minute {
+			lastErr = time.Now()
+			t.logger.Printf("Failed to export %d spans: %v (%d dropped so far)", len(batch), err, t.dropped.Load())
+		}
+		batch = batch[:0]
+	}
+	for {
+		select {
+		case span := <-t.queue:
+			if batch = append(batch, span); len(batch) >= traceBatchSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		case <-stop:
+			flush()
+			return
+		}
+	}
+}
+
+type otlpValue struct {
+	StringValue *string  `json:"stringValue,omitempty"`
+	IntValue    *string  `json:"intValue,omitempty"`
+	DoubleValue *float64 `json:"doubleValue,omitempty"`
+	BoolValue   *bool    `json:"boolValue,omitempty"`
+}
+
+type otlpAttr struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpSpan struct {
+	TraceID      string     `json:"traceId"`
+	SpanID       string     `json:"spanId"`
+	ParentSpanID string     `json:"parentSpanId,omitempty"`
+	Name         string     `json:"name"`
+	Kind         int        `json:"kind"`
+	Start        string     `json:"startTimeUnixNano"`
+	End          string     `json:"endTimeUnixNano"`
+	Attributes   []otlpAttr `json:"attributes,omitempty"`
+	Status       struct {
+		Code    int    `json:"code,omitempty"`
+		Message string `json:"message,omitempty"`
+	} `json:"status"`
+}
+
+func otlpAttribute(key string, value any) otlpAttr {
+	attr := otlpAttr{Key: key}
+	switch v := value.(type) {
+	case string:
+		attr.Value.StringValue = &v
+	case int:
+		s := strconv.Itoa(v)
+		attr.Value.IntValue = &s
+	case int64:
+		s := strconv.FormatInt(v, 10)
+		attr.Value.IntValue = &s
+	case float64:
+		attr.Value.DoubleValue = &v
+	case bool:
+		attr.Value.BoolValue = &v
+	default:
+		s := fmt.Sprint(v)
+		attr.Value.StringValue = &s
+	}
+	return attr
+}
+
+// export posts a batch as an OTLP ExportTraceServiceRequest
+func (t *Tracer) export(batch []*Span) error {
+	spans := make([]otlpSpan, 0, len(batch))
+	for _, sp := range batch {
+		out := otlpSpan{
+			TraceID: hex.EncodeToString(sp.traceID[:]),
+			SpanID:  hex.EncodeToString(sp.spanID[:]),
+			Name:    sp.name,
+			Kind:    sp.kind,
+			Start:   strconv.FormatInt(sp.start.UnixNano(), 10),
+			End:     strconv.FormatInt(sp.end.UnixNano(), 10),
+		}
+		if sp.parentID != [8]byte{} {
+			out.ParentSpanID = hex.EncodeToString(sp.parentID[:])
+		}
+		for _, a := range sp.attrs {
+			out.Attributes = append(out.Attributes, otlpAttribute(a.key, a.value))
+		}
+		if sp.err != nil {
+			out.Status.Code, out.Status.Message = 2, sp.err.Error()
+		}
+		spans = append(spans, out)
+	}
+	request := map[string]any{
+		"resourceSpans": []any{map[string]any{
+			"resource": map[string]any{
+				"attributes": []otlpAttr{otlpAttribute("service.name", t.service)},
+			},
+			"scopeSpans": []any{map[string]any{
+				"scope": map[string]string{"name": "github.com/bitechdev/go-turbo-cachesrv"},
+				"spans": spans,
+			}},
+		}},
+	}
+	body, err := json.Marshal(request)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, t.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	for k, v := range t.headers {
+		req.Header[k] = v
+	}
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("collector answered %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,256 @@
+package cachesrv
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Transfer directions
+const (
+	transferUpload   = "upload"
+	transferDownload = "download"
+)
+
+var (
+	errTransferNotFound  = errors.New("transfer not found")
+	errTransferCancelled = errors.New("transfer cancelled by an admin")
+)
+
+// Transfer is an artifact upload or download in flight
+type Transfer struct {
+	id        string
+	direction string
+	hash      string
+	team      string
+	client    string
+	userAgent string
+	size      int64
+	startedAt time.Time
+	bytes     atomic.Int64
+	cancelled atomic.Bool
+	// rc cuts off the connection on cancel, which a read or write blocked on
+	// the client would otherwise never notice
+	rc *http.ResponseController
+}
+
+// TransferStatus is the progress of a transfer
+type TransferStatus struct {
+	ID        string    `json:"id"`
+	Direction string    `json:"direction"`
+	Hash      string    `json:"hash"`
+	Team      string    `json:"team,omitempty"`
+	Client    string    `json:"client"`
+	UserAgent string    `json:"userAgent,omitempty"`
+	Bytes     int64     `json:"bytes"`
+	Size      int64     `json:"size"`
+	StartedAt time.Time `json:"startedAt"`
+	ElapsedMs int64     `json:"elapsedMs"`
+	// Rate is the average in bytes per second
+	Rate float64 `json:"rate"`
+}
+
+func (t *Transfer) status(now time.Time) TransferStatus {
+	elapsed := now.Sub(t.startedAt)
+	bytes := t.bytes.Load()
+	status := TransferStatus{
+		ID:        t.id,
+		Direction: t.direction,
+		Hash:      t.hash,
+		Team:      t.team,
+		Client:    t.client,
+		UserAgent: t.userAgent,
+		Bytes:     bytes,
+		Size:      t.size,
+		StartedAt: t.startedAt,
+		ElapsedMs: elapsed.Milliseconds(),
+	}
+	if elapsed > 0 {
+		status.Rate = float64(bytes) / elapsed.Seconds()
+	}
+	return status
+}
+
+// transferReader counts the bytes of a transfer as they are read and fails
+// once it is cancelled
+type transferReader struct {
+	io.ReadCloser
+	transfer *Transfer
+}
+
+func (pr *transferReader) Read(p []byte) (int, error) {
+	if pr.transfer.cancelled.Load() {
+		return 0, errTransferCancelled
+	}
+	n, err := pr.ReadCloser.Read(p)
+	pr.transfer.bytes.Add(int64(n))
+	if err != nil && pr.transfer.cancelled.Load() {
+		err = errTransferCancelled
+	}
+	return n, err
+}
+
+// transferWriter is transferReader for downloads, so readers that write
+// themselves out, like mapped files, still do
+type transferWriter struct {
+	w        io.Writer
+	transfer *Transfer
+}
+
+func (pw *transferWriter) Write(p []byte) (int, error) {
+	if pw.transfer.cancelled.Load() {
+		return 0, errTransferCancelled
+	}
+	n, err := pw.w.Write(p)
+	pw.transfer.bytes.Add(int64(n))
+	return n, err
+}
+
+// Transfers tracks the uploads and downloads in flight and periodically logs
+// the progress of large ones
+type Transfers struct {
+	logger *log.Logger
+	// minSize is the size from which progress is logged
+	minSize int64
+
+	mu     sync.Mutex
+	active map[string]*Transfer
+	nextID uint64
+}
+
+func NewTransfers(minSize int64, logger *log.Logger) *Transfers {
+	return &Transfers{logger: logger, minSize: minSize, active: make(map[string]*Transfer)}
+}
+
+// Start registers a transfer of size bytes; the caller calls Finish once it
+// is done
+func (ts *Transfers) Start(direction, hash string, w http.ResponseWriter, r *http.Request, size int64) *Transfer {
+	t := &Transfer{
+		direction: direction,
+		hash:      hash,
+		team:      teamOf(r),
+		client:    r.RemoteAddr,
+		userAgent: r.UserAgent(),
+		size:      size,
+		startedAt: time.Now(),
+		rc:        http.NewResponseController(w),
+	}
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	ts.nextID++
+	t.id = strconv.FormatUint(ts.nextID, 36)
+	ts.active[t.id] = t
+	return t
+}
+
+// Finish removes a transfer, logging the result of large ones
+func (ts *Transfers) Finish(t *Transfer) {
+	ts.mu.Lock()
+	delete(ts.active, t.id)
+	ts.mu.Unlock()
+	if t.size >= ts.minSize {
+		status := t.status(time.Now())
+		ts.logger.Printf("Transfer %s finished: %s of %s, %d bytes in %v (%.1f MB/s)",
+			t.id, t.direction, t.hash, status.Bytes, time.Since(t.startedAt).Round(time.Millisecond), status.Rate/(1<<20))
+	}
+}
+
+// List returns the progress of every transfer in flight
+func (ts *Transfers) List() []TransferStatus {
+	now := time.Now()
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	list := make([]TransferStatus, 0, len(ts.active))
+	for _, t := range ts.active {
+		list = append(list, t.status(now))
+	}
+	return list
+}
+
+// Get returns the progress of one transfer
+func (ts *Transfers) Get(id string) (TransferStatus, error) {
+	ts.mu.Lock()
+	t, ok := ts.active[id]
+	ts.mu.Unlock()
+	if !ok {
+		return TransferStatus{}, errTransferNotFound
+	}
+	return t.status(time.Now()), nil
+}
+
+// Cancel fails a transfer's further reads and cuts off its connection. The
+// handler then cleans up as it would after a client disconnect.
+func (ts *Transfers) Cancel(id string) (TransferStatus, error) {
+	ts.mu.Lock()
+	t, ok := ts.active[id]
+	ts.mu.Unlock()
+	if !ok {
+		return TransferStatus{}, errTransferNotFound
+	}
+	if !t.cancelled.Swap(true) {
+		ts.logger.Printf("Transfer %s cancelled: %s of %s by %s at %d of %d bytes",
+			t.id, t.direction, t.hash, t.client, t.bytes.Load(), t.size)
+		t.rc.SetReadDeadline(time.Now())
+		t.rc.SetWriteDeadline(time.Now())
+	}
+	return t.status(time.Now()), nil
+}
+
+// Run logs the progress of large transfers at every interval
+func (ts *Transfers) Run(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+		for _, status := range ts.List() {
+			if status.Size < ts.minSize {
+				continue
+			}
+			ts.logger.Printf("Transfer %s: %s of %s by %s at %d of %d bytes (%.0f%%) after %v, %.1f MB/s",
+				status.ID, status.Direction, status.Hash, status.Client, status.Bytes, status.Size,
+				100*float64(status.Bytes)/float64(max(status.Size, 1)),
+				(time.Duration(status.ElapsedMs) * time.Millisecond).Round(time.Second), status.Rate/(1<<20))
+		}
+	}
+}
+
+// Handler for /admin/transfers
+func (s *Server) listTransfers(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	s.writeList(w, r, s.transfers.List(), "startedAt", "id")
+}
+
+// Handler for /admin/transfers/{id}
+func (s *Server) handleTransfer(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, "/admin/transfers/")
+	var status TransferStatus
+	var err error
+	switch r.Method {
+	case http.MethodGet:
+		status, err = s.transfers.Get(id)
+	case http.MethodDelete:
+		status, err = s.transfers.Cancel(id)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if errors.Is(err, errTransferNotFound) {
+		http.Error(w, "Transfer not found", http.StatusNotFound)
+		return
+	}
+	json.NewEncoder(w).Encode(status)
+}
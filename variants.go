@@ -0,0 +1,41 @@
+package cachesrv
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+)
+
+const (
+	variantHeader = "X-Artifact-Variant"
+	// variantSeparator joins a hash and its variant into a storage key
+	variantSeparator = "__"
+	maxVariantLength = 32
+)
+
+var errInvalidVariant = errors.New("invalid artifact variant")
+
+// variantKey qualifies a hash with the variant sent in the X-Artifact-Variant
+// header or the variant query parameter, e.g. linux-arm64. Tasks whose
+// outputs are platform specific can then keep one artifact per OS and
+// architecture under the same turbo hash. Without a variant the hash is used
+// as is; a request for a variant never falls back to another one.
+func variantKey(hash string, r *http.Request) (string, error) {
+	variant := r.Header.Get(variantHeader)
+	if variant == "" {
+		variant = r.URL.Query().Get("variant")
+	}
+	if variant == "" {
+		return hash, nil
+	}
+	variant = strings.ToLower(variant)
+	if len(variant) > maxVariantLength || strings.Contains(variant, variantSeparator) ||
+		strings.HasPrefix(variant, strings.TrimPrefix(teamSeparator, variantSeparator)) || !validHash(variant) {
+		return "", errInvalidVariant
+	}
+	key := hash + variantSeparator + variant
+	if !validHash(key) {
+		return "", errInvalidVariant
+	}
+	return key, nil
+}